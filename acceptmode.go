@@ -0,0 +1,26 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// AcceptMode tells where the connections are accepted when they are accepted for the event-loops by one acceptor,
+// namely on stream networks without ReusePort and MassiveConnections, see WithAcceptMode.
+type AcceptMode int
+
+const (
+	// AcceptOnMainReactor accepts the connections on the main reactor running in a goroutine of its own,
+	// which shares the OS threads with the other goroutines.
+	AcceptOnMainReactor AcceptMode = iota
+
+	// AcceptOnDedicatedThread accepts the connections on the main reactor locked to an OS thread of its own, so that
+	// accepting keeps up under accept storms without waiting for the Go scheduler, which suits the workloads of
+	// short-lived connections.
+	AcceptOnDedicatedThread
+
+	// AcceptOnLoop accepts the connections on event-loop 0, which watches the listener along with its own
+	// connections and hands over the new ones to the event-loops chosen by the load-balancing algorithm, saving
+	// the thread and the poller of the main reactor, which suits the workloads of long-lived connections. It is not
+	// supported on Windows, where the connections are accepted by a blocking goroutine.
+	AcceptOnLoop
+)
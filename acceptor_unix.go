@@ -6,29 +6,186 @@
 
 package gnet
 
-import "golang.org/x/sys/unix"
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/panjf2000/gnet/internal/netpoll"
+	"golang.org/x/sys/unix"
+)
 
 func (svr *server) acceptNewConnection(fd int) error {
-	nfd, sa, err := unix.Accept(fd)
+	wait := svr.acceptLimit.take()
+	if wait > 0 && svr.opts.AcceptLimitPolicy == AcceptLimitDefer {
+		svr.acceptor.deferAccept(wait)
+		return nil
+	}
+	nfd, sa, remoteAddr, err := svr.accept(fd)
 	if err != nil {
 		if err == unix.EAGAIN {
 			return nil
 		}
 		return err
 	}
-	if err := unix.SetNonblock(nfd, true); err != nil {
+	if wait > 0 {
+		_ = svr.transport.Close(nfd)
+		return nil
+	}
+	if ok, err := svr.admitConn(); !ok {
+		svr.shedConn(nfd)
 		return err
 	}
-	el := svr.subLoopGroup.next(nfd)
+	codec, action := svr.onAccepted(nfd, remoteAddr)
+	if action != None {
+		_ = svr.transport.Close(nfd)
+		if action == Shutdown {
+			return ErrServerShutdown
+		}
+		return nil
+	}
+	_ = svr.assignConn(nfd, sa, remoteAddr, codec, nil)
+	return nil
+}
+
+// accept accepts a pending connection of the listener, sa is nil for the custom transports.
+func (svr *server) accept(fd int) (nfd int, sa unix.Sockaddr, remoteAddr net.Addr, err error) {
+	if t := svr.ln.transport; t != nil {
+		nfd, remoteAddr, err = t.Accept(fd)
+		return
+	}
+	if nfd, sa, err = unix.Accept(fd); err != nil {
+		return
+	}
+	if err = unix.SetNonblock(nfd, true); err != nil {
+		_ = unix.Close(nfd)
+		return
+	}
+	remoteAddr = netpoll.SockaddrToTCPOrUnixAddr(sa)
+	return
+}
+
+// shedConn writes the response of accept overload protection to the connection and closes it.
+func (svr *server) shedConn(nfd int) {
+	if resp := svr.opts.AcceptOverload.Response; len(resp) > 0 {
+		_, _ = svr.transport.Write(nfd, resp)
+	}
+	_ = svr.transport.Close(nfd)
+}
+
+// onAccepted consults AcceptHandler about the newly accepted connection and applies the socket options
+// it returns, the connection must be closed by the caller unless the returned action is None.
+func (svr *server) onAccepted(nfd int, remoteAddr net.Addr) (codec ICodec, action Action) {
+	if svr.acceptHandler == nil {
+		return
+	}
+	opts, action := svr.acceptHandler.OnAccepted(nfd, svr.ln.lnaddr, remoteAddr)
+	if action != None {
+		return
+	}
+	if opts.TCPNoDelay {
+		_ = unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+	}
+	if opts.SocketRecvBuffer > 0 {
+		_ = unix.SetsockoptInt(nfd, unix.SOL_SOCKET, unix.SO_RCVBUF, opts.SocketRecvBuffer)
+	}
+	if opts.SocketSendBuffer > 0 {
+		_ = unix.SetsockoptInt(nfd, unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SocketSendBuffer)
+	}
+	return opts.Codec, None
+}
+
+// assignConn hands over a new connection to the event-loop chosen by the load-balancing algorithm, or to the one
+// pinned to the CPU that handled its incoming packets with loop affinity, the remote address is resolved from sa
+// if remoteAddr is nil, and the codec of the server is used if codec is nil. prepare, if not nil, sets the connection
+// up before it is opened.
+func (svr *server) assignConn(nfd int, sa unix.Sockaddr, remoteAddr net.Addr, codec ICodec, prepare func(c *conn)) error {
+	el := svr.incomingLoop(nfd)
+	if el == nil {
+		el = svr.subLoopGroup.next(nfd)
+	}
 	c := newTCPConn(nfd, el, sa)
-	_ = el.poller.Trigger(func() (err error) {
-		if err = el.poller.AddRead(nfd); err != nil {
+	c.remoteAddr = remoteAddr
+	if codec != nil {
+		c.setCodec(codec)
+	}
+	if prepare != nil {
+		prepare(c)
+	}
+	if svr.opts.Enricher != nil {
+		svr.enrichConn(el, c)
+		return nil
+	}
+	atomic.AddInt32(&svr.pendingAccepts, 1)
+	return el.poller.Trigger(func() error {
+		atomic.AddInt32(&svr.pendingAccepts, -1)
+		return el.register(c)
+	})
+}
+
+// enrichConn runs the Enricher for a connection accepted, then hands it over to the event-loop with the result
+// attached, or closes it if the server shuts down meanwhile.
+func (svr *server) enrichConn(el *eventloop, c *conn) {
+	local, remote := c.localAddr, c.remoteAddr
+	if local == nil {
+		local = svr.ln.lnaddr
+	}
+	if remote == nil {
+		remote = netpoll.SockaddrToTCPOrUnixAddr(c.sa)
+	}
+	atomic.AddInt32(&svr.pendingAccepts, 1)
+	svr.enrich(local, remote, func(e enrichment) {
+		c.extension().enrichment = e
+		if e.err != ErrServerShutdown && el.poller.Trigger(func() error {
+			atomic.AddInt32(&svr.pendingAccepts, -1)
+			return el.register(c)
+		}) == nil {
 			return
 		}
-		el.connections[nfd] = c
-		el.plusConnCount()
-		err = el.loopOpen(c)
-		return
+		atomic.AddInt32(&svr.pendingAccepts, -1)
+		_ = svr.transport.Close(c.fd)
 	})
-	return nil
+}
+
+// adoptConn hands over a connection accepted outside the event-loops, e.g. by a passive data listener, to them with
+// the given codec and initial context, keeping the local address of the connection. The file descriptor of nc is
+// duplicated, so nc is closed in any case.
+func (svr *server) adoptConn(nc net.Conn, codec ICodec, ctx interface{}) error {
+	defer nc.Close()
+	sc, ok := nc.(syscall.Conn)
+	if !ok {
+		return ErrProtocolNotSupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		nfd    int
+		dupErr error
+	)
+	if err = rc.Control(func(fd uintptr) {
+		nfd, dupErr = unix.Dup(int(fd))
+	}); err != nil {
+		return err
+	}
+	if dupErr != nil {
+		return os.NewSyscallError("dup", dupErr)
+	}
+	unix.CloseOnExec(nfd)
+	if err = unix.SetNonblock(nfd, true); err != nil {
+		_ = unix.Close(nfd)
+		return os.NewSyscallError("setnonblock", err)
+	}
+	localAddr := nc.LocalAddr()
+	svr.dialMu.Lock()
+	err = svr.assignConn(nfd, nil, nc.RemoteAddr(), codec, func(c *conn) {
+		c.localAddr, c.ctx = localAddr, ctx
+	})
+	svr.dialMu.Unlock()
+	if err != nil {
+		_ = unix.Close(nfd)
+	}
+	return err
 }
@@ -8,12 +8,20 @@
 package gnet
 
 import (
+	"errors"
 	"hash/crc32"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/panjf2000/gnet/pool/bytebuffer"
 )
 
+// wsaeMsgSize is the WSAEMSGSIZE error of Winsock, which isn't exported by syscall.
+const wsaeMsgSize syscall.Errno = 10040
+
 // hashCode hashes a string to a unique hashcode.
 func hashCode(s string) int {
 	v := int(crc32.ChecksumIEEE([]byte(s)))
@@ -23,47 +31,187 @@ func hashCode(s string) int {
 	return -v
 }
 
-func (svr *server) listenerRun() {
+func (svr *server) listenerRun(ln *listener) {
+	if ln.pconn == nil && svr.opts.AcceptMode == AcceptOnDedicatedThread {
+		runtime.LockOSThread()
+	}
 	var err error
 	defer func() { svr.signalShutdown(err) }()
-	var packet [0x10000]byte
+	var packet []byte
+	if ln.pconn != nil {
+		packet = make([]byte, svr.opts.udpReadBufferSize())
+	}
 	for {
-		if svr.ln.pconn != nil {
+		if ln.pconn != nil {
 			// Read data from UDP socket.
-			n, addr, e := svr.ln.pconn.ReadFrom(packet[:])
-			if e != nil {
+			n, addr, e := ln.pconn.ReadFrom(packet)
+			// The datagrams exceeding the buffer are read truncated along with WSAEMSGSIZE.
+			truncated := e != nil && errors.Is(e, wsaeMsgSize)
+			if e != nil && !truncated {
+				if svr.onLoopError(-1, e) {
+					continue
+				}
 				err = e
 				return
 			}
 			buf := bytebuffer.Get()
 			_, _ = buf.Write(packet[:n])
 
-			el := svr.subLoopGroup.next(hashCode(addr.String()))
-			el.ch <- &udpIn{newUDPConn(el, svr.ln.lnaddr, addr, buf)}
+			// The sender of the datagrams read truncated is unknown.
+			var key string
+			if addr != nil {
+				key = addr.String()
+			}
+			el := svr.subLoopGroup.next(hashCode(key))
+			el.ch <- &udpIn{newUDPConn(el, ln.lnaddr, addr, buf), truncated}
 		} else {
 			// Accept TCP socket.
-			conn, e := svr.ln.ln.Accept()
+			svr.acceptPause.wait(svr.shutdown)
+			admitted := svr.waitAccept()
+			conn, e := ln.ln.Accept()
 			if e != nil {
+				if svr.onLoopError(-1, e) {
+					continue
+				}
 				err = e
 				return
 			}
-			el := svr.subLoopGroup.next(hashCode(conn.RemoteAddr().String()))
-			c := newTCPConn(conn, el)
-			el.ch <- c
-			go func() {
-				var packet [0x10000]byte
-				for {
-					n, err := c.conn.Read(packet[:])
-					if err != nil {
-						_ = c.conn.SetReadDeadline(time.Time{})
-						el.ch <- &stderr{c, err}
-						return
-					}
-					buf := bytebuffer.Get()
-					_, _ = buf.Write(packet[:n])
-					el.ch <- &tcpIn{c, buf}
+			if !admitted {
+				_ = conn.Close()
+				continue
+			}
+			var ok bool
+			if ok, err = svr.admitConn(); !ok {
+				svr.shedConn(conn)
+				if err != nil {
+					return
 				}
-			}()
+				continue
+			}
+			codec, action := svr.onAccepted(conn)
+			if action != None {
+				_ = conn.Close()
+				if action == Shutdown {
+					err = ErrServerShutdown
+					return
+				}
+				continue
+			}
+			svr.assignConn(conn, codec, nil)
+		}
+	}
+}
+
+// shedConn writes the response of accept overload protection to the connection and closes it.
+func (svr *server) shedConn(conn net.Conn) {
+	if resp := svr.opts.AcceptOverload.Response; len(resp) > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(shedWriteTimeout))
+		_, _ = conn.Write(resp)
+	}
+	_ = conn.Close()
+}
+
+// onAccepted consults AcceptHandler about the newly accepted connection and applies the socket options
+// it returns, the connection must be closed by the caller unless the returned action is None.
+func (svr *server) onAccepted(conn net.Conn) (codec ICodec, action Action) {
+	if svr.acceptHandler == nil {
+		return
+	}
+	opts, action := svr.acceptHandler.OnAccepted(-1, svr.ln.lnaddr, conn.RemoteAddr())
+	if action != None {
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if opts.TCPNoDelay {
+			_ = tc.SetNoDelay(true)
+		}
+		if opts.SocketRecvBuffer > 0 {
+			_ = tc.SetReadBuffer(opts.SocketRecvBuffer)
+		}
+		if opts.SocketSendBuffer > 0 {
+			_ = tc.SetWriteBuffer(opts.SocketSendBuffer)
 		}
 	}
+	return opts.Codec, None
+}
+
+// assignConn hands over a new connection to the event-loop chosen by the load-balancing algorithm
+// and starts reading from it, the codec of the server is used if codec is nil. prepare, if not nil, sets
+// the connection up before it is opened.
+func (svr *server) assignConn(conn net.Conn, codec ICodec, prepare func(c *stdConn)) {
+	el := svr.subLoopGroup.next(hashCode(conn.RemoteAddr().String()))
+	c := newTCPConn(conn, el)
+	if codec != nil {
+		c.codec = codec
+	}
+	if prepare != nil {
+		prepare(c)
+	}
+	if svr.opts.Enricher != nil {
+		svr.enrichConn(c)
+		return
+	}
+	svr.startConn(c)
+}
+
+// enrichConn runs the Enricher for a connection accepted, then hands it over to its event-loop with the result
+// attached, or closes it if the server shuts down meanwhile.
+func (svr *server) enrichConn(c *stdConn) {
+	local := c.localAddr
+	if local == nil {
+		local = svr.ln.lnaddr
+	}
+	atomic.AddInt32(&svr.pendingAccepts, 1)
+	svr.enrich(local, c.conn.RemoteAddr(), func(e enrichment) {
+		atomic.AddInt32(&svr.pendingAccepts, -1)
+		if e.err == ErrServerShutdown {
+			_ = c.conn.Close()
+			return
+		}
+		c.enrichment = e
+		svr.startConn(c)
+	})
+}
+
+// startConn hands over a new connection to its event-loop and starts reading from it.
+func (svr *server) startConn(c *stdConn) {
+	el := c.loop
+	if svr.opts.ConnGoroutine {
+		c.worker = newConnWorker(svr.opts)
+	}
+	w := c.worker
+	atomic.AddInt32(&svr.pendingAccepts, 1)
+	el.ch <- c
+	go func() {
+		var packet [0x10000]byte
+		for {
+			if w != nil {
+				w.waitResumed()
+			}
+			if c.hold.paused() {
+				c.hold.wait(c.Gone())
+			}
+			n, err := c.conn.Read(packet[:])
+			if err != nil {
+				_ = c.conn.SetReadDeadline(time.Time{})
+				el.ch <- &stderr{c, err}
+				return
+			}
+			buf := bytebuffer.Get()
+			_, _ = buf.Write(packet[:n])
+			el.ch <- &tcpIn{c, buf}
+		}
+	}()
+}
+
+// adoptConn hands over a connection accepted outside the event-loops, e.g. by a passive data listener, to them with
+// the given codec and initial context, keeping the local address of the connection.
+func (svr *server) adoptConn(nc net.Conn, codec ICodec, ctx interface{}) error {
+	localAddr := nc.LocalAddr()
+	svr.dialMu.Lock()
+	svr.assignConn(nc, codec, func(c *stdConn) {
+		c.localAddr, c.ctx = localAddr, ctx
+	})
+	svr.dialMu.Unlock()
+	return nil
 }
@@ -0,0 +1,80 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// acceptPause is the state of pausing accepting connections via Server.PauseAccept.
+type acceptPause struct {
+	mu     sync.Mutex    // serializes PauseAccept and ResumeAccept
+	paused int32         // 1 while accepting is paused
+	resume chan struct{} // wakes the goroutine accepting connections up on resuming, used on Windows
+}
+
+func (p *acceptPause) isPaused() bool {
+	return atomic.LoadInt32(&p.paused) != 0
+}
+
+// wait blocks while accepting is paused, until it is resumed or closed is closed.
+func (p *acceptPause) wait(closed chan struct{}) {
+	for p.isPaused() {
+		select {
+		case <-p.resume:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// PauseAccept stops accepting new connections until ResumeAccept, while the connections open so far are served
+// as usual, e.g. for shedding load at the front door during an incident. The incoming connections wait in
+// the backlog of the listener meanwhile, the kernel refuses or drops the further ones once the backlog is full,
+// and the connections being accepted when it is invoked may still be opened. It can be invoked from any goroutine,
+// and fails with ErrProtocolNotSupported if the server doesn't accept connections, namely for UDP and the memory
+// network, or with ErrServerShutdown if the server has been shut down.
+func (s Server) PauseAccept() error {
+	return s.svr.pauseAccept(true)
+}
+
+// ResumeAccept resumes accepting new connections paused by PauseAccept.
+func (s Server) ResumeAccept() error {
+	return s.svr.pauseAccept(false)
+}
+
+// AcceptPaused reports whether accepting new connections is paused by PauseAccept.
+func (s Server) AcceptPaused() bool {
+	return s.svr.acceptPause.isPaused()
+}
+
+func (svr *server) pauseAccept(pause bool) error {
+	if svr.ln.network == "memory" || svr.ln.pconn != nil {
+		return ErrProtocolNotSupported
+	}
+	p := &svr.acceptPause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isClosed(svr.shutdown) {
+		return ErrServerShutdown
+	}
+	if p.isPaused() == pause {
+		return nil
+	}
+	if pause {
+		atomic.StoreInt32(&p.paused, 1)
+	} else {
+		atomic.StoreInt32(&p.paused, 0)
+		select {
+		case p.resume <- struct{}{}:
+		default:
+		}
+	}
+	svr.watchListener(!pause)
+	return nil
+}
@@ -0,0 +1,23 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// FrameAccountant meters the sizes of the frames at the framing layer, e.g. for billing the requests and responses
+// of an API gateway without re-measuring them inside the event handler, set it up via WithFrameAccounting.
+type FrameAccountant interface {
+	// AccountFrame fires for every frame decoded from or encoded for c by the codec, inbound tells the direction,
+	// decodedSize is the size of the frame seen by the event handler and encodedSize is its size on the wire.
+	// It fires within the event-loop for the inbound frames, and within the goroutine encoding the outbound
+	// frames, e.g. the one invoking AsyncWrite, so it must be safe for concurrent use.
+	AccountFrame(c Conn, inbound bool, decodedSize, encodedSize int)
+}
+
+// FrameAccountantFunc is an adapter to allow the use of ordinary functions as frame accountants.
+type FrameAccountantFunc func(c Conn, inbound bool, decodedSize, encodedSize int)
+
+// AccountFrame calls f(c, inbound, decodedSize, encodedSize).
+func (f FrameAccountantFunc) AccountFrame(c Conn, inbound bool, decodedSize, encodedSize int) {
+	f(c, inbound, decodedSize, encodedSize)
+}
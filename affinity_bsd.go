@@ -0,0 +1,18 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gnet
+
+// assignCPUs is a no-op, loop affinity is only supported on Linux.
+func (svr *server) assignCPUs() error {
+	return nil
+}
+
+func (el *eventloop) pin() {}
+
+func (svr *server) incomingLoop(_ int) *eventloop {
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package gnet
+
+import (
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// assignCPUs assigns the CPUs that the process may run on to the event-loops in turn if loop affinity is enabled.
+func (svr *server) assignCPUs() error {
+	if !svr.opts.LoopAffinity {
+		return nil
+	}
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return os.NewSyscallError("sched_getaffinity", err)
+	}
+	cpus := make([]int, 0, set.Count())
+	for cpu := 0; len(cpus) < cap(cpus); cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	svr.cpuLoops = make(map[int]*eventloop, len(cpus))
+	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		el.cpu = cpus[i%len(cpus)]
+		if _, ok := svr.cpuLoops[el.cpu]; !ok {
+			svr.cpuLoops[el.cpu] = el
+		}
+		return true
+	})
+	return nil
+}
+
+// pin locks the goroutine of the event-loop to its thread and pins the thread to the CPU of the event-loop,
+// it must be invoked by the goroutine of the event-loop.
+func (el *eventloop) pin() {
+	if el.svr.cpuLoops == nil {
+		return
+	}
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(el.cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		el.svr.logger.Printf("failed to pin event-loop:%d to CPU %d, error:%v\n", el.idx, el.cpu, err)
+	}
+}
+
+// incomingLoop returns the active event-loop pinned to the CPU that handled the incoming packets of
+// the connection (SO_INCOMING_CPU), nil if loop affinity is disabled or there is no such event-loop.
+func (svr *server) incomingLoop(nfd int) *eventloop {
+	if svr.cpuLoops == nil {
+		return nil
+	}
+	cpu, err := unix.GetsockoptInt(nfd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU)
+	if err != nil {
+		return nil
+	}
+	if el := svr.cpuLoops[cpu]; el != nil && el.idx < svr.subLoopGroup.active() {
+		return el
+	}
+	return nil
+}
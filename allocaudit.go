@@ -0,0 +1,97 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build gnet_allocaudit
+
+package gnet
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// allocAudit indicates whether gnet is built with the "gnet_allocaudit" build tag, in which the handling of
+// inbound data on stream connections on Unix-like systems, namely decode -> React -> encode -> write, is asserted
+// to be free of heap allocations, and every violation is reported via the logger along with the call sites of the allocations.
+//
+// The audit stops the world twice every time inbound data is handled and profiles every allocation, so it must never be enabled
+// in production. The allocations made by other goroutines meanwhile are reported as well, thus it's better to
+// audit with a single event-loop and a quiet process, e.g. within a benchmark of the echo path.
+const allocAudit = true
+
+func init() {
+	runtime.MemProfileRate = 1
+}
+
+// allocSites holds the numbers of allocated objects per call stack that have been reported.
+var allocSites = struct {
+	sync.Mutex
+	once    sync.Once
+	objects map[[32]uintptr]int64
+}{objects: make(map[[32]uintptr]int64)}
+
+func beginAllocAudit() uint64 {
+	// Take the allocations made before the first audit as the baseline.
+	allocSites.once.Do(func() { _ = newAllocSites() })
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Mallocs
+}
+
+func endAllocAudit(logger Logger, mallocs uint64, loop, fd int) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if n := ms.Mallocs - mallocs; n > 0 {
+		logger.Printf("alloc audit: %d heap allocations while handling inbound data of fd:%d on event-loop:%d, "+
+			"call sites:\n%s", n, fd, loop, newAllocSites())
+	}
+}
+
+// newAllocSites returns the call stacks that have allocated since the last time they were reported.
+func newAllocSites() string {
+	// Materialize all the statistics of the memory profile.
+	runtime.GC()
+	n, _ := runtime.MemProfile(nil, true)
+	records := make([]runtime.MemProfileRecord, n+64)
+	for {
+		var ok bool
+		if n, ok = runtime.MemProfile(records, true); ok {
+			records = records[:n]
+			break
+		}
+		records = make([]runtime.MemProfileRecord, n+64)
+	}
+
+	allocSites.Lock()
+	defer allocSites.Unlock()
+	var sb strings.Builder
+	for _, r := range records {
+		delta := r.AllocObjects - allocSites.objects[r.Stack0]
+		allocSites.objects[r.Stack0] = r.AllocObjects
+		if delta <= 0 {
+			continue
+		}
+		frames := runtime.CallersFrames(r.Stack())
+		for depth := 0; depth < 8; {
+			frame, more := frames.Next()
+			if !strings.HasPrefix(frame.Function, "runtime.") {
+				sb.WriteString("\t")
+				sb.WriteString(frame.Function)
+				sb.WriteString("\n\t\t")
+				sb.WriteString(frame.File)
+				sb.WriteString(":")
+				sb.WriteString(strconv.Itoa(frame.Line))
+				sb.WriteString("\n")
+				depth++
+			}
+			if !more {
+				break
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,17 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build !gnet_allocaudit
+
+package gnet
+
+// allocAudit indicates whether gnet is built with the "gnet_allocaudit" build tag, see allocaudit.go.
+const allocAudit = false
+
+func beginAllocAudit() uint64 {
+	return 0
+}
+
+func endAllocAudit(_ Logger, _ uint64, _, _ int) {
+}
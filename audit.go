@@ -0,0 +1,122 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes the lifetime of a stream connection, it is emitted to the AuditSink once the connection
+// is closed.
+type AuditRecord struct {
+	// ConnID is the identifier of the connection, see Conn.ID.
+	ConnID uint64
+
+	// LocalAddr is the local address of the connection.
+	LocalAddr net.Addr
+
+	// RemoteAddr is the address of the peer.
+	RemoteAddr net.Addr
+
+	// OpenedAt is the moment the connection was opened.
+	OpenedAt time.Time
+
+	// ClosedAt is the moment the connection was closed.
+	ClosedAt time.Time
+
+	// BytesIn is the number of bytes read from the connection.
+	BytesIn uint64
+
+	// BytesOut is the number of bytes written to the connection.
+	BytesOut uint64
+
+	// Err is the reason of closing the connection, it is nil if the connection is closed by the peer
+	// or by an event handler, just like the error passed to OnClosed.
+	Err error
+}
+
+// AuditSink receives the audit records of the connections of a server, set it up via WithAudit.
+// Audit is invoked within the event-loops, so it must not block and must be safe for concurrent use
+// if there are more than one event-loop, buffer the records and ship them in another goroutine if needed.
+type AuditSink interface {
+	Audit(rec *AuditRecord)
+}
+
+// AuditSinkFunc is an adapter to allow the use of ordinary functions as audit sinks.
+type AuditSinkFunc func(rec *AuditRecord)
+
+// Audit calls f(rec).
+func (f AuditSinkFunc) Audit(rec *AuditRecord) {
+	f(rec)
+}
+
+// auditWriter writes the audit records in logfmt.
+type auditWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewAuditWriter returns an audit sink writing every record to w in one line of logfmt, i.e. space-separated
+// key=value pairs, which is friendly to syslog and journald, e.g. a *syslog.Writer or the stderr of a systemd
+// service. The writes to w are serialized, and they block the event-loops as long as w does.
+func NewAuditWriter(w io.Writer) AuditSink {
+	return &auditWriter{w: w}
+}
+
+func (aw *auditWriter) Audit(rec *AuditRecord) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	b := aw.buf[:0]
+	b = append(b, "conn_id="...)
+	b = strconv.AppendUint(b, rec.ConnID, 10)
+	b = appendAuditAddr(b, " local=", rec.LocalAddr)
+	b = appendAuditAddr(b, " peer=", rec.RemoteAddr)
+	b = append(b, " opened="...)
+	b = rec.OpenedAt.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, " closed="...)
+	b = rec.ClosedAt.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, " duration="...)
+	b = append(b, rec.ClosedAt.Sub(rec.OpenedAt).String()...)
+	b = append(b, " bytes_in="...)
+	b = strconv.AppendUint(b, rec.BytesIn, 10)
+	b = append(b, " bytes_out="...)
+	b = strconv.AppendUint(b, rec.BytesOut, 10)
+	b = append(b, " reason="...)
+	if rec.Err == nil {
+		b = append(b, "closed"...)
+	} else {
+		b = strconv.AppendQuote(b, rec.Err.Error())
+	}
+	b = append(b, '\n')
+	_, _ = aw.w.Write(b)
+	aw.buf = b
+}
+
+func appendAuditAddr(b []byte, key string, addr net.Addr) []byte {
+	b = append(b, key...)
+	if addr == nil {
+		return append(b, '-')
+	}
+	return append(b, addr.Network()+"://"+addr.String()...)
+}
+
+// audit emits the audit record of a connection that has just been closed.
+func audit(sink AuditSink, id uint64, local, remote net.Addr, openedAt time.Time, in, out uint64, err error) {
+	sink.Audit(&AuditRecord{
+		ConnID:     id,
+		LocalAddr:  local,
+		RemoteAddr: remote,
+		OpenedAt:   openedAt,
+		ClosedAt:   time.Now(),
+		BytesIn:    in,
+		BytesOut:   out,
+		Err:        err,
+	})
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// frameBatch collects the frames decoded from the inbound data of a connection for BatchHandler, the frames are
+// copied into a buffer reused by the event-loop, as the codecs may reuse their buffers across the Decode calls.
+type frameBatch struct {
+	buf    []byte
+	ends   []int // end offsets of the frames in buf, -1 for the frames owned by the event handler
+	frames [][]byte
+}
+
+func (b *frameBatch) reset() {
+	b.buf, b.ends = b.buf[:0], b.ends[:0]
+	for i := range b.frames {
+		b.frames[i] = nil
+	}
+	b.frames = b.frames[:0]
+}
+
+// add appends a copy of the frame to the batch, the copy is allocated on its own if owned is true,
+// see WithFrameOwnershipTransfer.
+func (b *frameBatch) add(frame []byte, owned bool) {
+	if owned {
+		b.frames = append(b.frames, append(make([]byte, 0, len(frame)), frame...))
+		b.ends = append(b.ends, -1)
+		return
+	}
+	b.buf = append(b.buf, frame...)
+	b.frames = append(b.frames, nil)
+	b.ends = append(b.ends, len(b.buf))
+}
+
+// seal returns the frames of the batch, which stay valid until the batch is reset.
+func (b *frameBatch) seal() [][]byte {
+	start := 0
+	for i, end := range b.ends {
+		if end < 0 {
+			continue
+		}
+		b.frames[i] = b.buf[start:end:end]
+		start = end
+	}
+	return b.frames
+}
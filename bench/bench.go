@@ -0,0 +1,302 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package bench provides a load generator for echo-style servers, it can be used either as a library in your own
+// tools or as a helper in Go benchmarks, so that you can validate how the gnet options perform on your hardware.
+//
+// Every connection writes messages with sizes drawn from a SizeDistribution and keeps up to Pipeline messages
+// in flight, the server is expected to echo every message back, and the latency of a message is measured from
+// the moment it is written until all of its bytes have been read back.
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// SizeDistribution generates the sizes of the messages sent to the server.
+type SizeDistribution interface {
+	// Next returns the size of the next message.
+	Next(r *rand.Rand) int
+}
+
+// FixedSize is a SizeDistribution that always returns the same size.
+type FixedSize int
+
+// Next returns the fixed size.
+func (s FixedSize) Next(_ *rand.Rand) int {
+	return int(s)
+}
+
+// UniformSize is a SizeDistribution that returns sizes uniformly distributed within [Min, Max].
+type UniformSize struct {
+	Min, Max int
+}
+
+// Next returns a size within [Min, Max].
+func (s UniformSize) Next(r *rand.Rand) int {
+	if s.Max <= s.Min {
+		return s.Min
+	}
+	return s.Min + r.Intn(s.Max-s.Min+1)
+}
+
+// Config is the configuration of a load generation run.
+type Config struct {
+	// Network is the network to dial, "tcp" is assumed when it is empty.
+	Network string
+
+	// Addr is the address of the server under test.
+	Addr string
+
+	// Connections is the number of concurrent connections, it defaults to 1.
+	Connections int
+
+	// Pipeline is the maximum number of in-flight messages per connection, it defaults to 1.
+	Pipeline int
+
+	// Sizes generates the message sizes, it defaults to FixedSize(64).
+	Sizes SizeDistribution
+
+	// Duration is how long the run lasts, either Duration or Requests must be set.
+	Duration time.Duration
+
+	// Requests is the total number of messages to send over all connections, it takes precedence over Duration.
+	Requests int64
+
+	// Timeout is the I/O timeout of every read and write, it defaults to 10 seconds.
+	Timeout time.Duration
+
+	// Seed is the seed of the random sources used for generating message sizes and payloads.
+	Seed int64
+}
+
+// Report is the result of a load generation run.
+type Report struct {
+	// Connections is the number of connections that were established.
+	Connections int
+
+	// Elapsed is the wall time of the run.
+	Elapsed time.Duration
+
+	// Requests is the number of messages that were echoed back completely.
+	Requests int64
+
+	// BytesSent is the number of bytes written to the server.
+	BytesSent int64
+
+	// BytesReceived is the number of bytes read from the server.
+	BytesReceived int64
+
+	// Errors is the number of connections that failed.
+	Errors int64
+
+	// Latency is the histogram of message latencies.
+	Latency *Histogram
+}
+
+// Throughput returns the number of messages per second.
+func (r *Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// String returns a human-readable summary of the report.
+func (r *Report) String() string {
+	return fmt.Sprintf("conns=%d elapsed=%v requests=%d (%.0f/s) sent=%dB received=%dB errors=%d latency: %v",
+		r.Connections, r.Elapsed, r.Requests, r.Throughput(), r.BytesSent, r.BytesReceived, r.Errors, r.Latency)
+}
+
+// ErrInvalidConfig occurs when neither Duration nor Requests is set.
+var ErrInvalidConfig = errors.New("either Duration or Requests must be set")
+
+func (cfg *Config) normalize() error {
+	if cfg.Duration <= 0 && cfg.Requests <= 0 {
+		return ErrInvalidConfig
+	}
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if cfg.Connections <= 0 {
+		cfg.Connections = 1
+	}
+	if cfg.Pipeline <= 0 {
+		cfg.Pipeline = 1
+	}
+	if cfg.Sizes == nil {
+		cfg.Sizes = FixedSize(64)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// Run generates load against the server with the given configuration and blocks until it is done.
+// It returns an error only when none of the connections could be established.
+func Run(cfg Config) (*Report, error) {
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	conns := make([]net.Conn, 0, cfg.Connections)
+	var err error
+	for i := 0; i < cfg.Connections; i++ {
+		var c net.Conn
+		if c, err = net.DialTimeout(cfg.Network, cfg.Addr, cfg.Timeout); err != nil {
+			break
+		}
+		conns = append(conns, c)
+	}
+	if len(conns) == 0 {
+		return nil, err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		budget   = cfg.Requests
+		deadline time.Time
+		report   = &Report{Connections: len(conns), Latency: NewHistogram()}
+		start    = time.Now()
+	)
+	if cfg.Requests <= 0 {
+		budget = -1
+		deadline = start.Add(cfg.Duration)
+	}
+	for i, c := range conns {
+		w := &worker{
+			cfg:      &cfg,
+			conn:     c,
+			rand:     rand.New(rand.NewSource(cfg.Seed + int64(i))),
+			budget:   &budget,
+			deadline: deadline,
+			latency:  NewHistogram(),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := w.run()
+			mu.Lock()
+			report.Latency.Merge(w.latency)
+			report.Requests += w.requests
+			report.BytesSent += w.sent
+			report.BytesReceived += w.received
+			if err != nil {
+				report.Errors++
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+// Benchmark runs b.N requests with the given configuration and reports the latency percentiles as custom metrics,
+// it is meant to be invoked within a Go benchmark function.
+func Benchmark(b *testing.B, cfg Config) *Report {
+	cfg.Requests = int64(b.N)
+	b.ResetTimer()
+	report, err := Run(cfg)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if report.Errors > 0 {
+		b.Errorf("%d connections failed", report.Errors)
+	}
+	b.SetBytes(report.BytesSent / int64(b.N))
+	b.ReportMetric(float64(report.Latency.Percentile(50).Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(report.Latency.Percentile(99).Nanoseconds()), "p99-ns")
+	return report
+}
+
+type inflight struct {
+	size   int
+	sentAt time.Time
+}
+
+type worker struct {
+	cfg      *Config
+	conn     net.Conn
+	rand     *rand.Rand
+	budget   *int64
+	deadline time.Time
+	latency  *Histogram
+
+	requests, sent, received int64
+}
+
+// acquire reports whether another message may be sent.
+func (w *worker) acquire() bool {
+	if !w.deadline.IsZero() {
+		return time.Now().Before(w.deadline)
+	}
+	return atomic.AddInt64(w.budget, -1) >= 0
+}
+
+func (w *worker) run() error {
+	defer w.conn.Close()
+	pending := make(chan inflight, w.cfg.Pipeline)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- w.readLoop(pending)
+	}()
+
+	var err error
+	payload := make([]byte, 0)
+	for w.acquire() {
+		size := w.cfg.Sizes.Next(w.rand)
+		if size <= 0 {
+			size = 1
+		}
+		if cap(payload) < size {
+			payload = make([]byte, size)
+		}
+		payload = payload[:size]
+		_, _ = w.rand.Read(payload)
+		select {
+		case pending <- inflight{size, time.Now()}:
+		case err = <-readErr:
+			return err
+		}
+		_ = w.conn.SetWriteDeadline(time.Now().Add(w.cfg.Timeout))
+		if _, err = w.conn.Write(payload); err != nil {
+			break
+		}
+		w.sent += int64(size)
+	}
+	close(pending)
+	if rerr := <-readErr; err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (w *worker) readLoop(pending <-chan inflight) error {
+	buf := make([]byte, 0)
+	for msg := range pending {
+		if cap(buf) < msg.size {
+			buf = make([]byte, msg.size)
+		}
+		_ = w.conn.SetReadDeadline(time.Now().Add(w.cfg.Timeout))
+		n, err := io.ReadFull(w.conn, buf[:msg.size])
+		w.received += int64(n)
+		if err != nil {
+			return err
+		}
+		w.latency.Record(time.Since(msg.sentAt))
+		w.requests++
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	if h.Count() != 1000 {
+		t.Fatalf("expected 1000 values, got %d", h.Count())
+	}
+	if h.Min() != time.Microsecond || h.Max() != time.Millisecond {
+		t.Fatalf("unexpected min/max: %v/%v", h.Min(), h.Max())
+	}
+	for _, p := range []float64{50, 90, 99} {
+		expected := time.Duration(p*10) * time.Microsecond
+		got := h.Percentile(p)
+		if diff := got - expected; diff > expected/16 || -diff > expected/16 {
+			t.Fatalf("p%v: expected about %v, got %v", p, expected, got)
+		}
+	}
+
+	other := NewHistogram()
+	other.Record(time.Second)
+	h.Merge(other)
+	if h.Max() != time.Second || h.Count() != 1001 {
+		t.Fatalf("unexpected histogram after merging: %v", h)
+	}
+}
+
+type echoServer struct {
+	*gnet.EventServer
+	ready chan struct{}
+	stop  int32
+}
+
+func (es *echoServer) OnInitComplete(svr gnet.Server) (action gnet.Action) {
+	close(es.ready)
+	return
+}
+
+func (es *echoServer) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	out = frame
+	return
+}
+
+func (es *echoServer) Tick() (delay time.Duration, action gnet.Action) {
+	delay = time.Millisecond * 100
+	if atomic.LoadInt32(&es.stop) == 1 {
+		action = gnet.Shutdown
+	}
+	return
+}
+
+func TestRun(t *testing.T) {
+	es := &echoServer{ready: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- gnet.Serve(es, "tcp://:9981", gnet.WithTicker(true))
+	}()
+	<-es.ready
+	time.Sleep(time.Millisecond * 50)
+
+	report, err := Run(Config{
+		Addr:        "127.0.0.1:9981",
+		Connections: 4,
+		Pipeline:    8,
+		Sizes:       UniformSize{Min: 16, Max: 4096},
+		Requests:    2000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors != 0 || report.Requests != 2000 || report.BytesSent != report.BytesReceived {
+		t.Fatalf("unexpected report: %v", report)
+	}
+	t.Log(report)
+
+	atomic.StoreInt32(&es.stop, 1)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+	numBuckets    = (64-subBucketBits)*subBuckets + subBuckets
+)
+
+// Histogram is a log-linear histogram of latencies, every power-of-two range is split into 16 linear sub-buckets,
+// which keeps the relative error of the recorded values under 1/16 with a fixed amount of memory.
+// It is not safe for concurrent use, merge per-goroutine histograms via Merge instead.
+type Histogram struct {
+	counts [numBuckets]uint64
+	total  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewHistogram instantiates and returns an empty histogram.
+func NewHistogram() *Histogram {
+	return new(Histogram)
+}
+
+func bucketIndex(v uint64) int {
+	if v < 2*subBuckets {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v) - subBucketBits - 1)
+	return int(shift)*subBuckets + int(v>>shift)
+}
+
+// bucketValue returns the midpoint of the range covered by the bucket with the given index.
+func bucketValue(idx int) uint64 {
+	if idx < 2*subBuckets {
+		return uint64(idx)
+	}
+	shift := uint(idx/subBuckets - 1)
+	lower := uint64(idx%subBuckets+subBuckets) << shift
+	return lower + (uint64(1)<<shift)/2
+}
+
+// Record records a latency.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[bucketIndex(uint64(d))]++
+	if h.total == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.total++
+	h.sum += d
+}
+
+// Merge adds all the values recorded by other into h.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.total == 0 {
+		return
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.total += other.total
+	h.sum += other.sum
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() uint64 {
+	return h.total
+}
+
+// Min returns the minimum recorded value.
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+// Max returns the maximum recorded value.
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Mean returns the arithmetic mean of the recorded values.
+func (h *Histogram) Mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.total)
+}
+
+// Percentile returns the approximate value below which the given percentage (0-100) of the recorded values fall.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	if p <= 0 {
+		return h.min
+	}
+	if p >= 100 {
+		return h.max
+	}
+	rank := uint64(p/100*float64(h.total) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		if seen += n; seen >= rank {
+			v := time.Duration(bucketValue(i))
+			if v < h.min {
+				return h.min
+			}
+			if v > h.max {
+				return h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// String returns a summary of the histogram.
+func (h *Histogram) String() string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "count=%d min=%v mean=%v max=%v", h.total, h.min, h.Mean(), h.max)
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		_, _ = fmt.Fprintf(&sb, " p%v=%v", p, h.Percentile(p))
+	}
+	return sb.String()
+}
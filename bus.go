@@ -0,0 +1,151 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"sync"
+
+	"github.com/panjf2000/gnet/internal"
+)
+
+// connIDLoopBits is the number of the low bits of a connection ID that hold the index of the owning event-loop.
+const connIDLoopBits = 16
+
+// busMessage is a message posted to an event-loop, it is either addressed to a connection or carries a function
+// to run on the event-loop.
+type busMessage struct {
+	connID uint64
+	msg    interface{}
+	fn     func()
+}
+
+// mailbox is the multi-producer single-consumer queue of the messages posted to an event-loop, the event-loop
+// is woken up only when the first message arrives at an empty mailbox, and then it drains all the messages
+// in a batch.
+type mailbox struct {
+	lock  sync.Locker
+	msgs  []busMessage
+	spare []busMessage
+}
+
+func newMailbox() mailbox {
+	return mailbox{lock: internal.SpinLock()}
+}
+
+// push queues a message and reports whether the mailbox was empty.
+func (mb *mailbox) push(m busMessage) (first bool) {
+	mb.lock.Lock()
+	mb.msgs = append(mb.msgs, m)
+	first = len(mb.msgs) == 1
+	mb.lock.Unlock()
+	return
+}
+
+// take returns all the queued messages, the returned slice must be passed back via recycle after being drained.
+func (mb *mailbox) take() (msgs []busMessage) {
+	mb.lock.Lock()
+	msgs = mb.msgs
+	mb.msgs = mb.spare[:0]
+	mb.spare = nil
+	mb.lock.Unlock()
+	return
+}
+
+// reset discards the queued messages once the event-loop fails to be woken up to drain them, so that the next push
+// finds the mailbox empty and tries to wake the event-loop up again, rather than queuing behind them forever.
+func (mb *mailbox) reset() {
+	mb.lock.Lock()
+	for i := range mb.msgs {
+		mb.msgs[i] = busMessage{}
+	}
+	mb.msgs = mb.msgs[:0]
+	mb.lock.Unlock()
+}
+
+func (mb *mailbox) recycle(msgs []busMessage) {
+	for i := range msgs {
+		msgs[i] = busMessage{}
+	}
+	mb.lock.Lock()
+	mb.spare = msgs[:0]
+	mb.lock.Unlock()
+}
+
+// nextConnID returns a new connection ID for the event-loop, it must be invoked within the event-loop.
+func nextConnID(seq *uint64, loopIdx int) uint64 {
+	*seq++
+	return *seq<<connIDLoopBits | uint64(loopIdx)
+}
+
+// loopOf returns the event-loop owning the connection with the given ID, or nil if there is no such event-loop.
+func (svr *server) loopOf(connID uint64) *eventloop {
+	return svr.loopAt(int(connID & (1<<connIDLoopBits - 1)))
+}
+
+// loopAt returns the event-loop with the given index, or nil if there is no such event-loop.
+func (svr *server) loopAt(idx int) (el *eventloop) {
+	if idx < 0 || idx >= svr.subLoopGroup.len() {
+		return nil
+	}
+	return svr.subLoopGroup.index(idx)
+}
+
+// Post sends a message to the connection with the given ID from any goroutine, the message is delivered to
+// UserEventHandler.OnUserEvent within the event-loop owning the connection, or to React with nil frame if the
+// event handler doesn't implement UserEventHandler. Messages posted to the same event-loop are delivered in order
+// and in batches, and they are discarded silently if the connection has been closed meanwhile.
+func (s Server) Post(connID uint64, msg interface{}) error {
+	el := s.svr.loopOf(connID)
+	if el == nil || connID>>connIDLoopBits == 0 {
+		return ErrInvalidConnID
+	}
+	return el.post(busMessage{connID: connID, msg: msg})
+}
+
+// AsyncWriteTo writes buf to the connection with the given ID asynchronously from any goroutine, just like
+// Conn.AsyncWrite. The connection ID pairs the index of the event-loop with the generation of the connection within
+// that event-loop, which is never reused by another connection during the lifetime of the server, thus the data is
+// never delivered to another client when a stale ID is used, e.g. by a worker outliving the connection, instead,
+// it is discarded silently if the connection has been closed meanwhile.
+func (s Server) AsyncWriteTo(connID uint64, buf []byte) error {
+	el := s.svr.loopOf(connID)
+	if el == nil || connID>>connIDLoopBits == 0 {
+		return ErrInvalidConnID
+	}
+	return el.post(busMessage{fn: func() {
+		if c, ok := el.connsByID[connID]; ok {
+			_ = c.AsyncWrite(buf)
+		}
+	}})
+}
+
+// WakeConn wakes the connection with the given ID up from any goroutine, just like Conn.Wake, the connection
+// ID is validated the same way as AsyncWriteTo does, and nothing happens if the connection has been closed.
+func (s Server) WakeConn(connID uint64) error {
+	el := s.svr.loopOf(connID)
+	if el == nil || connID>>connIDLoopBits == 0 {
+		return ErrInvalidConnID
+	}
+	return el.post(busMessage{fn: func() {
+		if c, ok := el.connsByID[connID]; ok {
+			_ = c.Wake()
+		}
+	}})
+}
+
+// PostLoop runs fn within the event-loop with the given index from any goroutine, in order with the messages
+// posted to the same event-loop, fn may access the connections owned by that event-loop, e.g. write to them.
+func (s Server) PostLoop(loopIdx int, fn func()) error {
+	el := s.svr.loopAt(loopIdx)
+	if el == nil {
+		return ErrInvalidLoopIndex
+	}
+	return el.post(busMessage{fn: fn})
+}
+
+// LoopIndex returns the index of the event-loop owning the connection with the given ID.
+func (s Server) LoopIndex(connID uint64) int {
+	return int(connID & (1<<connIDLoopBits - 1))
+}
@@ -0,0 +1,18 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// WriteCoalescingStats returns the number of the AsyncWrite calls whose data was merged by write coalescing
+// and the number of the writes the merged data was flushed in, writes/flushes is the average number of
+// AsyncWrite calls per write(2) call. The event-loops publish them in batches, see loopCounters.
+func (s Server) WriteCoalescingStats() (writes, flushes uint64) {
+	s.svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		w, f := el.counters.loadCoalesced()
+		writes += w
+		flushes += f
+		return true
+	})
+	return
+}
@@ -9,6 +9,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+
+	"github.com/panjf2000/gnet/pool/bytebuffer"
 )
 
 // CRLFByte represents a byte of CRLF.
@@ -23,6 +25,39 @@ type (
 		Decode(c Conn) ([]byte, error)
 	}
 
+	// ReadBufferProvider is an optional interface of ICodec for fixed-length or length-prefixed protocols, which
+	// provides the destination buffers of the reads, so that the payloads land directly in application-owned memory,
+	// e.g. slots of an arena, without being copied from the internal buffers of connections. The buffer returned by
+	// NextBuffer is filled up by one or more reads and then handed over to Filled, Decode is only invoked for the
+	// data read while NextBuffer returns nil. Both methods are invoked within the event-loop of the connection.
+	//
+	// It is ignored on Windows, by servers with TrafficHandler and for the connections subject to fault injection.
+	ReadBufferProvider interface {
+		// NextBuffer returns the buffer the next bytes of the stream of c are read into,
+		// or nil to read them into the internal buffer and decode them with Decode.
+		NextBuffer(c Conn) []byte
+		// Filled is invoked once the buffer returned by NextBuffer is full, it returns the frame passed to React,
+		// or nil if the buffer doesn't complete a frame, e.g. it holds the header of a length-prefixed frame.
+		Filled(c Conn, buf []byte) (frame []byte)
+	}
+
+	// HandshakeReporter is an optional interface of ICodec for protocols with a handshake, e.g. TLS, which tells
+	// whether the handshake of a connection has completed, see WithHandshakeTimeout.
+	HandshakeReporter interface {
+		// HandshakeComplete reports whether the handshake of c has completed, it is invoked within the event-loop
+		// after the inbound data of c is decoded, until it reports true.
+		HandshakeComplete(c Conn) bool
+	}
+
+	// BufferEncoder is an optional interface of ICodec, which encodes the outbound frames into pooled buffers rather
+	// than returning newly allocated slices as Encode does, so that no allocation is made per frame. When it is
+	// implemented, EncodeTo is invoked instead of Encode.
+	BufferEncoder interface {
+		// EncodeTo appends the encoding of frame to buf, which is put back into the pool once the encoded frame is
+		// written, thus buf must not be retained. Like Encode, it is invoked in the calling goroutine of AsyncWrite.
+		EncodeTo(c Conn, buf *bytebuffer.ByteBuffer, frame []byte) error
+	}
+
 	// BuiltInFrameCodec is the built-in codec which will be assigned to gnet server when customized codec is not set up.
 	BuiltInFrameCodec struct {
 	}
@@ -198,6 +233,12 @@ func (cc *LengthFieldBasedFrameCodec) Encode(c Conn, buf []byte) (out []byte, er
 	return
 }
 
+// isDecodeError reports whether err returned by Decode tells that the inbound data is malformed, rather than
+// that it doesn't make up a complete frame yet, see DecodeErrorHandler.
+func isDecodeError(err error) bool {
+	return err != nil && err != ErrUnexpectedEOF && err != ErrCRLFNotFound && err != ErrDelimiterNotFound
+}
+
 type innerBuffer []byte
 
 func (in *innerBuffer) readN(n int) (buf []byte, err error) {
@@ -1,9 +1,18 @@
 package gnet
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLengthFieldBasedFrameCodecWith1(t *testing.T) {
@@ -232,3 +241,522 @@ func TestInnerBufferReadN(t *testing.T) {
 		t.Fatal("wrong length of leftover bytes")
 	}
 }
+
+func TestCursor(t *testing.T) {
+	data := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0xac, 0x02, 0x03, 'a', 'b', 'c'}
+	// Split the data across all the segments, with the uint64 and the varint spanning them.
+	cur := newCursor(nil, data[:5], data[5:9], data[9:])
+	if v, err := cur.ReadUint16BE(); err != nil || v != 0x1234 {
+		t.Fatalf("unexpected uint16: %#x, %v", v, err)
+	}
+	offset := cur.Offset()
+	if _, err := cur.ReadBytes(13); err != ErrUnexpectedEOF || cur.Offset() != offset {
+		t.Fatalf("expected ErrUnexpectedEOF without moving the cursor, got %v at %d", err, cur.Offset())
+	}
+	if v, err := cur.ReadUint32LE(); err != nil || v != 0xbc9a7856 {
+		t.Fatalf("unexpected uint32: %#x, %v", v, err)
+	}
+	cur.Rewind(offset)
+	if v, err := cur.ReadUint32BE(); err != nil || v != 0x56789abc {
+		t.Fatalf("unexpected uint32 after rewinding: %#x, %v", v, err)
+	}
+	if err := cur.Skip(2); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cur.ReadUvarint(); err != nil || v != 300 {
+		t.Fatalf("unexpected uvarint: %d, %v", v, err)
+	}
+	if v, err := cur.ReadVarint(); err != nil || v != -2 {
+		t.Fatalf("unexpected varint: %d, %v", v, err)
+	}
+	if buf, err := cur.ReadBytes(3); err != nil || string(buf) != "abc" || cur.Len() != 0 {
+		t.Fatalf("unexpected bytes: %q, %v", buf, err)
+	}
+
+	cur = newCursor(nil, []byte{0x80, 0x80}, nil, nil)
+	if _, err := cur.ReadUvarint(); err != ErrUnexpectedEOF || cur.Offset() != 0 {
+		t.Fatalf("expected ErrUnexpectedEOF for the truncated varint, got %v at %d", err, cur.Offset())
+	}
+	cur = newCursor(nil, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, nil, nil)
+	if _, err := cur.ReadUvarint(); err != ErrVarintOverflow {
+		t.Fatalf("expected ErrVarintOverflow, got %v", err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		cur := newCursor(nil, data[:5], data[5:9], data[9:])
+		_, _ = cur.ReadUint64BE()
+		_, _ = cur.ReadUvarint()
+		_, _ = cur.ReadBytes(3)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestRTPCodec(t *testing.T) {
+	rtp := []byte{0x91, 0xe0, 0x12, 0x34, 0, 0, 0x03, 0xe8, 0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 7,
+		0xbe, 0xde, 0, 1, 1, 2, 3, 4, 'm', 'e', 'd', 'i', 'a'}
+	h, payload, err := ParseRTPHeader(rtp)
+	must(err)
+	if !h.Marker || h.PayloadType != 96 || h.SequenceNumber != 0x1234 || h.Timestamp != 1000 ||
+		h.SSRC != 0xdeadbeef || h.CSRCCount != 1 || h.CSRC(0) != 7 || h.ExtensionProfile != 0xbede ||
+		!bytes.Equal(h.Extension, []byte{1, 2, 3, 4}) || string(payload) != "media" {
+		t.Fatalf("unexpected RTP header: %+v, payload: %q", h, payload)
+	}
+	if _, _, err = ParseRTPHeader(rtp[:20]); err != ErrInvalidRTPPacket {
+		t.Fatalf("expected ErrInvalidRTPPacket, got %v", err)
+	}
+	rtcp := []byte{0x80, 201, 0, 2, 0xca, 0xfe, 0xba, 0xbe}
+	if IsRTCPPacket(rtp) || !IsRTCPPacket(rtcp) {
+		t.Fatal("unexpected RTP/RTCP demultiplexing")
+	}
+	rh, err := ParseRTCPHeader(rtcp)
+	if err != ErrInvalidRTPPacket {
+		t.Fatalf("expected ErrInvalidRTPPacket for the truncated RTCP packet, got %+v, %v", rh, err)
+	}
+	rtcp[3] = 1
+	if rh, err = ParseRTCPHeader(rtcp); err != nil || rh.PacketType != 201 || rh.Length != 8 || rh.SSRC != 0xcafebabe {
+		t.Fatalf("unexpected RTCP header: %+v, %v", rh, err)
+	}
+
+	events := &testRTPServer{ssrc: make(chan uint32, 2)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(&RTPCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	var stream []byte
+	for _, packet := range [][]byte{rtp, rtcp} {
+		frame, err := (&RTPCodec{}).Encode(nil, packet)
+		must(err)
+		stream = append(stream, frame...)
+	}
+	// Split the stream in the middle of the RTP packet.
+	_, err = c.Write(stream[:10])
+	must(err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = c.Write(stream[10:])
+	must(err)
+	if ssrc := <-events.ssrc; ssrc != 0xdeadbeef {
+		t.Fatalf("expected RTP SSRC 0xdeadbeef, got %#x", ssrc)
+	}
+	if ssrc := <-events.ssrc; ssrc != 0xcafebabe {
+		t.Fatalf("expected RTCP SSRC 0xcafebabe, got %#x", ssrc)
+	}
+	echo := make([]byte, len(stream))
+	_, err = io.ReadFull(c, echo)
+	must(err)
+	if !bytes.Equal(echo, stream) {
+		t.Fatalf("expected the packets echoed with the length prefixes, got %x", echo)
+	}
+}
+
+type testRTPServer struct {
+	*EventServer
+	ssrc chan uint32
+}
+
+func (t *testRTPServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if IsRTCPPacket(frame) {
+		h, _ := ParseRTCPHeader(frame)
+		t.ssrc <- h.SSRC
+	} else {
+		h, _, _ := ParseRTPHeader(frame)
+		t.ssrc <- h.SSRC
+	}
+	out = frame
+	return
+}
+
+func TestSMTPCodec(t *testing.T) {
+	if verb, arg := ParseSMTPCommand([]byte("mail FROM:<alice@example.com> ")); verb != "MAIL" ||
+		string(arg) != "FROM:<alice@example.com>" {
+		t.Fatalf("unexpected command: %q %q", verb, arg)
+	}
+	if reply := AppendSMTPReply(nil, 250, "mx.example.com", "SIZE 64"); string(reply) !=
+		"250-mx.example.com\r\n250 SIZE 64" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+
+	events := &testSMTPServer{messages: make(chan string, 2)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(&SMTPCodec{MaxLineLength: 32, MaxMessageSize: 64}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	roundTrip := func(request string, replies ...string) {
+		t.Helper()
+		_, err := c.Write([]byte(request))
+		must(err)
+		for _, reply := range replies {
+			if line, err := r.ReadString('\n'); err != nil || line != reply+"\r\n" {
+				t.Fatalf("expected %q, got %q, %v", reply, line, err)
+			}
+		}
+	}
+
+	roundTrip("EHLO client\r\n", "250-mx.example.com", "250 SIZE 64")
+	roundTrip("NOOP "+strings.Repeat("x", 32)+"\r\n", "500 line too long")
+	roundTrip("DATA\r\n", "354 go ahead")
+	// The mail data arrives in pieces, with a dot-stuffed line and a line starting like the end of the data.
+	for _, piece := range []string{"Subject: hi\r\n\r\n..hidden\r", "\n.x\r\n.", "\r\n"} {
+		_, err = c.Write([]byte(piece))
+		must(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "250 ok\r\n" {
+		t.Fatalf("expected 250, got %q, %v", line, err)
+	}
+	if msg := <-events.messages; msg != "Subject: hi\r\n\r\n.hidden\r\nx\r\n" {
+		t.Fatalf("unexpected message: %q", msg)
+	}
+	roundTrip("DATA\r\n", "354 go ahead")
+	roundTrip(strings.Repeat("y", 100)+"\r\n"+strings.Repeat("z", 100)+"\r\n.\r\n", "552 too large")
+	roundTrip("QUIT\r\n", "221 bye")
+}
+
+type testSMTPServer struct {
+	*EventServer
+	messages chan string
+}
+
+func (t *testSMTPServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	switch SMTPFrameKindOf(c) {
+	case SMTPLineTooLong:
+		return []byte("500 line too long"), None
+	case SMTPMessageTooLarge:
+		return []byte("552 too large"), None
+	case SMTPMessage:
+		t.messages <- string(frame)
+		return []byte("250 ok"), None
+	}
+	switch verb, _ := ParseSMTPCommand(frame); verb {
+	case "EHLO":
+		out = AppendSMTPReply(nil, 250, "mx.example.com", "SIZE 64")
+	case "DATA":
+		SMTPStartData(c)
+		out = []byte("354 go ahead")
+	case "QUIT":
+		out = []byte("221 bye")
+	default:
+		out = []byte("502 unknown")
+	}
+	return
+}
+
+func TestTelnetCodec(t *testing.T) {
+	codec := &TelnetCodec{
+		LocalOptions:  []byte{TelnetOptionEcho, TelnetOptionSuppressGoAhead},
+		RemoteOptions: []byte{TelnetOptionNAWS},
+		MaxLineLength: 16,
+	}
+	if out, _ := codec.Encode(nil, []byte("a\rb\r\nc\n\xff")); string(out) != "a\r\x00b\r\nc\r\n\xff\xff" {
+		t.Fatalf("unexpected encoding: %q", out)
+	}
+
+	s, err := NewServer(new(testTelnetServer), "tcp://127.0.0.1:0", WithCodec(codec))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	must(c.SetReadDeadline(time.Now().Add(10 * time.Second)))
+	expect := func(expected string) {
+		t.Helper()
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != expected {
+			t.Fatalf("expected %q, got %q, %v", expected, buf, err)
+		}
+	}
+	roundTrip := func(request, expected string) {
+		t.Helper()
+		_, err := c.Write([]byte(request))
+		must(err)
+		expect(expected)
+	}
+
+	// The server asks for the window size, which the client agrees to without being answered again.
+	expect("\xff\xfd\x1f")
+	roundTrip("\xff\xfb\x1f\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0", "window 80x24\r\n")
+	// The options listed are agreed to, the others are refused, and the acknowledgements aren't answered.
+	roundTrip("\xff\xfd\x01", "\xff\xfb\x01")
+	roundTrip("\xff\xfd\x01\xff\xfd\x63", "\xff\xfc\x63")
+	roundTrip("\xff\xfb\x62", "\xff\xfe\x62")
+	// The commands are taken out of the lines arriving in pieces, and IAC IAC is unescaped.
+	for _, piece := range []string{"he\xff", "\xf1lx\xff\xf7lo\xff", "\xff\r", "\nbye\r\x00"} {
+		_, err = c.Write([]byte(piece))
+		must(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect("line [hello\xff\xff]\r\nline [bye]\r\n")
+	roundTrip("abc\xff\xf8def\n", "line [def]\r\n")
+	roundTrip("x\xff\xf4\n", "command 244\r\nline [x]\r\n")
+	roundTrip(strings.Repeat("z", 40)+"\r\n", "too long\r\n")
+	// A subnegotiation within a line being discarded is handed over, and the line is still too long.
+	roundTrip(strings.Repeat("z", 20)+"\xff\xfa\x1f\x00\x64\x00\x30\xff\xf0"+strings.Repeat("z", 4)+"\r\n",
+		"window 100x48\r\ntoo long\r\n")
+}
+
+type testTelnetServer struct {
+	*EventServer
+}
+
+func (t *testTelnetServer) OnOpened(c Conn) (out []byte, action Action) {
+	must(TelnetRequest(c, TelnetDO, TelnetOptionNAWS))
+	return
+}
+
+func (t *testTelnetServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	switch TelnetFrameKindOf(c) {
+	case TelnetSubnegotiation:
+		if _, remote := TelnetOptionEnabled(c, TelnetOptionNAWS); !remote || frame[0] != TelnetOptionNAWS {
+			return nil, Close
+		}
+		out = []byte(fmt.Sprintf("window %dx%d\n", binary.BigEndian.Uint16(frame[1:]), binary.BigEndian.Uint16(frame[3:])))
+	case TelnetCommand:
+		out = []byte(fmt.Sprintf("command %d\n", frame[0]))
+	case TelnetLineTooLong:
+		out = []byte("too long\n")
+	default:
+		out = []byte(fmt.Sprintf("line [%s]\n", frame))
+	}
+	return
+}
+
+func TestSyslogCodec(t *testing.T) {
+	m, err := ParseSyslog([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 ` +
+		`[exampleSDID@32473 iut="3" eventID="1]011"][origin ip="192.0.2.1"] An application event` + "\n"))
+	must(err)
+	if m.Facility != 20 || m.Severity != 5 || m.Version != 1 || m.Timestamp.UnixNano() != 1065910455003000000 ||
+		string(m.Hostname) != "mymachine.example.com" || string(m.AppName) != "evntslog" || m.ProcID != nil ||
+		string(m.MsgID) != "ID47" || string(m.Message) != "An application event" ||
+		string(m.StructuredData) != `[exampleSDID@32473 iut="3" eventID="1]011"][origin ip="192.0.2.1"]` {
+		t.Fatalf("unexpected RFC 5424 message: %+v", m)
+	}
+	m, err = ParseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su[42]: 'su root' failed on /dev/pts/8"))
+	must(err)
+	if m.Facility != 4 || m.Severity != 2 || m.Version != 0 || m.Timestamp.Month() != time.October ||
+		m.Timestamp.Day() != 11 || string(m.Hostname) != "mymachine" || string(m.AppName) != "su" ||
+		string(m.ProcID) != "42" || string(m.Message) != "'su root' failed on /dev/pts/8" {
+		t.Fatalf("unexpected RFC 3164 message: %+v", m)
+	}
+	for _, msg := range []string{"", "<>1 -", "<192>1 -", "<034>hi", "34 hi"} {
+		if _, err = ParseSyslog([]byte(msg)); err != ErrInvalidSyslogMessage {
+			t.Fatalf("expected ErrInvalidSyslogMessage for %q, got %v", msg, err)
+		}
+	}
+
+	events := &testSyslogServer{messages: make(chan string, 8)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(&SyslogCodec{MaxMessageSize: 64}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	long := "<13>1 - - app - - - " + strings.Repeat("x", 100)
+	// The messages arrive in pieces, and the oversized ones of both framings are discarded.
+	for _, piece := range []string{
+		"23 <13>1 - - app - - - o", "ne",
+		"<13>Oct 11 22:14:15 host app: two\n\n",
+		strconv.Itoa(len(long)) + " " + long[:50], long[50:],
+		long + "\n",
+		"25 <13>1 - - app - - - three",
+	} {
+		_, err = c.Write([]byte(piece))
+		must(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, expected := range []string{"app: one", "app: two", "app: three"} {
+		select {
+		case msg := <-events.messages:
+			if msg != expected {
+				t.Fatalf("expected %q, got %q", expected, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+}
+
+type testSyslogServer struct {
+	*EventServer
+	messages chan string
+}
+
+func (t *testSyslogServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	m, err := ParseSyslog(frame)
+	if err != nil {
+		t.messages <- err.Error()
+		return
+	}
+	t.messages <- string(m.AppName) + ": " + string(m.Message)
+	return
+}
+
+func TestModbusCodec(t *testing.T) {
+	h := ModbusHeader{TransactionID: 7, UnitID: 17}
+	adu := AppendModbusADU(nil, h, []byte{0x03, 0x00, 0x6b, 0x00, 0x01})
+	if !bytes.Equal(adu, []byte{0, 7, 0, 0, 0, 6, 17, 0x03, 0x00, 0x6b, 0x00, 0x01}) {
+		t.Fatalf("unexpected ADU: %v", adu)
+	}
+	if parsed, pdu, err := ParseModbusADU(adu); err != nil || parsed != h || pdu[0] != 0x03 || len(pdu) != 5 {
+		t.Fatalf("unexpected ADU: %+v %v %v", parsed, pdu, err)
+	}
+	if _, _, err := ParseModbusADU(adu[:len(adu)-1]); err != ErrInvalidModbusADU {
+		t.Fatalf("expected ErrInvalidModbusADU, got %v", err)
+	}
+	if adu := AppendModbusADU(nil, h, make([]byte, 254)); adu != nil {
+		t.Fatalf("expected the oversized PDU to be rejected, got %v", adu)
+	}
+
+	s, err := NewServer(&testModbusServer{}, "tcp://127.0.0.1:0", WithCodec(&ModbusCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	readResponse := func(expected []byte) {
+		t.Helper()
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, len(expected))
+		_, err := io.ReadFull(c, buf)
+		must(err)
+		if !bytes.Equal(buf, expected) {
+			t.Fatalf("expected %v, got %v", expected, buf)
+		}
+	}
+
+	// Two pipelined requests, the second one arriving in pieces.
+	second := AppendModbusADU(nil, ModbusHeader{TransactionID: 8, UnitID: 1}, []byte{0x2b, 0x0e})
+	for _, piece := range [][]byte{append(adu, second[:3]...), second[3:9], second[9:]} {
+		_, err = c.Write(piece)
+		must(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	readResponse(AppendModbusADU(nil, h, []byte{0x03, 0x02, 0x00, 0x6b}))
+	readResponse(AppendModbusException(nil, ModbusHeader{TransactionID: 8, UnitID: 1}, 0x2b, ModbusIllegalFunction))
+
+	// A malformed header is discarded along with the data buffered after it.
+	_, err = c.Write(append([]byte{0, 9, 0, 1, 0, 6, 17}, adu...))
+	must(err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.Write(adu)
+	must(err)
+	readResponse(AppendModbusADU(nil, h, []byte{0x03, 0x02, 0x00, 0x6b}))
+}
+
+type testModbusServer struct {
+	*EventServer
+}
+
+func (t *testModbusServer) OnDecodeError(c Conn, err error) (action Action) {
+	return
+}
+
+func (t *testModbusServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	h, pdu, err := ParseModbusADU(frame)
+	if err != nil {
+		return nil, Close
+	}
+	if pdu[0] != 0x03 || len(pdu) != 5 {
+		return AppendModbusException(nil, h, pdu[0], ModbusIllegalFunction), None
+	}
+	// Every holding register holds its own address.
+	return AppendModbusADU(nil, h, []byte{0x03, 0x02, pdu[1], pdu[2]}), None
+}
+
+func TestSIPCodec(t *testing.T) {
+	// A datagram with the compact forms, a folded header and a body cut at Content-Length.
+	m, err := ParseSIPMessage([]byte("\r\nSIP/2.0 180 Ringing\r\nv: SIP/2.0/UDP pc33.example.com\r\n" +
+		"Via: SIP/2.0/UDP bigbox3.example.com\r\nSubject: a\r\n\tlong\r\n  subject\r\ni: a84b4c76e66710\r\n" +
+		"l: 4\r\n\r\nbodytrailing"))
+	must(err)
+	if m.IsRequest() || m.Proto != "SIP/2.0" || m.StatusCode != 180 || m.Reason != "Ringing" ||
+		m.Get("call-id") != "a84b4c76e66710" || m.Get("s") != "a long subject" || len(m.Values("Via")) != 2 ||
+		m.Headers[0].Name != "Via" || string(m.Body) != "body" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	for _, msg := range []string{"INVITE\r\n\r\n", "INVITE sip:bob@example.com HTTP/1.1\r\n\r\n",
+		"SIP/2.0 20 OK\r\n\r\n", "OPTIONS * RTSP/1.0\r\nContent-Length: 10\r\n\r\nshort"} {
+		if _, err = ParseSIPMessage([]byte(msg)); err != ErrInvalidSIPMessage {
+			t.Fatalf("expected ErrInvalidSIPMessage for %q, got %v", msg, err)
+		}
+	}
+	if channel, payload, ok := ParseRTSPInterleaved([]byte{'$', 1, 0, 2, 'h', 'i'}); !ok || channel != 1 ||
+		string(payload) != "hi" {
+		t.Fatalf("unexpected interleaved frame: %d %q %v", channel, payload, ok)
+	}
+
+	events := &testSIPServer{messages: make(chan string, 8)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(&SIPCodec{MaxHeaderSize: 128}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	// The messages arrive in pieces, along with the keep-alive pings and an interleaved frame.
+	for _, piece := range []string{
+		"\r\n\r\nDESCRIBE rtsp://example.com/media RTSP/1.0\r\nCSeq: 2\r\nContent-", "Length: 3\r\n\r",
+		"\nsdp$\x00\x00\x03rt", "pOPTIONS * RTSP/1.0\r\nCSeq: 3\r\n\r\n",
+		"OPTIONS * RTSP/1.0\r\nX-Padding: " + strings.Repeat("x", 200) + "\r\n\r\n",
+		"OPTIONS * RTSP/1.0\r\nCSeq: 4\r\n\r\n",
+	} {
+		_, err = c.Write([]byte(piece))
+		must(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, expected := range []string{"DESCRIBE 2 sdp", "channel 0 rtp", "OPTIONS 3 ", "OPTIONS 4 "} {
+		select {
+		case msg := <-events.messages:
+			if msg != expected {
+				t.Fatalf("expected %q, got %q", expected, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+}
+
+type testSIPServer struct {
+	*EventServer
+	messages chan string
+}
+
+func (t *testSIPServer) OnDecodeError(c Conn, err error) (action Action) {
+	return
+}
+
+func (t *testSIPServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if channel, payload, ok := ParseRTSPInterleaved(frame); ok {
+		t.messages <- fmt.Sprintf("channel %d %s", channel, payload)
+		return
+	}
+	m, err := ParseSIPMessage(frame)
+	if err != nil {
+		t.messages <- err.Error()
+		return
+	}
+	t.messages <- m.Method + " " + m.Get("CSeq") + " " + string(m.Body)
+	return
+}
@@ -8,7 +8,12 @@
 package gnet
 
 import (
+	"io"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/panjf2000/gnet/internal/netpoll"
 	"github.com/panjf2000/gnet/pool/bytebuffer"
@@ -18,94 +23,767 @@ import (
 )
 
 type conn struct {
+	id             uint64                 // connection id
 	fd             int                    // file descriptor
 	sa             unix.Sockaddr          // remote socket address
 	ctx            interface{}            // user-defined context
+	codecCtx       interface{}            // codec-defined context, see Conn.CodecContext
 	loop           *eventloop             // connected event-loop
 	buffer         []byte                 // reuse memory of inbound data as a temporary buffer
 	codec          ICodec                 // codec for TCP
-	opened         bool                   // connection opened event fired
+	bufferProvider ReadBufferProvider     // optional NextBuffer implementation of codec
 	localAddr      net.Addr               // local addr
 	remoteAddr     net.Addr               // remote addr
 	byteBuffer     *bytebuffer.ByteBuffer // bytes buffer for buffering current packet and data in ring-buffer
 	inboundBuffer  *ringbuffer.RingBuffer // buffer for data from client
 	outboundBuffer *ringbuffer.RingBuffer // buffer for data that is ready to write to client
+	ext            *connExt               // state of the optional features, nil for a plain connection
+	origDst        net.Addr               // original destination of the UDP packet, only set if it is transparent
+	bytesIn        uint64                 // number of bytes read from the connection
+	bytesOut       uint64                 // number of bytes written to the connection
+	bufferBytes    int                    // capacity of the ring-buffers accounted for in the loop counters
+	gone           connGone               // channel of Gone, closed once the connection is closed
+	hold           readHold               // state of pausing reading via PauseRead
+	wakePending    int32                  // 1 if a wake-up is pending, the further ones are coalesced into it
+	refs           connRefs               // references retained by Retain, and whether the connection is closed
+	opened         bool                   // connection opened event fired
+	unixSocket     bool                   // whether it is a Unix domain socket connection
+	outboundFull   bool                   // whether the outbound buffer has exceeded the limit since it was drained
+	bufferActive   bool                   // whether the connection has been active since the last sweep of idle buffers
+	readPaused     bool                   // whether reading is paused until the worker catches up
+}
+
+// connExt is the state of the optional features of a connection, it is allocated once a feature needs it,
+// see conn.extension, so that a plain connection doesn't pay for the features it doesn't use.
+type connExt struct {
+	faults         *faultInjector  // fault injector, nil if fault injection is disabled
+	recordID       uint64          // id of the connection in the recording, zero if it is not recorded
+	pending        []byte          // data of AsyncWrite calls merged by write coalescing
+	flushScheduled bool            // whether a flush of the merged data is scheduled
+	zeroCopy       *zeroCopySender // tracker of the zero-copy sends, nil if kernel zero-copy is disabled
+	readBuf        []byte          // buffer provided by ReadBufferProvider for the next reads
+	readN          int             // number of bytes read into readBuf
+	handshakeTimer *time.Timer     // timer of the handshake timeout, nil once the handshake completes
+	handshaking    bool            // whether the frames are handed over to OnHandshake rather than React
+	cipher         FrameCipher     // cipher of the frames, nil until the encryption handshake completes
+	sealPending    [][]byte        // frames written by AsyncWrite before the cipher is set up
+	partialTimer   *time.Timer     // timer of the partial frame timeout, nil if no frame is incomplete
+	partialSince   time.Time       // moment the incomplete frame started or the last frame was decoded
+	openedAt       time.Time       // moment the connection was opened, only set if audit is enabled
+	writeFilters   []WriteFilter   // chain of the write filters
+	stall          writeStall      // age of the outbound data, tracked if the write stall timeout is enabled
+	labels         []connLabel     // labels set via SetLabel, see Server.LabelStats
+	enrichment     enrichment      // result of the Enricher, see WithEnrichment
+	scan           connScanState   // state kept by the connection scanner, see ConnScan
+	worker         *connWorker     // goroutine running React in hybrid mode, see WithConnGoroutine
 }
 
+// connStructSize is the size of a connection struct, and connRingBuffers is the number of its ring-buffers, namely
+// the inbound and outbound ones, see Server.ConnMemoryStats.
+const (
+	connStructSize  = unsafe.Sizeof(conn{})
+	connRingBuffers = 2
+)
+
 func newTCPConn(fd int, el *eventloop, sa unix.Sockaddr) *conn {
-	return &conn{
+	c := &conn{
 		fd:             fd,
 		sa:             sa,
 		loop:           el,
 		codec:          el.codec,
-		inboundBuffer:  prb.Get(),
-		outboundBuffer: prb.Get(),
+		bufferProvider: el.svr.bufferProvider,
+	}
+	if el.svr.opts.MassiveConnections || el.svr.opts.BufferIdleTimeout > 0 {
+		// The ring-buffers are taken from the pool once the first byte is left over.
+		c.inboundBuffer, c.outboundBuffer = emptyRingBuffer, emptyRingBuffer
+	} else {
+		c.inboundBuffer, c.outboundBuffer = prb.Get(), prb.Get()
 	}
+	return c
 }
 
 func (c *conn) releaseTCP() {
 	c.opened = false
 	c.sa = nil
-	c.ctx = nil
 	c.buffer = nil
-	c.localAddr = nil
-	c.remoteAddr = nil
-	prb.Put(c.inboundBuffer)
-	prb.Put(c.outboundBuffer)
+	if c.refs.close() {
+		c.releaseRetained()
+	}
+	c.gone.close()
+	c.loop.counters.addBufferBytes(-int64(c.bufferBytes))
+	c.bufferBytes = 0
+	putRingBuffer(c.inboundBuffer)
+	putRingBuffer(c.outboundBuffer)
 	c.inboundBuffer = nil
 	c.outboundBuffer = nil
 	bytebuffer.Put(c.byteBuffer)
 	c.byteBuffer = nil
+	c.codecCtx = nil
+	c.outboundFull = false
+	c.readPaused = false
+	if x := c.ext; x != nil {
+		x.release()
+		c.ext = nil
+	}
+}
+
+// extension returns the state of the optional features of the connection, allocating it on first use.
+func (c *conn) extension() *connExt {
+	if c.ext == nil {
+		c.ext = new(connExt)
+	}
+	return c.ext
+}
+
+// scanState returns the state of the connection kept by the connection scanner.
+func (c *conn) scanState() *connScanState {
+	return &c.extension().scan
+}
+
+// release stops the timers and the worker of the connection and releases its labels.
+func (x *connExt) release() {
+	releaseLabels(x.labels)
+	if x.worker != nil {
+		x.worker.stop()
+	}
+	if x.handshakeTimer != nil {
+		x.handshakeTimer.Stop()
+	}
+	if x.partialTimer != nil {
+		x.partialTimer.Stop()
+	}
+	x.stall.reset()
+}
+
+// releaseRetained releases the state of the connection which stays valid as long as the connection is retained.
+func (c *conn) releaseRetained() {
+	c.ctx = nil
+	c.localAddr = nil
+	c.remoteAddr = nil
 }
 
 func newUDPConn(fd int, el *eventloop, sa unix.Sockaddr) *conn {
 	return &conn{
 		fd:         fd,
 		sa:         sa,
-		localAddr:  el.svr.ln.lnaddr,
+		localAddr:  el.svr.ln.packetListener().lnaddr,
 		remoteAddr: netpoll.SockaddrToUDPAddr(sa),
 	}
 }
 
+// startHandshakeTimer closes the connection unless its handshake completes within the timeout.
+func (c *conn) startHandshakeTimer(timeout time.Duration) {
+	x := c.extension()
+	x.handshakeTimer = time.AfterFunc(timeout, func() {
+		_ = c.trigger(func() error {
+			if c.opened && x.handshakeTimer != nil {
+				return c.loop.loopCloseConn(c, ErrHandshakeTimeout)
+			}
+			return nil
+		})
+	})
+}
+
+// endHandshake ends the handshake phase once OnHandshake accepts the handshake.
+func (c *conn) endHandshake() {
+	x := c.ext
+	if x == nil {
+		return
+	}
+	x.handshaking = false
+	if x.handshakeTimer != nil {
+		x.handshakeTimer.Stop()
+		x.handshakeTimer = nil
+	}
+}
+
+// checkHandshake stops the handshake timer once the handshake completes, which is reported by the codec
+// if it implements HandshakeReporter, or indicated by progress otherwise, i.e. a decoded frame.
+func (c *conn) checkHandshake(progress bool) {
+	x := c.ext
+	if x.handshaking {
+		// The handshake completes once OnHandshake accepts it.
+		return
+	}
+	if r, ok := c.codec.(HandshakeReporter); ok {
+		progress = r.HandshakeComplete(c)
+	}
+	if progress {
+		x.handshakeTimer.Stop()
+		x.handshakeTimer = nil
+	}
+}
+
+// checkPartialFrame keeps track of the incomplete frame left over after the inbound data is handled, the partial
+// frame timeout counts from the moment the frame started or the last frame was decoded.
+func (c *conn) checkPartialFrame(decoded bool) {
+	if c.inboundBuffer.IsEmpty() && (c.ext == nil || c.ext.readN == 0) {
+		if x := c.ext; x != nil && x.partialTimer != nil {
+			x.partialTimer.Stop()
+			x.partialTimer = nil
+		}
+		return
+	}
+	x := c.extension()
+	if x.partialTimer == nil {
+		x.partialSince = time.Now()
+		c.startPartialTimer(c.loop.svr.opts.PartialFrameTimeout)
+	} else if decoded {
+		x.partialSince = time.Now()
+	}
+}
+
+// startPartialTimer fires the partial frame timeout unless a frame is decoded in the meantime,
+// in which case the timer starts over for the remaining time.
+func (c *conn) startPartialTimer(d time.Duration) {
+	var t *time.Timer
+	x := c.extension()
+	t = time.AfterFunc(d, func() {
+		_ = c.trigger(func() error {
+			if !c.opened || x.partialTimer != t {
+				return nil
+			}
+			x.partialTimer = nil
+			if remaining := c.loop.svr.opts.PartialFrameTimeout - time.Since(x.partialSince); remaining > 0 {
+				c.startPartialTimer(remaining)
+				return nil
+			}
+			return c.loop.loopDecodeError(c, ErrPartialFrameTimeout)
+		})
+	})
+	x.partialTimer = t
+}
+
+// setCodec overrides the codec of the connection.
+func (c *conn) setCodec(codec ICodec) {
+	c.codec = codec
+	if c.loop.svr.trafficHandler == nil {
+		c.bufferProvider, _ = codec.(ReadBufferProvider)
+	}
+}
+
 func (c *conn) releaseUDP() {
 	c.ctx = nil
+	c.origDst = nil
 	c.localAddr = nil
 	c.remoteAddr = nil
 }
 
 func (c *conn) open(buf []byte) {
-	n, err := unix.Write(c.fd, buf)
+	if x := c.ext; x != nil && len(x.writeFilters) > 0 {
+		if buf = c.filterWrite(buf); len(buf) == 0 {
+			return
+		}
+	}
+	if x := c.ext; x != nil && (x.faults != nil || x.recordID != 0) {
+		c.send(buf)
+		return
+	}
+	n, err := c.loop.svr.transport.Write(c.fd, buf)
 	if err != nil {
-		_, _ = c.outboundBuffer.Write(buf)
+		c.bufferOutbound(buf)
 		return
 	}
+	c.addBytesOut(n)
 
 	if n < len(buf) {
-		_, _ = c.outboundBuffer.Write(buf[n:])
+		c.bufferOutbound(buf[n:])
 	}
 }
 
 func (c *conn) read() ([]byte, error) {
-	return c.codec.Decode(c)
+	a, t := c.loop.svr.opts.FrameAccounting, c.loop.svr.opts.FrameTracer
+	if a == nil && t == nil && (c.ext == nil || c.ext.cipher == nil) {
+		return c.codec.Decode(c)
+	}
+	buffered := c.BufferLength()
+	frame, err := c.codec.Decode(c)
+	if frame != nil && c.ext != nil && c.ext.cipher != nil {
+		if frame, _ = c.openFrame(frame); frame == nil {
+			// The connection is closed by openFrame.
+			return nil, nil
+		}
+	}
+	if frame != nil {
+		if a != nil {
+			a.AccountFrame(c, true, len(frame), buffered-c.BufferLength())
+		}
+		if t != nil {
+			t.trace(c, true, frame)
+		}
+	}
+	return frame, err
+}
+
+// encode encrypts the outbound frame with the cipher of the connection if the frames are encrypted, and encodes it
+// via encodeFrame.
+func (c *conn) encode(buf []byte) (frame []byte, bb *bytebuffer.ByteBuffer, err error) {
+	sealed := buf
+	if x := c.ext; c.loop.svr.opts.Encryption != nil && x != nil {
+		if x.cipher != nil {
+			if sealed, err = x.cipher.Seal(buf); err != nil {
+				return nil, nil, err
+			}
+		} else if x.handshaking {
+			return nil, nil, errEncryptionPending
+		}
+	}
+	if frame, bb, err = c.encodeFrame(sealed); err != nil {
+		return
+	}
+	if a := c.loop.svr.opts.FrameAccounting; a != nil {
+		a.AccountFrame(c, false, len(buf), len(frame))
+	}
+	if t := c.loop.svr.opts.FrameTracer; t != nil {
+		t.trace(c, false, buf)
+	}
+	return
+}
+
+// encodeFrame encodes the outbound frame with the codec of the connection, into a pooled buffer if the codec
+// implements BufferEncoder, in which case the buffer is returned along with the frame to be put back once the frame
+// is written.
+func (c *conn) encodeFrame(buf []byte) (frame []byte, bb *bytebuffer.ByteBuffer, err error) {
+	if e, ok := c.codec.(BufferEncoder); ok {
+		bb = bytebuffer.Get()
+		if err = e.EncodeTo(c, bb, buf); err != nil {
+			bytebuffer.Put(bb)
+			return nil, nil, err
+		}
+		frame = bb.B
+	} else if frame, err = c.codec.Encode(c, buf); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// openFrame decrypts an inbound frame with the cipher of the connection, the connection is closed if it fails.
+func (c *conn) openFrame(frame []byte) ([]byte, error) {
+	frame, err := c.ext.cipher.Open(frame)
+	if err != nil {
+		c.ext.cipher = failedCipher{err}
+		_ = c.trigger(func() error {
+			if c.opened {
+				return c.loop.loopCloseConn(c, err)
+			}
+			return nil
+		})
+	}
+	return frame, err
 }
 
 func (c *conn) write(buf []byte) {
-	if !c.outboundBuffer.IsEmpty() {
-		_, _ = c.outboundBuffer.Write(buf)
+	if x := c.ext; x != nil && len(x.writeFilters) > 0 {
+		if buf = c.filterWrite(buf); len(buf) == 0 {
+			return
+		}
+	}
+	c.send(buf)
+}
+
+// filterWrite passes the outbound data through the write filters of the connection in order.
+func (c *conn) filterWrite(buf []byte) []byte {
+	for _, f := range c.ext.writeFilters {
+		if buf = f(c, buf); len(buf) == 0 {
+			return nil
+		}
+	}
+	return buf
+}
+
+// send writes the outbound data that has passed through the write filters.
+func (c *conn) send(buf []byte) {
+	if c.loop.svr.opts.LoopWriteBatching {
+		c.batchWrite(buf)
+		return
+	}
+	if x := c.ext; x != nil && len(x.pending) > 0 {
+		// Flush the merged data along with buf to keep the order of writes.
+		x.pending = append(x.pending, buf...)
+		c.flushCoalesced()
+		return
+	}
+	c.sendNow(buf)
+}
+
+// sendNow writes the outbound data right away.
+func (c *conn) sendNow(buf []byte) {
+	x := c.ext
+	if x != nil && x.recordID != 0 {
+		c.loop.svr.opts.Recorder.record(RecordOutbound, x.recordID, buf)
+	}
+	if x != nil && x.faults != nil {
+		_ = x.faults.write.inject(buf, c.trigger, func(data []byte) error {
+			if c.opened {
+				c.writeDirect(data, false)
+			}
+			return nil
+		})
+		return
+	}
+	c.writeDirect(buf, false)
+}
+
+// asyncWrite writes the data handed over by AsyncWrite, which is merged if write coalescing is enabled,
+// or sent with zero-copy if it reaches the threshold of kernel zero-copy send. It puts bb, the pooled buffer
+// holding the data if any, back once the data is written.
+func (c *conn) asyncWrite(buf []byte, bb *bytebuffer.ByteBuffer) {
+	x := c.ext
+	if x != nil && len(x.writeFilters) > 0 {
+		if buf = c.filterWrite(buf); len(buf) == 0 {
+			bytebuffer.Put(bb)
+			return
+		}
+	}
+	opts := c.loop.svr.opts
+	switch {
+	case opts.WriteCoalescing:
+		c.coalesce(buf)
+	case x != nil && x.zeroCopy != nil && x.faults == nil && len(buf) >= opts.KernelZeroCopySendThreshold &&
+		len(x.pending) == 0:
+		if x.recordID != 0 {
+			opts.Recorder.record(RecordOutbound, x.recordID, buf)
+		}
+		c.writeDirect(buf, true)
+	default:
+		c.send(buf)
+	}
+	bytebuffer.Put(bb)
+}
+
+// asyncSeal encrypts and writes a frame written by AsyncWrite within the event-loop, the frame is queued until
+// the encryption handshake sets up the cipher, and the connection is closed if it fails to be encrypted.
+func (c *conn) asyncSeal(buf []byte) error {
+	if x := c.extension(); x.cipher == nil {
+		x.sealPending = append(x.sealPending, buf)
+		return nil
+	}
+	encodedBuf, bb, err := c.encode(buf)
+	if err != nil {
+		return c.loop.loopCloseConn(c, err)
+	}
+	c.asyncWrite(encodedBuf, bb)
+	return nil
+}
+
+// flushSealPending encrypts and writes the frames queued by asyncSeal once the cipher is set up.
+func (c *conn) flushSealPending() error {
+	pending := c.ext.sealPending
+	c.ext.sealPending = nil
+	for _, buf := range pending {
+		if !c.opened {
+			return nil
+		}
+		if err := c.asyncSeal(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coalesce merges buf into the pending data of the connection, which is flushed in one write
+// when the coalescing window elapses or when it reaches the size limit.
+func (c *conn) coalesce(buf []byte) {
+	el, x := c.loop, c.extension()
+	x.pending = append(x.pending, buf...)
+	el.counters.addCoalescedWrite()
+	if maxBytes := el.svr.opts.WriteCoalescingMaxBytes; maxBytes > 0 && len(x.pending) >= maxBytes {
+		c.flushCoalesced()
+		return
+	}
+	if x.flushScheduled {
+		return
+	}
+	x.flushScheduled = true
+	flush := func() error {
+		if c.opened && x.flushScheduled {
+			c.flushCoalesced()
+		}
+		return nil
+	}
+	if window := el.svr.opts.WriteCoalescingWindow; window > 0 {
+		time.AfterFunc(window, func() { _ = c.trigger(flush) })
 		return
 	}
-	n, err := unix.Write(c.fd, buf)
+	_ = c.trigger(flush)
+}
+
+// flushCoalesced writes the pending data of the connection, merged by write coalescing or write batching.
+func (c *conn) flushCoalesced() {
+	x := c.ext
+	x.flushScheduled = false
+	if len(x.pending) == 0 {
+		return
+	}
+	buf := x.pending
+	x.pending = nil
+	c.sendNow(buf)
+	if c.loop.svr.opts.LoopWriteBatching {
+		c.loop.counters.addBatchedFlush()
+	} else {
+		c.loop.counters.addCoalescedFlush()
+	}
+	if c.opened {
+		x.pending = buf[:0]
+	}
+}
+
+// batchWrite merges buf into the pending data of the connection, which is flushed in one write along with the data
+// written to the other connections at the end of the iteration of the event-loop, see LoopWriteBatching.
+func (c *conn) batchWrite(buf []byte) {
+	x := c.extension()
+	if !x.flushScheduled {
+		x.flushScheduled = true
+		c.loop.writeBatch = append(c.loop.writeBatch, c)
+	}
+	x.pending = append(x.pending, buf...)
+	c.loop.counters.addBatchedWrite()
+}
+
+// flushBatched writes the pending data of the connection merged by batchWrite, unless it has been closed or
+// flushed meanwhile.
+func (c *conn) flushBatched() {
+	if c.opened && c.ext.flushScheduled {
+		c.flushCoalesced()
+	}
+}
+
+func (c *conn) trigger(job func() error) error {
+	return c.loop.poller.Trigger(job)
+}
+
+func (c *conn) writeDirect(buf []byte, zeroCopy bool) {
+	if !c.outboundBuffer.IsEmpty() || c.outboundFull {
+		c.bufferOutbound(buf)
+		return
+	}
+	var (
+		n   int
+		err error
+	)
+	if zeroCopy {
+		n, err = c.ext.zeroCopy.send(c.fd, buf)
+	} else {
+		n, err = c.loop.svr.transport.Write(c.fd, buf)
+	}
 	if err != nil {
 		if err == unix.EAGAIN {
-			_, _ = c.outboundBuffer.Write(buf)
-			_ = c.loop.poller.ModReadWrite(c.fd)
+			c.pollReadWrite()
+			c.bufferOutbound(buf)
 			return
 		}
 		_ = c.loop.loopCloseConn(c, err)
 		return
 	}
+	c.addBytesOut(n)
 	if n < len(buf) {
-		_, _ = c.outboundBuffer.Write(buf[n:])
+		c.pollReadWrite()
+		c.bufferOutbound(buf[n:])
+	}
+}
+
+// bufferOutbound appends the data that can't be written to the socket right away to the outbound buffer,
+// and applies OutboundFullPolicy once the outbound buffer exceeds OutboundLimit.
+func (c *conn) bufferOutbound(buf []byte) {
+	opts := c.loop.svr.opts
+	if opts.OutboundLimit <= 0 {
+		c.queueOutbound(buf)
+		return
+	}
+	if opts.OutboundFullPolicy == OutboundDrop {
+		switch {
+		case c.outboundFull:
+		case c.outboundBuffer.Length()+len(buf) <= opts.OutboundLimit:
+			c.queueOutbound(buf)
+		default:
+			// The connection is closed in the next round of the event-loop rather than within the writer,
+			// which may still be working on it.
+			c.outboundFull = true
+			_ = c.trigger(func() error {
+				if c.opened {
+					return c.loop.loopCloseConn(c, ErrOutboundFull)
+				}
+				return nil
+			})
+		}
+		return
+	}
+	c.queueOutbound(buf)
+	if c.outboundFull || c.outboundBuffer.Length() <= opts.OutboundLimit {
+		return
+	}
+	c.outboundFull = true
+	switch opts.OutboundFullPolicy {
+	case OutboundBlockReads:
+		_ = c.loop.poller.ModWrite(c.fd)
+	case OutboundCallback:
+		_ = c.trigger(func() error {
+			if !c.opened || !c.outboundFull {
+				return nil
+			}
+			switch c.loop.svr.outboundHandler.OnOutboundFull(c, c.outboundBuffer.Length()) {
+			case Close:
+				return c.loop.loopCloseConn(c, ErrOutboundFull)
+			case Shutdown:
+				return ErrServerShutdown
+			}
+			return nil
+		})
+	}
+}
+
+// settleBuffers gives the drained ring-buffers back with MassiveConnections, and accounts for
+// the capacity of the ring-buffers in the loop counters, see Server.ConnMemoryStats. It is invoked after the inbound
+// data is handled and after the outbound data is written.
+func (c *conn) settleBuffers() {
+	if c.loop.svr.opts.MassiveConnections {
+		c.releaseBuffers()
+		return
+	}
+	c.bufferActive = true
+	c.accountBuffers()
+}
+
+// releaseBuffers gives the drained ring-buffers back to the pool, see WithLazyBuffers.
+func (c *conn) releaseBuffers() {
+	if c.inboundBuffer.Cap() > 0 && c.inboundBuffer.IsEmpty() {
+		prb.Put(c.inboundBuffer)
+		c.inboundBuffer = emptyRingBuffer
+	}
+	if c.outboundBuffer.Cap() > 0 && c.outboundBuffer.IsEmpty() {
+		prb.Put(c.outboundBuffer)
+		c.outboundBuffer = emptyRingBuffer
+	}
+	c.accountBuffers()
+}
+
+func (c *conn) accountBuffers() {
+	size := c.inboundBuffer.Cap() + c.outboundBuffer.Cap()
+	c.loop.counters.addBufferBytes(int64(size - c.bufferBytes))
+	c.bufferBytes = size
+}
+
+// bufferInbound appends the data left over in the event-loop-buffer to the inbound ring-buffer, taking one from
+// the pool if it has been given back.
+func (c *conn) bufferInbound() {
+	if len(c.buffer) == 0 {
+		return
+	}
+	if c.inboundBuffer.Cap() == 0 {
+		c.inboundBuffer = prb.Get()
+	}
+	_, _ = c.inboundBuffer.Write(c.buffer)
+}
+
+// queueOutbound appends buf to the outbound buffer, keeping track of its age if the write stall timeout is enabled.
+func (c *conn) queueOutbound(buf []byte) {
+	if c.outboundBuffer.Cap() == 0 {
+		c.outboundBuffer = prb.Get()
+	}
+	_, _ = c.outboundBuffer.Write(buf)
+	if timeout := c.loop.svr.opts.WriteStallTimeout; timeout > 0 {
+		x := c.extension()
+		x.stall.queue(len(buf), time.Now(), timeout/8)
+		if x.stall.timer == nil {
+			c.startStallTimer(timeout)
+		}
+	}
+}
+
+// flushOutbound discards the n bytes of the outbound buffer written to the socket.
+func (c *conn) flushOutbound(n int) {
+	c.outboundBuffer.Shift(n)
+	c.addBytesOut(n)
+	if x := c.ext; x != nil && c.loop.svr.opts.WriteStallTimeout > 0 {
+		x.stall.flush(n)
+	}
+}
+
+// startStallTimer fires the write stall timeout unless the outbound data waiting for longer than the timeout is
+// written in the meantime, in which case the timer starts over for the remaining time of the oldest byte left.
+func (c *conn) startStallTimer(d time.Duration) {
+	var t *time.Timer
+	x := c.extension()
+	t = time.AfterFunc(d, func() {
+		_ = c.trigger(func() error {
+			if !c.opened || x.stall.timer != t {
+				return nil
+			}
+			x.stall.timer = nil
+			oldest := x.stall.oldest()
+			if oldest.IsZero() {
+				return nil
+			}
+			timeout := c.loop.svr.opts.WriteStallTimeout
+			stalled := time.Since(oldest)
+			if remaining := timeout - stalled; remaining > 0 {
+				c.startStallTimer(remaining)
+				return nil
+			}
+			action := Close
+			if h := c.loop.svr.stallHandler; h != nil {
+				action = h.OnWriteStall(c, stalled, c.outboundBuffer.Length())
+			}
+			switch action {
+			case None:
+				if c.opened && x.stall.timer == nil && !x.stall.oldest().IsZero() {
+					c.startStallTimer(timeout)
+				}
+				return nil
+			case Shutdown:
+				return ErrServerShutdown
+			}
+			return c.loop.loopCloseConn(c, ErrWriteStall)
+		})
+	})
+	x.stall.timer = t
+}
+
+// pollReadWrite watches the writable event of the connection along with its readable event unless reading is paused.
+func (c *conn) pollReadWrite() {
+	if c.readPaused {
+		_ = c.loop.poller.ModWrite(c.fd)
+	} else {
+		_ = c.loop.poller.ModReadWrite(c.fd)
+	}
+}
+
+// pollRead stops watching the writable event of the connection, along with its readable event if reading is paused.
+func (c *conn) pollRead() {
+	if c.readPaused {
+		_ = c.loop.poller.ModNone(c.fd)
+	} else {
+		_ = c.loop.poller.ModRead(c.fd)
+	}
+}
+
+// pauseReads stops reading from the connection until resumeReads.
+func (c *conn) pauseReads() {
+	if c.readPaused {
+		return
+	}
+	c.readPaused = true
+	if c.outboundBuffer.IsEmpty() {
+		_ = c.loop.poller.ModNone(c.fd)
+	} else {
+		_ = c.loop.poller.ModWrite(c.fd)
+	}
+}
+
+// resumeReads resumes reading from the connection paused by pauseReads, unless reading is blocked by
+// OutboundBlockReads.
+func (c *conn) resumeReads() {
+	if !c.readPaused {
+		return
+	}
+	c.readPaused = false
+	switch {
+	case c.outboundBuffer.IsEmpty():
+		_ = c.loop.poller.ModRead(c.fd)
+	case c.outboundFull && c.loop.svr.opts.OutboundFullPolicy == OutboundBlockReads:
+	default:
+		// Watch the readable event first, ModReadWrite doesn't touch it with kqueue.
+		_ = c.loop.poller.ModRead(c.fd)
 		_ = c.loop.poller.ModReadWrite(c.fd)
 	}
 }
@@ -126,7 +804,9 @@ func (c *conn) Read() []byte {
 
 func (c *conn) ResetBuffer() {
 	c.buffer = nil
-	c.inboundBuffer.Reset()
+	if !c.inboundBuffer.IsEmpty() {
+		c.inboundBuffer.Reset()
+	}
 	bytebuffer.Put(c.byteBuffer)
 	c.byteBuffer = nil
 }
@@ -189,12 +869,132 @@ func (c *conn) BufferLength() int {
 	return c.inboundBuffer.Length() + len(c.buffer)
 }
 
+func (c *conn) InboundBuffered() int {
+	if c.inboundBuffer == nil {
+		return 0
+	}
+	n := c.inboundBuffer.Length() + len(c.buffer)
+	if c.ext != nil {
+		n += c.ext.readN
+	}
+	return n
+}
+
+func (c *conn) OutboundBuffered() int {
+	if c.outboundBuffer == nil {
+		return 0
+	}
+	n := c.outboundBuffer.Length()
+	if c.ext != nil {
+		n += len(c.ext.pending)
+	}
+	return n
+}
+
+func (c *conn) TCPInfo() (TCPInfo, error) {
+	if c.id == 0 || c.unixSocket {
+		return TCPInfo{}, ErrProtocolNotSupported
+	}
+	if !c.opened {
+		return TCPInfo{}, ErrConnClosed
+	}
+	return getTCPInfo(c.fd)
+}
+
+func (c *conn) Peek(n int) (buf []byte, err error) {
+	if n > c.BufferLength() {
+		return nil, io.ErrShortBuffer
+	}
+	_, buf = c.ReadN(n)
+	return
+}
+
+func (c *conn) Next(n int) (buf []byte, err error) {
+	if buf, err = c.Peek(n); err != nil {
+		return
+	}
+	// Detach the byte-buffer that may be backing buf so that ShiftN won't put it back into the pool
+	// while the caller is still holding buf.
+	c.byteBuffer = nil
+	c.ShiftN(len(buf))
+	return
+}
+
+func (c *conn) Cursor() Cursor {
+	if c.inboundBuffer == nil {
+		return newCursor(c, nil, nil, nil)
+	}
+	head, tail := c.inboundBuffer.LazyReadAll()
+	return newCursor(c, head, tail, c.buffer)
+}
+
+func (c *conn) Write(buf []byte) (n int, err error) {
+	if !c.opened {
+		return 0, ErrConnClosed
+	}
+	c.loop.eventHandler.PreWrite()
+	c.write(buf)
+	return len(buf), nil
+}
+
+func (c *conn) AddWriteFilter(f WriteFilter) {
+	x := c.extension()
+	x.writeFilters = append(x.writeFilters, f)
+}
+
+func (c *conn) SendFD(fd int, data []byte) error {
+	if !c.opened {
+		return ErrConnClosed
+	}
+	if !c.unixSocket {
+		return ErrProtocolNotSupported
+	}
+	if len(data) == 0 {
+		return ErrEmptyFDData
+	}
+	if c.ext != nil && len(c.ext.pending) > 0 {
+		c.flushCoalesced()
+	}
+	if !c.outboundBuffer.IsEmpty() {
+		return ErrOutboundPending
+	}
+	c.loop.eventHandler.PreWrite()
+	n, err := unix.SendmsgN(c.fd, data, unix.UnixRights(fd), nil, 0)
+	if err != nil {
+		return os.NewSyscallError("sendmsg", err)
+	}
+	c.addBytesOut(n)
+	if c.ext != nil && c.ext.recordID != 0 {
+		c.loop.svr.opts.Recorder.record(RecordOutbound, c.ext.recordID, data)
+	}
+	if n < len(data) {
+		c.pollReadWrite()
+		c.bufferOutbound(data[n:])
+	}
+	return nil
+}
+
 func (c *conn) AsyncWrite(buf []byte) (err error) {
-	var encodedBuf []byte
-	if encodedBuf, err = c.codec.Encode(c, buf); err == nil {
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	if c.loop.svr.opts.Encryption != nil {
+		// The frames are encrypted in the order they are written, namely within the event-loop.
+		return c.loop.poller.Trigger(func() error {
+			if c.opened {
+				return c.asyncSeal(buf)
+			}
+			return nil
+		})
+	}
+	var (
+		encodedBuf []byte
+		bb         *bytebuffer.ByteBuffer
+	)
+	if encodedBuf, bb, err = c.encode(buf); err == nil {
 		return c.loop.poller.Trigger(func() error {
 			if c.opened {
-				c.write(encodedBuf)
+				c.asyncWrite(encodedBuf, bb)
 			}
 			return nil
 		})
@@ -206,19 +1006,144 @@ func (c *conn) SendTo(buf []byte) error {
 	return c.sendTo(buf)
 }
 
-func (c *conn) Wake() error {
-	return c.loop.poller.Trigger(func() error {
+func (c *conn) Wake() (err error) {
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	if !atomic.CompareAndSwapInt32(&c.wakePending, 0, 1) {
+		return nil
+	}
+	if err = c.loop.poller.Trigger(func() error {
 		return c.loop.loopWake(c)
+	}); err != nil {
+		atomic.StoreInt32(&c.wakePending, 0)
+	}
+	return
+}
+
+func (c *conn) WakeWith(tag interface{}) error {
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	return c.loop.poller.Trigger(func() error {
+		return c.loop.loopUserEvent(c, tag)
 	})
 }
 
 func (c *conn) Close() error {
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
 	return c.loop.poller.Trigger(func() error {
+		if !c.opened {
+			return nil // the file descriptor may belong to another connection now.
+		}
 		return c.loop.loopCloseConn(c, nil)
 	})
 }
 
-func (c *conn) Context() interface{}       { return c.ctx }
-func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
-func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
-func (c *conn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *conn) Retain() error {
+	return c.refs.retain()
+}
+
+func (c *conn) Release() {
+	if c.refs.release() {
+		c.releaseRetained()
+	}
+}
+
+func (c *conn) Gone() <-chan struct{} {
+	return c.gone.done()
+}
+
+func (c *conn) PauseRead() error {
+	if c.id == 0 {
+		return ErrProtocolNotSupported
+	}
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	if !c.hold.pause() {
+		return nil
+	}
+	return c.trigger(func() error {
+		if c.opened && c.hold.paused() {
+			c.pauseReads()
+		}
+		return nil
+	})
+}
+
+func (c *conn) ResumeRead() error {
+	if c.id == 0 {
+		return ErrProtocolNotSupported
+	}
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	if !c.hold.release() {
+		return nil
+	}
+	return c.trigger(func() error {
+		return c.loop.loopResumeRead(c)
+	})
+}
+
+func (c *conn) SetLabel(key, value string) {
+	if c.id == 0 {
+		return
+	}
+	x := c.extension()
+	x.labels = c.loop.svr.setLabel(x.labels, key, value)
+}
+
+func (c *conn) Label(key string) string {
+	if c.ext == nil {
+		return ""
+	}
+	return labelValue(c.ext.labels, key)
+}
+
+func (c *conn) Enrichment() (interface{}, error) {
+	if c.ext == nil {
+		return nil, nil
+	}
+	return c.ext.enrichment.result, c.ext.enrichment.err
+}
+
+// addBytesIn counts the n bytes read from the connection.
+func (c *conn) addBytesIn(n int) {
+	c.bytesIn += uint64(n)
+	c.loop.counters.addBytesIn(n)
+	if c.ext != nil {
+		countLabelsIn(c.ext.labels, n)
+	}
+}
+
+// addBytesOut counts the n bytes written to the connection.
+func (c *conn) addBytesOut(n int) {
+	c.bytesOut += uint64(n)
+	c.loop.counters.addBytesOut(n)
+	if c.ext != nil {
+		countLabelsOut(c.ext.labels, n)
+	}
+}
+
+func (c *conn) ID() uint64                      { return c.id }
+func (c *conn) Context() interface{}            { return c.ctx }
+func (c *conn) SetContext(ctx interface{})      { c.ctx = ctx }
+func (c *conn) CodecContext() interface{}       { return c.codecCtx }
+func (c *conn) SetCodecContext(ctx interface{}) { c.codecCtx = ctx }
+func (c *conn) LocalAddr() net.Addr             { return c.localAddr }
+func (c *conn) RemoteAddr() net.Addr            { return c.remoteAddr }
+func (c *conn) OriginalDst() net.Addr           { return c.origDst }
+
+func (c *conn) RemoteIP() net.IP {
+	ip, _ := addrIPPort(c.remoteAddr)
+	return ip
+}
+
+func (c *conn) RemotePort() int {
+	_, port := addrIPPort(c.remoteAddr)
+	return port
+}
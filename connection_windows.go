@@ -8,7 +8,11 @@
 package gnet
 
 import (
+	"io"
 	"net"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/panjf2000/gnet/pool/bytebuffer"
 	prb "github.com/panjf2000/gnet/pool/ringbuffer"
@@ -24,45 +28,121 @@ type wakeReq struct {
 	c *stdConn
 }
 
+type userEvent struct {
+	c   *stdConn
+	tag interface{}
+}
+
 type tcpIn struct {
 	c  *stdConn
 	in *bytebuffer.ByteBuffer
 }
 
 type udpIn struct {
-	c *stdConn
+	c         *stdConn
+	truncated bool // whether the datagram exceeded the read buffer
 }
 
 type stdConn struct {
-	ctx           interface{}            // user-defined context
-	conn          net.Conn               // original connection
-	loop          *eventloop             // owner event-loop
-	done          int32                  // 0: attached, 1: closed
-	buffer        *bytebuffer.ByteBuffer // reuse memory of inbound data as a temporary buffer
-	codec         ICodec                 // codec for TCP
-	localAddr     net.Addr               // local server addr
-	remoteAddr    net.Addr               // remote peer addr
-	byteBuffer    *bytebuffer.ByteBuffer // bytes buffer for buffering current packet and data in ring-buffer
-	inboundBuffer *ringbuffer.RingBuffer // buffer for data from client
+	id             uint64                 // connection id
+	ctx            interface{}            // user-defined context
+	codecCtx       interface{}            // codec-defined context, see Conn.CodecContext
+	conn           net.Conn               // original connection
+	loop           *eventloop             // owner event-loop
+	done           int32                  // 0: attached, 1: closed
+	buffer         *bytebuffer.ByteBuffer // reuse memory of inbound data as a temporary buffer
+	codec          ICodec                 // codec for TCP
+	localAddr      net.Addr               // local server addr
+	remoteAddr     net.Addr               // remote peer addr
+	byteBuffer     *bytebuffer.ByteBuffer // bytes buffer for buffering current packet and data in ring-buffer
+	inboundBuffer  *ringbuffer.RingBuffer // buffer for data from client
+	faults         *faultInjector         // fault injector, nil if fault injection is disabled
+	recordID       uint64                 // id of the connection in the recording, zero if it is not recorded
+	wakePending    int32                  // 1 if a wake-up is pending, the further ones are coalesced into it
+	pending        []byte                 // data of AsyncWrite calls merged by write coalescing
+	flushScheduled bool                   // whether a flush of the merged data is scheduled
+	handshakeTimer *time.Timer            // timer of the handshake timeout, nil once the handshake completes
+	handshaking    bool                   // whether the frames are handed over to OnHandshake rather than React
+	cipher         FrameCipher            // cipher of the frames, nil until the encryption handshake completes
+	sealPending    [][]byte               // frames written by AsyncWrite before the cipher is set up
+	writeFilters   []WriteFilter          // chain of the write filters
+	partialTimer   *time.Timer            // timer of the partial frame timeout, nil if no frame is incomplete
+	partialSince   time.Time              // moment the incomplete frame started or the last frame was decoded
+	openedAt       time.Time              // moment the connection was opened, only set if audit is enabled
+	bytesIn        uint64                 // number of bytes read from the connection
+	bytesOut       uint64                 // number of bytes written to the connection
+	refs           connRefs               // references retained by Retain, and whether the connection is closed
+	gone           connGone               // channel of Gone, closed once the connection is closed
+	labels         []connLabel            // labels set via SetLabel, see Server.LabelStats
+	enrichment     enrichment             // result of the Enricher, see WithEnrichment
+	hold           readHold               // state of pausing reading via PauseRead
+	scan           connScanState          // state kept by the connection scanner, see ConnScan
+	bufferBytes    int                    // capacity of the inbound ring-buffer accounted for in the loop counters
+	bufferActive   bool                   // whether the connection has been active since the last sweep of idle buffers
+	worker         *connWorker            // goroutine running React in hybrid mode, see WithConnGoroutine
 }
 
+// connStructSize is the size of a connection struct, and connRingBuffers is the number of its ring-buffers, namely
+// the inbound one, see Server.ConnMemoryStats.
+const (
+	connStructSize  = unsafe.Sizeof(stdConn{})
+	connRingBuffers = 1
+)
+
 func newTCPConn(conn net.Conn, el *eventloop) *stdConn {
-	return &stdConn{
-		conn:          conn,
-		loop:          el,
-		codec:         el.codec,
-		inboundBuffer: prb.Get(),
+	c := &stdConn{
+		conn:  conn,
+		loop:  el,
+		codec: el.codec,
+		hold:  readHold{resume: make(chan struct{}, 1)},
 	}
+	if el.svr.opts.BufferIdleTimeout > 0 {
+		// The ring-buffer is taken from the pool once the first byte is left over.
+		c.inboundBuffer = emptyRingBuffer
+	} else {
+		c.inboundBuffer = prb.Get()
+	}
+	return c
 }
 
 func (c *stdConn) releaseTCP() {
-	c.ctx = nil
-	c.localAddr = nil
-	c.remoteAddr = nil
-	prb.Put(c.inboundBuffer)
+	if c.refs.close() {
+		c.releaseRetained()
+	}
+	c.gone.close()
+	releaseLabels(c.labels)
+	c.labels = nil
+	c.loop.counters.addBufferBytes(-int64(c.bufferBytes))
+	c.bufferBytes = 0
+	putRingBuffer(c.inboundBuffer)
 	c.inboundBuffer = nil
 	bytebuffer.Put(c.buffer)
 	c.buffer = nil
+	c.codecCtx = nil
+	c.faults = nil
+	c.recordID = 0
+	c.pending = nil
+	c.sealPending = nil
+	c.writeFilters = nil
+	if c.worker != nil {
+		c.worker.stop()
+		c.worker = nil
+	}
+	if c.handshakeTimer != nil {
+		c.handshakeTimer.Stop()
+		c.handshakeTimer = nil
+	}
+	if c.partialTimer != nil {
+		c.partialTimer.Stop()
+		c.partialTimer = nil
+	}
+}
+
+// releaseRetained releases the state of the connection which stays valid as long as the connection is retained.
+func (c *stdConn) releaseRetained() {
+	c.ctx = nil
+	c.localAddr = nil
+	c.remoteAddr = nil
 }
 
 func newUDPConn(el *eventloop, localAddr, remoteAddr net.Addr, buf *bytebuffer.ByteBuffer) *stdConn {
@@ -82,7 +162,368 @@ func (c *stdConn) releaseUDP() {
 }
 
 func (c *stdConn) read() ([]byte, error) {
-	return c.codec.Decode(c)
+	a, t := c.loop.svr.opts.FrameAccounting, c.loop.svr.opts.FrameTracer
+	if a == nil && t == nil && c.cipher == nil {
+		return c.codec.Decode(c)
+	}
+	buffered := c.BufferLength()
+	frame, err := c.codec.Decode(c)
+	if frame != nil && c.cipher != nil {
+		if frame, _ = c.openFrame(frame); frame == nil {
+			// The connection is closed by openFrame.
+			return nil, nil
+		}
+	}
+	if frame != nil {
+		if a != nil {
+			a.AccountFrame(c, true, len(frame), buffered-c.BufferLength())
+		}
+		if t != nil {
+			t.trace(c, true, frame)
+		}
+	}
+	return frame, err
+}
+
+// encode encrypts the outbound frame with the cipher of the connection if the frames are encrypted, and encodes it
+// via encodeFrame.
+func (c *stdConn) encode(buf []byte) (frame []byte, bb *bytebuffer.ByteBuffer, err error) {
+	sealed := buf
+	if c.loop.svr.opts.Encryption != nil {
+		if c.cipher != nil {
+			if sealed, err = c.cipher.Seal(buf); err != nil {
+				return nil, nil, err
+			}
+		} else if c.handshaking {
+			return nil, nil, errEncryptionPending
+		}
+	}
+	if frame, bb, err = c.encodeFrame(sealed); err != nil {
+		return
+	}
+	if a := c.loop.svr.opts.FrameAccounting; a != nil {
+		a.AccountFrame(c, false, len(buf), len(frame))
+	}
+	if t := c.loop.svr.opts.FrameTracer; t != nil {
+		t.trace(c, false, buf)
+	}
+	return
+}
+
+// encodeFrame encodes the outbound frame with the codec of the connection, into a pooled buffer if the codec
+// implements BufferEncoder, in which case the buffer is returned along with the frame to be put back once the frame
+// is written.
+func (c *stdConn) encodeFrame(buf []byte) (frame []byte, bb *bytebuffer.ByteBuffer, err error) {
+	if e, ok := c.codec.(BufferEncoder); ok {
+		bb = bytebuffer.Get()
+		if err = e.EncodeTo(c, bb, buf); err != nil {
+			bytebuffer.Put(bb)
+			return nil, nil, err
+		}
+		frame = bb.B
+	} else if frame, err = c.codec.Encode(c, buf); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// openFrame decrypts an inbound frame with the cipher of the connection, the connection is closed if it fails.
+func (c *stdConn) openFrame(frame []byte) ([]byte, error) {
+	frame, err := c.cipher.Open(frame)
+	if err != nil {
+		c.cipher = failedCipher{err}
+		_ = c.trigger(func() error {
+			if _, ok := c.loop.connections[c]; ok {
+				return c.loop.loopError(c, err)
+			}
+			return nil
+		})
+	}
+	return frame, err
+}
+
+func (c *stdConn) write(buf []byte) (n int, err error) {
+	if len(c.writeFilters) == 0 {
+		return c.send(buf)
+	}
+	// The filters may transform the data, so the size of buf is reported.
+	n = len(buf)
+	if buf = c.filterWrite(buf); len(buf) > 0 {
+		_, err = c.send(buf)
+	}
+	return
+}
+
+// filterWrite passes the outbound data through the write filters of the connection in order.
+func (c *stdConn) filterWrite(buf []byte) []byte {
+	for _, f := range c.writeFilters {
+		if buf = f(c, buf); len(buf) == 0 {
+			return nil
+		}
+	}
+	return buf
+}
+
+// send writes the outbound data that has passed through the write filters.
+func (c *stdConn) send(buf []byte) (n int, err error) {
+	if c.loop.svr.opts.LoopWriteBatching {
+		c.batchWrite(buf)
+		return len(buf), nil
+	}
+	if len(c.pending) > 0 {
+		// Flush the merged data along with buf to keep the order of writes.
+		c.pending = append(c.pending, buf...)
+		return len(buf), c.flushCoalesced()
+	}
+	return c.sendNow(buf)
+}
+
+// sendNow writes the outbound data right away.
+func (c *stdConn) sendNow(buf []byte) (n int, err error) {
+	if c.recordID != 0 {
+		c.loop.svr.opts.Recorder.record(RecordOutbound, c.recordID, buf)
+	}
+	if c.faults == nil {
+		timeout := c.loop.svr.opts.WriteStallTimeout
+		if timeout > 0 {
+			_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		n, err = c.conn.Write(buf)
+		c.addBytesOut(n)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && timeout > 0 {
+			// The rest of the data can't be written after the partial write, thus the connection is closed.
+			err = ErrWriteStall
+			_ = c.loop.loopCloseConn(c)
+		}
+		return
+	}
+	err = c.faults.write.inject(buf, c.trigger, func(data []byte) error {
+		if atomic.LoadInt32(&c.done) == 0 {
+			n, _ := c.conn.Write(data)
+			c.addBytesOut(n)
+		}
+		return nil
+	})
+	return len(buf), err
+}
+
+// asyncSeal encrypts and writes a frame written by AsyncWrite within the event-loop, the frame is queued until
+// the encryption handshake sets up the cipher, and the connection is closed if it fails to be encrypted.
+func (c *stdConn) asyncSeal(buf []byte) error {
+	if c.cipher == nil {
+		c.sealPending = append(c.sealPending, buf)
+		return nil
+	}
+	encodedBuf, bb, err := c.encode(buf)
+	if err != nil {
+		return c.loop.loopError(c, err)
+	}
+	if !c.loop.svr.opts.WriteCoalescing {
+		_, _ = c.write(encodedBuf)
+	} else if data := c.filterWrite(encodedBuf); len(data) > 0 {
+		c.coalesce(data)
+	}
+	bytebuffer.Put(bb)
+	return nil
+}
+
+// flushSealPending encrypts and writes the frames queued by asyncSeal once the cipher is set up.
+func (c *stdConn) flushSealPending() error {
+	pending := c.sealPending
+	c.sealPending = nil
+	for _, buf := range pending {
+		if _, ok := c.loop.connections[c]; !ok {
+			return nil
+		}
+		if err := c.asyncSeal(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coalesce merges buf into the pending data of the connection, which is flushed in one write
+// when the coalescing window elapses or when it reaches the size limit.
+func (c *stdConn) coalesce(buf []byte) {
+	el := c.loop
+	c.pending = append(c.pending, buf...)
+	el.counters.addCoalescedWrite()
+	if maxBytes := el.svr.opts.WriteCoalescingMaxBytes; maxBytes > 0 && len(c.pending) >= maxBytes {
+		_ = c.flushCoalesced()
+		return
+	}
+	if c.flushScheduled {
+		return
+	}
+	c.flushScheduled = true
+	flush := func() error {
+		if atomic.LoadInt32(&c.done) == 0 && c.flushScheduled {
+			_ = c.flushCoalesced()
+		}
+		return nil
+	}
+	if window := el.svr.opts.WriteCoalescingWindow; window > 0 {
+		time.AfterFunc(window, func() { _ = c.trigger(flush) })
+		return
+	}
+	// The flush must not block the event-loop on its own command channel.
+	go func() { _ = c.trigger(flush) }()
+}
+
+// flushCoalesced writes the pending data of the connection, merged by write coalescing or write batching.
+func (c *stdConn) flushCoalesced() (err error) {
+	c.flushScheduled = false
+	if len(c.pending) == 0 {
+		return
+	}
+	buf := c.pending
+	c.pending = nil
+	_, err = c.sendNow(buf)
+	if c.loop.svr.opts.LoopWriteBatching {
+		c.loop.counters.addBatchedFlush()
+	} else {
+		c.loop.counters.addCoalescedFlush()
+	}
+	c.pending = buf[:0]
+	return
+}
+
+// batchWrite merges buf into the pending data of the connection, which is flushed in one write along with the data
+// written to the other connections at the end of the iteration of the event-loop, see LoopWriteBatching.
+func (c *stdConn) batchWrite(buf []byte) {
+	if !c.flushScheduled {
+		c.flushScheduled = true
+		c.loop.writeBatch = append(c.loop.writeBatch, c)
+	}
+	c.pending = append(c.pending, buf...)
+	c.loop.counters.addBatchedWrite()
+}
+
+// flushBatched writes the pending data of the connection merged by batchWrite, unless it has been closed or
+// flushed meanwhile.
+func (c *stdConn) flushBatched() {
+	if atomic.LoadInt32(&c.done) == 0 && c.flushScheduled {
+		_ = c.flushCoalesced()
+	}
+}
+
+// settleBuffers accounts for the capacity of the inbound ring-buffer in the loop counters, see
+// Server.ConnMemoryStats. It is invoked after the inbound data is handled.
+func (c *stdConn) settleBuffers() {
+	c.bufferActive = true
+	c.accountBuffers()
+}
+
+// releaseBuffers gives the drained inbound ring-buffer back to the pool, see WithLazyBuffers.
+func (c *stdConn) releaseBuffers() {
+	if c.inboundBuffer.Cap() > 0 && c.inboundBuffer.IsEmpty() {
+		prb.Put(c.inboundBuffer)
+		c.inboundBuffer = emptyRingBuffer
+	}
+	c.accountBuffers()
+}
+
+func (c *stdConn) accountBuffers() {
+	size := c.inboundBuffer.Cap()
+	c.loop.counters.addBufferBytes(int64(size - c.bufferBytes))
+	c.bufferBytes = size
+}
+
+// bufferInbound appends the data left over in the event-loop-buffer to the inbound ring-buffer, taking one from
+// the pool if it has been given back.
+func (c *stdConn) bufferInbound() {
+	if c.buffer.Len() == 0 {
+		return
+	}
+	if c.inboundBuffer.Cap() == 0 {
+		c.inboundBuffer = prb.Get()
+	}
+	_, _ = c.inboundBuffer.Write(c.buffer.Bytes())
+}
+
+// startHandshakeTimer closes the connection unless its handshake completes within the timeout.
+func (c *stdConn) startHandshakeTimer(timeout time.Duration) {
+	c.handshakeTimer = time.AfterFunc(timeout, func() {
+		_ = c.trigger(func() error {
+			if atomic.LoadInt32(&c.done) == 0 && c.handshakeTimer != nil {
+				return c.loop.loopCloseConn(c)
+			}
+			return nil
+		})
+	})
+}
+
+// setCodec overrides the codec of the connection.
+func (c *stdConn) setCodec(codec ICodec) {
+	c.codec = codec
+}
+
+// endHandshake ends the handshake phase once OnHandshake accepts the handshake.
+func (c *stdConn) endHandshake() {
+	c.handshaking = false
+	if c.handshakeTimer != nil {
+		c.handshakeTimer.Stop()
+		c.handshakeTimer = nil
+	}
+}
+
+// checkHandshake stops the handshake timer once the handshake completes, which is reported by the codec
+// if it implements HandshakeReporter, or indicated by progress otherwise, i.e. a decoded frame.
+func (c *stdConn) checkHandshake(progress bool) {
+	if c.handshaking {
+		// The handshake completes once OnHandshake accepts it.
+		return
+	}
+	if r, ok := c.codec.(HandshakeReporter); ok {
+		progress = r.HandshakeComplete(c)
+	}
+	if progress {
+		c.handshakeTimer.Stop()
+		c.handshakeTimer = nil
+	}
+}
+
+// checkPartialFrame keeps track of the incomplete frame left over after the inbound data is handled, the partial
+// frame timeout counts from the moment the frame started or the last frame was decoded.
+func (c *stdConn) checkPartialFrame(decoded bool) {
+	if c.inboundBuffer.IsEmpty() {
+		if c.partialTimer != nil {
+			c.partialTimer.Stop()
+			c.partialTimer = nil
+		}
+		return
+	}
+	if c.partialTimer == nil {
+		c.partialSince = time.Now()
+		c.startPartialTimer(c.loop.svr.opts.PartialFrameTimeout)
+	} else if decoded {
+		c.partialSince = time.Now()
+	}
+}
+
+// startPartialTimer fires the partial frame timeout unless a frame is decoded in the meantime,
+// in which case the timer starts over for the remaining time.
+func (c *stdConn) startPartialTimer(d time.Duration) {
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		_ = c.trigger(func() error {
+			if atomic.LoadInt32(&c.done) != 0 || c.partialTimer != t {
+				return nil
+			}
+			c.partialTimer = nil
+			if remaining := c.loop.svr.opts.PartialFrameTimeout - time.Since(c.partialSince); remaining > 0 {
+				c.startPartialTimer(remaining)
+				return nil
+			}
+			return c.loop.loopDecodeError(c, ErrPartialFrameTimeout)
+		})
+	})
+	c.partialTimer = t
+}
+
+func (c *stdConn) trigger(job func() error) error {
+	c.loop.ch <- job
+	return nil
 }
 
 // ================================= Public APIs of gnet.Conn =================================
@@ -100,7 +541,9 @@ func (c *stdConn) Read() []byte {
 
 func (c *stdConn) ResetBuffer() {
 	c.buffer.Reset()
-	c.inboundBuffer.Reset()
+	if !c.inboundBuffer.IsEmpty() {
+		c.inboundBuffer.Reset()
+	}
 	bytebuffer.Put(c.byteBuffer)
 	c.byteBuffer = nil
 }
@@ -163,11 +606,90 @@ func (c *stdConn) BufferLength() int {
 	return c.inboundBuffer.Length() + c.buffer.Len()
 }
 
+func (c *stdConn) InboundBuffered() int {
+	if c.inboundBuffer == nil {
+		return 0
+	}
+	return c.inboundBuffer.Length() + c.buffer.Len()
+}
+
+func (c *stdConn) OutboundBuffered() int {
+	return len(c.pending)
+}
+
+func (c *stdConn) TCPInfo() (TCPInfo, error) {
+	return TCPInfo{}, ErrProtocolNotSupported
+}
+
+func (c *stdConn) Peek(n int) (buf []byte, err error) {
+	if n > c.BufferLength() {
+		return nil, io.ErrShortBuffer
+	}
+	_, buf = c.ReadN(n)
+	return
+}
+
+func (c *stdConn) Next(n int) (buf []byte, err error) {
+	if buf, err = c.Peek(n); err != nil {
+		return
+	}
+	// Detach the byte-buffer that may be backing buf so that ShiftN won't put it back into the pool
+	// while the caller is still holding buf.
+	c.byteBuffer = nil
+	c.ShiftN(len(buf))
+	return
+}
+
+func (c *stdConn) Cursor() Cursor {
+	if c.inboundBuffer == nil {
+		return newCursor(c, nil, nil, nil)
+	}
+	head, tail := c.inboundBuffer.LazyReadAll()
+	return newCursor(c, head, tail, c.buffer.B)
+}
+
+func (c *stdConn) Write(buf []byte) (n int, err error) {
+	if atomic.LoadInt32(&c.done) == 1 {
+		return 0, ErrConnClosed
+	}
+	c.loop.eventHandler.PreWrite()
+	return c.write(buf)
+}
+
+func (c *stdConn) AddWriteFilter(f WriteFilter) {
+	c.writeFilters = append(c.writeFilters, f)
+}
+
+func (c *stdConn) SendFD(fd int, data []byte) error {
+	return ErrProtocolNotSupported
+}
+
 func (c *stdConn) AsyncWrite(buf []byte) (err error) {
-	var encodedBuf []byte
-	if encodedBuf, err = c.codec.Encode(c, buf); err == nil {
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	if c.loop.svr.opts.Encryption != nil {
+		// The frames are encrypted in the order they are written, namely within the event-loop.
+		c.loop.ch <- func() error {
+			if _, ok := c.loop.connections[c]; !ok {
+				return nil
+			}
+			return c.asyncSeal(buf)
+		}
+		return nil
+	}
+	var (
+		encodedBuf []byte
+		bb         *bytebuffer.ByteBuffer
+	)
+	if encodedBuf, bb, err = c.encode(buf); err == nil {
 		c.loop.ch <- func() error {
-			_, _ = c.conn.Write(encodedBuf)
+			if !c.loop.svr.opts.WriteCoalescing {
+				_, _ = c.write(encodedBuf)
+			} else if data := c.filterWrite(encodedBuf); len(data) > 0 {
+				c.coalesce(data)
+			}
+			bytebuffer.Put(bb)
 			return nil
 		}
 	}
@@ -175,23 +697,128 @@ func (c *stdConn) AsyncWrite(buf []byte) (err error) {
 }
 
 func (c *stdConn) SendTo(buf []byte) (err error) {
-	_, err = c.loop.svr.ln.pconn.WriteTo(buf, c.remoteAddr)
+	_, err = c.loop.svr.ln.packetListener().pconn.WriteTo(buf, c.remoteAddr)
 	return
 }
 
 func (c *stdConn) Wake() error {
-	c.loop.ch <- wakeReq{c}
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	if atomic.CompareAndSwapInt32(&c.wakePending, 0, 1) {
+		c.loop.ch <- wakeReq{c}
+	}
+	return nil
+}
+
+func (c *stdConn) WakeWith(tag interface{}) error {
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	c.loop.ch <- userEvent{c, tag}
 	return nil
 }
 
 func (c *stdConn) Close() error {
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
 	c.loop.ch <- func() error {
 		return c.loop.loopCloseConn(c)
 	}
 	return nil
 }
 
-func (c *stdConn) Context() interface{}       { return c.ctx }
-func (c *stdConn) SetContext(ctx interface{}) { c.ctx = ctx }
-func (c *stdConn) LocalAddr() net.Addr        { return c.localAddr }
-func (c *stdConn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *stdConn) Retain() error {
+	return c.refs.retain()
+}
+
+func (c *stdConn) Release() {
+	if c.refs.release() {
+		c.releaseRetained()
+	}
+}
+
+func (c *stdConn) Gone() <-chan struct{} {
+	return c.gone.done()
+}
+
+func (c *stdConn) PauseRead() error {
+	if c.conn == nil {
+		return ErrProtocolNotSupported
+	}
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	// The goroutine reading from the connection waits before its next read.
+	c.hold.pause()
+	return nil
+}
+
+func (c *stdConn) ResumeRead() error {
+	if c.conn == nil {
+		return ErrProtocolNotSupported
+	}
+	if c.refs.closed() {
+		return ErrConnClosed
+	}
+	if !c.hold.release() {
+		return nil
+	}
+	return c.trigger(func() error {
+		return c.loop.loopResumeRead(c)
+	})
+}
+
+func (c *stdConn) SetLabel(key, value string) {
+	if c.conn == nil {
+		return
+	}
+	c.labels = c.loop.svr.setLabel(c.labels, key, value)
+}
+
+func (c *stdConn) Label(key string) string {
+	return labelValue(c.labels, key)
+}
+
+// scanState returns the state of the connection kept by the connection scanner.
+func (c *stdConn) scanState() *connScanState {
+	return &c.scan
+}
+
+func (c *stdConn) Enrichment() (interface{}, error) {
+	return c.enrichment.result, c.enrichment.err
+}
+
+// addBytesIn counts the n bytes read from the connection.
+func (c *stdConn) addBytesIn(n int) {
+	c.bytesIn += uint64(n)
+	c.loop.counters.addBytesIn(n)
+	countLabelsIn(c.labels, n)
+}
+
+// addBytesOut counts the n bytes written to the connection.
+func (c *stdConn) addBytesOut(n int) {
+	c.bytesOut += uint64(n)
+	c.loop.counters.addBytesOut(n)
+	countLabelsOut(c.labels, n)
+}
+
+func (c *stdConn) ID() uint64                      { return c.id }
+func (c *stdConn) Context() interface{}            { return c.ctx }
+func (c *stdConn) SetContext(ctx interface{})      { c.ctx = ctx }
+func (c *stdConn) CodecContext() interface{}       { return c.codecCtx }
+func (c *stdConn) SetCodecContext(ctx interface{}) { c.codecCtx = ctx }
+func (c *stdConn) LocalAddr() net.Addr             { return c.localAddr }
+func (c *stdConn) RemoteAddr() net.Addr            { return c.remoteAddr }
+func (c *stdConn) OriginalDst() net.Addr           { return nil }
+
+func (c *stdConn) RemoteIP() net.IP {
+	ip, _ := addrIPPort(c.remoteAddr)
+	return ip
+}
+
+func (c *stdConn) RemotePort() int {
+	_, port := addrIPPort(c.remoteAddr)
+	return port
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"unsafe"
+
+	"github.com/panjf2000/gnet/ringbuffer"
+)
+
+// ConnMemoryStats is the memory held in user space by the open stream connections of a server, excluding the memory
+// of the event handler, e.g. the contexts of the connections, and the socket buffers of the kernel.
+type ConnMemoryStats struct {
+	// Connections is the number of the open connections.
+	Connections int
+
+	// StructBytes is the memory of the structs of the connections along with the structs of their ring-buffers.
+	StructBytes int64
+
+	// BufferBytes is the capacity of the ring-buffers of the connections, which is zero for the idle connections
+	// with MassiveConnections or BufferIdleTimeout.
+	BufferBytes int64
+}
+
+// PerConn returns the memory held per connection, zero if there are no connections.
+func (s ConnMemoryStats) PerConn() int64 {
+	if s.Connections == 0 {
+		return 0
+	}
+	return (s.StructBytes + s.BufferBytes) / int64(s.Connections)
+}
+
+// ConnMemoryStats returns the memory held by the open stream connections, see WithMassiveConnections. The event-loops
+// publish the capacities of the ring-buffers in batches, see loopCounters.
+func (s Server) ConnMemoryStats() (stats ConnMemoryStats) {
+	s.svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		stats.Connections += int(el.counters.loadConns())
+		stats.BufferBytes += el.counters.loadBufferBytes()
+		return true
+	})
+	stats.StructBytes = int64(stats.Connections) * int64(connStructSize+connRingBuffers*unsafe.Sizeof(ringbuffer.RingBuffer{}))
+	return
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import "sync/atomic"
+
+// DefaultConnGoroutineQueue is the number of the frames queued up for the goroutine of a connection in hybrid mode
+// if ConnGoroutineQueue is not set.
+const DefaultConnGoroutineQueue = 64
+
+// ConnQueuePolicy tells what to do with the frames decoded while the queue of a connection in hybrid mode is full,
+// namely when React can't keep up with the peer, see WithConnGoroutineQueue.
+type ConnQueuePolicy int
+
+const (
+	// ConnQueueBlockReads stops decoding and reading from the connection until its goroutine has drained the queue,
+	// so that the peer is slowed down by TCP flow control.
+	ConnQueueBlockReads ConnQueuePolicy = iota
+
+	// ConnQueueDropOldest drops the oldest frame in the queue to make room for the new one.
+	ConnQueueDropOldest
+
+	// ConnQueueDropNewest drops the new frame.
+	ConnQueueDropNewest
+
+	// ConnQueueClose closes the connection with ErrConnQueueFull.
+	ConnQueueClose
+)
+
+// ConnQueueStats returns the number of the frames dropped by ConnQueueDropOldest and ConnQueueDropNewest and
+// the number of the connections closed by ConnQueueClose in hybrid mode. The event-loops publish them in batches,
+// see loopCounters.
+func (s Server) ConnQueueStats() (dropped, closed uint64) {
+	s.svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		d, c := el.counters.loadConnQueue()
+		dropped += d
+		closed += c
+		return true
+	})
+	return
+}
+
+// connWorker is the goroutine running React for a connection in hybrid mode, see WithConnGoroutine.
+// The event-loop decodes the frames and queues them up for the goroutine, and handles the frames decoded while
+// the queue is full per ConnQueuePolicy.
+type connWorker struct {
+	frames chan []byte   // frames waiting for React, closed by the event-loop once the connection is closed
+	paused int32         // 1 while the event-loop has stopped decoding, 2 once the goroutine has asked it to resume
+	resume chan struct{} // wakes the goroutine reading from the connection up on resuming, used on Windows
+	closed chan struct{} // closed once the connection is closed
+}
+
+func newConnWorker(opts *Options) *connWorker {
+	size := opts.ConnGoroutineQueue
+	if size <= 0 {
+		size = DefaultConnGoroutineQueue
+	}
+	return &connWorker{
+		frames: make(chan []byte, size),
+		resume: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// full reports whether the queue is full, it must be invoked within the event-loop, which is the only sender.
+func (w *connWorker) full() bool {
+	return len(w.frames) == cap(w.frames)
+}
+
+// push queues up a copy of frame, it must be invoked within the event-loop unless the queue is full.
+func (w *connWorker) push(frame []byte) {
+	if frame != nil {
+		frame = append(make([]byte, 0, len(frame)), frame...)
+	}
+	w.frames <- frame
+}
+
+// overflow applies ConnQueuePolicy to a frame decoded while the queue is full, other than ConnQueueBlockReads which
+// stops decoding beforehand, it reports whether to queue up the frame, and whether to close the connection.
+// It must be invoked within the event-loop.
+func (w *connWorker) overflow(el *eventloop) (push, closeConn bool) {
+	switch el.svr.opts.ConnQueuePolicy {
+	case ConnQueueDropOldest:
+		select {
+		case <-w.frames:
+		default:
+			// The goroutine has made room meanwhile.
+			return true, false
+		}
+		el.counters.addConnQueueDrop()
+		return true, false
+	case ConnQueueDropNewest:
+		el.counters.addConnQueueDrop()
+		return false, false
+	}
+	el.counters.addConnQueueClose()
+	return false, true
+}
+
+// tryPause marks the event-loop as having stopped decoding since the queue is full, it returns false if the goroutine
+// has drained the queue before seeing the mark, in which case the event-loop must go on decoding, since the goroutine
+// won't ask it to resume. It must be invoked within the event-loop.
+func (w *connWorker) tryPause() bool {
+	atomic.StoreInt32(&w.paused, 1)
+	return w.full() || !atomic.CompareAndSwapInt32(&w.paused, 1, 0)
+}
+
+// decodingPaused reports whether the event-loop has stopped decoding since the queue is full.
+func (w *connWorker) decodingPaused() bool {
+	return atomic.LoadInt32(&w.paused) != 0
+}
+
+// resumed clears the pause once the event-loop resumes decoding.
+func (w *connWorker) resumed() {
+	atomic.StoreInt32(&w.paused, 0)
+	select {
+	case w.resume <- struct{}{}:
+	default:
+	}
+}
+
+// waitResumed blocks while the event-loop has stopped decoding, until it resumes or the connection is closed.
+func (w *connWorker) waitResumed() {
+	for atomic.LoadInt32(&w.paused) != 0 {
+		select {
+		case <-w.resume:
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// stop stops the goroutine once it has drained the queue, the frames left in the queue are dropped.
+func (w *connWorker) stop() {
+	close(w.frames)
+	close(w.closed)
+}
+
+// start starts the goroutine running React for the frames queued up for c until the connection is closed, which
+// asks the event-loop to resume via loopResume once it has drained the queue the event-loop has stopped decoding on.
+// It must be invoked within the event-loop when the connection is opened.
+func (w *connWorker) start(el *eventloop, c Conn, loopResume func()) {
+	if c.Retain() != nil {
+		return
+	}
+	go w.run(el, c, loopResume)
+}
+
+func (w *connWorker) run(el *eventloop, c Conn, loopResume func()) {
+	defer c.Release()
+	for frame := range w.frames {
+		select {
+		case <-w.closed:
+			continue
+		default:
+		}
+		out, action := el.eventHandler.React(frame, c)
+		if out != nil {
+			_ = c.AsyncWrite(out)
+		}
+		switch action {
+		case Close:
+			_ = c.Close()
+		case Shutdown:
+			el.svr.requestShutdown()
+		}
+		if len(w.frames) == 0 && atomic.CompareAndSwapInt32(&w.paused, 1, 2) {
+			_ = el.post(busMessage{fn: loopResume})
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import "sync/atomic"
+
+// loopCounterValues are the values of the counters of an event-loop.
+type loopCounterValues struct {
+	coalescedWrites  uint64 // number of the AsyncWrite calls whose data was merged
+	coalescedFlushes uint64 // number of the writes of the merged data
+	batchedWrites    uint64 // number of the writes held until the end of the iteration, see LoopWriteBatching
+	batchedFlushes   uint64 // number of the writes of the data held
+	slowReacts       uint64 // number of the slow React invocations, see SlowReactThreshold
+	truncated        uint64 // number of the datagrams dropped as they exceeded UDPReadBufferSize
+	connQueueDrops   uint64 // number of the frames dropped by ConnQueuePolicy
+	connQueueCloses  uint64 // number of the connections closed by ConnQueueClose
+	accepted         uint64 // number of the connections opened so far
+	bytesIn          uint64 // number of the bytes read from the stream connections
+	bytesOut         uint64 // number of the bytes written to the stream connections
+	iterations       uint64 // number of the batches of events handled
+	bufferBytes      int64  // capacity of the ring-buffers of the connections
+	conns            int32  // number of active connections
+}
+
+// loopCounters holds the counters of an event-loop. They are updated on the hot path by the event-loop only,
+// as plain memory operations, and published for the other goroutines after every batch of events handled by
+// the event-loop. This way the event-loop doesn't pay for an atomic read-modify-write on every update, which is
+// costly on weakly-ordered CPUs, e.g. ARM64, and the cache line is only shared with the readers once per batch.
+// The readers may thus see values that are one batch behind.
+type loopCounters struct {
+	published loopCounterValues // read by the other goroutines with atomic loads, kept first for 64-bit alignment
+	local     loopCounterValues // updated by the event-loop only
+	dirty     bool              // whether local has changed since it was published
+}
+
+func (lc *loopCounters) addConns(delta int32) {
+	lc.local.conns += delta
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addAccepted() {
+	lc.local.accepted++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addBytesIn(n int) {
+	lc.local.bytesIn += uint64(n)
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addBytesOut(n int) {
+	lc.local.bytesOut += uint64(n)
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addBufferBytes(delta int64) {
+	if delta != 0 {
+		lc.local.bufferBytes += delta
+		lc.dirty = true
+	}
+}
+
+func (lc *loopCounters) addCoalescedWrite() {
+	lc.local.coalescedWrites++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addCoalescedFlush() {
+	lc.local.coalescedFlushes++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addBatchedWrite() {
+	lc.local.batchedWrites++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addBatchedFlush() {
+	lc.local.batchedFlushes++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addSlowReact() {
+	lc.local.slowReacts++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addTruncatedDatagram() {
+	lc.local.truncated++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addConnQueueDrop() {
+	lc.local.connQueueDrops++
+	lc.dirty = true
+}
+
+func (lc *loopCounters) addConnQueueClose() {
+	lc.local.connQueueCloses++
+	lc.dirty = true
+}
+
+// endBatch counts a batch of events handled by the event-loop and publishes the counters. The number of
+// the batches is published on its own, since it changes with every batch, while the others are published only
+// if they have changed, which spares the idle and the timed-out polls all the other stores.
+func (lc *loopCounters) endBatch() {
+	lc.local.iterations++
+	atomic.StoreUint64(&lc.published.iterations, lc.local.iterations)
+	lc.publish()
+}
+
+// publish publishes the local values of the counters if they have changed, it must be invoked by the event-loop,
+// or after the event-loop has exited.
+func (lc *loopCounters) publish() {
+	if !lc.dirty {
+		return
+	}
+	lc.dirty = false
+	atomic.StoreUint64(&lc.published.coalescedWrites, lc.local.coalescedWrites)
+	atomic.StoreUint64(&lc.published.coalescedFlushes, lc.local.coalescedFlushes)
+	atomic.StoreUint64(&lc.published.batchedWrites, lc.local.batchedWrites)
+	atomic.StoreUint64(&lc.published.batchedFlushes, lc.local.batchedFlushes)
+	atomic.StoreUint64(&lc.published.slowReacts, lc.local.slowReacts)
+	atomic.StoreUint64(&lc.published.truncated, lc.local.truncated)
+	atomic.StoreUint64(&lc.published.connQueueDrops, lc.local.connQueueDrops)
+	atomic.StoreUint64(&lc.published.connQueueCloses, lc.local.connQueueCloses)
+	atomic.StoreUint64(&lc.published.accepted, lc.local.accepted)
+	atomic.StoreUint64(&lc.published.bytesIn, lc.local.bytesIn)
+	atomic.StoreUint64(&lc.published.bytesOut, lc.local.bytesOut)
+	atomic.StoreInt64(&lc.published.bufferBytes, lc.local.bufferBytes)
+	atomic.StoreInt32(&lc.published.conns, lc.local.conns)
+}
+
+func (lc *loopCounters) loadConns() int32 {
+	return atomic.LoadInt32(&lc.published.conns)
+}
+
+func (lc *loopCounters) loadBufferBytes() int64 {
+	return atomic.LoadInt64(&lc.published.bufferBytes)
+}
+
+func (lc *loopCounters) loadCoalesced() (writes, flushes uint64) {
+	return atomic.LoadUint64(&lc.published.coalescedWrites), atomic.LoadUint64(&lc.published.coalescedFlushes)
+}
+
+func (lc *loopCounters) loadBatched() (writes, flushes uint64) {
+	return atomic.LoadUint64(&lc.published.batchedWrites), atomic.LoadUint64(&lc.published.batchedFlushes)
+}
+
+func (lc *loopCounters) loadSlowReacts() uint64 {
+	return atomic.LoadUint64(&lc.published.slowReacts)
+}
+
+func (lc *loopCounters) loadTruncatedDatagrams() uint64 {
+	return atomic.LoadUint64(&lc.published.truncated)
+}
+
+func (lc *loopCounters) loadConnQueue() (drops, closes uint64) {
+	return atomic.LoadUint64(&lc.published.connQueueDrops), atomic.LoadUint64(&lc.published.connQueueCloses)
+}
+
+func (lc *loopCounters) loadTraffic() (accepted, bytesIn, bytesOut, iterations uint64) {
+	return atomic.LoadUint64(&lc.published.accepted), atomic.LoadUint64(&lc.published.bytesIn),
+		atomic.LoadUint64(&lc.published.bytesOut), atomic.LoadUint64(&lc.published.iterations)
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Cursor reads the inbound data of a connection in place, namely across the inbound ring-buffer and
+// the event-loop-buffer, without copying it into a contiguous buffer first as Read and ReadN do, for writing
+// ICodec implementations of binary protocols. It is obtained via Conn.Cursor within Decode.
+//
+// The reads of a cursor never consume the inbound data, the codec consumes the data read so far via Commit
+// once a frame is complete. A read fails with ErrUnexpectedEOF without moving the cursor if there is not enough data,
+// in which case Decode returns the error to wait for more data and the cursor is simply dropped, so that the frame
+// is decoded again from its start next time, use Rewind to backtrack within a frame instead.
+type Cursor struct {
+	c    Conn
+	segs [3][]byte // the inbound data, namely the head and the tail of the ring-buffer and the event-loop-buffer
+	seg  int       // index of the segment of the cursor
+	off  int       // offset of the cursor within its segment
+	pos  int       // offset of the cursor within the inbound data
+	size int       // size of the inbound data
+}
+
+func newCursor(c Conn, head, tail, rest []byte) Cursor {
+	return Cursor{c: c, segs: [3][]byte{head, tail, rest}, size: len(head) + len(tail) + len(rest)}
+}
+
+// Len returns the number of bytes left after the cursor.
+func (cur *Cursor) Len() int {
+	return cur.size - cur.pos
+}
+
+// Offset returns the number of bytes read so far, which can be passed to Rewind to backtrack to the current position.
+func (cur *Cursor) Offset() int {
+	return cur.pos
+}
+
+// Rewind moves the cursor back to offset, which must not be greater than Offset.
+func (cur *Cursor) Rewind(offset int) {
+	if offset < 0 || offset > cur.pos {
+		return
+	}
+	cur.seg, cur.off, cur.pos = 0, 0, 0
+	cur.advance(offset)
+}
+
+// Commit consumes the data read so far from the inbound buffers of the connection, the cursor must not be used
+// afterwards.
+func (cur *Cursor) Commit() {
+	if cur.pos > 0 {
+		cur.c.ShiftN(cur.pos)
+	}
+	cur.segs = [3][]byte{}
+	cur.seg, cur.off, cur.pos, cur.size = 0, 0, 0, 0
+}
+
+// Skip moves the cursor forward by n bytes.
+func (cur *Cursor) Skip(n int) error {
+	if n < 0 || n > cur.Len() {
+		return ErrUnexpectedEOF
+	}
+	cur.advance(n)
+	return nil
+}
+
+// ReadByte reads a byte.
+func (cur *Cursor) ReadByte() (byte, error) {
+	var b [1]byte
+	buf, err := cur.next(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// ReadUint16BE reads a big-endian uint16.
+func (cur *Cursor) ReadUint16BE() (uint16, error) {
+	var b [2]byte
+	buf, err := cur.next(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf), nil
+}
+
+// ReadUint16LE reads a little-endian uint16.
+func (cur *Cursor) ReadUint16LE() (uint16, error) {
+	var b [2]byte
+	buf, err := cur.next(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(buf), nil
+}
+
+// ReadUint32BE reads a big-endian uint32.
+func (cur *Cursor) ReadUint32BE() (uint32, error) {
+	var b [4]byte
+	buf, err := cur.next(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// ReadUint32LE reads a little-endian uint32.
+func (cur *Cursor) ReadUint32LE() (uint32, error) {
+	var b [4]byte
+	buf, err := cur.next(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+// ReadUint64BE reads a big-endian uint64.
+func (cur *Cursor) ReadUint64BE() (uint64, error) {
+	var b [8]byte
+	buf, err := cur.next(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// ReadUint64LE reads a little-endian uint64.
+func (cur *Cursor) ReadUint64LE() (uint64, error) {
+	var b [8]byte
+	buf, err := cur.next(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// ReadUvarint reads an unsigned varint encoded as binary.PutUvarint does, it fails with ErrVarintOverflow
+// if the varint overflows 64 bits.
+func (cur *Cursor) ReadUvarint() (uint64, error) {
+	offset := cur.pos
+	var x uint64
+	for i, s := 0, uint(0); i < binary.MaxVarintLen64; i, s = i+1, s+7 {
+		b, err := cur.ReadByte()
+		if err != nil {
+			cur.Rewind(offset)
+			return 0, err
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				break
+			}
+			return x | uint64(b)<<s, nil
+		}
+		x |= uint64(b&0x7f) << s
+	}
+	cur.Rewind(offset)
+	return 0, ErrVarintOverflow
+}
+
+// ReadVarint reads a signed varint encoded as binary.PutVarint does, it fails with ErrVarintOverflow
+// if the varint overflows 64 bits.
+func (cur *Cursor) ReadVarint() (int64, error) {
+	ux, err := cur.ReadUvarint()
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x, err
+}
+
+// ReadBytes reads n bytes, which are a slice of the inbound buffers if they are contiguous there, or a copy of them
+// otherwise, in both cases they stay valid until the current event callback returns, just like those of Conn.Next.
+func (cur *Cursor) ReadBytes(n int) ([]byte, error) {
+	if n < 0 || n > cur.Len() {
+		return nil, ErrUnexpectedEOF
+	}
+	if seg := cur.segment(); len(seg) >= n {
+		cur.advance(n)
+		return seg[:n], nil
+	}
+	return cur.next(make([]byte, n))
+}
+
+// indexByte returns the offset of the first instance of b after the cursor relative to the cursor, or -1 if b is not
+// present, without moving the cursor.
+func (cur *Cursor) indexByte(b byte) int {
+	n := 0
+	for i, off := cur.seg, cur.off; i < len(cur.segs); i, off = i+1, 0 {
+		seg := cur.segs[i][off:]
+		if j := bytes.IndexByte(seg, b); j >= 0 {
+			return n + j
+		}
+		n += len(seg)
+	}
+	return -1
+}
+
+// segment returns the bytes left in the segment of the cursor, skipping the empty segments.
+func (cur *Cursor) segment() []byte {
+	for cur.seg < len(cur.segs)-1 && cur.off == len(cur.segs[cur.seg]) {
+		cur.seg, cur.off = cur.seg+1, 0
+	}
+	return cur.segs[cur.seg][cur.off:]
+}
+
+// next reads len(scratch) bytes, which are a slice of the segment of the cursor if they are contiguous there,
+// or copied into scratch otherwise.
+func (cur *Cursor) next(scratch []byte) ([]byte, error) {
+	n := len(scratch)
+	if n > cur.Len() {
+		return nil, ErrUnexpectedEOF
+	}
+	if seg := cur.segment(); len(seg) >= n {
+		cur.advance(n)
+		return seg[:n], nil
+	}
+	for copied := 0; copied < n; {
+		m := copy(scratch[copied:], cur.segment())
+		cur.advance(m)
+		copied += m
+	}
+	return scratch, nil
+}
+
+// advance moves the cursor forward by n bytes, n must not be greater than Len.
+func (cur *Cursor) advance(n int) {
+	cur.pos += n
+	for n > 0 {
+		seg := cur.segment()
+		m := len(seg)
+		if m > n {
+			m = n
+		}
+		cur.off += m
+		n -= m
+	}
+}
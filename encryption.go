@@ -0,0 +1,41 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import "errors"
+
+// FrameCipher encrypts and decrypts the frames of a stream connection, it is applied after framing, namely Open
+// decrypts the frames decoded by the codec before they are handed over to React, and Seal encrypts the frames
+// written by the event handler before they are encoded by the codec. Every connection has a cipher of its own,
+// which is only invoked within its event-loop, thus it may keep the state of the connection, e.g. the nonces.
+type FrameCipher interface {
+	// Seal encrypts an outbound frame.
+	Seal(frame []byte) ([]byte, error)
+
+	// Open decrypts an inbound frame, the connection is closed with the error if it fails, e.g. when the frame is
+	// forged.
+	Open(frame []byte) ([]byte, error)
+}
+
+// FrameEncryption sets up the FrameCipher of every stream connection via a handshake with the peer, e.g. NoiseIK,
+// set it up via WithEncryption.
+type FrameEncryption interface {
+	// Handshake fires within the event-loop of the connection for every frame decoded until it returns a cipher,
+	// out is written to the connection unencrypted, and the connection is closed with err if it is not nil. The frame
+	// is only valid within Handshake.
+	Handshake(c Conn, frame []byte) (cipher FrameCipher, out []byte, err error)
+}
+
+// errEncryptionPending occurs when encoding a frame for a connection whose encryption handshake hasn't completed.
+var errEncryptionPending = errors.New("encryption handshake of the connection hasn't completed")
+
+// failedCipher replaces the cipher of a connection that has failed to decrypt a frame, so that no more frames are
+// decrypted while the connection is being closed.
+type failedCipher struct {
+	err error
+}
+
+func (fc failedCipher) Seal(frame []byte) ([]byte, error) { return nil, fc.err }
+func (fc failedCipher) Open(frame []byte) ([]byte, error) { return nil, fc.err }
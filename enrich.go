@@ -0,0 +1,54 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"context"
+	"net"
+)
+
+// Enricher looks up the information about the peers of the stream connections off the event-loops, set it up via
+// WithEnrichment.
+type Enricher interface {
+	// Enrich fires within a goroutine of its own for every stream connection accepted, before the connection is
+	// handed over to its event-loop, local and remote are the addresses of the connection. ctx is done once
+	// EnrichmentTimeout elapses, the result returned afterwards is dropped. The result and the error are attached to
+	// the connection, see Conn.Enrichment. Enrich must be safe for concurrent use.
+	Enrich(ctx context.Context, local, remote net.Addr) (result interface{}, err error)
+}
+
+// enrichment is the result of an Enricher.
+type enrichment struct {
+	result interface{}
+	err    error
+}
+
+// enrich runs the Enricher for a stream connection being accepted, then invokes open within another goroutine with
+// the result, or with context.DeadlineExceeded once EnrichmentTimeout elapses, whichever comes first. open is
+// invoked with ErrServerShutdown if the server shuts down meanwhile, in which case the connection must be closed.
+// The server waits for open to return before shutting down the event-loops, see enrichWG.
+func (svr *server) enrich(local, remote net.Addr, open func(e enrichment)) {
+	ctx, cancel := context.WithTimeout(context.Background(), svr.opts.EnrichmentTimeout)
+	done := make(chan enrichment, 1)
+	go func() {
+		result, err := svr.opts.Enricher.Enrich(ctx, local, remote)
+		done <- enrichment{result, err}
+	}()
+	svr.enrichWG.Add(1)
+	go func() {
+		defer svr.enrichWG.Done()
+		defer cancel()
+		select {
+		case e := <-done:
+			open(e)
+		case <-ctx.Done():
+			open(enrichment{err: ctx.Err()})
+		case <-svr.shutdown:
+			open(enrichment{err: ErrServerShutdown})
+		}
+	}()
+}
@@ -7,6 +7,54 @@ var (
 	ErrProtocolNotSupported = errors.New("not supported protocol on this platform")
 	// ErrServerShutdown occurs when server is closing.
 	ErrServerShutdown = errors.New("server is going to be shutdown")
+	// ErrServerStarted occurs when starting a server that has already been started.
+	ErrServerStarted = errors.New("server has already been started")
+	// ErrNotInTestMode occurs when driving a server manually while it is not running in test mode.
+	ErrNotInTestMode = errors.New("server is not running in test mode")
+	// ErrInvalidConnID occurs when posting a message to a connection ID that is never assigned by the server.
+	ErrInvalidConnID = errors.New("invalid connection id")
+	// ErrInvalidLoopIndex occurs when posting a function to an event-loop index that is out of range.
+	ErrInvalidLoopIndex = errors.New("invalid event-loop index")
+	// ErrInvalidLoopCount occurs when resizing the event-loops to a number out of range.
+	ErrInvalidLoopCount = errors.New("invalid number of event-loops")
+	// ErrResizeNotSupported occurs when resizing the event-loops among which the kernel distributes the traffic.
+	ErrResizeNotSupported = errors.New("event-loops can't be resized with SO_REUSEPORT, UDP or MassiveConnections")
+	// ErrHandshakeTimeout occurs when a connection doesn't complete the handshake within the handshake timeout.
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+	// ErrPartialFrameTimeout occurs when a frame of a connection stays incomplete for longer than
+	// the partial frame timeout.
+	ErrPartialFrameTimeout = errors.New("partial frame timeout")
+	// ErrLoopRestarted occurs when closing the connections of an event-loop restarted with LoopRestartCloseConns.
+	ErrLoopRestarted = errors.New("event-loop is restarted")
+	// ErrConnClosed occurs when operating on a connection that has been closed.
+	ErrConnClosed = errors.New("connection is closed")
+	// ErrEmptyFDData occurs when passing a file descriptor without data along with it.
+	ErrEmptyFDData = errors.New("file descriptors must be passed along with non-empty data")
+	// ErrOutboundFull occurs when the outbound buffer of a connection exceeds the outbound limit.
+	ErrOutboundFull = errors.New("outbound buffer is full")
+	// ErrWriteStall occurs when the outbound data of a connection stays unwritten for longer than the write stall
+	// timeout.
+	ErrWriteStall = errors.New("write stall timeout")
+	// ErrConnQueueFull occurs when the queue of a connection in hybrid mode is full with ConnQueueClose.
+	ErrConnQueueFull = errors.New("queue of the connection is full")
+	// ErrOutboundPending occurs when passing a file descriptor while there is outbound data not written yet.
+	ErrOutboundPending = errors.New("outbound data is pending")
+	// ErrConnRejected occurs when dialing a memory address whose server rejects the connection in OnAccepted.
+	ErrConnRejected = errors.New("connection is rejected")
+	// ErrMemoryAddrInUse occurs when there is already a server serving on the same memory address.
+	ErrMemoryAddrInUse = errors.New("memory address is already in use")
+	// ErrMemoryAddrNotFound occurs when dialing a memory address that no server is serving on.
+	ErrMemoryAddrNotFound = errors.New("no server is serving on the memory address")
+	// ErrNoPassivePort occurs when all the ports in the range of a passive data listener are in use.
+	ErrNoPassivePort = errors.New("no free port in the passive port range")
+	// ErrTickerDisabled occurs when starting or stopping the ticker of a server that is not set up with a ticker.
+	ErrTickerDisabled = errors.New("ticker is not set up")
+	// ErrInvalidTicker occurs when adding a ticker without a function or with a non-positive interval.
+	ErrInvalidTicker = errors.New("invalid ticker")
+	// ErrTickerExists occurs when adding a ticker with the name of a ticker that has already been added.
+	ErrTickerExists = errors.New("ticker already exists")
+	// ErrTickerNotFound occurs when removing a ticker with a name that no ticker has been added with.
+	ErrTickerNotFound = errors.New("no such ticker")
 	// ErrInvalidFixedLength occurs when the output data have invalid fixed length.
 	ErrInvalidFixedLength = errors.New("invalid fixed length of bytes")
 	// ErrUnexpectedEOF occurs when no enough data to read by codec.
@@ -19,4 +67,22 @@ var (
 	ErrUnsupportedLength = errors.New("unsupported lengthFieldLength. (expected: 1, 2, 3, 4, or 8)")
 	// ErrTooLessLength occurs when adjusted frame length is less than zero.
 	ErrTooLessLength = errors.New("adjusted frame length is less than zero")
+	// ErrVarintOverflow occurs when a varint read by Cursor overflows 64 bits.
+	ErrVarintOverflow = errors.New("varint overflows a 64-bit integer")
+	// ErrInvalidRTPPacket occurs when the packet is neither a valid RTP packet nor a valid RTCP packet.
+	ErrInvalidRTPPacket = errors.New("invalid RTP packet")
+	// ErrInvalidSyslogMessage occurs when the priority of a syslog message is malformed.
+	ErrInvalidSyslogMessage = errors.New("invalid syslog message")
+	// ErrInvalidFlowPacket occurs when a Netflow or IPFIX packet is truncated or malformed.
+	ErrInvalidFlowPacket = errors.New("invalid Netflow or IPFIX packet")
+	// ErrInvalidModbusADU occurs when the MBAP header of a Modbus TCP ADU is malformed.
+	ErrInvalidModbusADU = errors.New("invalid Modbus TCP ADU")
+	// ErrInvalidSIPMessage occurs when a SIP or RTSP message is malformed or exceeds the limits of SIPCodec.
+	ErrInvalidSIPMessage = errors.New("invalid SIP or RTSP message")
+	// ErrUnsupportedVersion occurs when the protocol version requested by a peer is not served by VersionNegotiator.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	// ErrNoiseHandshake occurs when the handshake of NoiseIK fails, e.g. when a handshake message is malformed.
+	ErrNoiseHandshake = errors.New("noise handshake failed")
+	// ErrInvalidTelnetCommand occurs when TelnetRequest is invoked with a command other than WILL, WONT, DO and DONT.
+	ErrInvalidTelnetCommand = errors.New("invalid telnet negotiation command")
 )
@@ -13,33 +13,72 @@ import (
 	"time"
 
 	"github.com/panjf2000/gnet/internal/netpoll"
+	"github.com/panjf2000/gnet/pool/bytebuffer"
 	"golang.org/x/sys/unix"
 )
 
 type eventloop struct {
-	idx          int             // loop index in the server loops list
-	svr          *server         // server in loop
-	codec        ICodec          // codec for TCP
-	packet       []byte          // read packet buffer
-	poller       *netpoll.Poller // epoll or kqueue
-	connCount    int32           // number of active connections in event-loop
-	connections  map[int]*conn   // loop connections fd -> conn
-	eventHandler EventHandler    // user eventHandler
+	counters     loopCounters     // counters published in batches, kept first for 64-bit alignment
+	idx          int              // loop index in the server loops list
+	svr          *server          // server in loop
+	codec        ICodec           // codec for TCP
+	packet       []byte           // read packet buffer
+	udpPacket    []byte           // read buffer of the datagrams, see UDPReadBufferSize
+	poller       *netpoll.Poller  // epoll or kqueue
+	connections  map[int]*conn    // loop connections fd -> conn
+	connsByID    map[uint64]*conn // loop connections id -> conn
+	connSeq      uint64           // sequence number of the connection IDs
+	mailbox      mailbox          // messages posted to the loop
+	oob          []byte           // buffer for the control messages carrying file descriptors or original destinations
+	batch        frameBatch       // frames delivered to BatchHandler
+	writeBatch   []*conn          // connections written to within the iteration, see LoopWriteBatching
+	cpu          int              // CPU the event-loop is pinned to, see LoopAffinity
+	scanner      connScanner      // state of the connection scanner, see ConnScan
+	slowReact    slowReactState   // state of the slow React detection, see SlowReactThreshold
+	watchdog     loopWatchdog     // state of the watchdog, see WatchdogTimeout
+	utilization  loopUtilization  // utilization of the event-loop, see LoopOverloadThreshold
+	eventHandler EventHandler     // user eventHandler
+	exited       chan struct{}    // closed when the event-loop exits
+	lingering    []zeroCopyLinger // sockets closed with zero-copy sends in flight, see lingerZeroCopy
 }
 
 func (el *eventloop) plusConnCount() {
-	atomic.AddInt32(&el.connCount, 1)
+	el.counters.addConns(1)
+	el.counters.addAccepted()
 }
 
 func (el *eventloop) minusConnCount() {
-	atomic.AddInt32(&el.connCount, -1)
+	el.counters.addConns(-1)
 }
 
 func (el *eventloop) loadConnCount() int32 {
-	return atomic.LoadInt32(&el.connCount)
+	return el.counters.loadConns()
+}
+
+// setPollerHooks sets up the hooks of the poller publishing the counters after every batch of events, and measuring
+// the utilization of the event-loop if LoopOverloadThreshold is set.
+func (el *eventloop) setPollerHooks() {
+	overload, batching := el.svr.opts.LoopOverloadThreshold > 0, el.svr.opts.LoopWriteBatching
+	if !overload && !batching {
+		el.poller.SetBatchHook(el.counters.endBatch)
+		return
+	}
+	if overload {
+		el.poller.SetWakeHook(el.utilization.wake)
+	}
+	el.poller.SetBatchHook(func() {
+		if batching {
+			el.flushWriteBatch()
+		}
+		el.counters.endBatch()
+		if overload {
+			el.utilization.sleep()
+		}
+	})
 }
 
 func (el *eventloop) loopRun() {
+	el.pin()
 	defer func() {
 		if el.idx == 0 && el.svr.opts.Ticker {
 			close(el.svr.ticktock)
@@ -51,39 +90,188 @@ func (el *eventloop) loopRun() {
 		go el.loopTicker()
 	}
 
-	el.svr.logger.Printf("event-loop:%d exits with error: %v\n", el.idx, el.poller.Polling(el.handleEvent))
+	el.run(func() error {
+		return el.poller.Polling(el.handleEvent)
+	})
+}
+
+// run runs poll until the event-loop exits due to the shutdown, or due to an unexpected error after which
+// the event-loop is not restarted, see LoopRestartPolicy.
+func (el *eventloop) run(poll func() error) {
+	defer close(el.exited)
+	for {
+		err := poll()
+		el.svr.logger.Printf("event-loop:%d exits with error: %v\n", el.idx, err)
+		if err == ErrServerShutdown || !el.svr.onLoopError(el.idx, err) {
+			return
+		}
+		if el.svr.opts.LoopRestart == LoopRestartCloseConns {
+			for _, c := range el.connections {
+				if err = el.loopCloseConn(c, ErrLoopRestarted); err == ErrServerShutdown {
+					return
+				}
+			}
+		}
+		// Run the jobs left behind by the failed one.
+		_ = el.poller.Wake()
+	}
 }
 
 func (el *eventloop) loopAccept(fd int) error {
+	if el.isPacketFD(fd) {
+		return el.loopReadUDP(fd)
+	}
 	if fd == el.svr.ln.fd {
 		if el.svr.ln.pconn != nil {
 			return el.loopReadUDP(fd)
 		}
-		nfd, sa, err := unix.Accept(fd)
+		wait := el.svr.acceptLimit.take()
+		if wait > 0 && el.svr.opts.AcceptLimitPolicy == AcceptLimitDefer {
+			el.deferAccept(wait)
+			return nil
+		}
+		nfd, sa, remoteAddr, err := el.svr.accept(fd)
 		if err != nil {
 			if err == unix.EAGAIN {
 				return nil
 			}
 			return err
 		}
-		if err = unix.SetNonblock(nfd, true); err != nil {
+		if wait > 0 {
+			_ = el.svr.transport.Close(nfd)
+			return nil
+		}
+		if ok, err := el.svr.admitConn(); !ok {
+			el.svr.shedConn(nfd)
 			return err
 		}
+		codec, action := el.svr.onAccepted(nfd, remoteAddr)
+		if action != None {
+			_ = el.svr.transport.Close(nfd)
+			if action == Shutdown {
+				return ErrServerShutdown
+			}
+			return nil
+		}
 		c := newTCPConn(nfd, el, sa)
-		if err = el.poller.AddRead(c.fd); err == nil {
-			el.connections[c.fd] = c
-			el.plusConnCount()
-			return el.loopOpen(c)
+		c.remoteAddr = remoteAddr
+		if codec != nil {
+			c.setCodec(codec)
 		}
-		return err
+		if el.svr.opts.Enricher != nil {
+			el.svr.enrichConn(el, c)
+			return nil
+		}
+		return el.register(c)
 	}
 	return nil
 }
 
+// register starts watching a connection accepted and opens it.
+func (el *eventloop) register(c *conn) error {
+	if err := el.poller.AddRead(c.fd); err != nil {
+		return err
+	}
+	el.connections[c.fd] = c
+	el.plusConnCount()
+	return el.loopOpen(c)
+}
+
+// deferAccept stops watching the listener for the given duration, leaving the pending connections in the backlog.
+func (el *eventloop) deferAccept(wait time.Duration) {
+	fd := el.svr.ln.fd
+	if err := el.poller.DeleteRead(fd); err != nil {
+		return
+	}
+	time.AfterFunc(wait, func() {
+		_ = el.poller.Trigger(func() error {
+			select {
+			case <-el.svr.shutdown:
+				// Accepting has been stopped for good.
+			default:
+				if !el.svr.acceptPause.isPaused() {
+					_ = el.poller.AddRead(fd)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// runSync runs job within the event-loop and waits for it to complete, it returns without running job
+// if the event-loop has exited.
+func (el *eventloop) runSync(job func()) {
+	ran := make(chan struct{})
+	if err := el.poller.Trigger(func() error {
+		job()
+		close(ran)
+		return nil
+	}); err != nil {
+		return
+	}
+	select {
+	case <-ran:
+	case <-el.exited:
+	}
+}
+
+// flushOnShutdown writes the outbound data of c until it is drained or the deadline is reached, the event-loop
+// must have exited.
+func (el *eventloop) flushOnShutdown(c *conn, deadline time.Time) {
+	for c.opened && (c.ext != nil && len(c.ext.pending) > 0 || !c.outboundBuffer.IsEmpty()) {
+		if err := el.loopWrite(c); err != nil || !c.opened || c.outboundBuffer.IsEmpty() {
+			return
+		}
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return
+		}
+		fds := []unix.PollFd{{Fd: int32(c.fd), Events: unix.POLLOUT}}
+		if _, err := unix.Poll(fds, int(timeout/time.Millisecond)+1); err != nil && err != unix.EINTR ||
+			fds[0].Revents&unix.POLLNVAL != 0 {
+			return
+		}
+	}
+}
+
 func (el *eventloop) loopOpen(c *conn) error {
 	c.opened = true
-	c.localAddr = el.svr.ln.lnaddr
-	c.remoteAddr = netpoll.SockaddrToTCPOrUnixAddr(c.sa)
+	c.id = nextConnID(&el.connSeq, el.idx)
+	el.connsByID[c.id] = c
+	if c.localAddr == nil {
+		c.localAddr = el.svr.ln.lnaddr
+	}
+	if c.remoteAddr == nil {
+		c.remoteAddr = netpoll.SockaddrToTCPOrUnixAddr(c.sa)
+	}
+	if faults := newFaultInjector(el.svr.opts.FaultInjection, &el.svr.faultSeq, c); faults != nil {
+		c.extension().faults = faults
+	}
+	c.settleBuffers()
+	if _, ok := c.sa.(*unix.SockaddrUnix); ok || el.svr.ln.network == "memory" {
+		// The in-memory connections are backed by Unix domain socket pairs.
+		c.unixSocket = true
+	}
+	if el.svr.opts.KernelZeroCopySendThreshold > 0 {
+		c.extension().zeroCopy = newZeroCopySender(c.fd)
+	}
+	if el.svr.opts.ConnGoroutine {
+		w := newConnWorker(el.svr.opts)
+		c.extension().worker = w
+		w.start(el, c, func() { el.loopResumeWorker(c, w) })
+	}
+	if r := el.svr.opts.Recorder; r != nil {
+		c.extension().recordID = r.open(c)
+	}
+	if el.svr.opts.Audit != nil {
+		c.extension().openedAt = time.Now()
+	}
+	if el.svr.handshakeHandler != nil || el.svr.opts.Encryption != nil {
+		c.extension().handshaking = true
+	}
+	if timeout := el.svr.opts.HandshakeTimeout; timeout > 0 {
+		c.startHandshakeTimer(timeout)
+	}
 	out, action := el.eventHandler.OnOpened(c)
 	if el.svr.opts.TCPKeepAlive > 0 {
 		if _, ok := el.svr.ln.ln.(*net.TCPListener); ok {
@@ -101,22 +289,220 @@ func (el *eventloop) loopOpen(c *conn) error {
 	return el.handleAction(c, action)
 }
 
+// loopRead reads from the connection until it is drained, closed or has something to write,
+// at most MaxReadsPerLoopIteration times.
 func (el *eventloop) loopRead(c *conn) error {
-	n, err := unix.Read(c.fd, el.packet)
+	if c.hold.paused() {
+		// The readable event may fire before the job of PauseRead runs.
+		c.pauseReads()
+	}
+	if c.readPaused {
+		return nil
+	}
+	for i := el.svr.opts.MaxReadsPerLoopIteration; ; i-- {
+		bytesIn := c.bytesIn
+		if err := el.loopReadOnce(c); err != nil {
+			return err
+		}
+		if !c.opened {
+			return nil
+		}
+		if i <= 1 || c.bytesIn == bytesIn || !c.outboundBuffer.IsEmpty() || c.readPaused || c.hold.paused() {
+			c.settleBuffers()
+			return nil
+		}
+	}
+}
+
+// loopReadOnce reads from the connection once and fires React for the inbound data.
+func (el *eventloop) loopReadOnce(c *conn) error {
+	if p := c.bufferProvider; p != nil && (c.ext == nil || c.ext.faults == nil) && c.inboundBuffer.IsEmpty() {
+		x := c.extension()
+		if x.readBuf == nil {
+			x.readBuf, x.readN = p.NextBuffer(c), 0
+		}
+		if len(x.readBuf) > 0 {
+			return el.loopReadInto(c, p)
+		}
+		x.readBuf = nil
+	}
+	var (
+		n      int
+		err    error
+		action Action
+	)
+	if c.unixSocket && el.svr.fdHandler != nil {
+		n, action, err = el.loopReadFDs(c)
+	} else {
+		n, err = el.svr.transport.Read(c.fd, el.packet)
+	}
 	if n == 0 || err != nil {
 		if err == unix.EAGAIN {
 			return nil
 		}
 		return el.loopCloseConn(c, err)
 	}
-	c.buffer = el.packet[:n]
+	c.addBytesIn(n)
+	if action != None {
+		return el.handleAction(c, action)
+	}
+	x := c.ext
+	if x != nil && x.recordID != 0 {
+		el.svr.opts.Recorder.record(RecordInbound, x.recordID, el.packet[:n])
+	}
+	if x != nil && x.faults != nil {
+		return x.faults.read.inject(el.packet[:n], c.trigger, func(data []byte) error {
+			if !c.opened {
+				return nil
+			}
+			return el.loopReact(c, data)
+		})
+	}
+	return el.loopReact(c, el.packet[:n])
+}
+
+// maxFDsPerMsg is the maximum number of file descriptors passed in one message, namely SCM_MAX_FD on Linux.
+const maxFDsPerMsg = 253
+
+// loopReadFDs reads into the packet buffer along with the file descriptors passed via SCM_RIGHTS,
+// and hands the file descriptors over to OnFileDescriptors.
+func (el *eventloop) loopReadFDs(c *conn) (n int, action Action, err error) {
+	if el.oob == nil {
+		el.oob = make([]byte, unix.CmsgSpace(maxFDsPerMsg*4))
+	}
+	n, oobn, _, _, err := unix.Recvmsg(c.fd, el.packet, el.oob, 0)
+	if err != nil || oobn == 0 {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(el.oob[:oobn])
+	if err != nil {
+		return n, None, nil
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range rights {
+			unix.CloseOnExec(fd)
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) > 0 {
+		action = el.svr.fdHandler.OnFileDescriptors(c, fds)
+	}
+	return n, action, nil
+}
+
+// loopReadInto reads into the buffer provided by ReadBufferProvider, and fires React once it completes a frame.
+func (el *eventloop) loopReadInto(c *conn, p ReadBufferProvider) error {
+	x := c.ext
+	n, err := el.svr.transport.Read(c.fd, x.readBuf[x.readN:])
+	if n == 0 || err != nil {
+		if err == unix.EAGAIN {
+			return nil
+		}
+		return el.loopCloseConn(c, err)
+	}
+	c.addBytesIn(n)
+	if x.recordID != 0 {
+		el.svr.opts.Recorder.record(RecordInbound, x.recordID, x.readBuf[x.readN:x.readN+n])
+	}
+	if x.readN += n; x.readN < len(x.readBuf) {
+		if el.svr.opts.PartialFrameTimeout > 0 {
+			c.checkPartialFrame(false)
+		}
+		return nil
+	}
+	buf := x.readBuf
+	x.readBuf, x.readN = nil, 0
+	frame := p.Filled(c, buf)
+	if a := el.svr.opts.FrameAccounting; a != nil && frame != nil {
+		a.AccountFrame(c, true, len(frame), len(buf))
+	}
+	if c.ext != nil && c.ext.handshakeTimer != nil {
+		c.checkHandshake(frame != nil)
+	}
+	if el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(frame != nil)
+	}
+	if frame == nil {
+		return nil
+	}
+	if x.cipher != nil {
+		if frame, _ = c.openFrame(frame); frame == nil {
+			return nil
+		}
+	}
+	if x.handshaking {
+		return el.handshake(c, frame)
+	}
+	var (
+		out    []byte
+		action Action
+	)
+	start := el.beginReact(c)
+	if bh := el.svr.batchHandler; bh != nil {
+		el.batch.reset()
+		el.batch.frames = append(el.batch.frames, frame)
+		out, action = bh.ReactBatch(el.batch.frames, c)
+	} else {
+		out, action = el.eventHandler.React(frame, c)
+	}
+	el.endReact(c, start)
+	if out != nil {
+		outFrame, bb, _ := c.encode(out)
+		el.eventHandler.PreWrite()
+		c.write(outFrame)
+		bytebuffer.Put(bb)
+		if !c.opened {
+			return nil
+		}
+	}
+	return el.handleAction(c, action)
+}
+
+// loopReact handles the inbound data that has just been read from the connection.
+func (el *eventloop) loopReact(c *conn, data []byte) error {
+	if allocAudit {
+		defer endAllocAudit(el.svr.logger, beginAllocAudit(), el.idx, c.fd)
+	}
+	c.buffer = data
 
-	for inFrame, _ := c.read(); inFrame != nil; inFrame, _ = c.read() {
-		out, action := el.eventHandler.React(inFrame, c)
+	if c.ext != nil && c.ext.handshaking {
+		if stop, err := el.loopHandshake(c); stop {
+			return err
+		}
+	}
+	if th := el.svr.trafficHandler; th != nil {
+		return el.loopTraffic(c, th)
+	}
+	if bh := el.svr.batchHandler; bh != nil {
+		return el.loopReactBatch(c, bh)
+	}
+	if c.ext != nil && c.ext.worker != nil {
+		return el.loopDispatch(c)
+	}
+
+	var (
+		inFrame   []byte
+		decodeErr error
+	)
+	decoded := false
+	for inFrame, decodeErr = c.read(); inFrame != nil; inFrame, decodeErr = c.read() {
+		decoded = true
+		if c.ext != nil && c.ext.handshakeTimer != nil {
+			c.checkHandshake(true)
+		}
+		start := el.beginReact(c)
+		out, action := el.eventHandler.React(ownFrame(el.svr.opts, inFrame), c)
+		el.endReact(c, start)
 		if out != nil {
-			outFrame, _ := el.codec.Encode(c, out)
+			outFrame, bb, _ := c.encode(out)
 			el.eventHandler.PreWrite()
 			c.write(outFrame)
+			bytebuffer.Put(bb)
 		}
 		switch action {
 		case None:
@@ -130,52 +516,304 @@ func (el *eventloop) loopRead(c *conn) error {
 		if !c.opened {
 			return nil
 		}
+		if c.hold.paused() {
+			break
+		}
+	}
+	if c.ext != nil && c.ext.handshakeTimer != nil {
+		c.checkHandshake(false)
+	}
+	c.bufferInbound()
+	if el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(decoded)
+	}
+	if isDecodeError(decodeErr) {
+		return el.loopDecodeError(c, decodeErr)
 	}
-	_, _ = c.inboundBuffer.Write(c.buffer)
 
 	return nil
 }
 
+// loopHandshake hands over the frames decoded from the inbound data to HandshakeHandler until it accepts
+// the handshake, the frames following the handshake are left for React. It reports whether reacting to the inbound
+// data must stop, namely when the handshake is still in progress or the connection has been closed.
+func (el *eventloop) loopHandshake(c *conn) (stop bool, err error) {
+	for c.ext.handshaking {
+		inFrame, decodeErr := c.read()
+		if inFrame == nil {
+			c.bufferInbound()
+			if isDecodeError(decodeErr) {
+				return true, el.loopDecodeError(c, decodeErr)
+			}
+			return true, nil
+		}
+		if err = el.handshake(c, inFrame); err != nil || !c.opened {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// handshake hands over a frame decoded during the handshake phase to FrameEncryption until the cipher of
+// the connection is set up, and then to HandshakeHandler.
+func (el *eventloop) handshake(c *conn, frame []byte) error {
+	if c.ext.cipher == nil && el.svr.opts.Encryption != nil {
+		return el.encryptionHandshake(c, frame)
+	}
+	ok, out, action := el.svr.handshakeHandler.OnHandshake(c, frame)
+	if out != nil {
+		outFrame, bb, _ := c.encode(out)
+		el.eventHandler.PreWrite()
+		c.write(outFrame)
+		bytebuffer.Put(bb)
+		if !c.opened {
+			return nil
+		}
+	}
+	if ok {
+		c.endHandshake()
+	}
+	return el.handleAction(c, action)
+}
+
+// encryptionHandshake hands over a frame decoded during the encryption handshake to FrameEncryption, the handshake
+// phase ends along with the encryption handshake unless the event handler is a HandshakeHandler.
+func (el *eventloop) encryptionHandshake(c *conn, frame []byte) error {
+	cipher, out, err := el.svr.opts.Encryption.Handshake(c, frame)
+	if err != nil {
+		return el.loopCloseConn(c, err)
+	}
+	if out != nil {
+		outFrame, bb, _ := c.encodeFrame(out)
+		el.eventHandler.PreWrite()
+		c.write(outFrame)
+		bytebuffer.Put(bb)
+		if !c.opened {
+			return nil
+		}
+	}
+	if cipher != nil {
+		c.ext.cipher = cipher
+		if el.svr.handshakeHandler == nil {
+			c.endHandshake()
+		}
+		return c.flushSealPending()
+	}
+	return nil
+}
+
+// loopDispatch queues up the frames decoded from the inbound data for the goroutine of the connection in hybrid mode,
+// and pauses reading from the connection once the queue is full.
+func (el *eventloop) loopDispatch(c *conn) error {
+	var decodeErr error
+	decoded, w := false, c.ext.worker
+	blockReads := el.svr.opts.ConnQueuePolicy == ConnQueueBlockReads
+	for paused := false; !paused && !c.hold.paused(); {
+		if blockReads && w.full() {
+			if paused = w.tryPause(); paused {
+				c.pauseReads()
+			}
+			continue
+		}
+		var inFrame []byte
+		if inFrame, decodeErr = c.read(); inFrame == nil {
+			break
+		}
+		decoded = true
+		if c.ext != nil && c.ext.handshakeTimer != nil {
+			c.checkHandshake(true)
+		}
+		if w.full() {
+			push, closeConn := w.overflow(el)
+			if closeConn {
+				return el.loopCloseConn(c, ErrConnQueueFull)
+			}
+			if !push {
+				continue
+			}
+		}
+		w.push(inFrame)
+	}
+	if c.ext != nil && c.ext.handshakeTimer != nil {
+		c.checkHandshake(false)
+	}
+	c.bufferInbound()
+	c.buffer = nil
+	if el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(decoded)
+	}
+	if isDecodeError(decodeErr) {
+		return el.loopDecodeError(c, decodeErr)
+	}
+	return nil
+}
+
+// loopResumeRead resumes reading from the connection paused by PauseRead and decodes the frames left in its inbound
+// buffer, unless reading is still paused by the goroutine of the connection, which resumes it later.
+func (el *eventloop) loopResumeRead(c *conn) error {
+	if !c.opened || c.hold.paused() || c.ext != nil && c.ext.worker != nil && c.ext.worker.decodingPaused() {
+		return nil
+	}
+	c.resumeReads()
+	if c.inboundBuffer.IsEmpty() {
+		return nil
+	}
+	return el.loopReact(c, nil)
+}
+
+// loopResumeWorker resumes decoding and reading once the goroutine of the connection has drained its queue.
+func (el *eventloop) loopResumeWorker(c *conn, w *connWorker) {
+	if !c.opened || c.ext.worker != w {
+		return
+	}
+	w.resumed()
+	if !c.hold.paused() {
+		c.resumeReads()
+	}
+	if err := el.loopReact(c, nil); err == ErrServerShutdown {
+		el.svr.requestShutdown()
+	}
+}
+
+// loopReactBatch delivers all the frames decoded from the inbound data to BatchHandler at once.
+func (el *eventloop) loopReactBatch(c *conn, bh BatchHandler) error {
+	el.batch.reset()
+	inFrame, decodeErr := c.read()
+	for ; inFrame != nil; inFrame, decodeErr = c.read() {
+		el.batch.add(inFrame, el.svr.opts.FrameOwnershipTransfer)
+	}
+	decoded := len(el.batch.frames) > 0
+	if c.ext != nil && c.ext.handshakeTimer != nil {
+		c.checkHandshake(decoded)
+	}
+	c.bufferInbound()
+	if el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(decoded)
+	}
+	if !decoded {
+		if isDecodeError(decodeErr) {
+			return el.loopDecodeError(c, decodeErr)
+		}
+		return nil
+	}
+	start := el.beginReact(c)
+	out, action := bh.ReactBatch(el.batch.seal(), c)
+	el.endReact(c, start)
+	if out != nil {
+		outFrame, bb, _ := c.encode(out)
+		el.eventHandler.PreWrite()
+		c.write(outFrame)
+		bytebuffer.Put(bb)
+		if !c.opened {
+			return nil
+		}
+	}
+	if err := el.handleAction(c, action); err != nil || !c.opened || !isDecodeError(decodeErr) {
+		return err
+	}
+	return el.loopDecodeError(c, decodeErr)
+}
+
+func (el *eventloop) loopTraffic(c *conn, th TrafficHandler) error {
+	buffered := c.BufferLength()
+	start := el.beginReact(c)
+	action := th.OnTraffic(c)
+	el.endReact(c, start)
+	consumed := c.BufferLength() < buffered
+	if c.ext != nil && c.ext.handshakeTimer != nil {
+		c.checkHandshake(consumed)
+	}
+	if action != None {
+		return el.handleAction(c, action)
+	}
+	if c.opened {
+		c.bufferInbound()
+		c.buffer = nil
+		if el.svr.opts.PartialFrameTimeout > 0 {
+			c.checkPartialFrame(consumed)
+		}
+	}
+	return nil
+}
+
+// loopDecodeError hands over the decoding error of the connection to DecodeErrorHandler if the event handler
+// implements it, otherwise closes the connection with the error.
+func (el *eventloop) loopDecodeError(c *conn, err error) error {
+	action := Close
+	if h := el.svr.decodeErrHandler; h != nil {
+		action = h.OnDecodeError(c, err)
+	}
+	switch action {
+	case None:
+		if el.svr.opts.PartialFrameTimeout > 0 {
+			c.checkPartialFrame(false)
+		}
+		return nil
+	case Shutdown:
+		return ErrServerShutdown
+	}
+	return el.loopCloseConn(c, err)
+}
+
 func (el *eventloop) loopWrite(c *conn) error {
 	el.eventHandler.PreWrite()
 
+	if c.ext != nil && len(c.ext.pending) > 0 {
+		c.flushCoalesced()
+		if !c.opened {
+			return nil
+		}
+	}
+
 	head, tail := c.outboundBuffer.LazyReadAll()
-	n, err := unix.Write(c.fd, head)
+	n, err := el.svr.transport.Write(c.fd, head)
 	if err != nil {
 		if err == unix.EAGAIN {
 			return nil
 		}
 		return el.loopCloseConn(c, err)
 	}
-	c.outboundBuffer.Shift(n)
+	c.flushOutbound(n)
 
 	if len(head) == n && tail != nil {
-		n, err = unix.Write(c.fd, tail)
+		n, err = el.svr.transport.Write(c.fd, tail)
 		if err != nil {
 			if err == unix.EAGAIN {
 				return nil
 			}
 			return el.loopCloseConn(c, err)
 		}
-		c.outboundBuffer.Shift(n)
+		c.flushOutbound(n)
 	}
 
 	if c.outboundBuffer.IsEmpty() {
-		_ = el.poller.ModRead(c.fd)
+		if el.svr.opts.OutboundFullPolicy != OutboundDrop {
+			c.outboundFull = false
+		}
+		c.pollRead()
 	}
+	c.settleBuffers()
 	return nil
 }
 
 func (el *eventloop) loopCloseConn(c *conn, err error) error {
-	err0, err1 := el.poller.Delete(c.fd), unix.Close(c.fd)
+	err0, err1 := el.poller.Delete(c.fd), el.closeConnFD(c)
 	if err0 == nil && err1 == nil {
 		delete(el.connections, c.fd)
+		delete(el.connsByID, c.id)
 		el.minusConnCount()
-		switch el.eventHandler.OnClosed(c, err) {
+		if c.ext != nil && c.ext.recordID != 0 {
+			el.svr.opts.Recorder.record(RecordClose, c.ext.recordID, nil)
+		}
+		if sink := el.svr.opts.Audit; sink != nil {
+			audit(sink, c.id, c.localAddr, c.remoteAddr, c.ext.openedAt, c.bytesIn, c.bytesOut, err)
+		}
+		action := el.eventHandler.OnClosed(c, err)
+		c.releaseTCP()
+		switch action {
 		case Shutdown:
 			return ErrServerShutdown
 		}
-		c.releaseTCP()
 	} else {
 		if err0 != nil {
 			el.svr.logger.Printf("failed to delete fd:%d from poller, error:%v\n", c.fd, err0)
@@ -188,24 +826,79 @@ func (el *eventloop) loopCloseConn(c *conn, err error) error {
 }
 
 func (el *eventloop) loopWake(c *conn) error {
-	//if co, ok := el.connections[c.fd]; !ok || co != c {
-	//	return nil // ignore stale wakes.
-	//}
+	atomic.StoreInt32(&c.wakePending, 0)
+	if !c.opened {
+		return nil // ignore stale wakes.
+	}
+	if x := c.ext; x != nil && x.worker != nil {
+		// A full queue fires React anyway, into which the wake-up is coalesced.
+		if !x.worker.full() {
+			x.worker.push(nil)
+		}
+		return nil
+	}
 	out, action := el.eventHandler.React(nil, c)
 	if out != nil {
-		frame, _ := el.codec.Encode(c, out)
+		frame, bb, _ := c.encode(out)
 		c.write(frame)
+		bytebuffer.Put(bb)
 	}
 	return el.handleAction(c, action)
 }
 
+func (el *eventloop) loopUserEvent(c *conn, tag interface{}) error {
+	if !c.opened {
+		return nil
+	}
+	uh := el.svr.userEventHandler
+	if uh == nil {
+		return el.loopWake(c)
+	}
+	return el.handleAction(c, uh.OnUserEvent(c, tag))
+}
+
+func (el *eventloop) post(m busMessage) error {
+	if el.mailbox.push(m) {
+		if err := el.poller.Trigger(el.loopMailbox); err != nil {
+			el.mailbox.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+// loopMailbox delivers the messages posted to the event-loop, the whole batch is delivered even if a message fails,
+// e.g. shuts the server down, since the messages taken out of the mailbox would be lost otherwise, and the first
+// error is returned.
+func (el *eventloop) loopMailbox() (err error) {
+	msgs := el.mailbox.take()
+	defer el.mailbox.recycle(msgs)
+	for i := range msgs {
+		m := &msgs[i]
+		if m.fn != nil {
+			m.fn()
+		} else if c, ok := el.connsByID[m.connID]; ok {
+			if e := el.loopUserEvent(c, m.msg); err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
 func (el *eventloop) loopTicker() {
 	var (
 		delay time.Duration
 		open  bool
 		err   error
 	)
+	if !el.svr.delayTicker() {
+		return
+	}
 	for {
+		if !el.svr.waitTicker() {
+			break
+		}
 		err = el.poller.Trigger(func() (err error) {
 			delay, action := el.eventHandler.Tick()
 			el.svr.ticktock <- delay
@@ -221,7 +914,7 @@ func (el *eventloop) loopTicker() {
 			break
 		}
 		if delay, open = <-el.svr.ticktock; open {
-			time.Sleep(delay)
+			time.Sleep(el.svr.jitterTick(delay))
 		} else {
 			break
 		}
@@ -243,8 +936,25 @@ func (el *eventloop) handleAction(c *conn, action Action) error {
 	}
 }
 
+// isPacketFD reports whether fd is the UDP listener of the "tcp+udp" network.
+func (el *eventloop) isPacketFD(fd int) bool {
+	u := el.svr.ln.udp
+	return u != nil && fd == u.fd
+}
+
 func (el *eventloop) loopReadUDP(fd int) error {
-	n, sa, err := unix.Recvfrom(fd, el.packet, 0)
+	if el.udpPacket == nil {
+		el.udpPacket = make([]byte, el.svr.opts.udpReadBufferSize())
+	}
+	var oob []byte
+	if el.svr.opts.Transparent {
+		if len(el.oob) < netpoll.OrigDstSpace {
+			el.oob = make([]byte, netpoll.OrigDstSpace)
+		}
+		oob = el.oob
+	}
+	// Recvmsg rather than Recvfrom, so that the datagrams exceeding the buffer are told by MSG_TRUNC.
+	n, oobn, flags, sa, err := unix.Recvmsg(fd, el.udpPacket, oob, 0)
 	if err != nil || n == 0 {
 		if err != nil && err != unix.EAGAIN {
 			el.svr.logger.Printf("failed to read UDP packet from fd:%d, error:%v\n", fd, err)
@@ -252,7 +962,20 @@ func (el *eventloop) loopReadUDP(fd int) error {
 		return nil
 	}
 	c := newUDPConn(fd, el, sa)
-	out, action := el.eventHandler.React(el.packet[:n], c)
+	if flags&unix.MSG_TRUNC != 0 {
+		action := el.dropTruncated(c, el.udpPacket[:n])
+		c.releaseUDP()
+		if action == Shutdown {
+			return ErrServerShutdown
+		}
+		return nil
+	}
+	if oobn > 0 {
+		if addr := netpoll.ParseOrigDst(el.oob[:oobn]); addr != nil {
+			c.origDst = addr
+		}
+	}
+	out, action := el.eventHandler.React(ownFrame(el.svr.opts, el.udpPacket[:n]), c)
 	if out != nil {
 		el.eventHandler.PreWrite()
 		_ = c.sendTo(out)
@@ -17,25 +17,35 @@ import (
 )
 
 type eventloop struct {
+	counters     loopCounters          // counters published in batches, kept first for 64-bit alignment
 	ch           chan interface{}      // command channel
 	idx          int                   // loop index
 	svr          *server               // server in loop
 	codec        ICodec                // codec for TCP
-	connCount    int32                 // number of active connections in event-loop
 	connections  map[*stdConn]struct{} // track all the sockets bound to this loop
+	connsByID    map[uint64]*stdConn   // loop connections id -> conn
+	connSeq      uint64                // sequence number of the connection IDs
+	mailbox      mailbox               // messages posted to the loop
+	batch        frameBatch            // frames delivered to BatchHandler
+	writeBatch   []*stdConn            // connections written to within the iteration, see LoopWriteBatching
+	scanner      connScanner           // state of the connection scanner, see ConnScan
+	slowReact    slowReactState        // state of the slow React detection, see SlowReactThreshold
+	watchdog     loopWatchdog          // state of the watchdog, see WatchdogTimeout
+	utilization  loopUtilization       // utilization of the event-loop, see LoopOverloadThreshold
 	eventHandler EventHandler          // user eventHandler
 }
 
 func (el *eventloop) plusConnCount() {
-	atomic.AddInt32(&el.connCount, 1)
+	el.counters.addConns(1)
+	el.counters.addAccepted()
 }
 
 func (el *eventloop) minusConnCount() {
-	atomic.AddInt32(&el.connCount, -1)
+	el.counters.addConns(-1)
 }
 
 func (el *eventloop) loadConnCount() int32 {
-	return atomic.LoadInt32(&el.connCount)
+	return el.counters.loadConns()
 }
 
 func (el *eventloop) loopRun() {
@@ -52,40 +62,98 @@ func (el *eventloop) loopRun() {
 	if el.idx == 0 && el.svr.opts.Ticker {
 		go el.loopTicker()
 	}
+	measure := el.svr.opts.LoopOverloadThreshold > 0
+	busy := false
 	for v := range el.ch {
-		switch v := v.(type) {
-		case error:
-			err = v
-		case *stdConn:
-			err = el.loopAccept(v)
-		case *tcpIn:
-			err = el.loopRead(v)
-		case *udpIn:
-			err = el.loopReadUDP(v.c)
-		case *stderr:
-			err = el.loopError(v.c, v.err)
-		case wakeReq:
-			err = el.loopWake(v.c)
-		case func() error:
-			err = v()
+		if measure && !busy {
+			busy = true
+			el.utilization.wake()
 		}
-		if err != nil {
+		if err = el.handleCommand(v); err != nil {
 			el.svr.logger.Printf("event-loop:%d exits with error:%v\n", el.idx, err)
-			break
+			if err == errClosing || err == ErrServerShutdown || !el.svr.onLoopError(el.idx, err) {
+				break
+			}
+			if err = el.restart(); err != nil {
+				break
+			}
+		}
+		if len(el.ch) == 0 {
+			// The commands queued up so far make up a batch.
+			el.flushWriteBatch()
+			el.counters.endBatch()
+			if busy {
+				busy = false
+				el.utilization.sleep()
+			}
+		}
+	}
+}
+
+// restart prepares the event-loop for going on after an unexpected error, see LoopRestartPolicy.
+func (el *eventloop) restart() error {
+	if el.svr.opts.LoopRestart == LoopRestartCloseConns {
+		for c := range el.connections {
+			if err := el.loopError(c, ErrLoopRestarted); err == errClosing {
+				return err
+			}
 		}
 	}
+	return nil
+}
+
+func (el *eventloop) handleCommand(v interface{}) (err error) {
+	switch v := v.(type) {
+	case error:
+		err = v
+	case *stdConn:
+		err = el.loopAccept(v)
+	case *tcpIn:
+		err = el.loopRead(v)
+	case *udpIn:
+		err = el.loopReadUDP(v.c, v.truncated)
+	case *stderr:
+		err = el.loopError(v.c, v.err)
+	case wakeReq:
+		err = el.loopWake(v.c)
+	case userEvent:
+		err = el.loopUserEvent(v.c, v.tag)
+	case func() error:
+		err = v()
+	}
+	return
 }
 
 func (el *eventloop) loopAccept(c *stdConn) error {
+	atomic.AddInt32(&el.svr.pendingAccepts, -1)
 	el.connections[c] = struct{}{}
-	c.localAddr = el.svr.ln.lnaddr
+	c.id = nextConnID(&el.connSeq, el.idx)
+	el.connsByID[c.id] = c
+	if c.localAddr == nil {
+		c.localAddr = el.svr.ln.lnaddr
+	}
 	c.remoteAddr = c.conn.RemoteAddr()
+	c.faults = newFaultInjector(el.svr.opts.FaultInjection, &el.svr.faultSeq, c)
+	c.settleBuffers()
+	if r := el.svr.opts.Recorder; r != nil {
+		c.recordID = r.open(c)
+	}
+	if el.svr.opts.Audit != nil {
+		c.openedAt = time.Now()
+	}
 	el.plusConnCount()
 
+	c.handshaking = el.svr.handshakeHandler != nil || el.svr.opts.Encryption != nil
+	if timeout := el.svr.opts.HandshakeTimeout; timeout > 0 {
+		c.startHandshakeTimer(timeout)
+	}
+	if w := c.worker; w != nil {
+		w.start(el, c, func() { el.loopResumeWorker(c, w) })
+	}
 	out, action := el.eventHandler.OnOpened(c)
 	if out != nil {
 		el.eventHandler.PreWrite()
-		_, _ = c.conn.Write(out)
+		_, _ = c.write(out)
 	}
 	if el.svr.opts.TCPKeepAlive > 0 {
 		if c, ok := c.conn.(*net.TCPConn); ok {
@@ -96,16 +164,67 @@ func (el *eventloop) loopAccept(c *stdConn) error {
 	return el.handleAction(c, action)
 }
 
-func (el *eventloop) loopRead(ti *tcpIn) (err error) {
+func (el *eventloop) loopRead(ti *tcpIn) error {
 	c := ti.c
-	c.buffer = ti.in
+	c.addBytesIn(ti.in.Len())
+	if c.recordID != 0 {
+		el.svr.opts.Recorder.record(RecordInbound, c.recordID, ti.in.Bytes())
+	}
+	if c.faults != nil {
+		defer bytebuffer.Put(ti.in)
+		return c.faults.read.inject(ti.in.Bytes(), c.trigger, func(data []byte) error {
+			if _, ok := el.connections[c]; !ok {
+				return nil
+			}
+			buf := bytebuffer.Get()
+			_, _ = buf.Write(data)
+			return el.loopReact(c, buf)
+		})
+	}
+	err := el.loopReact(c, ti.in)
+	if _, ok := el.connections[c]; ok {
+		c.settleBuffers()
+	}
+	return err
+}
+
+// loopReact handles the inbound data that has just been read from the connection.
+func (el *eventloop) loopReact(c *stdConn, in *bytebuffer.ByteBuffer) (err error) {
+	c.buffer = in
 
-	for inFrame, _ := c.read(); inFrame != nil; inFrame, _ = c.read() {
-		out, action := el.eventHandler.React(inFrame, c)
+	if c.handshaking {
+		if stop, err := el.loopHandshake(c); stop {
+			return err
+		}
+	}
+	if th := el.svr.trafficHandler; th != nil {
+		return el.loopTraffic(c, th)
+	}
+	if bh := el.svr.batchHandler; bh != nil {
+		return el.loopReactBatch(c, bh)
+	}
+	if c.worker != nil {
+		return el.loopDispatch(c)
+	}
+
+	var (
+		inFrame   []byte
+		decodeErr error
+	)
+	decoded := false
+	for inFrame, decodeErr = c.read(); inFrame != nil; inFrame, decodeErr = c.read() {
+		decoded = true
+		if c.handshakeTimer != nil {
+			c.checkHandshake(true)
+		}
+		start := el.beginReact(c)
+		out, action := el.eventHandler.React(ownFrame(el.svr.opts, inFrame), c)
+		el.endReact(c, start)
 		if out != nil {
-			outFrame, _ := el.codec.Encode(c, out)
+			outFrame, bb, _ := c.encode(out)
 			el.eventHandler.PreWrite()
-			_, err = c.conn.Write(outFrame)
+			_, err = c.write(outFrame)
+			bytebuffer.Put(bb)
 		}
 		switch action {
 		case None:
@@ -117,18 +236,264 @@ func (el *eventloop) loopRead(ti *tcpIn) (err error) {
 		if err != nil {
 			return el.loopError(c, err)
 		}
+		if c.hold.paused() {
+			break
+		}
 	}
-	_, _ = c.inboundBuffer.Write(c.buffer.Bytes())
+	if c.handshakeTimer != nil {
+		c.checkHandshake(false)
+	}
+	c.bufferInbound()
 	bytebuffer.Put(c.buffer)
 	c.buffer = nil
+	if el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(decoded)
+	}
+	if isDecodeError(decodeErr) {
+		return el.loopDecodeError(c, decodeErr)
+	}
+	return nil
+}
+
+// loopHandshake hands over the frames decoded from the inbound data to HandshakeHandler until it accepts
+// the handshake, the frames following the handshake are left for React. It reports whether reacting to the inbound
+// data must stop, namely when the handshake is still in progress or the connection has been closed.
+func (el *eventloop) loopHandshake(c *stdConn) (stop bool, err error) {
+	for c.handshaking {
+		inFrame, decodeErr := c.read()
+		if inFrame == nil {
+			c.bufferInbound()
+			bytebuffer.Put(c.buffer)
+			c.buffer = nil
+			if isDecodeError(decodeErr) {
+				return true, el.loopDecodeError(c, decodeErr)
+			}
+			return true, nil
+		}
+		if err = el.handshake(c, inFrame); err != nil {
+			return true, err
+		}
+		if _, ok := el.connections[c]; !ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// handshake hands over a frame decoded during the handshake phase to FrameEncryption until the cipher of
+// the connection is set up, and then to HandshakeHandler.
+func (el *eventloop) handshake(c *stdConn, frame []byte) error {
+	if c.cipher == nil && el.svr.opts.Encryption != nil {
+		return el.encryptionHandshake(c, frame)
+	}
+	ok, out, action := el.svr.handshakeHandler.OnHandshake(c, frame)
+	if out != nil {
+		outFrame, bb, _ := c.encode(out)
+		el.eventHandler.PreWrite()
+		_, err := c.write(outFrame)
+		bytebuffer.Put(bb)
+		if err != nil {
+			return el.loopError(c, err)
+		}
+	}
+	if ok {
+		c.endHandshake()
+	}
+	return el.handleAction(c, action)
+}
+
+// encryptionHandshake hands over a frame decoded during the encryption handshake to FrameEncryption, the handshake
+// phase ends along with the encryption handshake unless the event handler is a HandshakeHandler.
+func (el *eventloop) encryptionHandshake(c *stdConn, frame []byte) error {
+	cipher, out, err := el.svr.opts.Encryption.Handshake(c, frame)
+	if err != nil {
+		return el.loopError(c, err)
+	}
+	if out != nil {
+		outFrame, bb, _ := c.encodeFrame(out)
+		el.eventHandler.PreWrite()
+		_, err = c.write(outFrame)
+		bytebuffer.Put(bb)
+		if err != nil {
+			return el.loopError(c, err)
+		}
+	}
+	if cipher != nil {
+		c.cipher = cipher
+		if el.svr.handshakeHandler == nil {
+			c.endHandshake()
+		}
+		return c.flushSealPending()
+	}
 	return nil
 }
 
+// loopDispatch queues up the frames decoded from the inbound data for the goroutine of the connection in hybrid mode,
+// and pauses reading from the connection once the queue is full.
+func (el *eventloop) loopDispatch(c *stdConn) error {
+	var decodeErr error
+	decoded := false
+	blockReads := el.svr.opts.ConnQueuePolicy == ConnQueueBlockReads
+	for paused := false; !paused && !c.hold.paused(); {
+		if blockReads && c.worker.full() {
+			// The goroutine reading from the connection waits until the event-loop resumes.
+			paused = c.worker.tryPause()
+			continue
+		}
+		var inFrame []byte
+		if inFrame, decodeErr = c.read(); inFrame == nil {
+			break
+		}
+		decoded = true
+		if c.handshakeTimer != nil {
+			c.checkHandshake(true)
+		}
+		if c.worker.full() {
+			push, closeConn := c.worker.overflow(el)
+			if closeConn {
+				return el.loopError(c, ErrConnQueueFull)
+			}
+			if !push {
+				continue
+			}
+		}
+		c.worker.push(inFrame)
+	}
+	if c.handshakeTimer != nil {
+		c.checkHandshake(false)
+	}
+	c.bufferInbound()
+	bytebuffer.Put(c.buffer)
+	c.buffer = nil
+	if el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(decoded)
+	}
+	if isDecodeError(decodeErr) {
+		return el.loopDecodeError(c, decodeErr)
+	}
+	return nil
+}
+
+// loopResumeRead decodes the frames left in the inbound buffer of the connection once reading is resumed after
+// PauseRead, unless decoding is still paused by the goroutine of the connection, which resumes it later.
+func (el *eventloop) loopResumeRead(c *stdConn) error {
+	if _, ok := el.connections[c]; !ok || c.hold.paused() || c.worker != nil && c.worker.decodingPaused() {
+		return nil
+	}
+	if c.inboundBuffer.IsEmpty() {
+		return nil
+	}
+	return el.loopReact(c, bytebuffer.Get())
+}
+
+// loopResumeWorker resumes decoding and reading once the goroutine of the connection has drained its queue.
+func (el *eventloop) loopResumeWorker(c *stdConn, w *connWorker) {
+	if _, ok := el.connections[c]; !ok || c.worker != w {
+		return
+	}
+	w.resumed()
+	if err := el.loopReact(c, bytebuffer.Get()); err == ErrServerShutdown {
+		el.svr.requestShutdown()
+	}
+}
+
+// loopReactBatch delivers all the frames decoded from the inbound data to BatchHandler at once.
+func (el *eventloop) loopReactBatch(c *stdConn, bh BatchHandler) error {
+	el.batch.reset()
+	inFrame, decodeErr := c.read()
+	for ; inFrame != nil; inFrame, decodeErr = c.read() {
+		el.batch.add(inFrame, el.svr.opts.FrameOwnershipTransfer)
+	}
+	decoded := len(el.batch.frames) > 0
+	if c.handshakeTimer != nil {
+		c.checkHandshake(decoded)
+	}
+	c.bufferInbound()
+	bytebuffer.Put(c.buffer)
+	c.buffer = nil
+	if el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(decoded)
+	}
+	if !decoded {
+		if isDecodeError(decodeErr) {
+			return el.loopDecodeError(c, decodeErr)
+		}
+		return nil
+	}
+	start := el.beginReact(c)
+	out, action := bh.ReactBatch(el.batch.seal(), c)
+	el.endReact(c, start)
+	if out != nil {
+		outFrame, bb, _ := c.encode(out)
+		el.eventHandler.PreWrite()
+		_, err := c.write(outFrame)
+		bytebuffer.Put(bb)
+		if err != nil {
+			return el.loopError(c, err)
+		}
+	}
+	if action != None || !isDecodeError(decodeErr) {
+		return el.handleAction(c, action)
+	}
+	return el.loopDecodeError(c, decodeErr)
+}
+
+func (el *eventloop) loopTraffic(c *stdConn, th TrafficHandler) error {
+	buffered := c.BufferLength()
+	start := el.beginReact(c)
+	action := th.OnTraffic(c)
+	el.endReact(c, start)
+	consumed := c.BufferLength() < buffered
+	if c.handshakeTimer != nil {
+		c.checkHandshake(consumed)
+	}
+	c.bufferInbound()
+	bytebuffer.Put(c.buffer)
+	c.buffer = nil
+	if action == None && el.svr.opts.PartialFrameTimeout > 0 {
+		c.checkPartialFrame(consumed)
+	}
+	return el.handleAction(c, action)
+}
+
+// loopDecodeError hands over the decoding error of the connection to DecodeErrorHandler if the event handler
+// implements it, otherwise closes the connection with the error.
+func (el *eventloop) loopDecodeError(c *stdConn, err error) error {
+	action := Close
+	if h := el.svr.decodeErrHandler; h != nil {
+		action = h.OnDecodeError(c, err)
+	}
+	switch action {
+	case None:
+		if el.svr.opts.PartialFrameTimeout > 0 {
+			c.checkPartialFrame(false)
+		}
+		return nil
+	case Shutdown:
+		return ErrServerShutdown
+	}
+	return el.loopError(c, err)
+}
+
 func (el *eventloop) loopCloseConn(c *stdConn) error {
+	if len(c.pending) > 0 {
+		c.flushCoalesced()
+	}
 	atomic.StoreInt32(&c.done, 1)
 	return c.conn.SetReadDeadline(time.Now())
 }
 
+// flushOnShutdown bounds the write of the data of c merged by write coalescing, which is flushed by loopCloseConn,
+// by the deadline, or discards the data if the deadline is zero. The other writes are synchronous, thus there
+// is nothing else to flush.
+func (el *eventloop) flushOnShutdown(c *stdConn, deadline time.Time) {
+	if deadline.IsZero() {
+		c.pending = c.pending[:0]
+		return
+	}
+	_ = c.conn.SetWriteDeadline(deadline)
+}
+
 func (el *eventloop) loopEgress() {
 	var closed bool
 	for v := range el.ch {
@@ -136,7 +501,9 @@ func (el *eventloop) loopEgress() {
 		case error:
 			if v == errCloseConns {
 				closed = true
+				deadline := el.svr.shutdownFlushDeadline()
 				for c := range el.connections {
+					el.flushOnShutdown(c, deadline)
 					_ = el.loopCloseConn(c)
 				}
 			}
@@ -147,6 +514,7 @@ func (el *eventloop) loopEgress() {
 			break
 		}
 	}
+	el.counters.publish()
 }
 
 func (el *eventloop) loopTicker() {
@@ -154,7 +522,13 @@ func (el *eventloop) loopTicker() {
 		delay time.Duration
 		open  bool
 	)
+	if !el.svr.delayTicker() {
+		return
+	}
 	for {
+		if !el.svr.waitTicker() {
+			break
+		}
 		el.ch <- func() (err error) {
 			delay, action := el.eventHandler.Tick()
 			el.svr.ticktock <- delay
@@ -165,7 +539,7 @@ func (el *eventloop) loopTicker() {
 			return
 		}
 		if delay, open = <-el.svr.ticktock; open {
-			time.Sleep(delay)
+			time.Sleep(el.svr.jitterTick(delay))
 		} else {
 			break
 		}
@@ -175,7 +549,14 @@ func (el *eventloop) loopTicker() {
 func (el *eventloop) loopError(c *stdConn, err error) (e error) {
 	if e = c.conn.Close(); e == nil {
 		delete(el.connections, c)
+		delete(el.connsByID, c.id)
 		el.minusConnCount()
+		if c.recordID != 0 {
+			el.svr.opts.Recorder.record(RecordClose, c.recordID, nil)
+		}
+		if sink := el.svr.opts.Audit; sink != nil {
+			audit(sink, c.id, c.localAddr, c.remoteAddr, c.openedAt, c.bytesIn, c.bytesOut, err)
+		}
 		switch atomic.LoadInt32(&c.done) {
 		case 0: // read error
 			if err != io.EOF {
@@ -184,11 +565,12 @@ func (el *eventloop) loopError(c *stdConn, err error) (e error) {
 		case 1: // closed
 			el.svr.logger.Printf("socket: %s has been closed by client\n", c.remoteAddr.String())
 		}
-		switch el.eventHandler.OnClosed(c, err) {
+		action := el.eventHandler.OnClosed(c, err)
+		c.releaseTCP()
+		switch action {
 		case Shutdown:
 			return errClosing
 		}
-		c.releaseTCP()
 	} else {
 		el.svr.logger.Printf("failed to close connection:%s, error:%v\n", c.remoteAddr.String(), e)
 	}
@@ -196,17 +578,63 @@ func (el *eventloop) loopError(c *stdConn, err error) (e error) {
 }
 
 func (el *eventloop) loopWake(c *stdConn) error {
-	//if co, ok := el.connections[c]; !ok || co != c {
-	//	return nil // ignore stale wakes.
-	//}
+	atomic.StoreInt32(&c.wakePending, 0)
+	if _, ok := el.connections[c]; !ok {
+		return nil // ignore stale wakes.
+	}
+	if c.worker != nil {
+		// A full queue fires React anyway, into which the wake-up is coalesced.
+		if !c.worker.full() {
+			c.worker.push(nil)
+		}
+		return nil
+	}
 	out, action := el.eventHandler.React(nil, c)
 	if out != nil {
-		frame, _ := el.codec.Encode(c, out)
-		_, _ = c.conn.Write(frame)
+		frame, bb, _ := c.encode(out)
+		_, _ = c.write(frame)
+		bytebuffer.Put(bb)
 	}
 	return el.handleAction(c, action)
 }
 
+func (el *eventloop) loopUserEvent(c *stdConn, tag interface{}) error {
+	if _, ok := el.connections[c]; !ok {
+		return nil
+	}
+	uh := el.svr.userEventHandler
+	if uh == nil {
+		return el.loopWake(c)
+	}
+	return el.handleAction(c, uh.OnUserEvent(c, tag))
+}
+
+func (el *eventloop) post(m busMessage) error {
+	if el.mailbox.push(m) {
+		el.ch <- el.loopMailbox
+	}
+	return nil
+}
+
+// loopMailbox delivers the messages posted to the event-loop, the whole batch is delivered even if a message fails,
+// e.g. shuts the server down, since the messages taken out of the mailbox would be lost otherwise, and the first
+// error is returned.
+func (el *eventloop) loopMailbox() (err error) {
+	msgs := el.mailbox.take()
+	defer el.mailbox.recycle(msgs)
+	for i := range msgs {
+		m := &msgs[i]
+		if m.fn != nil {
+			m.fn()
+		} else if c, ok := el.connsByID[m.connID]; ok {
+			if e := el.loopUserEvent(c, m.msg); err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
 func (el *eventloop) handleAction(c *stdConn, action Action) error {
 	switch action {
 	case None:
@@ -220,11 +648,19 @@ func (el *eventloop) handleAction(c *stdConn, action Action) error {
 	}
 }
 
-func (el *eventloop) loopReadUDP(c *stdConn) error {
-	out, action := el.eventHandler.React(c.buffer.Bytes(), c)
+func (el *eventloop) loopReadUDP(c *stdConn, truncated bool) error {
+	if truncated {
+		action := el.dropTruncated(c, c.buffer.Bytes())
+		c.releaseUDP()
+		if action == Shutdown {
+			return errClosing
+		}
+		return nil
+	}
+	out, action := el.eventHandler.React(ownFrame(el.svr.opts, c.buffer.Bytes()), c)
 	if out != nil {
 		el.eventHandler.PreWrite()
-		_, _ = el.svr.ln.pconn.WriteTo(out, c.remoteAddr)
+		_, _ = el.svr.ln.packetListener().pconn.WriteTo(out, c.remoteAddr)
 	}
 	switch action {
 	case Shutdown:
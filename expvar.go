@@ -0,0 +1,99 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"expvar"
+	"sync"
+)
+
+// expvarTotals are the values of the counters exported via expvar.
+type expvarTotals struct {
+	accepted, active, bytesIn, bytesOut, iterations uint64
+}
+
+// expvarServers holds the servers exporting their counters via expvar, along with the totals of the servers that
+// have stopped, so that the exported counters don't go back when a server stops.
+var expvarServers struct {
+	sync.Mutex
+	once    sync.Once
+	servers map[*server]struct{}
+	retired expvarTotals
+}
+
+// startExpvar adds the counters of the server to the ones exported via expvar if the server is set up with
+// WithExpvar, until the server stops.
+func (svr *server) startExpvar() {
+	if !svr.opts.Expvar {
+		return
+	}
+	expvarServers.once.Do(publishExpvar)
+	expvarServers.Lock()
+	if expvarServers.servers == nil {
+		expvarServers.servers = make(map[*server]struct{})
+	}
+	expvarServers.servers[svr] = struct{}{}
+	expvarServers.Unlock()
+	go func() {
+		<-svr.done
+		t := svr.expvarTotals()
+		expvarServers.Lock()
+		delete(expvarServers.servers, svr)
+		expvarServers.retired.accepted += t.accepted
+		expvarServers.retired.bytesIn += t.bytesIn
+		expvarServers.retired.bytesOut += t.bytesOut
+		expvarServers.retired.iterations += t.iterations
+		expvarServers.Unlock()
+	}()
+}
+
+// expvarTotals sums up the counters of the event-loops of the server.
+func (svr *server) expvarTotals() (t expvarTotals) {
+	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		accepted, in, out, iterations := el.counters.loadTraffic()
+		t.accepted += accepted
+		t.bytesIn += in
+		t.bytesOut += out
+		t.iterations += iterations
+		if conns := el.counters.loadConns(); conns > 0 {
+			t.active += uint64(conns)
+		}
+		return true
+	})
+	return
+}
+
+// loadExpvarTotals sums up the counters of all the servers exporting them via expvar.
+func loadExpvarTotals() expvarTotals {
+	expvarServers.Lock()
+	defer expvarServers.Unlock()
+	t := expvarServers.retired
+	for svr := range expvarServers.servers {
+		st := svr.expvarTotals()
+		t.accepted += st.accepted
+		t.active += st.active
+		t.bytesIn += st.bytesIn
+		t.bytesOut += st.bytesOut
+		t.iterations += st.iterations
+	}
+	return t
+}
+
+// publishExpvar publishes the counters under the gnet.* keys, they are the sums over all the servers set up with
+// WithExpvar in the process.
+func publishExpvar() {
+	for name, value := range map[string]func(t expvarTotals) uint64{
+		"gnet.accepted":        func(t expvarTotals) uint64 { return t.accepted },
+		"gnet.active":          func(t expvarTotals) uint64 { return t.active },
+		"gnet.bytes_in":        func(t expvarTotals) uint64 { return t.bytesIn },
+		"gnet.bytes_out":       func(t expvarTotals) uint64 { return t.bytesOut },
+		"gnet.loop_iterations": func(t expvarTotals) uint64 { return t.iterations },
+	} {
+		value := value
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			return value(loadExpvarTotals())
+		}))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// FaultPolicy describes the faults injected into one direction of the traffic of a connection,
+// every chunk of data that is read from or written to the connection is subject to the policy.
+type FaultPolicy struct {
+	// Latency delays every chunk of data by the given duration.
+	Latency time.Duration
+
+	// Jitter adds a random duration within [0, Jitter) to the latency of every chunk of data.
+	Jitter time.Duration
+
+	// DropRate is the probability (0-1) of a chunk of data being dropped entirely.
+	DropRate float64
+
+	// TruncateRate is the probability (0-1) of a chunk of data losing a tail of random length.
+	TruncateRate float64
+
+	// DuplicateRate is the probability (0-1) of a chunk of data being delivered twice.
+	DuplicateRate float64
+}
+
+// FaultInjection is the configuration of the fault-injection layer which simulates bad network conditions
+// on stream connections, so that the robustness of protocols can be tested without external tools like tc/netem.
+// Chunks of data keep their order even if they are delayed, and the faults of every connection are drawn from
+// a random source seeded with Seed and the sequence number of the connection, which makes a test reproducible.
+type FaultInjection struct {
+	// Seed is the seed of the random sources.
+	Seed int64
+
+	// Filter selects the connections that are subject to fault injection, all connections are if it is nil.
+	Filter func(c Conn) bool
+
+	// Read is the policy for the inbound data.
+	Read FaultPolicy
+
+	// Write is the policy for the outbound data.
+	Write FaultPolicy
+}
+
+type faultInjector struct {
+	read, write faultStream
+}
+
+// faultStream injects faults into one direction of a connection, it must only be used within the event-loop.
+type faultStream struct {
+	policy  *FaultPolicy
+	rand    *rand.Rand
+	pending [][]byte  // delayed chunks in order
+	last    time.Time // delivery time of the last delayed chunk
+}
+
+// newFaultInjector returns a fault injector for the connection if it is subject to fault injection, otherwise nil.
+func newFaultInjector(fi *FaultInjection, seq *int32, c Conn) *faultInjector {
+	if fi == nil || (fi.Filter != nil && !fi.Filter(c)) {
+		return nil
+	}
+	seed := fi.Seed + int64(atomic.AddInt32(seq, 1))
+	return &faultInjector{
+		read:  faultStream{policy: &fi.Read, rand: rand.New(rand.NewSource(seed))},
+		write: faultStream{policy: &fi.Write, rand: rand.New(rand.NewSource(-seed))},
+	}
+}
+
+// inject applies the faults to data and hands the result over to deliver, either immediately or as a job
+// submitted by trigger after the latency elapses. Data is copied before it is delayed.
+func (s *faultStream) inject(data []byte, trigger func(job func() error) error, deliver func([]byte) error) error {
+	p := s.policy
+	if p.DropRate > 0 && s.rand.Float64() < p.DropRate {
+		return nil
+	}
+	if p.TruncateRate > 0 && len(data) > 1 && s.rand.Float64() < p.TruncateRate {
+		data = data[:1+s.rand.Intn(len(data)-1)]
+	}
+	if p.DuplicateRate > 0 && s.rand.Float64() < p.DuplicateRate {
+		dup := make([]byte, 2*len(data))
+		copy(dup[copy(dup, data):], data)
+		data = dup
+	}
+	latency := p.Latency
+	if p.Jitter > 0 {
+		latency += time.Duration(s.rand.Int63n(int64(p.Jitter)))
+	}
+	if latency <= 0 && len(s.pending) == 0 {
+		return deliver(data)
+	}
+
+	chunk := make([]byte, len(data))
+	copy(chunk, data)
+	s.pending = append(s.pending, chunk)
+	now := time.Now()
+	at := now.Add(latency)
+	if at.Before(s.last) {
+		at = s.last
+	}
+	s.last = at
+	// Every timer delivers the oldest pending chunk, so that the order is kept even if timers fire out of order.
+	time.AfterFunc(at.Sub(now), func() {
+		_ = trigger(func() error {
+			chunk := s.pending[0]
+			s.pending[0] = nil
+			s.pending = s.pending[1:]
+			return deliver(chunk)
+		})
+	})
+	return nil
+}
@@ -0,0 +1,11 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// WriteFilter transforms the outbound data of a connection right before it is written, after it is encoded by
+// the codec, e.g. appending protocol trailers, encrypting or accounting, see Conn.AddWriteFilter. It returns
+// the data to write, which may be buf itself, or nothing to drop the data. The filters are invoked within
+// the event-loop, the data passed to a filter is only valid until the filter returns.
+type WriteFilter func(c Conn, buf []byte) (out []byte)
@@ -0,0 +1,407 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Netflow and IPFIX packet layouts, see RFC 3954 and RFC 7011.
+const (
+	netflowV5HeaderSize           = 24
+	netflowV5RecordSize           = 48
+	netflowV9HeaderSize           = 20
+	ipfixHeaderSize               = 16
+	flowSetHeaderSize             = 4
+	netflowV9TemplateSetID        = 0
+	netflowV9OptionsTemplateSetID = 1
+	ipfixTemplateSetID            = 2
+	ipfixOptionsTemplateSetID     = 3
+	flowMinDataSetID              = 256
+	ipfixEnterpriseBit            = 0x8000
+	ipfixVariableLength           = 65535
+	ipfixLongLength               = 255
+)
+
+// FlowVersion returns the version of the Netflow or IPFIX packet, namely 5 or 9 for Netflow and 10 for IPFIX, which
+// tells whether to parse it by ParseNetflowV5 or FlowDecoder, or 0 if the packet is too short to tell.
+func FlowVersion(packet []byte) int {
+	if len(packet) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(packet))
+}
+
+// NetflowV5Header is the header of a Netflow v5 packet.
+type NetflowV5Header struct {
+	// SysUptime is the uptime of the exporter in milliseconds when the packet is exported, which the times of
+	// the records are relative to.
+	SysUptime uint32
+
+	// ExportTime is the time when the packet is exported.
+	ExportTime time.Time
+
+	// Sequence is the number of the flows seen by the exporter before the packet, e.g. for detecting losses.
+	Sequence uint32
+
+	// EngineType and EngineID identify the flow switching engine of the exporter.
+	EngineType, EngineID uint8
+
+	// SamplingInterval is the sampling mode in the first two bits followed by the sampling interval.
+	SamplingInterval uint16
+}
+
+// NetflowV5Record is a flow record of a Netflow v5 packet, its addresses are slices of the packet.
+type NetflowV5Record struct {
+	SrcAddr, DstAddr, NextHop net.IP
+	Input, Output             uint16 // SNMP indexes of the input and output interfaces
+	Packets, Octets           uint32
+	First, Last               uint32 // SysUptime at the first and the last packets of the flow
+	SrcPort, DstPort          uint16
+	TCPFlags                  uint8 // cumulative OR of the TCP flags
+	Protocol                  uint8
+	ToS                       uint8
+	SrcAS, DstAS              uint16
+	SrcMask, DstMask          uint8 // prefix lengths of the source and destination addresses
+}
+
+// ParseNetflowV5 parses the Netflow v5 packet, e.g. in React on UDP, and fails with ErrInvalidFlowPacket if
+// the packet is not a Netflow v5 packet or is truncated.
+func ParseNetflowV5(packet []byte) (h NetflowV5Header, records []NetflowV5Record, err error) {
+	if len(packet) < netflowV5HeaderSize || FlowVersion(packet) != 5 {
+		return h, nil, ErrInvalidFlowPacket
+	}
+	count := int(binary.BigEndian.Uint16(packet[2:]))
+	if len(packet) < netflowV5HeaderSize+count*netflowV5RecordSize {
+		return h, nil, ErrInvalidFlowPacket
+	}
+	h.SysUptime = binary.BigEndian.Uint32(packet[4:])
+	h.ExportTime = time.Unix(int64(binary.BigEndian.Uint32(packet[8:])), int64(binary.BigEndian.Uint32(packet[12:])))
+	h.Sequence = binary.BigEndian.Uint32(packet[16:])
+	h.EngineType, h.EngineID = packet[20], packet[21]
+	h.SamplingInterval = binary.BigEndian.Uint16(packet[22:])
+	records = make([]NetflowV5Record, count)
+	for i := range records {
+		b := packet[netflowV5HeaderSize+i*netflowV5RecordSize:]
+		records[i] = NetflowV5Record{
+			SrcAddr:  net.IP(b[0:4:4]),
+			DstAddr:  net.IP(b[4:8:8]),
+			NextHop:  net.IP(b[8:12:12]),
+			Input:    binary.BigEndian.Uint16(b[12:]),
+			Output:   binary.BigEndian.Uint16(b[14:]),
+			Packets:  binary.BigEndian.Uint32(b[16:]),
+			Octets:   binary.BigEndian.Uint32(b[20:]),
+			First:    binary.BigEndian.Uint32(b[24:]),
+			Last:     binary.BigEndian.Uint32(b[28:]),
+			SrcPort:  binary.BigEndian.Uint16(b[32:]),
+			DstPort:  binary.BigEndian.Uint16(b[34:]),
+			TCPFlags: b[37],
+			Protocol: b[38],
+			ToS:      b[39],
+			SrcAS:    binary.BigEndian.Uint16(b[40:]),
+			DstAS:    binary.BigEndian.Uint16(b[42:]),
+			SrcMask:  b[44],
+			DstMask:  b[45],
+		}
+	}
+	return h, records, nil
+}
+
+// FlowPacket is a Netflow v9 or IPFIX packet decoded by FlowDecoder.
+type FlowPacket struct {
+	// Version is 9 for Netflow v9 and 10 for IPFIX.
+	Version int
+
+	// ExportTime is the time when the packet is exported.
+	ExportTime time.Time
+
+	// Sequence is the sequence number of the packet, which counts the packets for Netflow v9 and the data records
+	// for IPFIX.
+	Sequence uint32
+
+	// DomainID is the observation domain ID of IPFIX or the source ID of Netflow v9, which scopes the templates
+	// along with the exporter.
+	DomainID uint32
+
+	// Records are the data records of the packet.
+	Records []FlowRecord
+
+	// Skipped is the number of the data sets skipped since their templates have not been received yet, which are
+	// usually sent by the exporters periodically.
+	Skipped int
+}
+
+// FlowRecord is a data record of a Netflow v9 or IPFIX packet, decoded by the template it refers to.
+type FlowRecord struct {
+	// TemplateID is the ID of the template of the record.
+	TemplateID uint16
+
+	// ScopeFields is the number of the scope fields at the start of Fields if the record is an options record,
+	// e.g. the exporting process the options apply to, or 0 otherwise.
+	ScopeFields int
+
+	// Fields are the fields of the record in the order of the template.
+	Fields []FlowField
+}
+
+// FlowField is a field of a flow record, whose value is a slice of the packet.
+type FlowField struct {
+	// Type is the information element ID of the field, e.g. 8 for sourceIPv4Address, see the IANA IPFIX registry.
+	Type uint16
+
+	// EnterpriseID is the private enterprise number of the enterprise-specific information elements of IPFIX,
+	// or 0 for the IANA ones.
+	EnterpriseID uint32
+
+	// Value is the value of the field in network byte order.
+	Value []byte
+}
+
+// Uint returns the value of the field as an unsigned integer, including the values of the reduced-size encoding,
+// or 0 if it is longer than 8 bytes.
+func (f FlowField) Uint() uint64 {
+	if len(f.Value) > 8 {
+		return 0
+	}
+	var v uint64
+	for _, b := range f.Value {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// flowFieldSpec is a field specifier of a template.
+type flowFieldSpec struct {
+	typ          uint16
+	enterpriseID uint32
+	length       int
+	variable     bool // whether the length is carried by the values, IPFIX only
+}
+
+// flowTemplate is a template or an options template.
+type flowTemplate struct {
+	fields      []flowFieldSpec
+	scopeFields int
+	minSize     int // size of a record with the variable-length fields empty
+}
+
+// flowTemplateKey scopes the templates by the exporter and the observation domain.
+type flowTemplateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+// FlowDecoder decodes the Netflow v9 and IPFIX packets, e.g. in React on UDP, keeping the templates of every
+// exporter, since the data records can't be decoded without the templates sent earlier. The templates are kept
+// until they are withdrawn, replaced or forgotten by Forget. The zero value is ready to use, and it is safe for
+// concurrent use, so one decoder can be shared by all the event-loops.
+type FlowDecoder struct {
+	mu        sync.RWMutex
+	templates map[flowTemplateKey]*flowTemplate
+}
+
+// Decode decodes the Netflow v9 or IPFIX packet sent by the exporter, which is usually Conn.RemoteAddr, learning
+// the templates it carries and decoding the data records by the templates learnt so far. It fails with
+// ErrInvalidFlowPacket if the packet is neither Netflow v9 nor IPFIX, or it is malformed, in which case
+// the records decoded before the malformed set are returned along with the error.
+func (d *FlowDecoder) Decode(exporter net.Addr, packet []byte) (p FlowPacket, err error) {
+	p.Version = FlowVersion(packet)
+	var sets []byte
+	switch p.Version {
+	case 9:
+		if len(packet) < netflowV9HeaderSize {
+			return p, ErrInvalidFlowPacket
+		}
+		p.ExportTime = time.Unix(int64(binary.BigEndian.Uint32(packet[8:])), 0)
+		p.Sequence = binary.BigEndian.Uint32(packet[12:])
+		p.DomainID = binary.BigEndian.Uint32(packet[16:])
+		sets = packet[netflowV9HeaderSize:]
+	case 10:
+		if len(packet) < ipfixHeaderSize {
+			return p, ErrInvalidFlowPacket
+		}
+		size := int(binary.BigEndian.Uint16(packet[2:]))
+		if size < ipfixHeaderSize || size > len(packet) {
+			return p, ErrInvalidFlowPacket
+		}
+		p.ExportTime = time.Unix(int64(binary.BigEndian.Uint32(packet[4:])), 0)
+		p.Sequence = binary.BigEndian.Uint32(packet[8:])
+		p.DomainID = binary.BigEndian.Uint32(packet[12:])
+		sets = packet[ipfixHeaderSize:size]
+	default:
+		return p, ErrInvalidFlowPacket
+	}
+
+	key := flowTemplateKey{domain: p.DomainID}
+	if exporter != nil {
+		key.exporter = exporter.String()
+	}
+	ipfix := p.Version == 10
+	for len(sets) >= flowSetHeaderSize {
+		id, size := binary.BigEndian.Uint16(sets), int(binary.BigEndian.Uint16(sets[2:]))
+		if size < flowSetHeaderSize || size > len(sets) {
+			return p, ErrInvalidFlowPacket
+		}
+		body := sets[flowSetHeaderSize:size]
+		sets = sets[size:]
+		switch {
+		case id >= flowMinDataSetID:
+			key.id = id
+			d.mu.RLock()
+			t := d.templates[key]
+			d.mu.RUnlock()
+			if t == nil {
+				p.Skipped++
+				continue
+			}
+			if p.Records, err = t.decode(p.Records, id, body); err != nil {
+				return p, err
+			}
+		case !ipfix && id == netflowV9TemplateSetID, ipfix && id == ipfixTemplateSetID:
+			err = d.learn(key, body, ipfix, false)
+		case !ipfix && id == netflowV9OptionsTemplateSetID, ipfix && id == ipfixOptionsTemplateSetID:
+			err = d.learn(key, body, ipfix, true)
+		}
+		// The other sets are reserved and skipped.
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// Forget drops the templates of the exporter, e.g. once it restarts or goes away, so that the templates of
+// the exporters that are gone don't pile up.
+func (d *FlowDecoder) Forget(exporter net.Addr) {
+	var name string
+	if exporter != nil {
+		name = exporter.String()
+	}
+	d.mu.Lock()
+	for key := range d.templates {
+		if key.exporter == name {
+			delete(d.templates, key)
+		}
+	}
+	d.mu.Unlock()
+}
+
+// learn stores the templates of a template set or an options template set, the templates without any field
+// withdraw the ones with the same IDs.
+func (d *FlowDecoder) learn(key flowTemplateKey, body []byte, ipfix, options bool) error {
+	// The set may be padded up to the next 4-byte boundary.
+	for len(body) >= 4 {
+		var (
+			count, scope int
+			ok           bool
+			t            = new(flowTemplate)
+		)
+		key.id = binary.BigEndian.Uint16(body)
+		switch {
+		case !options:
+			count, body = int(binary.BigEndian.Uint16(body[2:])), body[4:]
+		case ipfix:
+			if len(body) < 6 {
+				return ErrInvalidFlowPacket
+			}
+			count, scope, body = int(binary.BigEndian.Uint16(body[2:])), int(binary.BigEndian.Uint16(body[4:])), body[6:]
+		default:
+			// The scope and the option lengths of Netflow v9 are the sizes of their field specifiers in bytes.
+			if len(body) < 6 {
+				return ErrInvalidFlowPacket
+			}
+			scope = int(binary.BigEndian.Uint16(body[2:])) / 4
+			count, body = scope+int(binary.BigEndian.Uint16(body[4:]))/4, body[6:]
+		}
+		if key.id < flowMinDataSetID || scope > count {
+			return ErrInvalidFlowPacket
+		}
+		if t.fields, body, ok = parseFlowFieldSpecs(body, count, ipfix); !ok {
+			return ErrInvalidFlowPacket
+		}
+		t.scopeFields = scope
+		for _, f := range t.fields {
+			if f.variable {
+				t.minSize++
+			} else {
+				t.minSize += f.length
+			}
+		}
+
+		d.mu.Lock()
+		if d.templates == nil {
+			d.templates = make(map[flowTemplateKey]*flowTemplate)
+		}
+		if count == 0 {
+			delete(d.templates, key)
+		} else {
+			d.templates[key] = t
+		}
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// parseFlowFieldSpecs parses count field specifiers, which carry the enterprise numbers of the enterprise-specific
+// information elements of IPFIX.
+func parseFlowFieldSpecs(b []byte, count int, ipfix bool) (fields []flowFieldSpec, rest []byte, ok bool) {
+	fields = make([]flowFieldSpec, count)
+	for i := range fields {
+		if len(b) < 4 {
+			return nil, b, false
+		}
+		f := &fields[i]
+		f.typ, f.length, b = binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:])), b[4:]
+		if !ipfix {
+			continue
+		}
+		f.variable = f.length == ipfixVariableLength
+		if f.typ&ipfixEnterpriseBit != 0 {
+			if len(b) < 4 {
+				return nil, b, false
+			}
+			f.typ &^= ipfixEnterpriseBit
+			f.enterpriseID, b = binary.BigEndian.Uint32(b), b[4:]
+		}
+	}
+	return fields, b, true
+}
+
+// decode appends the records of the data set to records, the bytes left that are too few for a record are
+// the padding of the set.
+func (t *flowTemplate) decode(records []FlowRecord, id uint16, body []byte) ([]FlowRecord, error) {
+	if t.minSize == 0 {
+		return records, nil
+	}
+	for len(body) >= t.minSize {
+		rec := FlowRecord{TemplateID: id, ScopeFields: t.scopeFields, Fields: make([]FlowField, len(t.fields))}
+		for i, f := range t.fields {
+			n := f.length
+			if f.variable {
+				if len(body) < 1 {
+					return records, ErrInvalidFlowPacket
+				}
+				n, body = int(body[0]), body[1:]
+				if n == ipfixLongLength {
+					if len(body) < 2 {
+						return records, ErrInvalidFlowPacket
+					}
+					n, body = int(binary.BigEndian.Uint16(body)), body[2:]
+				}
+			}
+			if n > len(body) {
+				return records, ErrInvalidFlowPacket
+			}
+			rec.Fields[i] = FlowField{Type: f.typ, EnterpriseID: f.enterpriseID, Value: body[:n:n]}
+			body = body[n:]
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package fsm provides per-connection state machines for implementing the stateful protocols on gnet, e.g. SMTP,
+// the FTP control connection or IMAP, so that every state of the protocol is handled by its own callbacks rather
+// than by a giant switch statement in React.
+//
+// Every connection owns a Session, which is in one of the states of the Machine at any time and is driven by
+// the frames decoded by the codec of the server, the events posted to the connection and the timeouts of the states.
+// The sessions are sharded by the event-loops owning them and are only touched within their own event-loops, just
+// like the connections, so the callbacks don't need any lock.
+//
+// The Machine is plugged into the event handler by forwarding OnOpened, React, OnUserEvent and OnClosed to Open,
+// React, Event and Closed respectively. The timeouts of the states are delivered via gnet.Server.Post, thus they
+// never fire unless the event handler implements gnet.UserEventHandler.
+package fsm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/panjf2000/gnet"
+)
+
+// ErrUnknownState occurs when a state is not defined in the Machine.
+var ErrUnknownState = errors.New("unknown state")
+
+// State is a state of the sessions, all of its callbacks are optional and are invoked within the event-loop owning
+// the connection. The out return values of the callbacks are written to the connection, and a Close or Shutdown
+// action stops the pending transition and is handed over to gnet.
+type State struct {
+	// OnEnter is invoked when a session enters the state, e.g. to write the greeting or the prompt of the state.
+	OnEnter func(s *Session) (out []byte, action gnet.Action)
+
+	// OnFrame is invoked for every frame decoded while the session is in the state, the frames are discarded
+	// if it is nil. The frame is only valid until OnFrame returns, just like the one of React.
+	OnFrame func(s *Session, frame []byte) (out []byte, action gnet.Action)
+
+	// OnEvent is invoked for every event posted to the connection by Conn.WakeWith or gnet.Server.Post while
+	// the session is in the state, the events are discarded if it is nil.
+	OnEvent func(s *Session, ev interface{}) (out []byte, action gnet.Action)
+
+	// Timeout is the maximum duration for which a session may stay in the state without receiving a frame, there is
+	// no timeout if it is not positive.
+	Timeout time.Duration
+
+	// OnTimeout is invoked once Timeout elapses, usually to write an error reply and Goto another state, the
+	// connection is closed if it is nil.
+	OnTimeout func(s *Session) (out []byte, action gnet.Action)
+
+	// OnExit is invoked when a session leaves the state, before the OnEnter of the next state.
+	OnExit func(s *Session)
+}
+
+// Machine defines the states of the sessions and drives the sessions of the connections of a server.
+type Machine struct {
+	svr     gnet.Server
+	codec   gnet.ICodec
+	initial string
+	states  map[string]*State
+	shards  []map[uint64]*Session // sessions owned by every event-loop, connection id -> session
+}
+
+// New instantiates a machine for the given server with the given states, whose sessions start in the initial state,
+// it is usually invoked in OnInitComplete. The out return values of the callbacks are encoded by the given codec,
+// which is usually the one of the server, and written with Conn.Write one by one, so that every one of them is
+// a frame of its own, they are written as-is if the codec is nil. It fails with ErrUnknownState if the initial state is not defined.
+func New(svr gnet.Server, codec gnet.ICodec, initial string, states map[string]*State) (*Machine, error) {
+	if states[initial] == nil {
+		return nil, ErrUnknownState
+	}
+	m := &Machine{
+		svr:     svr,
+		codec:   codec,
+		initial: initial,
+		states:  states,
+		shards:  make([]map[uint64]*Session, svr.NumEventLoop),
+	}
+	for i := range m.shards {
+		m.shards[i] = make(map[uint64]*Session)
+	}
+	return m, nil
+}
+
+// Session is the state machine of a connection.
+type Session struct {
+	// Data is the data of the protocol kept by the session across the states, e.g. the envelope of an SMTP
+	// transaction, it is up to the callbacks of the states.
+	Data interface{}
+
+	m        *Machine
+	c        gnet.Conn
+	name     string
+	state    *State
+	next     string    // state to enter once the callback in progress returns, empty if there is none
+	deadline time.Time // deadline of the timeout of the state, zero if there is none
+	timer    *time.Timer
+}
+
+// timeoutEvent is the event posted to the connection once the timer of its session fires.
+type timeoutEvent struct {
+	s *Session
+}
+
+// Conn returns the connection of the session.
+func (s *Session) Conn() gnet.Conn {
+	return s.c
+}
+
+// State returns the name of the state the session is in.
+func (s *Session) State() string {
+	return s.name
+}
+
+// Goto makes the session enter the given state once the callback in progress returns, the OnExit of the current
+// state and the OnEnter of the next one are invoked then, and the timeout of the next state starts. Entering
+// the current state again restarts it the same way. Only the last Goto of a callback takes effect, and it fails
+// with ErrUnknownState if the state is not defined.
+func (s *Session) Goto(state string) error {
+	if s.m.states[state] == nil {
+		return ErrUnknownState
+	}
+	s.next = state
+	return nil
+}
+
+// Open creates the session of the connection in the initial state with the given data, it must be invoked
+// in OnOpened, which returns the action of the OnEnter of the initial state.
+func (m *Machine) Open(c gnet.Conn, data interface{}) (action gnet.Action) {
+	s := &Session{Data: data, m: m, c: c, next: m.initial}
+	m.shards[m.svr.LoopIndex(c.ID())][c.ID()] = s
+	return s.settle(nil, gnet.None)
+}
+
+// Session returns the session of the connection, nil if it has not been opened.
+// It must be invoked within the event-loop owning the connection.
+func (m *Machine) Session(c gnet.Conn) *Session {
+	return m.shards[m.svr.LoopIndex(c.ID())][c.ID()]
+}
+
+// React hands the frame over to the OnFrame of the state of the session and makes the transition it asks for,
+// it must be invoked in React, which returns its action.
+func (m *Machine) React(frame []byte, c gnet.Conn) (action gnet.Action) {
+	s := m.Session(c)
+	if s == nil || frame == nil {
+		return
+	}
+	if s.state.Timeout > 0 {
+		s.deadline = time.Now().Add(s.state.Timeout)
+	}
+	var out []byte
+	if s.state.OnFrame != nil {
+		out, action = s.state.OnFrame(s, frame)
+	}
+	return s.settle(out, action)
+}
+
+// Event hands the event over to the OnEvent of the state of the session, or fires the timeout of the state,
+// and makes the transition it asks for, it must be invoked in OnUserEvent, which returns its action.
+func (m *Machine) Event(c gnet.Conn, ev interface{}) (action gnet.Action) {
+	s := m.Session(c)
+	if s == nil {
+		return
+	}
+	var out []byte
+	if t, ok := ev.(timeoutEvent); ok {
+		if t.s != s {
+			return
+		}
+		if out, action, ok = s.expire(); !ok {
+			return
+		}
+	} else if s.state.OnEvent != nil {
+		out, action = s.state.OnEvent(s, ev)
+	}
+	return s.settle(out, action)
+}
+
+// Closed discards the session of the connection, it must be invoked in OnClosed.
+func (m *Machine) Closed(c gnet.Conn) {
+	shard := m.shards[m.svr.LoopIndex(c.ID())]
+	if s := shard[c.ID()]; s != nil {
+		delete(shard, c.ID())
+		s.stopTimer()
+		s.state, s.next = nil, ""
+	}
+}
+
+// expire fires the timeout of the state if it has elapsed, otherwise it restarts the timer for the rest of it,
+// since the frames push the deadline back without resetting the timer.
+func (s *Session) expire() (out []byte, action gnet.Action, fired bool) {
+	if s.deadline.IsZero() {
+		return
+	}
+	if rest := time.Until(s.deadline); rest > 0 {
+		s.timer.Reset(rest)
+		return
+	}
+	s.deadline = time.Time{}
+	if s.state.OnTimeout == nil {
+		return nil, gnet.Close, true
+	}
+	out, action = s.state.OnTimeout(s)
+	return out, action, true
+}
+
+// settle writes the out of the callback that has just returned, then makes the transitions asked for by
+// the callbacks until there is none left or an action other than None is taken, writing the out of every OnEnter.
+func (s *Session) settle(out []byte, action gnet.Action) gnet.Action {
+	for {
+		if !s.write(out) {
+			return gnet.Close
+		}
+		if s.next == "" || action != gnet.None {
+			break
+		}
+		name := s.next
+		s.next = ""
+		if s.state != nil && s.state.OnExit != nil {
+			s.state.OnExit(s)
+		}
+		s.name, s.state = name, s.m.states[name]
+		s.startTimer()
+		out = nil
+		if s.state.OnEnter != nil {
+			out, action = s.state.OnEnter(s)
+		}
+	}
+	s.next = ""
+	return action
+}
+
+// write encodes out as a frame of its own and writes it to the connection, it reports whether it succeeds.
+func (s *Session) write(out []byte) bool {
+	if len(out) == 0 {
+		return true
+	}
+	var err error
+	if s.m.codec != nil {
+		if out, err = s.m.codec.Encode(s.c, out); err != nil {
+			return false
+		}
+	}
+	_, err = s.c.Write(out)
+	return err == nil
+}
+
+func (s *Session) startTimer() {
+	timeout := s.state.Timeout
+	if timeout <= 0 {
+		s.deadline = time.Time{}
+		s.stopTimer()
+		return
+	}
+	s.deadline = time.Now().Add(timeout)
+	if s.timer == nil {
+		svr, id, ev := s.m.svr, s.c.ID(), timeoutEvent{s}
+		s.timer = time.AfterFunc(timeout, func() {
+			_ = svr.Post(id, ev)
+		})
+		return
+	}
+	s.timer.Reset(timeout)
+}
+
+func (s *Session) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package fsm
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet"
+)
+
+// loginServer speaks a toy line protocol: the client logs in with "login", then authenticates with any password
+// within the timeout of the auth state, and quits with "quit".
+type loginServer struct {
+	*gnet.EventServer
+	m *Machine
+}
+
+func (ls *loginServer) OnInitComplete(svr gnet.Server) (action gnet.Action) {
+	var err error
+	ls.m, err = New(svr, new(gnet.LineBasedFrameCodec), "idle", map[string]*State{
+		"idle": {
+			OnEnter: func(s *Session) ([]byte, gnet.Action) {
+				return []byte("hello"), gnet.None
+			},
+			OnFrame: func(s *Session, frame []byte) ([]byte, gnet.Action) {
+				if string(frame) != "login" {
+					return []byte("bad command"), gnet.None
+				}
+				_ = s.Goto("auth")
+				return nil, gnet.None
+			},
+		},
+		"auth": {
+			OnEnter: func(s *Session) ([]byte, gnet.Action) {
+				return []byte("password?"), gnet.None
+			},
+			OnFrame: func(s *Session, frame []byte) ([]byte, gnet.Action) {
+				s.Data = string(frame)
+				_ = s.Goto("ready")
+				return []byte("ok"), gnet.None
+			},
+			Timeout: 50 * time.Millisecond,
+			OnTimeout: func(s *Session) ([]byte, gnet.Action) {
+				_ = s.Goto("idle")
+				return []byte("timeout"), gnet.None
+			},
+		},
+		"ready": {
+			OnFrame: func(s *Session, frame []byte) ([]byte, gnet.Action) {
+				if string(frame) == "quit" {
+					return []byte("bye " + s.Data.(string)), gnet.Close
+				}
+				return frame, gnet.None
+			},
+			OnEvent: func(s *Session, ev interface{}) ([]byte, gnet.Action) {
+				return []byte(ev.(string)), gnet.None
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (ls *loginServer) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+	action = ls.m.Open(c, nil)
+	return
+}
+
+func (ls *loginServer) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	action = ls.m.React(frame, c)
+	return
+}
+
+func (ls *loginServer) OnUserEvent(c gnet.Conn, tag interface{}) (action gnet.Action) {
+	return ls.m.Event(c, tag)
+}
+
+func (ls *loginServer) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+	ls.m.Closed(c)
+	return
+}
+
+func TestMachine(t *testing.T) {
+	ls := new(loginServer)
+	s, err := gnet.NewServer(ls, "tcp://127.0.0.1:0", gnet.WithCodec(new(gnet.LineBasedFrameCodec)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.Stop(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err = New(*s, nil, "unknown", nil); err != ErrUnknownState {
+		t.Fatalf("expected ErrUnknownState, got %v", err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	expect := func(line string) {
+		t.Helper()
+		if got, err := r.ReadString('\n'); err != nil || got != line+"\n" {
+			t.Fatalf("expected %q, got %q, %v", line, got, err)
+		}
+	}
+	send := func(line string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect("hello")
+	send("whoami")
+	expect("bad command")
+	// The auth state times out and goes back to the idle state.
+	send("login")
+	expect("password?")
+	expect("timeout")
+	expect("hello")
+	send("login")
+	expect("password?")
+	send("secret")
+	expect("ok")
+
+	var id uint64
+	done := make(chan struct{})
+	_ = s.PostLoop(0, func() {
+		defer close(done)
+		for _, sess := range ls.m.shards[0] {
+			id = sess.Conn().ID()
+			if sess.State() != "ready" {
+				t.Errorf("expected the ready state, got %q", sess.State())
+			}
+		}
+	})
+	<-done
+	if err = s.Post(id, "news"); err != nil {
+		t.Fatal(err)
+	}
+	expect("news")
+	send("echo")
+	expect("echo")
+	send("quit")
+	expect("bye secret")
+	if _, err = r.ReadByte(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
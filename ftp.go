@@ -0,0 +1,215 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultFTPMaxLineLength is the maximum length of a command line including its CRLF if FTPCodec.MaxLineLength
+	// is not set.
+	DefaultFTPMaxLineLength = 4096
+
+	// DefaultPassiveTimeout is the duration for which a passive data listener waits for the data connection if
+	// PassiveData.Timeout is not set.
+	DefaultPassiveTimeout = 30 * time.Second
+)
+
+// FTPCodec encodes/decodes the control connections of FTP on the server side, see RFC 959. It decodes the command
+// lines without their CRLF, use ParseFTPCommand to parse them, and the lines exceeding MaxLineLength are discarded
+// rather than buffered, which are decoded as empty lines, namely invalid commands. Encode appends CRLF to the reply,
+// use AppendFTPReply to build the multiline replies. The data connections are opened by Server.ListenPassive.
+//
+// The commands of FTPS such as AUTH TLS, PBSZ and PROT are parsed like the others, but the TLS of the connections
+// is not provided by gnet.
+type FTPCodec struct {
+	// MaxLineLength is the maximum length of a command line including its CRLF, DefaultFTPMaxLineLength if it is
+	// not set.
+	MaxLineLength int
+}
+
+// ftpState is the state of FTPCodec for a connection.
+type ftpState struct {
+	discarding bool // whether the line being decoded is discarded since it is too long
+}
+
+// Encode ...
+func (cc *FTPCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	return append(buf, '\r', '\n'), nil
+}
+
+// Decode ...
+func (cc *FTPCodec) Decode(c Conn) ([]byte, error) {
+	st, _ := c.CodecContext().(*ftpState)
+	if st == nil {
+		st = new(ftpState)
+		c.SetCodecContext(st)
+	}
+	maxLine := cc.MaxLineLength
+	if maxLine <= 0 {
+		maxLine = DefaultFTPMaxLineLength
+	}
+	line, tooLong, err := decodeTextLine(c, maxLine, &st.discarding)
+	switch {
+	case err != nil:
+		return nil, err
+	case tooLong:
+		return []byte{}, nil
+	}
+	return line, nil
+}
+
+// ParseFTPCommand splits a command line into its verb in upper case, e.g. "RETR", and its argument, e.g. a path,
+// which is the rest of the line after the space following the verb as is, since the spaces may be part of a path.
+// The argument is a slice of the line.
+func ParseFTPCommand(line []byte) (verb string, arg []byte) {
+	line = bytes.TrimRight(line, "\r\n")
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		return strings.ToUpper(string(line[:i])), line[i+1:]
+	}
+	return strings.ToUpper(string(line)), nil
+}
+
+// AppendFTPReply appends to dst the reply with the given code and lines, which continue with the code followed by
+// a hyphen but for the last line, without the CRLF of the last line, which is appended by FTPCodec.Encode, and
+// returns the extended buffer, e.g. for the replies to FEAT listing the features.
+func AppendFTPReply(dst []byte, code int, lines ...string) []byte {
+	return appendTextReply(dst, code, lines)
+}
+
+// AppendFTPPassiveReply appends to dst the 227 reply to PASV announcing the IPv4 address and the port of a passive
+// data listener, e.g. "227 Entering Passive Mode (127,0,0,1,195,80)", and returns the extended buffer. The address
+// is usually the public address of the server rather than the one the listener is bound to, which differ behind NATs.
+// It returns dst as is if ip is not an IPv4 address, in which case EPSV is to be used instead.
+func AppendFTPPassiveReply(dst []byte, ip net.IP, port int) []byte {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return dst
+	}
+	dst = append(dst, "227 Entering Passive Mode ("...)
+	for _, b := range ip4 {
+		dst = strconv.AppendInt(dst, int64(b), 10)
+		dst = append(dst, ',')
+	}
+	dst = strconv.AppendInt(dst, int64(port>>8), 10)
+	dst = append(dst, ',')
+	dst = strconv.AppendInt(dst, int64(port&0xff), 10)
+	return append(dst, ')')
+}
+
+// AppendFTPExtendedPassiveReply appends to dst the 229 reply to EPSV announcing the port of a passive data listener,
+// e.g. "229 Entering Extended Passive Mode (|||50000|)", see RFC 2428, and returns the extended buffer.
+func AppendFTPExtendedPassiveReply(dst []byte, port int) []byte {
+	dst = append(dst, "229 Entering Extended Passive Mode (|||"...)
+	dst = strconv.AppendInt(dst, int64(port), 10)
+	return append(dst, "|)"...)
+}
+
+// PassiveData sets up a passive data listener of Server.ListenPassive.
+type PassiveData struct {
+	// Control is the control connection asking for the data connection, only the peers with the same IP address as
+	// the one of Control may connect to the listener, so that the data connections can't be stolen by third parties.
+	// Any peer may connect if it is nil.
+	Control Conn
+
+	// MinPort and MaxPort are the range of the ports to listen on, e.g. the range forwarded by the firewall,
+	// an ephemeral port is chosen if MaxPort is not set.
+	MinPort, MaxPort int
+
+	// Timeout is the duration for which the listener waits for the data connection, DefaultPassiveTimeout if it is
+	// not set.
+	Timeout time.Duration
+
+	// Codec is the codec of the data connection, the codec of the server is used if it is nil, which is usually not
+	// suitable for the data, e.g. BuiltInFrameCodec passes the data through as is.
+	Codec ICodec
+
+	// Context is the initial context of the data connection, see Conn.Context, e.g. the session of the control
+	// connection, which tells OnOpened that the connection is the data connection of that session.
+	Context interface{}
+}
+
+// ListenPassive opens a listener for one passive data connection of FTP on the host of the server, and returns
+// its address for the reply to PASV or EPSV, see AppendFTPPassiveReply and AppendFTPExtendedPassiveReply. The data
+// connection is accepted outside the event-loops and then served by them like the other connections, but with
+// the address of the listener as its local address and PassiveData.Context as its initial context, while
+// AcceptHandler is not consulted. The listener is closed once the data connection is accepted, PassiveData.Timeout
+// elapses or the server shuts down. It can be invoked from any goroutine, and fails with ErrProtocolNotSupported
+// if the server doesn't serve on TCP, or with ErrNoPassivePort if all the ports in the range are in use.
+func (s Server) ListenPassive(p PassiveData) (addr *net.TCPAddr, err error) {
+	svr := s.svr
+	host, ok := svr.ln.lnaddr.(*net.TCPAddr)
+	if !ok {
+		return nil, ErrProtocolNotSupported
+	}
+	ln, err := listenPassive(host.IP, p.MinPort, p.MaxPort)
+	if err != nil {
+		return nil, err
+	}
+	var peer net.IP
+	if p.Control != nil {
+		peer, _ = addrIPPort(p.Control.RemoteAddr())
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultPassiveTimeout
+	}
+	_ = ln.SetDeadline(time.Now().Add(timeout))
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-svr.shutdown:
+			_ = ln.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(done)
+		defer ln.Close()
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if ip, _ := addrIPPort(nc.RemoteAddr()); peer != nil && !peer.Equal(ip) {
+				_ = nc.Close()
+				continue
+			}
+			if err = svr.adoptConn(nc, p.Codec, p.Context); err != nil {
+				svr.logger.Printf("failed to serve the passive data connection from %v: %v\n", nc.RemoteAddr(), err)
+			}
+			return
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), nil
+}
+
+// listenPassive listens on a port in the range starting from a random one, or on an ephemeral port if the range
+// is not set.
+func listenPassive(ip net.IP, minPort, maxPort int) (*net.TCPListener, error) {
+	if maxPort <= 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+	if minPort <= 0 || minPort > maxPort {
+		minPort = maxPort
+	}
+	n := maxPort - minPort + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := minPort + (start+i)%n
+		if ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port}); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, ErrNoPassivePort
+}
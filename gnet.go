@@ -6,11 +6,14 @@
 package gnet
 
 import (
+	"context"
 	"log"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/gnet/internal/netpoll"
@@ -61,6 +64,10 @@ type Server struct {
 
 	// TCPKeepAlive (SO_KEEPALIVE) socket option.
 	TCPKeepAlive time.Duration
+
+	// Options is the effective configuration of the server, in which the defaults are resolved,
+	// e.g. NumEventLoop, Codec and Logger, print it via Options.String to see how the server is set up.
+	Options Options
 }
 
 // CountConnections counts the number of currently active connections and returns it.
@@ -72,20 +79,88 @@ func (s Server) CountConnections() (count int) {
 	return
 }
 
+// ResizeLoops changes the number of the event-loops that new connections are assigned to, n must be within
+// [1, NumEventLoop], so set up NumEventLoop as the maximum, and it may be invoked in OnInitComplete as well.
+// When the number shrinks, the event-loops beyond it stop receiving new connections and drain: they keep serving
+// their connections until those are closed, and then sit idle without consuming CPU, until the number grows back.
+// It is not supported by the servers with SO_REUSEPORT, on UDP or with MassiveConnections on Unix-like systems,
+// where the kernel distributes the traffic among the event-loops.
+func (s Server) ResizeLoops(n int) error {
+	if !s.svr.loopsResizable() {
+		return ErrResizeNotSupported
+	}
+	if n < 1 || n > s.NumEventLoop {
+		return ErrInvalidLoopCount
+	}
+	s.svr.subLoopGroup.resize(n)
+	return nil
+}
+
+// ActiveLoops returns the number of the event-loops that new connections are assigned to, see ResizeLoops.
+func (s Server) ActiveLoops() int {
+	return s.svr.subLoopGroup.active()
+}
+
+// PollOnce drives a server running in test mode, it waits for events for at most the given timeout, a negative
+// timeout means waiting indefinitely, and then handles all the ready events in the calling goroutine, after that,
+// it fires Tick once if the ticker is set up, the delay returned by Tick is ignored in test mode.
+// When an event handler or Tick returns Shutdown, all connections are closed along with the listener and
+// ErrServerShutdown is returned, so is it by every further call.
+func (s Server) PollOnce(timeout time.Duration) error {
+	if !s.svr.opts.TestMode {
+		return ErrNotInTestMode
+	}
+	return s.svr.pollOnce(timeout)
+}
+
+// testLoop returns the only event-loop of a server running in test mode.
+func (svr *server) testLoop() (el *eventloop) {
+	svr.subLoopGroup.iterate(func(i int, loop *eventloop) bool {
+		el = loop
+		return false
+	})
+	return
+}
+
 // Conn is a interface of gnet connection.
 type Conn interface {
+	// ID returns the identifier of the connection, which is unique within the server and never reused,
+	// it can be used for addressing the connection via Server.Post, Server.AsyncWriteTo and Server.WakeConn from any
+	// goroutine. It is zero for UDP.
+	ID() (id uint64)
+
 	// Context returns a user-defined context.
 	Context() (ctx interface{})
 
 	// SetContext sets a user-defined context.
 	SetContext(ctx interface{})
 
-	// LocalAddr is the connection's local socket address.
+	// CodecContext returns the context of the codec, which is kept apart from the user-defined context, so that
+	// stateful codecs keep their per-connection state, e.g. the state of a decompressor or the negotiated version of
+	// the protocol, without colliding with the application. The application may also pass decode hints through it,
+	// e.g. the type of the next frame, as agreed upon with the codec. It is cleared once the connection is closed.
+	CodecContext() (ctx interface{})
+
+	// SetCodecContext sets the context of the codec, see CodecContext. Like CodecContext, it must be invoked within
+	// the event-loop goroutine, note that Encode invoked by AsyncWrite runs in the calling goroutine instead.
+	SetCodecContext(ctx interface{})
+
+	// LocalAddr is the connection's local socket address. Its Network reports "udp" for the datagrams, which tells
+	// them apart from the TCP connections on a "tcp+udp" server.
 	LocalAddr() (addr net.Addr)
 
 	// RemoteAddr is the connection's remote peer address.
 	RemoteAddr() (addr net.Addr)
 
+	// RemoteIP returns the IP address of the remote peer without allocating, unlike formatting RemoteAddr, e.g. for
+	// keying the per-client state, it is nil for the connections other than TCP and UDP, e.g. Unix domain sockets.
+	// The returned IP is shared by the connection and must not be modified.
+	RemoteIP() (ip net.IP)
+
+	// RemotePort returns the port of the remote peer without allocating, it is zero for the connections other than
+	// TCP and UDP.
+	RemotePort() (port int)
+
 	// Read reads all data from inbound ring-buffer and event-loop-buffer without moving "read" pointer, which means
 	// it does not evict the data from buffers actually and those data will present in buffers until the
 	// ResetBuffer method is invoked.
@@ -108,21 +183,125 @@ type Conn interface {
 	// BufferLength returns the length of available data in the inbound ring-buffer.
 	BufferLength() (size int)
 
+	// InboundBuffered returns the number of bytes read from the connection but not consumed yet, namely the data
+	// in the inbound buffers, which is the incomplete frame left over by the codec when it is invoked in React, and
+	// the data read into the buffer provided by ReadBufferProvider but not filled up yet. It is zero for UDP.
+	InboundBuffered() (size int)
+
+	// OutboundBuffered returns the number of bytes written to the connection but not flushed to the socket yet,
+	// namely the data in the outbound buffer and the data of AsyncWrite merged by write coalescing, which is what
+	// the peer hasn't caught up with. It must be invoked within the event-loop goroutine, and it is zero for UDP.
+	// There is no outbound buffer on Windows, where the writes are synchronous.
+	OutboundBuffered() (size int)
+
+	// TCPInfo samples the state of the path of the TCP connection from the kernel, such as the round-trip time,
+	// the retransmits, the congestion window and the delivery rate, e.g. for adapting the sending to the quality of
+	// the path. It must be invoked within the event-loop goroutine, and it fails with ErrProtocolNotSupported
+	// on the platforms other than Linux and for the connections other than TCP.
+	TCPInfo() (info TCPInfo, err error)
+
+	// Peek returns the next n bytes of inbound data without advancing the "read" pointer, if n <= 0, it returns all
+	// the available data. If there are fewer than n bytes available, Peek returns io.ErrShortBuffer along with nil.
+	// The returned bytes are only valid until the next call of Peek, Next, ReadN, ShiftN or ResetBuffer.
+	Peek(n int) (buf []byte, err error)
+
+	// Next returns the next n bytes of inbound data and advances the "read" pointer, if n <= 0, it returns all
+	// the available data. If there are fewer than n bytes available, Next returns io.ErrShortBuffer along with nil
+	// and consumes nothing. The returned bytes stay valid until the current event callback returns.
+	Next(n int) (buf []byte, err error)
+
+	// Cursor returns a cursor reading the inbound data in place without copying it into a contiguous buffer,
+	// for decoding binary protocols in ICodec.Decode, see Cursor. It must be invoked within the event-loop goroutine.
+	Cursor() (cur Cursor)
+
+	// Write writes data to the connection synchronously, it must be invoked within the event-loop goroutine, namely
+	// inside the event callbacks, use AsyncWrite instead when writing from other goroutines.
+	// Unlike AsyncWrite, the data is written as-is without being encoded by the codec.
+	Write(buf []byte) (n int, err error)
+
 	// InboundBuffer returns the inbound ring-buffer.
 	//InboundBuffer() *ringbuffer.RingBuffer
 
 	// SendTo writes data for UDP sockets, it allows you to send data back to UDP socket in individual goroutines.
 	SendTo(buf []byte) error
 
+	// OriginalDst returns the original destination of the UDP packet redirected to the transparent proxy by TPROXY,
+	// see WithTransparent, it returns nil if the packet isn't redirected or transparent proxying is disabled.
+	OriginalDst() (addr net.Addr)
+
+	// AddWriteFilter appends the filter to the chain of write filters of the connection, through which all the data
+	// written to the connection passes in the order of the filters, except for the data of SendFD. It must be
+	// invoked within the event-loop goroutine, e.g. in OnOpened to filter the out return value as well.
+	AddWriteFilter(f WriteFilter)
+
+	// SendFD passes the file descriptor fd to the peer of a Unix domain socket connection via SCM_RIGHTS along
+	// with data, which must not be empty and is written as-is. It must be invoked within the event-loop goroutine,
+	// and fails with ErrOutboundPending if the data written before hasn't been flushed to the socket yet, in which
+	// case it should be retried later, e.g. upon a Wake. The kernel duplicates fd, so it can be closed afterwards.
+	// Use FileDescriptorHandler to receive the passed file descriptors.
+	SendFD(fd int, data []byte) error
+
 	// AsyncWrite writes data to client/connection asynchronously, usually you would invoke it in individual goroutines
-	// instead of the event-loop goroutines.
+	// instead of the event-loop goroutines. It fails with ErrConnClosed if the connection has been closed.
 	AsyncWrite(buf []byte) error
 
-	// Wake triggers a React event for this connection.
+	// Wake triggers a React event for this connection, the Wake calls made before the React event fires
+	// are coalesced into one.
 	Wake() error
 
+	// WakeWith triggers an OnUserEvent event carrying the given tag for this connection, which tells the event
+	// handler why it is woken up, unlike Wake, every WakeWith call fires its own event. If the event handler doesn't
+	// implement UserEventHandler, a React event with nil frame fires instead, just like Wake.
+	WakeWith(tag interface{}) error
+
 	// Close closes the current connection.
 	Close() error
+
+	// Retain retains a reference to the connection for using it outside the event-loop after the event callback
+	// returns, e.g. within a worker goroutine handling a request, it fails with ErrConnClosed if the connection
+	// has been closed. The context and the addresses of a retained connection stay valid until the last reference
+	// is released, even after the connection is closed, while AsyncWrite, Wake, WakeWith and Close fail with
+	// ErrConnClosed once it is closed, rather than acting on its file descriptor, which may have been reused by
+	// another connection. Every successful Retain must be paired with a Release.
+	Retain() error
+
+	// Release releases a reference retained by Retain.
+	Release()
+
+	// Gone returns a channel that is closed once the connection has been closed, right after OnClosed returns,
+	// so that the goroutines serving the connection outside the event-loop, e.g. the ones bridging it to another
+	// stream, can select on it rather than being notified by OnClosed. It can be invoked from any goroutine, and
+	// returns a closed channel if the connection has been closed already. The channel of a UDP datagram is never
+	// closed, as there is no connection to close.
+	Gone() <-chan struct{}
+
+	// PauseRead stops reading from the connection until ResumeRead, so that the peer is pushed back by the flow
+	// control of TCP rather than having its frames buffered, e.g. while the side effect of the last frame, such as
+	// a database write, is being completed. No more frames are decoded once it returns, but for the rest of the batch
+	// being handed over to ReactBatch, and the data read already stays in the inbound buffer. It is independent of
+	// the pauses made by gnet itself, e.g. by OutboundBlockReads, and can be invoked from any goroutine. It fails with
+	// ErrConnClosed if the connection has been closed, or with ErrProtocolNotSupported for a UDP datagram.
+	PauseRead() error
+
+	// ResumeRead resumes reading from the connection paused by PauseRead, the frames left in the inbound buffer are
+	// decoded first. It can be invoked from any goroutine.
+	ResumeRead() error
+
+	// SetLabel tags the connection with a label, replacing the former value of the key, the traffic and the number
+	// of the connections are aggregated by the labels in Server.LabelStats, e.g. by tenant. The number of the distinct
+	// labels is bounded by Options.MaxLabelValues, the ones beyond it are aggregated under LabelOverflow, so the labels
+	// are meant to be dimensions rather than identifiers. It must be invoked within the event-loop, and is a no-op for
+	// a UDP datagram.
+	SetLabel(key, value string)
+
+	// Label returns the value of the label of the connection set via SetLabel, or an empty string if it is not set.
+	// It must be invoked within the event-loop.
+	Label(key string) string
+
+	// Enrichment returns the result of the Enricher for the connection along with its error, which is
+	// context.DeadlineExceeded if the Enricher didn't return within EnrichmentTimeout, see WithEnrichment. Both are nil
+	// if enrichment is disabled, and for UDP.
+	Enrichment() (result interface{}, err error)
 }
 
 type (
@@ -157,6 +336,199 @@ type (
 		Tick() (delay time.Duration, action Action)
 	}
 
+	// TrafficHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnTraffic is invoked instead of React every time new data arrives at a stream connection (TCP or Unix),
+	// and the inbound data is never decoded by the codec, the handler pulls whatever it needs via c.Peek, c.Next
+	// or c.Read and writes responses via c.Write, so there is no frame slice with an ambiguous lifetime.
+	// The remaining unconsumed data is kept in the inbound buffer until the next OnTraffic.
+	// UDP datagrams are still delivered to React.
+	TrafficHandler interface {
+		// OnTraffic fires when a stream connection has new inbound data.
+		OnTraffic(c Conn) (action Action)
+	}
+
+	// BatchHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// ReactBatch is invoked instead of React with all the frames decoded from the inbound data of a stream
+	// connection at once, which lets the handlers of pipelined protocols like Redis amortize locking and
+	// write coalescing across the frames. UDP datagrams and wakes are still delivered to React, and OnTraffic
+	// takes precedence if the event handler is a TrafficHandler as well.
+	BatchHandler interface {
+		// ReactBatch fires when frames are decoded from the inbound data of a stream connection, in the order of
+		// arrival. The frames stay valid until ReactBatch returns unless the frame ownership is transferred, see
+		// WithFrameOwnershipTransfer. Use the out return value to write the data encoded by the codec to the
+		// connection, which usually carries the responses to all the frames.
+		ReactBatch(frames [][]byte, c Conn) (out []byte, action Action)
+	}
+
+	// UserEventHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnUserEvent is invoked for every Conn.WakeWith call, so that signals sent from other goroutines to
+	// a connection carry their meaning instead of being an ambiguous React with nil frame.
+	UserEventHandler interface {
+		// OnUserEvent fires within the event-loop of the connection when Conn.WakeWith is invoked,
+		// the tag parameter is the one passed to WakeWith. Use c.Write to write data to the connection.
+		OnUserEvent(c Conn, tag interface{}) (action Action)
+	}
+
+	// FileDescriptorHandler is an optional interface which can be implemented by EventHandler, when it is
+	// implemented, the file descriptors passed via SCM_RIGHTS to Unix domain socket connections are received
+	// and handed over to OnFileDescriptors, which enables control-plane daemons passing sockets or files between
+	// processes. Otherwise the passed file descriptors are discarded. It is not supported on Windows.
+	FileDescriptorHandler interface {
+		// OnFileDescriptors fires when file descriptors arrive at a connection, before the data carrying them is
+		// handled, the received file descriptors are close-on-exec and owned by the handler which must close them.
+		OnFileDescriptors(c Conn, fds []int) (action Action)
+	}
+
+	// AcceptHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnAccepted is invoked for every accepted connection before any resource is allocated for it and before it is
+	// registered to an event-loop, so that filtered connections are rejected without wasting the setup work.
+	AcceptHandler interface {
+		// OnAccepted fires right after a connection is accepted, fd is its file descriptor (-1 on Windows),
+		// local and remote are its addresses. It returns the per-connection overrides of the server-wide options,
+		// and Close to reject the connection or Shutdown to shut the server down. It is invoked within the
+		// goroutine accepting connections, which is the main reactor rather than an event-loop unless
+		// the server runs with SO_REUSEPORT.
+		OnAccepted(fd int, local, remote net.Addr) (opts ConnOpts, action Action)
+	}
+
+	// OverloadHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnOverload is invoked whenever the server enters or leaves the shed mode of accept overload protection.
+	OverloadHandler interface {
+		// OnOverload fires with overloaded being true when the server enters shed mode, and with it being false
+		// when the server leaves shed mode, within the goroutine accepting connections. Return Shutdown to shut
+		// the server down.
+		OnOverload(overloaded bool) (action Action)
+	}
+
+	// OutboundFullHandler is an optional interface which can be implemented by EventHandler, it must be implemented
+	// for OutboundCallback, see WithOutboundLimit.
+	OutboundFullHandler interface {
+		// OnOutboundFull fires within the event-loop of the connection when its outbound buffer exceeds the outbound
+		// limit, buffered is the number of bytes in the outbound buffer. Return Close to close the connection with
+		// ErrOutboundFull, or None to keep it, e.g. after stopping producing data for it until it catches up.
+		OnOutboundFull(c Conn, buffered int) (action Action)
+	}
+
+	// WriteStallHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnWriteStall is invoked when the outbound data of a connection stalls, instead of closing the connection right
+	// away, see WithWriteStallTimeout.
+	WriteStallHandler interface {
+		// OnWriteStall fires within the event-loop of the connection once the oldest byte in its outbound buffer has
+		// been waiting for longer than WriteStallTimeout, stalled is for how long it has been waiting, and buffered
+		// is the number of bytes in the outbound buffer. Return Close to close the connection with ErrWriteStall,
+		// or None to keep it, in which case OnWriteStall fires again after another WriteStallTimeout unless
+		// the peer reads the outbound data meanwhile.
+		OnWriteStall(c Conn, stalled time.Duration, buffered int) (action Action)
+	}
+
+	// HandshakeHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// every stream connection starts in the handshake phase, in which the decoded frames are handed over to
+	// OnHandshake rather than React, e.g. to validate a token, a magic number or a protocol version before
+	// the connection is served. The handshake must be accepted within HandshakeTimeout if it is set, otherwise
+	// the connection is closed with ErrHandshakeTimeout.
+	HandshakeHandler interface {
+		// OnHandshake fires within the event-loop of the connection for every frame decoded during the handshake
+		// phase. Return ok to accept the handshake, the frames following it are handed over to React, or not ok
+		// to wait for more frames, out is written to the connection either way. Return Close to reject the
+		// handshake. The frame is only valid within OnHandshake.
+		OnHandshake(c Conn, frame []byte) (ok bool, out []byte, action Action)
+	}
+
+	// UrgentDataHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnUrgentData is invoked for the TCP urgent data (MSG_OOB) received by the stream connections, e.g. the Telnet
+	// interrupts sent along with the Data Mark. It is only supported on Linux, the urgent data is discarded
+	// elsewhere.
+	UrgentDataHandler interface {
+		// OnUrgentData fires within the event-loop of the connection with the byte of urgent data received, ahead of
+		// the inbound data received along with it, which may have been sent before it. out is written to
+		// the connection. Return Close to close the connection, e.g. to abort the session.
+		OnUrgentData(c Conn, b byte) (out []byte, action Action)
+	}
+
+	// TruncatedDatagramHandler is an optional interface which can be implemented by EventHandler, when it is
+	// implemented, OnTruncatedDatagram is invoked for the datagrams exceeding UDPReadBufferSize instead of logging
+	// them. Such datagrams are dropped rather than handed over to React, see Server.TruncatedDatagrams.
+	TruncatedDatagramHandler interface {
+		// OnTruncatedDatagram fires within the event-loop with the head of a datagram which didn't fit the read
+		// buffer, truncated to UDPReadBufferSize, it is only valid within OnTruncatedDatagram. c is the UDP
+		// connection of the sender, e.g. to reply with an error via SendTo, but for Windows, which doesn't tell
+		// the sender of such datagrams, thus c.RemoteAddr is nil. Return Shutdown to shut down the server.
+		OnTruncatedDatagram(c Conn, head []byte) (action Action)
+	}
+
+	// DecodeErrorHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnDecodeError is invoked when the inbound data of a connection fails to be decoded, instead of closing
+	// the connection right away, which is what happens to the connections of the other event handlers.
+	DecodeErrorHandler interface {
+		// OnDecodeError fires within the event-loop of the connection with the decoding error, which is either
+		// the error returned by Decode of the codec, but for ErrUnexpectedEOF, ErrCRLFNotFound and
+		// ErrDelimiterNotFound, which tell that the frame is incomplete rather than malformed, or
+		// ErrPartialFrameTimeout when a frame stays incomplete for longer than PartialFrameTimeout. Return Close to
+		// close the connection with the error, or None to keep it, e.g. after discarding the malformed or incomplete
+		// frame via c.ResetBuffer, in which case the timeout starts over if there is still an incomplete frame.
+		OnDecodeError(c Conn, err error) (action Action)
+	}
+
+	// ReloadHandler is an optional interface which can be implemented by EventHandler, it must be implemented
+	// for WithReloadSignals.
+	ReloadHandler interface {
+		// OnReload fires within a goroutine of its own, rather than an event-loop, upon any of the signals set
+		// up by WithReloadSignals, sig is the received signal, e.g. for reloading the configuration of the service.
+		OnReload(server Server, sig os.Signal)
+	}
+
+	// ShutdownHandler is an optional interface which can be implemented by EventHandler, see OnShutdown.
+	ShutdownHandler interface {
+		// OnShutdown fires once the server has been shut down, which stops accepting connections, then stops
+		// reading from the connections, then flushes their outbound data within ShutdownFlushTimeout unless
+		// SkipShutdownFlush is set, then closes them, firing OnClosed for every connection. OnShutdown is the last
+		// event of the server, it fires after all the OnClosed events and after the event-loops exit.
+		OnShutdown()
+	}
+
+	// SlowReactHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnSlowReact is invoked for the slow React invocations instead of logging them, see WithSlowReact.
+	SlowReactHandler interface {
+		// OnSlowReact fires within the event-loop of c right after an invocation of React, ReactBatch or OnTraffic
+		// on c took d, which is longer than SlowReactThreshold, stack is the stack of the event-loop captured while
+		// the invocation was running if SlowReactStack is set, it may be nil if the invocation returned before
+		// the sampler got to it.
+		OnSlowReact(c Conn, d time.Duration, stack []byte)
+	}
+
+	// WatchdogHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnLoopBlocked is invoked for the blocked event-loops instead of logging them, see WithWatchdog.
+	WatchdogHandler interface {
+		// OnLoopBlocked fires within the watchdog goroutine, rather than an event-loop, when an event-loop hasn't
+		// responded to the watchdog within WatchdogTimeout. It must not touch the connections of the event-loop.
+		OnLoopBlocked(report BlockedLoop)
+	}
+
+	// LoopOverloadHandler is an optional interface which can be implemented by EventHandler, when it is implemented,
+	// OnLoopOverload is invoked for the overloaded event-loops instead of logging them, see WithLoopOverload.
+	LoopOverloadHandler interface {
+		// OnLoopOverload fires within the sampling goroutine, rather than an event-loop, every second for as long as
+		// the utilization of the event-loop reaches LoopOverloadThreshold. It must not touch the connections of
+		// the event-loop.
+		OnLoopOverload(loop int, utilization float64)
+	}
+
+	// ConnOpts holds the per-connection overrides returned by AcceptHandler.OnAccepted,
+	// the zero value of every field keeps the server-wide setting.
+	ConnOpts struct {
+		// Codec overrides the codec of the connection.
+		Codec ICodec
+
+		// TCPNoDelay enables TCP_NODELAY on the connection.
+		TCPNoDelay bool
+
+		// SocketRecvBuffer sets SO_RCVBUF of the connection.
+		SocketRecvBuffer int
+
+		// SocketSendBuffer sets SO_SNDBUF of the connection.
+		SocketSendBuffer int
+	}
+
 	// EventServer is a built-in implementation of EventHandler which sets up each method with a default implementation,
 	// you can compose it with your own implementation of EventHandler when you don't want to implement all methods
 	// in EventHandler.
@@ -212,39 +584,160 @@ func (es *EventServer) Tick() (delay time.Duration, action Action) {
 //  udp   - bind to both IPv4 and IPv6
 //  udp4  - IPv4
 //  udp6  - IPv6
+//  tcp+udp - both TCP and UDP on the same port, e.g. for DNS, see Conn.LocalAddr
 //  unix  - Unix Domain Socket
+//  memory - In-memory transport, connect to it via DialMemory
 //
 // The "tcp" network scheme is assumed when one is not specified.
+//
+// Serve blocks until the server is shut down, it is equivalent to NewServer followed by Server.Start and
+// Server.Wait, which give control over the lifecycle of the server along with Server.Stop.
+// In test mode, Serve returns right after the server is initialized, see WithTestMode and Server.PollOnce.
 func Serve(eventHandler EventHandler, addr string, opts ...Option) error {
-	var ln listener
-	defer func() {
-		ln.close()
-		if ln.network == "unix" {
-			sniffErrorAndLog(os.RemoveAll(ln.addr))
-		}
-	}()
+	s, err := NewServer(eventHandler, addr, opts...)
+	if err != nil {
+		return err
+	}
+	if err = s.Start(); err != nil || s.svr.opts.TestMode {
+		return err
+	}
+	s.Wait()
+	return nil
+}
 
+// NewServer validates the options and binds the listener of the given address without starting to serve on it,
+// the address is formatted as the one passed to Serve. The bound address is available via Server.Addr, which
+// tells the actual port when serving on port 0, e.g. "tcp://127.0.0.1:0", and the server starts via Server.Start.
+func NewServer(eventHandler EventHandler, addr string, opts ...Option) (s *Server, err error) {
 	options := loadOptions(opts...)
+	network, address := parseAddr(addr)
+	if err = options.validate(network, eventHandler); err != nil {
+		return
+	}
 
 	if options.Logger != nil {
 		defaultLogger = options.Logger
 	}
+	if options.AutoAdjustNOFILE {
+		raiseNOFILE(defaultLogger)
+	}
+
+	var ln *listener
+	if network == "tcp+udp" {
+		ln, err = listenTCPAndUDP(address, options)
+	} else {
+		ln, err = listen(network, address, options)
+	}
+	if err != nil {
+		return
+	}
+
+	// Figure out the correct number of loops/goroutines to use.
+	numEventLoop := 1
+	if options.Multicore {
+		numEventLoop = runtime.NumCPU()
+	}
+	if options.NumEventLoop > 0 {
+		numEventLoop = options.NumEventLoop
+	}
+	if options.TestMode {
+		numEventLoop = 1
+	}
+
+	svr := newServer(eventHandler, ln, options)
+	s = &Server{
+		svr:          svr,
+		Multicore:    options.Multicore,
+		Addr:         ln.lnaddr,
+		NumEventLoop: numEventLoop,
+		ReusePort:    options.ReusePort,
+		TCPKeepAlive: options.TCPKeepAlive,
+		Options:      svr.effectiveOptions(numEventLoop),
+	}
+	return
+}
+
+// Start fires OnInitComplete and starts the event-loops of a server created by NewServer, it returns once
+// the server is serving, while the event-loops keep running in the background until the server is shut down,
+// either by an event handler returning Shutdown or by Stop. The listener is closed if the server fails to start
+// or OnInitComplete returns Shutdown. In test mode, the server is driven by PollOnce after Start returns.
+func (s Server) Start() error {
+	if !atomic.CompareAndSwapInt32(&s.svr.started, 0, 1) {
+		return ErrServerStarted
+	}
+	return s.svr.serve(s)
+}
+
+// Stop shuts the server down as if an event handler returned Shutdown and waits until all the event-loops exit
+// and all the connections are closed, or until ctx is done, in which case the shutdown keeps going in the
+// background and the error of ctx is returned. A server that hasn't been started is closed right away.
+// It must not be invoked within the event callbacks, which return Shutdown instead. In test mode, it must be
+// invoked within the goroutine driving PollOnce, and it closes everything right away.
+func (s Server) Stop(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&s.svr.started, 0, 1) {
+		s.svr.ln.close()
+		close(s.svr.done)
+		return nil
+	}
+	if s.svr.opts.TestMode {
+		if !s.svr.stopped && s.svr.testLoop() != nil {
+			s.svr.stopTestLoop()
+		}
+		return nil
+	}
+	s.svr.requestShutdown()
+	select {
+	case <-s.svr.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until the server has been stopped, it returns right away if the server fails to start.
+func (s Server) Wait() {
+	<-s.svr.done
+}
+
+// addrIPPort returns the IP address and the port of a TCP or UDP address.
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	}
+	return nil, 0
+}
+
+// listen creates the listener of a server on the network.
+func listen(network, addr string, options *Options) (ln *listener, err error) {
+	ln = &listener{network: network, addr: addr}
+	defer func() {
+		if err != nil {
+			ln.close()
+			ln = nil
+		}
+	}()
 
-	ln.network, ln.addr = parseAddr(addr)
 	if ln.network == "unix" {
 		sniffErrorAndLog(os.RemoveAll(ln.addr))
 		if runtime.GOOS == "windows" {
-			return ErrProtocolNotSupported
+			return nil, ErrProtocolNotSupported
 		}
 	}
-	var err error
-	if ln.network == "udp" {
+	switch t := lookupTransport(ln.network); {
+	case t != nil:
+		err = ln.listenTransport(t)
+	case ln.network == "memory":
+		ln.lnaddr = memoryAddr(ln.addr)
+	case ln.network == "udp":
 		if options.ReusePort && runtime.GOOS != "windows" {
 			ln.pconn, err = netpoll.ReusePortListenPacket(ln.network, ln.addr)
 		} else {
 			ln.pconn, err = net.ListenPacket(ln.network, ln.addr)
 		}
-	} else {
+	default:
 		if options.ReusePort && runtime.GOOS != "windows" {
 			ln.ln, err = netpoll.ReusePortListen(ln.network, ln.addr)
 		} else {
@@ -252,17 +745,49 @@ func Serve(eventHandler EventHandler, addr string, opts ...Option) error {
 		}
 	}
 	if err != nil {
-		return err
+		return
 	}
-	if ln.pconn != nil {
+	switch {
+	case ln.pconn != nil:
 		ln.lnaddr = ln.pconn.LocalAddr()
-	} else {
+	case ln.ln != nil:
 		ln.lnaddr = ln.ln.Addr()
 	}
-	if err := ln.system(); err != nil {
-		return err
+	if err = ln.system(); err != nil {
+		return
+	}
+	err = ln.setSockopts(options)
+	return
+}
+
+// listenTCPAndUDP creates the listeners of a server on the "tcp+udp" network, namely a TCP listener on addr along with
+// a UDP listener on the same host and port, which is the port picked for the TCP listener if the one of addr is zero.
+func listenTCPAndUDP(addr string, options *Options) (*listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listen("tcp", addr, options)
+	if err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(ln.lnaddr.(*net.TCPAddr).Port)
+	if ln.udp, err = listen("udp", net.JoinHostPort(host, port), options); err != nil {
+		ln.close()
+		return nil, err
 	}
-	return serve(eventHandler, &ln, options)
+	return ln, nil
+}
+
+// packetListener returns the listener reading the datagrams of a server, nil if the server doesn't listen on UDP.
+func (ln *listener) packetListener() *listener {
+	if ln.udp != nil {
+		return ln.udp
+	}
+	if ln.pconn != nil {
+		return ln
+	}
+	return nil
 }
 
 func parseAddr(addr string) (network, address string) {
@@ -276,6 +801,17 @@ func parseAddr(addr string) (network, address string) {
 	return
 }
 
+// ownFrame returns a copy of frame that is owned by the caller if the frame ownership transfer is enabled,
+// otherwise the original frame.
+func ownFrame(opts *Options, frame []byte) []byte {
+	if !opts.FrameOwnershipTransfer || frame == nil {
+		return frame
+	}
+	owned := make([]byte, len(frame))
+	copy(owned, frame)
+	return owned
+}
+
 func sniffErrorAndLog(err error) {
 	if err != nil {
 		defaultLogger.Printf(err.Error())
@@ -7,14 +7,22 @@ package gnet
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -341,6 +349,22 @@ func TestServe(t *testing.T) {
 				testServe("unix", "gnet2.sock", false, true, true, 10, SourceAddrHash)
 			})
 		})
+		t.Run("memory", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("memory", "gnet1", false, false, false, 10, RoundRobin)
+			})
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("memory", "gnet2", false, true, false, 10, LeastConnections)
+			})
+		})
+		t.Run("memory-async", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("memory", "gnet1", false, false, true, 10, RoundRobin)
+			})
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("memory", "gnet2", false, true, true, 10, SourceAddrHash)
+			})
+		})
 	})
 
 	t.Run("poll-reuseport", func(t *testing.T) {
@@ -376,22 +400,30 @@ func TestServe(t *testing.T) {
 				testServe("udp", ":9992", true, true, true, 10, LeastConnections)
 			})
 		})
+		// SO_REUSEPORT doesn't apply to Unix domain sockets, the cases are kept running without it for
+		// the coverage of LeastConnections.
 		t.Run("unix", func(t *testing.T) {
 			t.Run("1-loop", func(t *testing.T) {
-				testServe("unix", "gnet1.sock", true, false, false, 10, RoundRobin)
+				testServe("unix", "gnet1.sock", false, false, false, 10, RoundRobin)
 			})
 			t.Run("N-loop", func(t *testing.T) {
-				testServe("unix", "gnet2.sock", true, true, false, 10, LeastConnections)
+				testServe("unix", "gnet2.sock", false, true, false, 10, LeastConnections)
 			})
 		})
 		t.Run("unix-async", func(t *testing.T) {
 			t.Run("1-loop", func(t *testing.T) {
-				testServe("unix", "gnet1.sock", true, false, true, 10, RoundRobin)
+				testServe("unix", "gnet1.sock", false, false, true, 10, RoundRobin)
 			})
 			t.Run("N-loop", func(t *testing.T) {
-				testServe("unix", "gnet2.sock", true, true, true, 10, LeastConnections)
+				testServe("unix", "gnet2.sock", false, true, true, 10, LeastConnections)
 			})
 		})
+		t.Run("unix-options-error", func(t *testing.T) {
+			err := Serve(new(testServer), "unix://gnet1.sock", WithReusePort(true))
+			if oe, ok := err.(*OptionsError); !ok || oe.Option != "ReusePort" {
+				t.Fatalf("expected an OptionsError of ReusePort, got %v", err)
+			}
+		})
 	})
 }
 
@@ -450,7 +482,7 @@ func (s *testServer) OnClosed(c Conn, err error) (action Action) {
 }
 func (s *testServer) React(frame []byte, c Conn) (out []byte, action Action) {
 	if s.async {
-		if s.network == "tcp" || s.network == "unix" {
+		if s.network == "tcp" || s.network == "unix" || s.network == "memory" {
 			_ = c.BufferLength()
 			buf := bytebuffer.Get()
 			_, _ = buf.Write(frame)
@@ -509,7 +541,15 @@ func testServe(network, addr string, reuseport, multicore, async bool, nclients
 
 func startClient(network, addr string, multicore, async bool) {
 	rand.Seed(time.Now().UnixNano())
-	c, err := net.Dial(network, addr)
+	var (
+		c   net.Conn
+		err error
+	)
+	if network == "memory" {
+		c, err = DialMemory(addr)
+	} else {
+		c, err = net.Dial(network, addr)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -530,7 +570,7 @@ func startClient(network, addr string, multicore, async bool) {
 		//sz := rand.Intn(10) * (1024 * 1024)
 		sz := 1024 * 1024
 		data := make([]byte, sz)
-		if network == "udp" || network == "unix" {
+		if network == "udp" || network == "unix" || network == "memory" {
 			n := 1024
 			data = data[:n]
 		}
@@ -981,3 +1021,3244 @@ func testCloseConnection(network, addr string) {
 	events := &testCloseConnectionServer{network: network, addr: addr}
 	must(Serve(events, network+"://"+addr, WithTicker(true)))
 }
+
+func TestTraffic(t *testing.T) {
+	testTraffic("tcp", ":9991")
+}
+
+type testTrafficServer struct {
+	*EventServer
+	network, addr string
+	action        bool
+	frames        int32
+}
+
+func (t *testTrafficServer) OnTraffic(c Conn) (action Action) {
+	for {
+		header, err := c.Peek(2)
+		if err != nil {
+			return
+		}
+		size := int(binary.BigEndian.Uint16(header))
+		frame, err := c.Next(2 + size)
+		if err != nil {
+			return
+		}
+		if _, err = c.Write(frame[2:]); err != nil {
+			panic(err)
+		}
+		atomic.AddInt32(&t.frames, 1)
+	}
+}
+func (t *testTrafficServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	panic("React should not be invoked when OnTraffic is implemented")
+}
+func (t *testTrafficServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+func (t *testTrafficServer) Tick() (delay time.Duration, action Action) {
+	if !t.action {
+		t.action = true
+		go func() {
+			conn, err := net.Dial(t.network, t.addr)
+			must(err)
+			defer conn.Close()
+			msg := []byte{0, 5, 'h', 'e', 'l', 'l', 'o', 0, 6, 'w', 'o', 'r', 'l', 'd', '!'}
+			// Send the frames in pieces so that they have to be reassembled in the inbound buffer.
+			for i := 0; i < len(msg); i += 4 {
+				end := i + 4
+				if end > len(msg) {
+					end = len(msg)
+				}
+				_, _ = conn.Write(msg[i:end])
+				time.Sleep(time.Millisecond * 10)
+			}
+			data := make([]byte, 11)
+			if _, err = io.ReadFull(conn, data); err != nil {
+				panic(err)
+			}
+			if string(data) != "helloworld!" {
+				panic(fmt.Sprintf("unexpected data: %s", data))
+			}
+		}()
+	}
+	delay = time.Millisecond * 100
+	return
+}
+
+func testTraffic(network, addr string) {
+	events := &testTrafficServer{network: network, addr: addr}
+	must(Serve(events, network+"://"+addr, WithTicker(true)))
+	if atomic.LoadInt32(&events.frames) != 2 {
+		panic("expected 2 frames")
+	}
+}
+
+func TestTestMode(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		testTestMode("tcp", ":9992")
+	})
+	t.Run("memory", func(t *testing.T) {
+		testTestMode("memory", "test-mode")
+	})
+}
+
+type testTestModeServer struct {
+	*EventServer
+	svr                   Server
+	opened, closed, ticks int
+}
+
+func (t *testTestModeServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testTestModeServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.opened++
+	return
+}
+func (t *testTestModeServer) OnClosed(c Conn, err error) (action Action) {
+	t.closed++
+	return
+}
+func (t *testTestModeServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	out = frame
+	return
+}
+func (t *testTestModeServer) Tick() (delay time.Duration, action Action) {
+	t.ticks++
+	if t.closed > 0 {
+		action = Shutdown
+	}
+	return
+}
+
+func testTestMode(network, addr string) {
+	events := new(testTestModeServer)
+	// Serve returns immediately in test mode.
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithTicker(true)))
+	if events.svr.NumEventLoop != 1 {
+		panic("expected exactly one event-loop in test mode")
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if network == "memory" {
+		conn, err = DialMemory(addr)
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+	must(err)
+	defer conn.Close()
+
+	must(events.svr.PollOnce(time.Second))
+	if events.opened != 1 || events.ticks != 1 {
+		panic(fmt.Sprintf("expected 1 opened connection and 1 tick, got %d and %d", events.opened, events.ticks))
+	}
+	_, err = conn.Write([]byte("hello"))
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	data := make([]byte, 5)
+	_, err = io.ReadFull(conn, data)
+	must(err)
+	if string(data) != "hello" {
+		panic(fmt.Sprintf("unexpected data: %s", data))
+	}
+
+	// Nothing happens, PollOnce times out.
+	must(events.svr.PollOnce(0))
+	if events.ticks != 3 || events.closed != 0 {
+		panic(fmt.Sprintf("expected 3 ticks and no closed connection, got %d and %d", events.ticks, events.closed))
+	}
+
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+	if events.closed != 1 {
+		panic("expected 1 closed connection")
+	}
+	if err = events.svr.PollOnce(0); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown after shutdown, got %v", err))
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	testFaultInjection("memory", "fault-injection")
+}
+
+type testFaultInjectionServer struct {
+	*EventServer
+	svr    Server
+	frames []string
+}
+
+func (t *testFaultInjectionServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testFaultInjectionServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames = append(t.frames, string(frame))
+	out = frame
+	return
+}
+func (t *testFaultInjectionServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+
+func testFaultInjection(network, addr string) {
+	events := new(testFaultInjectionServer)
+	fi := &FaultInjection{
+		Read:  FaultPolicy{DuplicateRate: 1},
+		Write: FaultPolicy{Latency: time.Millisecond * 50},
+	}
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithFaultInjection(fi)))
+	conn, err := DialMemory(addr)
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+
+	start := time.Now()
+	_, err = conn.Write([]byte("hello"))
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	if len(events.frames) != 1 || events.frames[0] != "hellohello" {
+		panic(fmt.Sprintf("expected the inbound data to be duplicated, got %q", events.frames))
+	}
+	// The echo is delayed, PollOnce handles it when the latency elapses.
+	must(events.svr.PollOnce(time.Second))
+	data := make([]byte, 10)
+	_, err = io.ReadFull(conn, data)
+	must(err)
+	if string(data) != "hellohello" {
+		panic(fmt.Sprintf("unexpected data: %s", data))
+	}
+	if elapsed := time.Since(start); elapsed < fi.Write.Latency {
+		panic(fmt.Sprintf("expected the outbound data to be delayed for %v, got %v", fi.Write.Latency, elapsed))
+	}
+
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	testRecordReplay("memory", "record-replay")
+}
+
+type testRecordReplayServer struct {
+	*EventServer
+	svr            Server
+	frames         []string
+	opened, closed int
+}
+
+func (t *testRecordReplayServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testRecordReplayServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.opened++
+	return
+}
+func (t *testRecordReplayServer) OnClosed(c Conn, err error) (action Action) {
+	t.closed++
+	action = Shutdown
+	return
+}
+func (t *testRecordReplayServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames = append(t.frames, string(frame))
+	out = frame
+	return
+}
+
+func testRecordReplay(network, addr string) {
+	var recording bytes.Buffer
+	recorder := NewRecorder(&recording, RecorderConfig{})
+	events := new(testRecordReplayServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithRecorder(recorder)))
+	conn, err := DialMemory(addr)
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	for _, msg := range []string{"hello", "world"} {
+		_, err = conn.Write([]byte(msg))
+		must(err)
+		must(events.svr.PollOnce(time.Second))
+		data := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, data)
+		must(err)
+	}
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+	must(recorder.Flush())
+
+	var kinds []RecordKind
+	rr := NewRecordReader(bytes.NewReader(recording.Bytes()))
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		must(err)
+		if rec.ConnID != 1 {
+			panic(fmt.Sprintf("unexpected connection id: %d", rec.ConnID))
+		}
+		kinds = append(kinds, rec.Kind)
+	}
+	expected := []RecordKind{RecordOpen, RecordInbound, RecordOutbound, RecordInbound, RecordOutbound, RecordClose}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		panic(fmt.Sprintf("expected records %v, got %v", expected, kinds))
+	}
+
+	replayed := new(testRecordReplayServer)
+	must(Replay(bytes.NewReader(recording.Bytes()), replayed))
+	if replayed.opened != 1 || replayed.closed != 1 || fmt.Sprint(replayed.frames) != "[hello world]" {
+		panic(fmt.Sprintf("unexpected replay: %d opened, %d closed, frames %q",
+			replayed.opened, replayed.closed, replayed.frames))
+	}
+}
+
+func TestWakeCoalescing(t *testing.T) {
+	testWakeCoalescing("memory", "wake-coalescing")
+}
+
+type testWakeCoalescingServer struct {
+	*EventServer
+	svr   Server
+	conn  Conn
+	wakes int
+}
+
+func (t *testWakeCoalescingServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testWakeCoalescingServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.conn = c
+	return
+}
+func (t *testWakeCoalescingServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+func (t *testWakeCoalescingServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if frame == nil {
+		t.wakes++
+	}
+	return
+}
+
+func testWakeCoalescing(network, addr string) {
+	events := new(testWakeCoalescingServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithPollEventsCap(1), WithPollTimeout(time.Second)))
+	conn, err := DialMemory(addr)
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	for i := 0; i < 1000; i++ {
+		must(events.conn.Wake())
+	}
+	must(events.svr.PollOnce(time.Second))
+	if events.wakes != 1 {
+		panic(fmt.Sprintf("expected the wake-ups to be coalesced into 1, got %d", events.wakes))
+	}
+	must(events.conn.Wake())
+	must(events.svr.PollOnce(time.Second))
+	if events.wakes != 2 {
+		panic(fmt.Sprintf("expected 2 wake-ups, got %d", events.wakes))
+	}
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestUserEvent(t *testing.T) {
+	testUserEvent("memory", "user-event")
+}
+
+type testUserEventServer struct {
+	*EventServer
+	svr  Server
+	conn Conn
+	tags []interface{}
+}
+
+func (t *testUserEventServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testUserEventServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.conn = c
+	return
+}
+func (t *testUserEventServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	panic("React should not be invoked when OnUserEvent is implemented")
+}
+func (t *testUserEventServer) OnUserEvent(c Conn, tag interface{}) (action Action) {
+	t.tags = append(t.tags, tag)
+	if s, ok := tag.(string); ok {
+		_, _ = c.Write([]byte(s))
+	}
+	if tag == nil {
+		action = Shutdown
+	}
+	return
+}
+
+func testUserEvent(network, addr string) {
+	events := new(testUserEventServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true)))
+	conn, err := DialMemory(addr)
+	must(err)
+	defer conn.Close()
+	must(events.svr.PollOnce(time.Second))
+	done := make(chan struct{})
+	go func() {
+		must(events.conn.WakeWith("ping"))
+		must(events.conn.WakeWith(42))
+		close(done)
+	}()
+	<-done
+	must(events.svr.PollOnce(time.Second))
+	if fmt.Sprint(events.tags) != "[ping 42]" {
+		panic(fmt.Sprintf("unexpected tags: %v", events.tags))
+	}
+	data := make([]byte, 4)
+	_, err = io.ReadFull(conn, data)
+	must(err)
+	if string(data) != "ping" {
+		panic(fmt.Sprintf("unexpected data: %s", data))
+	}
+	must(events.conn.WakeWith(nil))
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestMessageBus(t *testing.T) {
+	testMessageBus("memory", "message-bus")
+}
+
+func testMessageBus(network, addr string) {
+	events := new(testUserEventServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true)))
+	conn, err := DialMemory(addr)
+	must(err)
+	defer conn.Close()
+	must(events.svr.PollOnce(time.Second))
+	id := events.conn.ID()
+	if id == 0 || events.svr.LoopIndex(id) != 0 {
+		panic(fmt.Sprintf("unexpected connection id: %d", id))
+	}
+	if err = events.svr.Post(12345<<16|7, "nowhere"); err != ErrInvalidConnID {
+		panic(fmt.Sprintf("expected ErrInvalidConnID, got %v", err))
+	}
+	if err = events.svr.PostLoop(1, func() {}); err != ErrInvalidLoopIndex {
+		panic(fmt.Sprintf("expected ErrInvalidLoopIndex, got %v", err))
+	}
+
+	var ran bool
+	done := make(chan struct{})
+	go func() {
+		must(events.svr.Post(id, "a"))
+		must(events.svr.PostLoop(0, func() {
+			ran = true
+		}))
+		must(events.svr.Post(id, "b"))
+		// Messages to a connection that doesn't exist anymore are discarded.
+		must(events.svr.Post(id+1<<16, "c"))
+		close(done)
+	}()
+	<-done
+	must(events.svr.PollOnce(time.Second))
+	if !ran || fmt.Sprint(events.tags) != "[a b]" {
+		panic(fmt.Sprintf("unexpected delivery: ran=%v, tags=%v", ran, events.tags))
+	}
+	data := make([]byte, 2)
+	_, err = io.ReadFull(conn, data)
+	must(err)
+	if string(data) != "ab" {
+		panic(fmt.Sprintf("unexpected data: %s", data))
+	}
+	// The messages of the batch following the one shutting the server down are still delivered.
+	ran = false
+	must(events.svr.Post(id, nil))
+	must(events.svr.PostLoop(0, func() {
+		ran = true
+	}))
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown || !ran {
+		panic(fmt.Sprintf("expected ErrServerShutdown along with the rest of the batch, got %v, ran=%v", err, ran))
+	}
+}
+
+func TestMailboxReset(t *testing.T) {
+	mb := newMailbox()
+	if !mb.push(busMessage{connID: 1}) || mb.push(busMessage{connID: 2}) {
+		t.Fatal("expected only the first message to wake the event-loop up")
+	}
+	// The event-loop failed to be woken up, the next message tries again rather than queuing up forever.
+	mb.reset()
+	if !mb.push(busMessage{connID: 3}) {
+		t.Fatal("expected the message following a reset to wake the event-loop up")
+	}
+	if msgs := mb.take(); len(msgs) != 1 || msgs[0].connID != 3 {
+		t.Fatalf("expected the message following the reset alone, got %v", msgs)
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	testWriteCoalescing("memory", "write-coalescing")
+}
+
+type testWriteCoalescingServer struct {
+	*EventServer
+	svr  Server
+	conn Conn
+}
+
+func (t *testWriteCoalescingServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testWriteCoalescingServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.conn = c
+	return
+}
+func (t *testWriteCoalescingServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+
+func testWriteCoalescing(network, addr string) {
+	events := new(testWriteCoalescingServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithWriteCoalescing(20*time.Millisecond, 8)))
+	conn, err := DialMemory(addr)
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	expected := bytes.Repeat([]byte("ab"), 10)
+	for i := 0; i < 10; i++ {
+		must(events.conn.AsyncWrite(expected[2*i : 2*i+2]))
+	}
+	// The first 16 bytes are flushed as soon as they reach the limit, the rest when the window elapses.
+	must(events.svr.PollOnce(time.Second))
+	must(events.svr.PollOnce(time.Second))
+	if writes, flushes := events.svr.WriteCoalescingStats(); writes != 10 || flushes != 3 {
+		panic(fmt.Sprintf("expected 10 writes merged into 3 flushes, got %d writes and %d flushes", writes, flushes))
+	}
+	must(conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, buf)
+	must(err)
+	if !bytes.Equal(buf, expected) {
+		panic(fmt.Sprintf("expected %q, got %q", expected, buf))
+	}
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestLoopWriteBatching(t *testing.T) {
+	testLoopWriteBatching("memory", "loop-write-batching")
+}
+
+type testLoopWriteBatchingServer struct {
+	*EventServer
+	svr Server
+}
+
+func (t *testLoopWriteBatchingServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testLoopWriteBatchingServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	// The frame is echoed twice, by React and by AsyncWrite, which is handled after the replies of React.
+	out = append([]byte(nil), frame...)
+	must(c.AsyncWrite(append([]byte(nil), frame...)))
+	return
+}
+func (t *testLoopWriteBatchingServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+
+func testLoopWriteBatching(network, addr string) {
+	events := new(testLoopWriteBatchingServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithLoopWriteBatching(true),
+		WithCodec(&LineBasedFrameCodec{})))
+	conn, err := DialMemory(addr)
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	// The pipelined requests are read at once, and their replies flushed at the end of the iterations.
+	_, err = conn.Write([]byte("a\nb\nc\n"))
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	must(events.svr.PollOnce(100 * time.Millisecond))
+	expected := []byte("a\nb\nc\na\nb\nc\n")
+	must(conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, buf)
+	must(err)
+	if !bytes.Equal(buf, expected) {
+		panic(fmt.Sprintf("expected %q, got %q", expected, buf))
+	}
+	// The replies of React are flushed together, and so are the ones of AsyncWrite, handled in the next iteration.
+	if writes, flushes := events.svr.WriteBatchingStats(); writes != 6 || flushes != 2 {
+		panic(fmt.Sprintf("expected 6 writes batched into 2 flushes, got %d writes and %d flushes", writes, flushes))
+	}
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestKernelZeroCopySend(t *testing.T) {
+	testKernelZeroCopySend("tcp", ":9983")
+}
+
+type testKernelZeroCopySendServer struct {
+	*EventServer
+	svr     Server
+	payload []byte
+}
+
+func (t *testKernelZeroCopySendServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testKernelZeroCopySendServer) OnOpened(c Conn) (out []byte, action Action) {
+	for i := 0; i < len(t.payload); i += 256 << 10 {
+		must(c.AsyncWrite(t.payload[i : i+256<<10]))
+	}
+	return
+}
+func (t *testKernelZeroCopySendServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+
+func testKernelZeroCopySend(network, addr string) {
+	events := &testKernelZeroCopySendServer{payload: make([]byte, 4<<20)}
+	rand.Read(events.payload)
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithKernelZeroCopySend(64<<10)))
+	conn, err := net.Dial(network, addr)
+	must(err)
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(events.payload))
+		_, err := io.ReadFull(conn, buf)
+		must(err)
+		_ = conn.Close()
+		received <- buf
+	}()
+	for {
+		if err = events.svr.PollOnce(100 * time.Millisecond); err != nil {
+			break
+		}
+	}
+	if err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+	if buf := <-received; !bytes.Equal(buf, events.payload) {
+		panic("the received data doesn't match the sent data")
+	}
+}
+
+func TestReadBufferProvider(t *testing.T) {
+	testReadBufferProvider("memory", "read-buffer-provider")
+}
+
+// testArenaCodec reads fixed-length frames right into the slots of an arena.
+type testArenaCodec struct {
+	FixedLengthFrameCodec
+	arena []byte
+	slot  int
+}
+
+func (codec *testArenaCodec) NextBuffer(c Conn) []byte {
+	if codec.slot == len(codec.arena)/codec.frameLength {
+		return nil
+	}
+	return codec.arena[codec.slot*codec.frameLength : (codec.slot+1)*codec.frameLength]
+}
+
+func (codec *testArenaCodec) Filled(c Conn, buf []byte) []byte {
+	codec.slot++
+	return buf
+}
+
+type testReadBufferProviderServer struct {
+	*EventServer
+	svr    Server
+	frames [][]byte
+}
+
+func (t *testReadBufferProviderServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testReadBufferProviderServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+func (t *testReadBufferProviderServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames = append(t.frames, frame)
+	return
+}
+
+func testReadBufferProvider(network, addr string) {
+	codec := &testArenaCodec{FixedLengthFrameCodec: FixedLengthFrameCodec{frameLength: 4}, arena: make([]byte, 8)}
+	events := new(testReadBufferProviderServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithCodec(codec)))
+	conn, err := DialMemory(addr)
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	// The frames beyond the arena are decoded via the regular path.
+	for _, piece := range []string{"ab", "cdefg", "hijkl"} {
+		_, err = conn.Write([]byte(piece))
+		must(err)
+		must(events.svr.PollOnce(time.Second))
+	}
+	must(events.svr.PollOnce(10 * time.Millisecond))
+	if len(events.frames) != 3 {
+		panic(fmt.Sprintf("expected 3 frames, got %d", len(events.frames)))
+	}
+	for i, expected := range []string{"abcd", "efgh", "ijkl"} {
+		if string(events.frames[i]) != expected {
+			panic(fmt.Sprintf("expected frame %q, got %q", expected, events.frames[i]))
+		}
+	}
+	if &events.frames[0][0] != &codec.arena[0] || &events.frames[1][0] != &codec.arena[4] {
+		panic("expected the frames to be read into the arena")
+	}
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestOnAccepted(t *testing.T) {
+	testOnAccepted("memory", "on-accepted")
+}
+
+type testOnAcceptedServer struct {
+	*EventServer
+	svr      Server
+	accepted int
+	opened   int
+	frames   []string
+}
+
+func (t *testOnAcceptedServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testOnAcceptedServer) OnAccepted(fd int, local, remote net.Addr) (opts ConnOpts, action Action) {
+	t.accepted++
+	if t.accepted > 1 {
+		action = Close
+		return
+	}
+	opts.Codec = new(LineBasedFrameCodec)
+	return
+}
+func (t *testOnAcceptedServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.opened++
+	return
+}
+func (t *testOnAcceptedServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+func (t *testOnAcceptedServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames = append(t.frames, string(frame))
+	return
+}
+
+func testOnAccepted(network, addr string) {
+	events := new(testOnAcceptedServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true)))
+	conn, err := DialMemory(addr)
+	must(err)
+	if _, err = DialMemory(addr); err != ErrConnRejected {
+		panic(fmt.Sprintf("expected ErrConnRejected, got %v", err))
+	}
+	must(events.svr.PollOnce(time.Second))
+	_, err = conn.Write([]byte("hello\nworld\n"))
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	if events.accepted != 2 || events.opened != 1 {
+		panic(fmt.Sprintf("expected 2 accepted and 1 opened connections, got %d and %d", events.accepted, events.opened))
+	}
+	if len(events.frames) != 2 || events.frames[0] != "hello" || events.frames[1] != "world" {
+		panic(fmt.Sprintf("expected the frames to be decoded by the codec of the connection, got %q", events.frames))
+	}
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestResizeLoops(t *testing.T) {
+	testResizeLoops("memory", "resize-loops")
+}
+
+type testResizeLoopsServer struct {
+	*EventServer
+	server Server
+	svr    chan Server
+	loops  chan int
+	closed int32
+}
+
+func (t *testResizeLoopsServer) OnInitComplete(svr Server) (action Action) {
+	if err := svr.ResizeLoops(0); err != ErrInvalidLoopCount {
+		panic(fmt.Sprintf("expected ErrInvalidLoopCount, got %v", err))
+	}
+	must(svr.ResizeLoops(1))
+	t.server = svr
+	t.svr <- svr
+	return
+}
+func (t *testResizeLoopsServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.loops <- t.server.LoopIndex(c.ID())
+	return
+}
+func (t *testResizeLoopsServer) OnClosed(c Conn, err error) (action Action) {
+	if atomic.AddInt32(&t.closed, 1) == 6 {
+		action = Shutdown
+	}
+	return
+}
+
+func testResizeLoops(network, addr string) {
+	events := &testResizeLoopsServer{svr: make(chan Server, 1), loops: make(chan int, 6)}
+	done := make(chan struct{})
+	go func() {
+		must(Serve(events, network+"://"+addr, WithNumEventLoop(3)))
+		close(done)
+	}()
+	svr := <-events.svr
+	var conns []net.Conn
+	dial := func() int {
+		conn, err := DialMemory(addr)
+		must(err)
+		conns = append(conns, conn)
+		return <-events.loops
+	}
+	for i := 0; i < 3; i++ {
+		if idx := dial(); idx != 0 {
+			panic(fmt.Sprintf("expected the connection to be assigned to event-loop 0, got %d", idx))
+		}
+	}
+	must(svr.ResizeLoops(3))
+	if n := svr.ActiveLoops(); n != 3 {
+		panic(fmt.Sprintf("expected 3 active event-loops, got %d", n))
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		seen[dial()] = true
+	}
+	if len(seen) != 3 {
+		panic(fmt.Sprintf("expected the connections to be spread over 3 event-loops, got %v", seen))
+	}
+	for _, conn := range conns {
+		must(conn.Close())
+	}
+	<-done
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	testHandshakeTimeout("memory", "handshake-timeout")
+}
+
+type testHandshakeTimeoutServer struct {
+	*EventServer
+	svr    Server
+	errors []error
+}
+
+func (t *testHandshakeTimeoutServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testHandshakeTimeoutServer) OnClosed(c Conn, err error) (action Action) {
+	t.errors = append(t.errors, err)
+	if len(t.errors) == 2 {
+		action = Shutdown
+	}
+	return
+}
+
+func testHandshakeTimeout(network, addr string) {
+	events := new(testHandshakeTimeoutServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithHandshakeTimeout(20*time.Millisecond)))
+	active, err := DialMemory(addr)
+	must(err)
+	idle, err := DialMemory(addr)
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	_, err = active.Write([]byte("hello"))
+	must(err)
+	must(events.svr.PollOnce(time.Second))
+	// The idle connection is closed once the handshake timeout elapses.
+	must(events.svr.PollOnce(time.Second))
+	if len(events.errors) != 1 || events.errors[0] != ErrHandshakeTimeout {
+		panic(fmt.Sprintf("expected the idle connection to be closed with ErrHandshakeTimeout, got %v", events.errors))
+	}
+	must(idle.SetReadDeadline(time.Now().Add(time.Second)))
+	if _, err = idle.Read(make([]byte, 1)); err != io.EOF {
+		panic(fmt.Sprintf("expected EOF, got %v", err))
+	}
+	time.Sleep(30 * time.Millisecond)
+	must(events.svr.PollOnce(10 * time.Millisecond))
+	if n := events.svr.CountConnections(); n != 1 {
+		panic(fmt.Sprintf("expected the active connection to survive, got %d connections", n))
+	}
+	must(active.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{LB: SourceAddrHash + 1},
+		{NumEventLoop: -1},
+		{TestMode: true, Multicore: true},
+		{HandshakeTimeout: -time.Second},
+		{AcceptFilter: "a-very-long-filter"},
+		{AcceptMode: AcceptOnLoop, ReusePort: true},
+		{LoopOverloadThreshold: 1.5},
+		{WriteCoalescingWindow: time.Millisecond},
+		{LoopWriteBatching: true, WriteCoalescing: true},
+		{Enricher: &testEnricher{}},
+		{UDPReadBufferSize: MaxUDPReadBufferSize + 1},
+		{AcceptOverload: &AcceptOverload{DropRate: 0.5}},
+		{FaultInjection: &FaultInjection{Write: FaultPolicy{DropRate: 2}}},
+	} {
+		if _, ok := opts.Validate().(*OptionsError); !ok {
+			t.Fatalf("expected an OptionsError for %s", opts)
+		}
+	}
+	if err := Serve(new(EventServer), "memory://options", WithTicker(true)); err == nil {
+		t.Fatal("expected an error for a ticker without Tick")
+	}
+	if err := Serve(new(EventServer), "udp://:0", WithAcceptFilter("dataready")); err == nil {
+		t.Fatal("expected an error for an accept filter on udp")
+	}
+	if err := Serve(new(EventServer), "udp://:0", WithAcceptMode(AcceptOnDedicatedThread)); err == nil {
+		t.Fatal("expected an error for an accept mode on udp")
+	}
+
+	events := &testOptionsServer{}
+	must(Serve(events, "memory://options", WithTestMode(true), WithCodec(new(LineBasedFrameCodec)),
+		WithHandshakeTimeout(time.Second)))
+	var dump map[string]interface{}
+	must(json.Unmarshal([]byte(events.svr.Options.String()), &dump))
+	if dump["NumEventLoop"] != float64(1) || dump["LB"] != "RoundRobin" || dump["HandshakeTimeout"] != "1s" ||
+		dump["Codec"] != "*gnet.LineBasedFrameCodec" || dump["Logger"] == "" {
+		t.Fatalf("unexpected effective options: %s", events.svr.Options)
+	}
+	events.svr.svr.stopTestLoop()
+}
+
+type testOptionsServer struct {
+	*EventServer
+	svr Server
+}
+
+func (t *testOptionsServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+
+func TestNewServer(t *testing.T) {
+	events := &testNewServer{}
+	s, err := NewServer(events, "tcp://127.0.0.1:0")
+	must(err)
+	port := s.Addr.(*net.TCPAddr).Port
+	if port == 0 {
+		t.Fatal("expected the bound port")
+	}
+	if events.started {
+		t.Fatal("expected OnInitComplete to fire in Start")
+	}
+	must(s.Start())
+	if err = s.Start(); err != ErrServerStarted {
+		t.Fatalf("expected ErrServerStarted, got %v", err)
+	}
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	if string(buf) != "hello" {
+		t.Fatalf("expected echo, got %q", buf)
+	}
+	_, err = c.Write([]byte("shutdown"))
+	must(err)
+	<-s.svr.done
+}
+
+type testNewServer struct {
+	*EventServer
+	started bool
+}
+
+func (t *testNewServer) OnInitComplete(svr Server) (action Action) {
+	t.started = true
+	return
+}
+
+func (t *testNewServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if string(frame) == "shutdown" {
+		return nil, Shutdown
+	}
+	return frame, None
+}
+
+func TestServerLifecycle(t *testing.T) {
+	s, err := NewServer(&testNewServer{}, "memory://lifecycle")
+	must(err)
+	must(s.Stop(context.Background()))
+	s.Wait()
+	if err = s.Start(); err != ErrServerStarted {
+		t.Fatalf("expected ErrServerStarted, got %v", err)
+	}
+
+	s, err = NewServer(&testNewServer{}, "memory://lifecycle", WithNumEventLoop(2))
+	must(err)
+	must(s.Start())
+	c, err := DialMemory("lifecycle")
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	must(s.Stop(context.Background()))
+	s.Wait()
+	if _, err = c.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF after Stop, got %v", err)
+	}
+	if _, err = DialMemory("lifecycle"); err != ErrMemoryAddrNotFound {
+		t.Fatalf("expected ErrMemoryAddrNotFound after Stop, got %v", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	var out bytes.Buffer
+	s, err := NewServer(&testNewServer{}, "memory://audit", WithTestMode(true), WithAudit(NewAuditWriter(&out)))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("audit")
+	must(err)
+	must(s.PollOnce(time.Second))
+	// The echo is read in another goroutine, as the in-memory connections are synchronous on Windows.
+	echo := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(c, make([]byte, 5))
+		echo <- err
+	}()
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	must(s.PollOnce(time.Second))
+	must(<-echo)
+	must(c.Close())
+	must(s.PollOnce(time.Second))
+	line := out.String()
+	for _, field := range []string{"conn_id=", " peer=memory://audit ", " bytes_in=5 ", " bytes_out=5 ", " reason=closed\n"} {
+		if !strings.Contains(line, field) {
+			t.Fatalf("expected %q in the audit record %q", field, line)
+		}
+	}
+}
+
+func TestAcceptRateLimit(t *testing.T) {
+	t.Run("defer", func(t *testing.T) {
+		testAcceptRateLimit(t, AcceptLimitDefer)
+	})
+	t.Run("close", func(t *testing.T) {
+		testAcceptRateLimit(t, AcceptLimitClose)
+	})
+}
+
+func testAcceptRateLimit(t *testing.T, policy AcceptLimitPolicy) {
+	rps := 20.0
+	if policy == AcceptLimitClose {
+		rps = 0.01
+	}
+	s, err := NewServer(&testNewServer{}, "tcp://127.0.0.1:0",
+		WithAcceptRateLimit(rps, 1), WithAcceptLimitPolicy(policy))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		_, err = c.Write([]byte("hello"))
+		must(err)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(c, make([]byte, 5))
+		_ = c.Close()
+		switch {
+		case policy == AcceptLimitDefer || i == 0:
+			must(err)
+		case err == nil:
+			t.Fatalf("expected connection %d beyond the limit to be closed", i)
+		}
+	}
+	if elapsed := time.Since(start); policy == AcceptLimitDefer && elapsed < 80*time.Millisecond {
+		t.Fatalf("expected the connections beyond the burst to be deferred, took %v", elapsed)
+	}
+}
+
+func TestAcceptMode(t *testing.T) {
+	t.Run("dedicated-thread", func(t *testing.T) {
+		testAcceptMode(t, AcceptOnDedicatedThread)
+	})
+	if runtime.GOOS != "windows" {
+		t.Run("loop", func(t *testing.T) {
+			testAcceptMode(t, AcceptOnLoop)
+		})
+	}
+}
+
+func testAcceptMode(t *testing.T, mode AcceptMode) {
+	events := &testAcceptModeServer{loops: make(chan int, 6)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithNumEventLoop(3), WithAcceptMode(mode))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	loops := make(map[int]bool)
+	for i := 0; i < 6; i++ {
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		defer c.Close()
+		_, err = c.Write([]byte("hello"))
+		must(err)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(c, make([]byte, 5))
+		must(err)
+		loops[<-events.loops] = true
+	}
+	// The connections are spread over all the event-loops, including the one accepting them with AcceptOnLoop.
+	if len(loops) != 3 {
+		t.Fatalf("expected the connections to be spread over 3 event-loops, got %v", loops)
+	}
+}
+
+type testAcceptModeServer struct {
+	*EventServer
+	svr   Server
+	loops chan int
+}
+
+func (t *testAcceptModeServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+
+func (t *testAcceptModeServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.loops <- t.svr.LoopIndex(c.ID())
+	return
+}
+
+func (t *testAcceptModeServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return frame, None
+}
+
+func TestPartialFrameTimeout(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		testPartialFrameTimeout(t, false)
+	})
+	t.Run("keep", func(t *testing.T) {
+		testPartialFrameTimeout(t, true)
+	})
+}
+
+type testPartialFrameTimeoutServer struct {
+	*EventServer
+	keep      bool
+	decodeErr error
+	closeErr  error
+}
+
+func (t *testPartialFrameTimeoutServer) OnClosed(c Conn, err error) (action Action) {
+	t.closeErr = err
+	return
+}
+
+func (t *testPartialFrameTimeoutServer) OnDecodeError(c Conn, err error) (action Action) {
+	t.decodeErr = err
+	if !t.keep {
+		return Close
+	}
+	c.ResetBuffer()
+	return
+}
+
+func testPartialFrameTimeout(t *testing.T, keep bool) {
+	events := &testPartialFrameTimeoutServer{keep: keep}
+	s, err := NewServer(events, "memory://partial-frame-timeout", WithTestMode(true),
+		WithCodec(&LineBasedFrameCodec{}), WithPartialFrameTimeout(20*time.Millisecond))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("partial-frame-timeout")
+	must(err)
+	defer c.Close()
+	must(s.PollOnce(time.Second))
+	// A length prefix or a line without its delimiter holds the buffers until the timeout elapses.
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	must(s.PollOnce(time.Second))
+	must(s.PollOnce(time.Second))
+	if events.decodeErr != ErrPartialFrameTimeout {
+		t.Fatalf("expected OnDecodeError with ErrPartialFrameTimeout, got %v", events.decodeErr)
+	}
+	if keep {
+		time.Sleep(30 * time.Millisecond)
+		must(s.PollOnce(10 * time.Millisecond))
+		if n := s.CountConnections(); n != 1 || events.closeErr != nil {
+			t.Fatalf("expected the connection to be kept, got %d connections closed with %v", n, events.closeErr)
+		}
+		return
+	}
+	if events.closeErr != ErrPartialFrameTimeout {
+		t.Fatalf("expected the connection to be closed with ErrPartialFrameTimeout, got %v", events.closeErr)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		testDecodeError(t, false)
+	})
+	t.Run("keep", func(t *testing.T) {
+		testDecodeError(t, true)
+	})
+	t.Run("no-handler", func(t *testing.T) {
+		events := &testNoDecodeErrorServer{EventServer: &EventServer{}}
+		s, err := NewServer(events, "memory://decode-error", WithTestMode(true), WithCodec(&ModbusCodec{}))
+		must(err)
+		must(s.Start())
+		defer func() {
+			must(s.Stop(context.Background()))
+		}()
+		c, err := DialMemory("decode-error")
+		must(err)
+		defer c.Close()
+		must(s.PollOnce(time.Second))
+		_, err = c.Write([]byte{0, 1, 0, 1, 0, 2, 17, 3})
+		must(err)
+		must(s.PollOnce(time.Second))
+		if events.closeErr != ErrInvalidModbusADU {
+			t.Fatalf("expected the connection to be closed with ErrInvalidModbusADU, got %v", events.closeErr)
+		}
+	})
+}
+
+type testDecodeErrorServer struct {
+	*EventServer
+	keep      bool
+	decodeErr error
+	closeErr  error
+	frames    int
+}
+
+func (t *testDecodeErrorServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames++
+	return
+}
+
+func (t *testDecodeErrorServer) OnClosed(c Conn, err error) (action Action) {
+	t.closeErr = err
+	return
+}
+
+func (t *testDecodeErrorServer) OnDecodeError(c Conn, err error) (action Action) {
+	t.decodeErr = err
+	if !t.keep {
+		return Close
+	}
+	return
+}
+
+type testNoDecodeErrorServer struct {
+	*EventServer
+	closeErr error
+}
+
+func (t *testNoDecodeErrorServer) OnClosed(c Conn, err error) (action Action) {
+	t.closeErr = err
+	return
+}
+
+func testDecodeError(t *testing.T, keep bool) {
+	events := &testDecodeErrorServer{EventServer: &EventServer{}, keep: keep}
+	s, err := NewServer(events, "memory://decode-error", WithTestMode(true), WithCodec(&ModbusCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("decode-error")
+	must(err)
+	defer c.Close()
+	must(s.PollOnce(time.Second))
+	// The protocol identifier of the MBAP header must be zero, ModbusCodec discards the malformed ADU.
+	_, err = c.Write([]byte{0, 1, 0, 1, 0, 2, 17, 3})
+	must(err)
+	must(s.PollOnce(time.Second))
+	if events.decodeErr != ErrInvalidModbusADU {
+		t.Fatalf("expected OnDecodeError with ErrInvalidModbusADU, got %v", events.decodeErr)
+	}
+	if !keep {
+		if events.closeErr != ErrInvalidModbusADU {
+			t.Fatalf("expected the connection to be closed with ErrInvalidModbusADU, got %v", events.closeErr)
+		}
+		return
+	}
+	_, err = c.Write(AppendModbusADU(nil, ModbusHeader{TransactionID: 2, UnitID: 17}, []byte{0x03, 0x00, 0x6b}))
+	must(err)
+	must(s.PollOnce(time.Second))
+	if n := s.CountConnections(); n != 1 || events.closeErr != nil || events.frames != 1 {
+		t.Fatalf("expected the connection to be kept and the next ADU to be decoded, got %d connections closed "+
+			"with %v and %d frames", n, events.closeErr, events.frames)
+	}
+}
+
+func TestFrameAccounting(t *testing.T) {
+	var frames []string
+	accountant := FrameAccountantFunc(func(c Conn, inbound bool, decodedSize, encodedSize int) {
+		frames = append(frames, fmt.Sprintf("%t:%d:%d", inbound, decodedSize, encodedSize))
+	})
+	s, err := NewServer(&testNewServer{}, "memory://frame-accounting", WithTestMode(true),
+		WithCodec(&LineBasedFrameCodec{}), WithFrameAccounting(accountant))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("frame-accounting")
+	must(err)
+	defer c.Close()
+	must(s.PollOnce(time.Second))
+	echo := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(c, make([]byte, 12))
+		echo <- err
+	}()
+	_, err = c.Write([]byte("hello\nworld\n"))
+	must(err)
+	must(s.PollOnce(time.Second))
+	must(<-echo)
+	if got := strings.Join(frames, " "); got != "true:5:6 false:5:6 true:5:6 false:5:6" {
+		t.Fatalf("expected every frame to be accounted in both directions, got %q", got)
+	}
+}
+
+func TestFrameTracer(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewFrameTracer(NewFrameTraceWriter(&out), FrameTracerConfig{
+		Filter: func(c Conn, inbound bool, frame []byte) bool {
+			return inbound && string(frame) != "skip"
+		},
+		Rate:        1e-9,
+		Burst:       2,
+		PreviewSize: 4,
+	})
+	s, err := NewServer(&testNewServer{}, "memory://frame-tracer", WithTestMode(true),
+		WithCodec(&LineBasedFrameCodec{}), WithFrameTracer(tracer))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("frame-tracer")
+	must(err)
+	defer c.Close()
+	must(s.PollOnce(time.Second))
+	echo := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(c, make([]byte, 20))
+		echo <- err
+	}()
+	_, err = c.Write([]byte("hello\nskip\nhi\nagain\n"))
+	must(err)
+	must(s.PollOnce(time.Second))
+	must(<-echo)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " dir=in size=5 preview=68656c6c") ||
+		!strings.HasSuffix(lines[1], " dir=in size=2 preview=6869") {
+		t.Fatalf("expected the selected inbound frames to be traced up to the burst, got %q", out.String())
+	}
+	if tracer.Dropped() != 1 {
+		t.Fatalf("expected 1 trace to be dropped by the rate limit, got %d", tracer.Dropped())
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	load := func() (v [5]uint64) {
+		for i, name := range []string{"accepted", "active", "bytes_in", "bytes_out", "loop_iterations"} {
+			if f, ok := expvar.Get("gnet." + name).(expvar.Func); ok {
+				v[i] = f().(uint64)
+			}
+		}
+		return
+	}
+	base := load()
+	s, err := NewServer(&testNewServer{}, "memory://expvar", WithTestMode(true), WithExpvar(true))
+	must(err)
+	must(s.Start())
+	c, err := DialMemory("expvar")
+	must(err)
+	defer c.Close()
+	must(s.PollOnce(time.Second))
+	echo := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(c, make([]byte, 5))
+		echo <- err
+	}()
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	must(s.PollOnce(time.Second))
+	must(<-echo)
+	got := load()
+	if got[0]-base[0] != 1 || got[1]-base[1] != 1 || got[2]-base[2] != 5 || got[3]-base[3] != 5 || got[4] <= base[4] {
+		t.Fatalf("expected the counters to account for the connection, got %v over %v", got, base)
+	}
+
+	must(s.Stop(context.Background()))
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		expvarServers.Lock()
+		n := len(expvarServers.servers)
+		expvarServers.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stopped server to be removed from expvar")
+		}
+	}
+	if stopped := load(); stopped[0] != got[0] || stopped[1] != base[1] || stopped[2] != got[2] {
+		t.Fatalf("expected the counters of the stopped server to be retained but for the active connections, got %v",
+			stopped)
+	}
+}
+
+func TestReactBatch(t *testing.T) {
+	events := &testReactBatchServer{}
+	s, err := NewServer(events, "memory://react-batch", WithTestMode(true), WithCodec(&LineBasedFrameCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("react-batch")
+	must(err)
+	defer c.Close()
+	must(s.PollOnce(time.Second))
+	echo := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 12)
+		_, err := io.ReadFull(c, buf)
+		must(err)
+		echo <- string(buf)
+	}()
+	_, err = c.Write([]byte("GET\nSET\nDEL\n"))
+	must(err)
+	must(s.PollOnce(time.Second))
+	if got := <-echo; got != "GET,SET,DEL\n" || events.batches != 1 {
+		t.Fatalf("expected the pipelined frames in one batch, got %q in %d batches", got, events.batches)
+	}
+}
+
+type testReactBatchServer struct {
+	*EventServer
+	batches int
+}
+
+func (t *testReactBatchServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	panic("React fires for a BatchHandler")
+}
+
+func (t *testReactBatchServer) ReactBatch(frames [][]byte, c Conn) (out []byte, action Action) {
+	t.batches++
+	return bytes.Join(frames, []byte(",")), None
+}
+
+func TestWriteFilter(t *testing.T) {
+	s, err := NewServer(&testWriteFilterServer{}, "memory://write-filter", WithTestMode(true),
+		WithCodec(&LineBasedFrameCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("write-filter")
+	must(err)
+	defer c.Close()
+	echo := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 13)
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := io.ReadFull(c, buf)
+		echo <- string(buf[:n])
+	}()
+	must(s.PollOnce(time.Second))
+	_, err = c.Write([]byte("hello\nsecret\n"))
+	must(err)
+	must(s.PollOnce(time.Second))
+	if got := <-echo; got != "<HI\n><HELLO\n>" {
+		t.Fatalf("expected the writes to pass through the filters in order, got %q", got)
+	}
+}
+
+type testWriteFilterServer struct {
+	*EventServer
+}
+
+func (t *testWriteFilterServer) OnOpened(c Conn) (out []byte, action Action) {
+	c.AddWriteFilter(func(c Conn, buf []byte) []byte {
+		if string(buf) == "secret\n" {
+			return nil
+		}
+		return bytes.ToUpper(buf)
+	})
+	c.AddWriteFilter(func(c Conn, buf []byte) []byte {
+		return append(append([]byte("<"), buf...), '>')
+	})
+	return []byte("hi\n"), None
+}
+
+func (t *testWriteFilterServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return frame, None
+}
+
+func TestLoopCounters(t *testing.T) {
+	var lc loopCounters
+	lc.addConns(2)
+	lc.addCoalescedWrite()
+	lc.addCoalescedWrite()
+	lc.addCoalescedFlush()
+	if n := lc.loadConns(); n != 0 {
+		t.Fatalf("expected the counters to be unpublished, got %d connections", n)
+	}
+	lc.publish()
+	lc.addConns(-1)
+	writes, flushes := lc.loadCoalesced()
+	if n := lc.loadConns(); n != 2 || writes != 2 || flushes != 1 {
+		t.Fatalf("unexpected published counters: conns=%d writes=%d flushes=%d", n, writes, flushes)
+	}
+	lc.publish()
+	if n := lc.loadConns(); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+	lc.endBatch()
+	if _, _, _, iterations := lc.loadTraffic(); iterations != 1 || lc.dirty {
+		t.Fatalf("expected 1 iteration published alone, got %d, dirty=%t", iterations, lc.dirty)
+	}
+}
+
+func TestShutdownOrdering(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp-reuseport"} {
+		t.Run(network, func(t *testing.T) {
+			var opts []Option
+			if network == "tcp-reuseport" {
+				opts = append(opts, WithReusePort(true))
+			}
+			h := &testShutdownOrderServer{reacted: make(chan struct{}), shutdown: make(chan int32, 1)}
+			s, err := NewServer(h, "tcp://127.0.0.1:0", append(opts, WithMulticore(true))...)
+			must(err)
+			must(s.Start())
+			idle, err := net.Dial("tcp", s.Addr.String())
+			must(err)
+			defer idle.Close()
+			c, err := net.Dial("tcp", s.Addr.String())
+			must(err)
+			defer c.Close()
+			_, err = c.Write([]byte("x"))
+			must(err)
+			<-h.reacted
+			// Start reading only after the shutdown begins, so that the response is flushed by the shutdown.
+			received := make(chan int, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+				n, _ := io.Copy(ioutil.Discard, c)
+				received <- int(n)
+			}()
+			must(s.Stop(context.Background()))
+			if n := <-received; n != testShutdownResponseSize {
+				t.Fatalf("expected the response of %d bytes to be flushed, got %d bytes", testShutdownResponseSize, n)
+			}
+			if closed := <-h.shutdown; closed != 2 {
+				t.Fatalf("expected OnShutdown to fire after OnClosed of both connections, got %d", closed)
+			}
+		})
+	}
+}
+
+const testShutdownResponseSize = 8 << 20
+
+type testShutdownOrderServer struct {
+	*EventServer
+	closed   int32
+	reacted  chan struct{}
+	shutdown chan int32
+}
+
+func (t *testShutdownOrderServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	close(t.reacted)
+	return make([]byte, testShutdownResponseSize), None
+}
+
+func (t *testShutdownOrderServer) OnClosed(c Conn, err error) (action Action) {
+	atomic.AddInt32(&t.closed, 1)
+	return
+}
+
+func (t *testShutdownOrderServer) OnShutdown() {
+	t.shutdown <- atomic.LoadInt32(&t.closed)
+}
+
+func TestConnRetain(t *testing.T) {
+	h := &testRetainServer{retained: make(chan Conn, 1), closed: make(chan struct{})}
+	s, err := NewServer(h, "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	conn := <-h.retained
+	must(c.Close())
+	<-h.closed
+	if conn.Context() != "retained" || conn.RemoteAddr() == nil {
+		t.Fatalf("expected the context and the address to stay valid, got %v and %v", conn.Context(), conn.RemoteAddr())
+	}
+	for name, err := range map[string]error{
+		"AsyncWrite": conn.AsyncWrite([]byte("stale")),
+		"Wake":       conn.Wake(),
+		"WakeWith":   conn.WakeWith(nil),
+		"Close":      conn.Close(),
+		"Retain":     conn.Retain(),
+	} {
+		if err != ErrConnClosed {
+			t.Fatalf("expected %s to fail with ErrConnClosed, got %v", name, err)
+		}
+	}
+	conn.Release()
+}
+
+type testRetainServer struct {
+	*EventServer
+	retained chan Conn
+	closed   chan struct{}
+}
+
+func (t *testRetainServer) OnOpened(c Conn) (out []byte, action Action) {
+	c.SetContext("retained")
+	must(c.Retain())
+	t.retained <- c
+	return
+}
+
+func (t *testRetainServer) OnClosed(c Conn, err error) (action Action) {
+	close(t.closed)
+	return
+}
+
+func TestConnGone(t *testing.T) {
+	h := &testGoneServer{opened: make(chan Conn, 1), closed: make(chan struct{})}
+	s, err := NewServer(h, "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	conn := <-h.opened
+	gone := conn.Gone()
+	select {
+	case <-gone:
+		t.Fatal("expected Gone to stay open until the connection is closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	must(c.Close())
+	select {
+	case <-gone:
+	case <-time.After(time.Second):
+		t.Fatal("expected Gone to be closed once the connection is closed")
+	}
+	select {
+	case <-h.closed:
+	default:
+		t.Fatal("expected Gone to be closed after OnClosed")
+	}
+	select {
+	case <-conn.Gone():
+	default:
+		t.Fatal("expected Gone of a closed connection to return a closed channel")
+	}
+}
+
+type testGoneServer struct {
+	*EventServer
+	opened chan Conn
+	closed chan struct{}
+}
+
+func (t *testGoneServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.opened <- c
+	return
+}
+
+func (t *testGoneServer) OnClosed(c Conn, err error) (action Action) {
+	close(t.closed)
+	return
+}
+
+func TestPauseRead(t *testing.T) {
+	h := &testPauseReadServer{paused: make(chan Conn, 1), frames: make(chan string, 4)}
+	s, err := NewServer(h, "tcp://127.0.0.1:0", WithCodec(&LineBasedFrameCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("pause\nfirst\n"))
+	must(err)
+	conn := <-h.paused
+	_, err = c.Write([]byte("second\n"))
+	must(err)
+	select {
+	case frame := <-h.frames:
+		t.Fatalf("expected no frames while reading is paused, got %q", frame)
+	case <-time.After(100 * time.Millisecond):
+	}
+	must(conn.ResumeRead())
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case frame := <-h.frames:
+			if frame != expected {
+				t.Fatalf("expected %q after resuming, got %q", expected, frame)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q after resuming", expected)
+		}
+	}
+}
+
+type testPauseReadServer struct {
+	*EventServer
+	paused chan Conn
+	frames chan string
+}
+
+func (t *testPauseReadServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if string(frame) == "pause" {
+		must(c.PauseRead())
+		t.paused <- c
+		return
+	}
+	t.frames <- string(frame)
+	return
+}
+
+func TestPauseAccept(t *testing.T) {
+	h := &testPauseAcceptServer{opened: make(chan struct{}, 2)}
+	s, err := NewServer(h, "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	must(s.PauseAccept())
+	if !s.AcceptPaused() {
+		t.Fatal("expected accepting to be paused")
+	}
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	select {
+	case <-h.opened:
+		t.Fatal("expected no connections to be opened while accepting is paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	must(s.ResumeAccept())
+	select {
+	case <-h.opened:
+	case <-time.After(time.Second):
+		t.Fatal("expected the pending connection to be opened after resuming")
+	}
+
+	m, err := NewServer(new(EventServer), "memory://pause-accept", WithTestMode(true))
+	must(err)
+	must(m.Start())
+	defer func() {
+		must(m.Stop(context.Background()))
+	}()
+	if err = m.PauseAccept(); err != ErrProtocolNotSupported {
+		t.Fatalf("expected ErrProtocolNotSupported for the memory network, got %v", err)
+	}
+}
+
+type testPauseAcceptServer struct {
+	*EventServer
+	opened chan struct{}
+}
+
+func (t *testPauseAcceptServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.opened <- struct{}{}
+	return
+}
+
+func TestAsyncWriteTo(t *testing.T) {
+	h := &testAsyncWriteToServer{opened: make(chan uint64, 2), closed: make(chan struct{}, 2)}
+	s, err := NewServer(h, "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	if err = s.AsyncWriteTo(0, []byte("udp")); err != ErrInvalidConnID {
+		t.Fatalf("expected ErrInvalidConnID, got %v", err)
+	}
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	id := <-h.opened
+	must(s.AsyncWriteTo(id, []byte("hello")))
+	buf := make([]byte, 5)
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+	must(c.Close())
+	<-h.closed
+
+	// The stale ID must not address the next connection, which is likely to reuse the file descriptor.
+	c, err = net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	if next := <-h.opened; next == id {
+		t.Fatalf("expected a new ID for the next connection, got %d again", next)
+	}
+	must(s.AsyncWriteTo(id, []byte("stale")))
+	must(s.WakeConn(id))
+	_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := c.Read(buf); err == nil {
+		t.Fatalf("expected nothing to be delivered to the next connection, got %q", buf[:n])
+	}
+}
+
+type testAsyncWriteToServer struct {
+	*EventServer
+	opened chan uint64
+	closed chan struct{}
+}
+
+func (t *testAsyncWriteToServer) OnOpened(c Conn) (out []byte, action Action) {
+	t.opened <- c.ID()
+	return
+}
+
+func (t *testAsyncWriteToServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if frame == nil {
+		out = []byte("woken")
+	}
+	return
+}
+
+func (t *testAsyncWriteToServer) OnClosed(c Conn, err error) (action Action) {
+	t.closed <- struct{}{}
+	return
+}
+
+func TestTickerSchedule(t *testing.T) {
+	h := &testTickerScheduleServer{}
+	started := time.Now()
+	s, err := NewServer(h, "tcp://127.0.0.1:0", WithTicker(true), WithTickerSchedule(100*time.Millisecond, 0.5))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	for atomic.LoadInt32(&h.ticks) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if first := time.Unix(0, atomic.LoadInt64(&h.first)); first.Sub(started) < 100*time.Millisecond {
+		t.Fatalf("expected the first tick after the initial delay, got it after %v", first.Sub(started))
+	}
+	must(s.StopTicker())
+	time.Sleep(50 * time.Millisecond)
+	stopped := atomic.LoadInt32(&h.ticks)
+	time.Sleep(100 * time.Millisecond)
+	if ticks := atomic.LoadInt32(&h.ticks); ticks != stopped {
+		t.Fatalf("expected no tick while the ticker is stopped, got %d more", ticks-stopped)
+	}
+	must(s.StartTicker())
+	for atomic.LoadInt32(&h.ticks) == stopped {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	s, err = NewServer(new(EventServer), "tcp://127.0.0.1:0")
+	must(err)
+	if err = s.StopTicker(); err != ErrTickerDisabled {
+		t.Fatalf("expected ErrTickerDisabled, got %v", err)
+	}
+	must(s.Stop(context.Background()))
+	if _, err = NewServer(h, "tcp://127.0.0.1:0", WithTicker(true), WithTickerSchedule(0, 1)); err == nil {
+		t.Fatal("expected the jitter of 1 to be rejected")
+	}
+}
+
+type testTickerScheduleServer struct {
+	*EventServer
+	ticks int32
+	first int64
+}
+
+func (t *testTickerScheduleServer) Tick() (delay time.Duration, action Action) {
+	atomic.CompareAndSwapInt64(&t.first, 0, time.Now().UnixNano())
+	atomic.AddInt32(&t.ticks, 1)
+	return 10 * time.Millisecond, None
+}
+
+func TestAddTicker(t *testing.T) {
+	s, err := NewServer(new(EventServer), "tcp://127.0.0.1:0", WithNumEventLoop(2))
+	must(err)
+	must(s.Start())
+	var fast, slow int32
+	must(s.AddTicker("fast", 0, 5*time.Millisecond, func() Action {
+		atomic.AddInt32(&fast, 1)
+		return None
+	}))
+	must(s.AddTicker("slow", 1, 50*time.Millisecond, func() Action {
+		atomic.AddInt32(&slow, 1)
+		return None
+	}))
+	if err = s.AddTicker("fast", 1, time.Second, func() Action { return None }); err != ErrTickerExists {
+		t.Fatalf("expected ErrTickerExists, got %v", err)
+	}
+	if err = s.AddTicker("bad", 2, time.Second, func() Action { return None }); err != ErrInvalidLoopIndex {
+		t.Fatalf("expected ErrInvalidLoopIndex, got %v", err)
+	}
+	for atomic.LoadInt32(&slow) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&fast); n <= 2 {
+		t.Fatalf("expected the fast ticker to run more often than the slow one, got %d runs", n)
+	}
+	must(s.RemoveTicker("fast"))
+	if err = s.RemoveTicker("fast"); err != ErrTickerNotFound {
+		t.Fatalf("expected ErrTickerNotFound, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	removed := atomic.LoadInt32(&fast)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&fast); n != removed {
+		t.Fatalf("expected the removed ticker to stop, got %d more runs", n-removed)
+	}
+	must(s.AddTicker("shutdown", 1, time.Millisecond, func() Action { return Shutdown }))
+	s.Wait()
+}
+
+func TestConnScan(t *testing.T) {
+	h := &testConnScanServer{notices: make(chan IdleNotice, 64)}
+	s, err := NewServer(h, "tcp://127.0.0.1:0", WithConnScan(&ConnScan{
+		Interval: 40 * time.Millisecond,
+		Inspect: func(c Conn, idle time.Duration) ScanVerdict {
+			switch {
+			case idle >= 150*time.Millisecond:
+				return ScanClose
+			case idle > 0:
+				return ScanNotify
+			}
+			return ScanKeep
+		},
+	}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	idle, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer idle.Close()
+	busy, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer busy.Close()
+	closed := make(chan error, 1)
+	go func() {
+		_ = idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := idle.Read(make([]byte, 1))
+		closed <- err
+	}()
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); {
+		_, err = busy.Write([]byte("x"))
+		must(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = <-closed; err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed by the scanner, got %v", err)
+	}
+	if n := <-h.notices; n.Idle <= 0 {
+		t.Fatalf("expected a positive idle duration, got %v", n.Idle)
+	}
+	_ = busy.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = busy.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatal("expected the busy connection to be kept")
+	}
+}
+
+type testConnScanServer struct {
+	*EventServer
+	notices chan IdleNotice
+}
+
+func (t *testConnScanServer) OnUserEvent(c Conn, tag interface{}) (action Action) {
+	t.notices <- tag.(IdleNotice)
+	return
+}
+
+func TestListenerStats(t *testing.T) {
+	s, err := NewServer(new(EventServer), "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	stats, err := s.ListenerStats()
+	if runtime.GOOS != "linux" {
+		if err != ErrProtocolNotSupported {
+			t.Fatalf("expected ErrProtocolNotSupported, got %v", err)
+		}
+		return
+	}
+	must(err)
+	if stats.AcceptQueueCap <= 0 || stats.AcceptQueueLen < 0 {
+		t.Fatalf("unexpected accept queue: %+v", stats)
+	}
+
+	u, err := NewServer(new(EventServer), "udp://127.0.0.1:0")
+	must(err)
+	must(u.Start())
+	defer func() {
+		must(u.Stop(context.Background()))
+	}()
+	if _, err = u.ListenerStats(); err != ErrProtocolNotSupported {
+		t.Fatalf("expected ErrProtocolNotSupported for udp, got %v", err)
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	h := &testTCPInfoServer{infos: make(chan error, 1)}
+	s, err := NewServer(h, "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("ping"))
+	must(err)
+	err = <-h.infos
+	if runtime.GOOS != "linux" {
+		if err != ErrProtocolNotSupported {
+			t.Fatalf("expected ErrProtocolNotSupported, got %v", err)
+		}
+		return
+	}
+	must(err)
+	if h.info.SndCwnd == 0 || h.info.SndMSS == 0 {
+		t.Fatalf("unexpected TCP_INFO: %+v", h.info)
+	}
+}
+
+type testTCPInfoServer struct {
+	*EventServer
+	info  TCPInfo
+	infos chan error
+}
+
+func (t *testTCPInfoServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	var err error
+	t.info, err = c.TCPInfo()
+	t.infos <- err
+	return
+}
+
+func TestSlowReact(t *testing.T) {
+	events := &testSlowReactServer{slow: make(chan []byte, 1)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithSlowReact(20*time.Millisecond, true))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("slow"))
+	must(err)
+	stack := <-events.slow
+	if !bytes.Contains(stack, []byte("testSlowReactServer).React")) {
+		t.Fatalf("expected the stack of the slow React, got:\n%s", stack)
+	}
+	for i := 0; s.SlowReacts() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("expected 1 slow React, got %d", s.SlowReacts())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testSlowReactServer struct {
+	*EventServer
+	slow chan []byte
+}
+
+func (t *testSlowReactServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	time.Sleep(100 * time.Millisecond)
+	return
+}
+func (t *testSlowReactServer) OnSlowReact(c Conn, d time.Duration, stack []byte) {
+	if d < 100*time.Millisecond {
+		panic(fmt.Sprintf("unexpected duration of the slow React: %v", d))
+	}
+	t.slow <- stack
+}
+
+func TestWatchdog(t *testing.T) {
+	events := &testWatchdogServer{
+		ids:     make(chan uint64, 1),
+		release: make(chan struct{}),
+		blocked: make(chan BlockedLoop, 1),
+	}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithWatchdog(100*time.Millisecond))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("block"))
+	must(err)
+	id := <-events.ids
+	report := <-events.blocked
+	close(events.release)
+	if report.LastConn != id || report.Blocked < 100*time.Millisecond {
+		t.Fatalf("unexpected report of the blocked event-loop: %+v", report)
+	}
+	if !bytes.Contains(report.Goroutines, []byte("testWatchdogServer).React")) {
+		t.Fatalf("expected the goroutine dump to contain the blocked React, got:\n%s", report.Goroutines)
+	}
+}
+
+type testWatchdogServer struct {
+	*EventServer
+	ids     chan uint64
+	release chan struct{}
+	blocked chan BlockedLoop
+}
+
+func (t *testWatchdogServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.ids <- c.ID()
+	<-t.release
+	return
+}
+func (t *testWatchdogServer) OnLoopBlocked(report BlockedLoop) {
+	select {
+	case t.blocked <- report:
+	default:
+	}
+}
+
+func TestLoopOverload(t *testing.T) {
+	events := &testLoopOverloadServer{
+		release:    make(chan struct{}),
+		overloaded: make(chan float64, 1),
+	}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithLoopOverload(0.5))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("block"))
+	must(err)
+	var utilization float64
+	select {
+	case utilization = <-events.overloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the blocked event-loop to be reported overloaded")
+	}
+	loops := s.LoopUtilization()
+	close(events.release)
+	if utilization < 0.5 || utilization > 1 || len(loops) != 1 || loops[0] != utilization {
+		t.Fatalf("unexpected utilization of the blocked event-loop: %v, %v", utilization, loops)
+	}
+}
+
+type testLoopOverloadServer struct {
+	*EventServer
+	release    chan struct{}
+	overloaded chan float64
+}
+
+func (t *testLoopOverloadServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	<-t.release
+	return
+}
+
+func (t *testLoopOverloadServer) OnLoopOverload(loop int, utilization float64) {
+	select {
+	case t.overloaded <- utilization:
+	default:
+	}
+}
+
+func TestConnGoroutine(t *testing.T) {
+	events := new(testConnGoroutineServer)
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithConnGoroutine(true), WithConnGoroutineQueue(1, ConnQueueBlockReads))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+
+	slow, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer slow.Close()
+	_, err = slow.Write([]byte("slow"))
+	must(err)
+	time.Sleep(20 * time.Millisecond)
+	// The blocking React of the slow connection doesn't stall the event-loop.
+	fast, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer fast.Close()
+	_, err = fast.Write([]byte("fast"))
+	must(err)
+	must(fast.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(fast, buf)
+	must(err)
+
+	// The reads are paused while the queue is full, the data is echoed in order.
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	go func() {
+		_, _ = fast.Write(data)
+	}()
+	must(fast.SetReadDeadline(time.Now().Add(10 * time.Second)))
+	echo := make([]byte, len(data))
+	_, err = io.ReadFull(fast, echo)
+	must(err)
+	if !bytes.Equal(echo, data) {
+		t.Fatal("unexpected echo")
+	}
+}
+
+type testConnGoroutineServer struct {
+	*EventServer
+}
+
+func (t *testConnGoroutineServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if string(frame) == "slow" {
+		time.Sleep(time.Second)
+	}
+	return frame, None
+}
+
+func TestConnQueuePolicy(t *testing.T) {
+	for _, policy := range []ConnQueuePolicy{ConnQueueDropNewest, ConnQueueClose} {
+		events := &testConnQueueServer{release: make(chan struct{})}
+		s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(new(LineBasedFrameCodec)),
+			WithConnGoroutine(true), WithConnGoroutineQueue(1, policy))
+		must(err)
+		must(s.Start())
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		_, err = c.Write(bytes.Repeat([]byte("frame\n"), 10))
+		must(err)
+		for i := 0; ; i++ {
+			dropped, closed := s.ConnQueueStats()
+			if policy == ConnQueueDropNewest && dropped >= 8 || policy == ConnQueueClose && closed == 1 {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("unexpected stats of policy %d: %d dropped, %d closed", policy, dropped, closed)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(events.release)
+		must(c.Close())
+		must(s.Stop(context.Background()))
+	}
+}
+
+type testConnQueueServer struct {
+	*EventServer
+	release chan struct{}
+}
+
+func (t *testConnQueueServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	<-t.release
+	return
+}
+
+func TestRemoteIPPort(t *testing.T) {
+	events := &testRemoteIPServer{result: make(chan string, 1)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("ip"))
+	must(err)
+	local := c.LocalAddr().(*net.TCPAddr)
+	if result, expected := <-events.result, fmt.Sprintf("%v:%d allocs:0", local.IP, local.Port); result != expected {
+		t.Fatalf("expected %s, got %s", expected, result)
+	}
+}
+
+type testRemoteIPServer struct {
+	*EventServer
+	result chan string
+}
+
+func (t *testRemoteIPServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = c.RemoteIP(), c.RemotePort()
+	})
+	t.result <- fmt.Sprintf("%v:%d allocs:%v", c.RemoteIP(), c.RemotePort(), allocs)
+	return
+}
+
+func TestHolePunch(t *testing.T) {
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request, 0x0001)
+	binary.BigEndian.PutUint32(request[4:], 0x2112A442)
+	copy(request[8:], "transaction!")
+	if !IsSTUNBindingRequest(request) || IsSTUNBindingRequest(request[:19]) {
+		t.Fatal("unexpected STUN Binding request detection")
+	}
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.1"), Port: 32853},
+		{IP: net.ParseIP("2001:db8::1"), Port: 32853},
+	} {
+		resp := AppendSTUNBindingResponse(nil, request, addr)
+		if binary.BigEndian.Uint16(resp) != 0x0101 || !bytes.Equal(resp[4:20], request[4:20]) ||
+			int(binary.BigEndian.Uint16(resp[2:])) != len(resp)-20 {
+			t.Fatalf("unexpected STUN Binding response header: %x", resp)
+		}
+		xaddr := resp[28:]
+		ip := make(net.IP, len(xaddr))
+		for i := range xaddr {
+			ip[i] = xaddr[i] ^ request[4+i]
+		}
+		port := int(binary.BigEndian.Uint16(resp[26:]) ^ 0x2112)
+		if !ip.Equal(addr.IP) || port != addr.Port {
+			t.Fatalf("expected %v, got %v:%d", addr, ip, port)
+		}
+	}
+
+	s, err := NewServer(&EventServer{}, "udp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	must(err)
+	defer peer.Close()
+	stop, err := s.Punch(HolePunch{
+		Candidates: []net.Addr{peer.LocalAddr()},
+		Payload:    []byte("punch"),
+		Attempts:   3,
+		Interval:   10 * time.Millisecond,
+	})
+	must(err)
+	defer stop()
+	buf := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		must(peer.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := peer.ReadFrom(buf)
+		must(err)
+		if string(buf[:n]) != "punch" {
+			t.Fatalf("expected punch, got %q", buf[:n])
+		}
+	}
+	must(peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	if _, _, err = peer.ReadFrom(buf); err == nil {
+		t.Fatal("expected no more than 3 rounds of sends")
+	}
+}
+
+func TestUDPReadBufferSize(t *testing.T) {
+	for _, tc := range []struct {
+		size, datagram, expected int
+	}{
+		{0, 60000, 60000},
+		{1500, 1500, 1500},
+	} {
+		s, err := NewServer(&testUDPEchoServer{}, "udp://127.0.0.1:0", WithUDPReadBufferSize(tc.size))
+		must(err)
+		must(s.Start())
+		c, err := net.Dial("udp", s.Addr.String())
+		must(err)
+		_, err = c.Write(bytes.Repeat([]byte{'x'}, tc.datagram))
+		must(err)
+		must(c.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, MaxUDPReadBufferSize)
+		n, err := c.Read(buf)
+		must(err)
+		if n != tc.expected {
+			t.Fatalf("expected a datagram of %d bytes to be read in %d bytes, got %d", tc.datagram, tc.expected, n)
+		}
+		must(c.Close())
+		must(s.Stop(context.Background()))
+	}
+}
+
+type testUDPEchoServer struct {
+	*EventServer
+}
+
+func (t *testUDPEchoServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return frame, None
+}
+
+func TestUDPTruncation(t *testing.T) {
+	events := &testUDPTruncationServer{truncated: make(chan int, 1)}
+	s, err := NewServer(events, "udp://127.0.0.1:0", WithUDPReadBufferSize(1500))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("udp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write(bytes.Repeat([]byte{'x'}, 1501))
+	must(err)
+	select {
+	case n := <-events.truncated:
+		if n != 1500 {
+			t.Fatalf("expected the truncated datagram to be reported with 1500 bytes, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the truncated datagram wasn't reported")
+	}
+	_, err = c.Write([]byte("ping"))
+	must(err)
+	must(c.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, MaxUDPReadBufferSize)
+	n, err := c.Read(buf)
+	must(err)
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("expected only the datagram fitting the buffer to be echoed, got %d bytes", n)
+	}
+	for i := 0; s.TruncatedDatagrams() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("expected 1 truncated datagram, got %d", s.TruncatedDatagrams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testUDPTruncationServer struct {
+	testUDPEchoServer
+	truncated chan int
+}
+
+func (t *testUDPTruncationServer) OnTruncatedDatagram(c Conn, head []byte) (action Action) {
+	t.truncated <- len(head)
+	return
+}
+
+func TestFTPPassive(t *testing.T) {
+	if verb, arg := ParseFTPCommand([]byte("stor my file.txt\r")); verb != "STOR" || string(arg) != "my file.txt" {
+		t.Fatalf("unexpected command: %q %q", verb, arg)
+	}
+	if reply := AppendFTPReply(nil, 211, "Features:", " EPSV", "End"); string(reply) !=
+		"211-Features:\r\n211- EPSV\r\n211 End" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if reply := AppendFTPPassiveReply(nil, net.IPv4(127, 0, 0, 1), 50000); string(reply) !=
+		"227 Entering Passive Mode (127,0,0,1,195,80)" {
+		t.Fatalf("unexpected PASV reply: %q", reply)
+	}
+
+	events := &testFTPServer{localAddrs: make(chan net.Addr, 1)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(&FTPCodec{MaxLineLength: 64}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	_, err = c.Write([]byte("NOOP " + strings.Repeat("x", 64) + "\r\nEPSV\r\n"))
+	must(err)
+	if line, err := r.ReadString('\n'); err != nil || line != "500 syntax error\r\n" {
+		t.Fatalf("expected 500, got %q, %v", line, err)
+	}
+	line, err := r.ReadString('\n')
+	must(err)
+	var port int
+	if _, err = fmt.Sscanf(line, "229 Entering Extended Passive Mode (|||%d|)", &port); err != nil {
+		t.Fatalf("unexpected EPSV reply: %q", line)
+	}
+
+	data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	must(err)
+	defer data.Close()
+	_ = data.SetReadDeadline(time.Now().Add(5 * time.Second))
+	content, err := ioutil.ReadAll(data)
+	must(err)
+	if string(content) != "file content" {
+		t.Fatalf("unexpected data: %q", content)
+	}
+	if addr := <-events.localAddrs; addr.(*net.TCPAddr).Port != port {
+		t.Fatalf("expected the data connection on port %d, got %v", port, addr)
+	}
+	// The listener is closed once the data connection is accepted.
+	if data, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		_ = data.Close()
+		t.Fatal("expected the passive listener to be closed")
+	}
+}
+
+type testFTPServer struct {
+	*EventServer
+	svr        Server
+	localAddrs chan net.Addr
+}
+
+func (t *testFTPServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+
+func (t *testFTPServer) OnOpened(c Conn) (out []byte, action Action) {
+	if c.Context() == "data" {
+		t.localAddrs <- c.LocalAddr()
+		return []byte("file content"), Close
+	}
+	return
+}
+
+func (t *testFTPServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	switch verb, _ := ParseFTPCommand(frame); verb {
+	case "EPSV":
+		addr, err := t.svr.ListenPassive(PassiveData{Control: c, Codec: &BuiltInFrameCodec{}, Context: "data"})
+		if err != nil {
+			return []byte("425 " + err.Error()), None
+		}
+		out = AppendFTPExtendedPassiveReply(nil, addr.Port)
+	default:
+		out = []byte("500 syntax error")
+	}
+	return
+}
+
+func TestFlowDecoder(t *testing.T) {
+	v5 := make([]byte, 24+48)
+	binary.BigEndian.PutUint16(v5, 5)
+	binary.BigEndian.PutUint16(v5[2:], 1)
+	binary.BigEndian.PutUint32(v5[8:], 1600000000)
+	copy(v5[24:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	binary.BigEndian.PutUint32(v5[24+20:], 1500)
+	binary.BigEndian.PutUint16(v5[24+34:], 443)
+	v5[24+38] = 6
+	h, records, err := ParseNetflowV5(v5)
+	must(err)
+	if h.ExportTime.Unix() != 1600000000 || len(records) != 1 || records[0].SrcAddr.String() != "10.0.0.1" ||
+		records[0].DstAddr.String() != "10.0.0.2" || records[0].Octets != 1500 || records[0].DstPort != 443 ||
+		records[0].Protocol != 6 {
+		t.Fatalf("unexpected Netflow v5 packet: %+v %+v", h, records)
+	}
+	if _, _, err = ParseNetflowV5(v5[:len(v5)-1]); err != ErrInvalidFlowPacket {
+		t.Fatalf("expected ErrInvalidFlowPacket, got %v", err)
+	}
+
+	var d FlowDecoder
+	exporter := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2055}
+	// A Netflow v9 packet with a template of sourceIPv4Address and inBytes of 2 bytes, and a data set of two records.
+	v9 := []byte{0, 9, 0, 2, 0, 0, 0, 0, 0x5f, 0x5e, 0x10, 0, 0, 0, 0, 7, 0, 0, 0, 1,
+		0, 0, 0, 16, 1, 0, 0, 2, 0, 8, 0, 4, 0, 1, 0, 2,
+		1, 0, 0, 16, 10, 0, 0, 1, 0, 100, 10, 0, 0, 2, 0, 200}
+	p, err := d.Decode(exporter, v9)
+	must(err)
+	if p.Version != 9 || p.Sequence != 7 || p.DomainID != 1 || len(p.Records) != 2 ||
+		net.IP(p.Records[1].Fields[0].Value).String() != "10.0.0.2" || p.Records[1].Fields[1].Uint() != 200 {
+		t.Fatalf("unexpected Netflow v9 packet: %+v", p)
+	}
+
+	// An IPFIX data set arriving before its template is skipped.
+	data := []byte{1, 1, 0, 13, 0, 0, 0, 42, 3, 'a', 'b', 'c', 0}
+	ipfix := func(sets ...[]byte) []byte {
+		packet := []byte{0, 10, 0, 0, 0x5f, 0x5e, 0x10, 0, 0, 0, 0, 1, 0, 0, 0, 3}
+		for _, set := range sets {
+			packet = append(packet, set...)
+		}
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		return packet
+	}
+	if p, err = d.Decode(exporter, ipfix(data)); err != nil || p.Skipped != 1 || len(p.Records) != 0 {
+		t.Fatalf("expected the data set to be skipped, got %+v, %v", p, err)
+	}
+	// The template of an enterprise-specific field of 4 bytes and a variable-length field.
+	template := []byte{0, 2, 0, 20, 1, 1, 0, 2, 0x80, 1, 0, 4, 0, 0, 0x7a, 0x69, 0, 82, 0xff, 0xff}
+	p, err = d.Decode(exporter, ipfix(template, data))
+	must(err)
+	if p.Version != 10 || p.Skipped != 0 || len(p.Records) != 1 || p.Records[0].Fields[0].EnterpriseID != 31337 ||
+		p.Records[0].Fields[0].Type != 1 || p.Records[0].Fields[0].Uint() != 42 ||
+		string(p.Records[0].Fields[1].Value) != "abc" {
+		t.Fatalf("unexpected IPFIX packet: %+v", p)
+	}
+	// The templates are scoped by the exporters.
+	if p, err = d.Decode(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2055}, ipfix(data)); err != nil ||
+		p.Skipped != 1 {
+		t.Fatalf("expected the data set of another exporter to be skipped, got %+v, %v", p, err)
+	}
+	// The withdrawn templates are dropped.
+	if p, err = d.Decode(exporter, ipfix([]byte{0, 2, 0, 8, 1, 1, 0, 0}, data)); err != nil || p.Skipped != 1 {
+		t.Fatalf("expected the template to be withdrawn, got %+v, %v", p, err)
+	}
+	if _, err = d.Decode(exporter, ipfix([]byte{1, 0, 0, 40})); err != ErrInvalidFlowPacket {
+		t.Fatalf("expected ErrInvalidFlowPacket, got %v", err)
+	}
+	d.Forget(exporter)
+	if p, err = d.Decode(exporter, v9); err != nil || len(p.Records) != 2 {
+		t.Fatalf("unexpected Netflow v9 packet: %+v, %v", p, err)
+	}
+}
+
+func TestCursorCodec(t *testing.T) {
+	events := &testCursorServer{frames: make(chan string, 3)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(&testVarintCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	var stream []byte
+	for _, frame := range []string{"hello", strings.Repeat("x", 200), "world"} {
+		stream = append(stream, make([]byte, binary.MaxVarintLen64)...)
+		n := binary.PutUvarint(stream[len(stream)-binary.MaxVarintLen64:], uint64(len(frame)))
+		stream = append(stream[:len(stream)-binary.MaxVarintLen64+n], frame...)
+	}
+	// Feed the stream byte by byte to leave incomplete frames behind.
+	for _, b := range stream {
+		_, err = c.Write([]byte{b})
+		must(err)
+		time.Sleep(time.Millisecond)
+	}
+	for _, expected := range []string{"hello", strings.Repeat("x", 200), "world"} {
+		if frame := <-events.frames; frame != expected {
+			t.Fatalf("expected %q, got %q", expected, frame)
+		}
+	}
+}
+
+type testVarintCodec struct{}
+
+func (cc *testVarintCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func (cc *testVarintCodec) Decode(c Conn) ([]byte, error) {
+	cur := c.Cursor()
+	size, err := cur.ReadUvarint()
+	if err != nil {
+		return nil, err
+	}
+	frame, err := cur.ReadBytes(int(size))
+	if err != nil {
+		return nil, err
+	}
+	cur.Commit()
+	return frame, nil
+}
+
+type testCursorServer struct {
+	*EventServer
+	frames chan string
+}
+
+func (t *testCursorServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames <- string(frame)
+	return
+}
+
+func TestCodecContext(t *testing.T) {
+	events := &testCodecContextServer{frames: make(chan string, 3)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(&testCountingCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("a\nb\nc\n"))
+	must(err)
+	for _, expected := range []string{"user 1:a", "user 2:b", "user 3:c"} {
+		if frame := <-events.frames; frame != expected {
+			t.Fatalf("expected %q, got %q", expected, frame)
+		}
+	}
+}
+
+// testCountingCodec numbers the lines of every connection, keeping the count in the codec context.
+type testCountingCodec struct {
+	LineBasedFrameCodec
+}
+
+func (cc *testCountingCodec) Decode(c Conn) ([]byte, error) {
+	frame, err := cc.LineBasedFrameCodec.Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := c.CodecContext().(int)
+	c.SetCodecContext(n + 1)
+	return []byte(fmt.Sprintf("%d:%s", n+1, frame)), nil
+}
+
+type testCodecContextServer struct {
+	*EventServer
+	frames chan string
+}
+
+func (t *testCodecContextServer) OnOpened(c Conn) (out []byte, action Action) {
+	c.SetContext("user")
+	return
+}
+
+func (t *testCodecContextServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames <- fmt.Sprintf("%v %s", c.Context(), frame)
+	return
+}
+
+func TestBufferEncoder(t *testing.T) {
+	s, err := NewServer(&testBufferEncoderServer{}, "tcp://127.0.0.1:0", WithCodec(&testBufferEncoderCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("ping\n"))
+	must(err)
+	// The reply of React is followed by the one of AsyncWrite.
+	r := bufio.NewReader(c)
+	for _, expected := range []string{"[ping]\n", "[async ping]\n"} {
+		line, err := r.ReadString('\n')
+		must(err)
+		if line != expected {
+			t.Fatalf("expected %q, got %q", expected, line)
+		}
+	}
+}
+
+type testBufferEncoderCodec struct {
+	LineBasedFrameCodec
+}
+
+func (cc *testBufferEncoderCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	panic("Encode is invoked despite EncodeTo")
+}
+
+func (cc *testBufferEncoderCodec) EncodeTo(c Conn, buf *bytebuffer.ByteBuffer, frame []byte) error {
+	_ = buf.WriteByte('[')
+	_, _ = buf.Write(frame)
+	_, _ = buf.WriteString("]\n")
+	return nil
+}
+
+type testBufferEncoderServer struct {
+	*EventServer
+}
+
+func (t *testBufferEncoderServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	async := append([]byte("async "), frame...)
+	_ = c.Retain()
+	go func() {
+		defer c.Release()
+		time.Sleep(10 * time.Millisecond)
+		_ = c.AsyncWrite(async)
+	}()
+	out = frame
+	return
+}
+
+type testTCPAndUDPServer struct {
+	*EventServer
+}
+
+func (s *testTCPAndUDPServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return append([]byte(c.LocalAddr().Network()+":"), frame...), None
+}
+
+func TestTCPAndUDP(t *testing.T) {
+	for _, multicore := range []bool{false, true} {
+		s, err := NewServer(&testTCPAndUDPServer{&EventServer{}}, "tcp+udp://127.0.0.1:0", WithMulticore(multicore))
+		must(err)
+		must(s.Start())
+		addr := s.Addr.String()
+
+		tc, err := net.Dial("tcp", addr)
+		must(err)
+		uc, err := net.Dial("udp", addr)
+		must(err)
+		buf := make([]byte, 16)
+		for _, c := range []net.Conn{tc, uc} {
+			expected := c.LocalAddr().Network() + ":ping"
+			_, err = c.Write([]byte("ping"))
+			must(err)
+			must(c.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := io.ReadFull(c, buf[:len(expected)])
+			must(err)
+			if string(buf[:n]) != expected {
+				t.Fatalf("expected %q, got %q", expected, buf[:n])
+			}
+			_ = c.Close()
+		}
+		must(s.Stop(context.Background()))
+	}
+}
+
+func TestConnLabels(t *testing.T) {
+	h := &testLabelServer{}
+	s, err := NewServer(h, "tcp://127.0.0.1:0", WithCodec(&LineBasedFrameCodec{}), WithMaxLabelValues(2))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	var clients []net.Conn
+	for _, tenant := range []string{"acme", "beta", "gamma"} {
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		clients = append(clients, c)
+		_, err = c.Write([]byte(tenant + "\n"))
+		must(err)
+		buf := make([]byte, len(tenant)+1)
+		_, err = io.ReadFull(c, buf)
+		must(err)
+		if string(buf) != tenant+"\n" {
+			t.Fatalf("expected the label to be echoed, got %q", buf)
+		}
+	}
+	stats := s.LabelStats()
+	expected := []LabelStats{
+		{Key: "tenant", Value: "_other", Connections: 1, BytesOut: 6},
+		{Key: "tenant", Value: "acme", Connections: 1, BytesOut: 5},
+		{Key: "tenant", Value: "beta", Connections: 1, BytesOut: 5},
+	}
+	if len(stats) != len(expected) {
+		t.Fatalf("expected label stats %+v, got %+v", expected, stats)
+	}
+	for i := range stats {
+		if stats[i] != expected[i] {
+			t.Fatalf("expected label stats %+v, got %+v", expected, stats)
+		}
+	}
+	for _, c := range clients {
+		must(c.Close())
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		var conns int64
+		for _, st := range s.LabelStats() {
+			conns += st.Connections
+		}
+		if conns == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the closed connections to leave their labels, got %+v", s.LabelStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testLabelServer struct {
+	*EventServer
+}
+
+func (t *testLabelServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	c.SetLabel("tenant", string(frame))
+	return []byte(c.Label("tenant")), None
+}
+
+func TestEnrichment(t *testing.T) {
+	enricher := &testEnricher{}
+	s, err := NewServer(&testEnrichmentServer{}, "tcp://127.0.0.1:0",
+		WithCodec(&LineBasedFrameCodec{}), WithEnrichment(enricher, 100*time.Millisecond))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	expect := func(request, expected string) {
+		t.Helper()
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		defer c.Close()
+		// The request is read once the connection is opened, after the Enricher returns.
+		_, err = c.Write([]byte(request))
+		must(err)
+		must(c.SetReadDeadline(time.Now().Add(10 * time.Second)))
+		buf := make([]byte, len(expected))
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != expected {
+			t.Fatalf("expected %q, got %q, %v", expected, buf, err)
+		}
+	}
+	expect("ping\n", "opened 127.0.0.1 <nil>\nping\n")
+	// The second lookup doesn't return until the deadline.
+	expect("ping\n", "opened <nil> context deadline exceeded\nping\n")
+}
+
+func TestEnrichmentShutdown(t *testing.T) {
+	// The lookups don't return until the deadline, which is beyond the shutdown.
+	s, err := NewServer(&testEnrichmentServer{}, "tcp://127.0.0.1:0",
+		WithCodec(&LineBasedFrameCodec{}), WithEnrichment(&testEnricher{calls: 1}, time.Minute))
+	must(err)
+	must(s.Start())
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	for i := 0; atomic.LoadInt32(&s.svr.pendingAccepts) != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected the connection to be enriched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	must(s.Stop(context.Background()))
+	if n := atomic.LoadInt32(&s.svr.pendingAccepts); n != 0 {
+		t.Fatalf("expected no connection pending after the shutdown, got %d", n)
+	}
+	must(c.SetReadDeadline(time.Now().Add(time.Second)))
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection being enriched to be closed by the shutdown")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("expected the connection being enriched to be closed by the shutdown, got %v", err)
+	}
+}
+
+type testEnricher struct {
+	calls int32
+}
+
+func (t *testEnricher) Enrich(ctx context.Context, local, remote net.Addr) (result interface{}, err error) {
+	if atomic.AddInt32(&t.calls, 1) == 1 {
+		return remote.(*net.TCPAddr).IP.String(), nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type testEnrichmentServer struct {
+	*EventServer
+}
+
+func (t *testEnrichmentServer) OnOpened(c Conn) (out []byte, action Action) {
+	result, err := c.Enrichment()
+	return []byte(fmt.Sprintf("opened %v %v\n", result, err)), None
+}
+
+func (t *testEnrichmentServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return frame, None
+}
+
+func TestHandshakeHandler(t *testing.T) {
+	s, err := NewServer(&testHandshakeServer{}, "tcp://127.0.0.1:0",
+		WithCodec(&LineBasedFrameCodec{}), WithHandshakeTimeout(200*time.Millisecond))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("secret\nping\n"))
+	must(err)
+	buf := make([]byte, len("welcome\nping\n"))
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	if string(buf) != "welcome\nping\n" {
+		t.Fatalf("expected the handshake to be accepted followed by the echo, got %q", buf)
+	}
+	time.Sleep(300 * time.Millisecond)
+	_, err = c.Write([]byte("pong\n"))
+	must(err)
+	buf = make([]byte, len("pong\n"))
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	if string(buf) != "pong\n" {
+		t.Fatalf("expected the accepted connection to outlive the handshake timeout, got %q", buf)
+	}
+
+	rejected, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer rejected.Close()
+	_, err = rejected.Write([]byte("wrong\nping\n"))
+	must(err)
+	data, _ := ioutil.ReadAll(rejected)
+	if string(data) != "denied\n" {
+		t.Fatalf("expected the handshake to be rejected, got %q", data)
+	}
+
+	stalled, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer stalled.Close()
+	_, err = stalled.Write([]byte("hello\n"))
+	must(err)
+	must(stalled.SetReadDeadline(time.Now().Add(time.Second)))
+	data, err = ioutil.ReadAll(stalled)
+	if err != nil || len(data) != 0 {
+		t.Fatalf("expected the connection to be closed by the handshake timeout, got %q, %v", data, err)
+	}
+}
+
+type testHandshakeServer struct {
+	*EventServer
+}
+
+func (t *testHandshakeServer) OnHandshake(c Conn, frame []byte) (ok bool, out []byte, action Action) {
+	switch string(frame) {
+	case "secret":
+		return true, []byte("welcome"), None
+	case "hello":
+		return false, nil, None
+	default:
+		return false, []byte("denied"), Close
+	}
+}
+
+func (t *testHandshakeServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return append([]byte(nil), frame...), None
+}
+
+func TestVersionNegotiator(t *testing.T) {
+	n := NewVersionNegotiator(VersionNegotiatorConfig{
+		Parse: func(frame []byte) (int, error) {
+			return strconv.Atoi(strings.TrimPrefix(string(frame), "v"))
+		},
+		Reply: func(version int, err error) []byte {
+			if err != nil {
+				return []byte("error")
+			}
+			return []byte(fmt.Sprintf("v%d", version))
+		},
+		MinVersion:     1,
+		AllowDowngrade: true,
+	},
+		ProtocolVersion{Version: 2, Codec: NewDelimiterBasedFrameCodec(';'), Handler: &testVersionServer{prefix: "2:"}},
+		ProtocolVersion{Version: 1, Handler: &testVersionServer{prefix: "1:"}},
+		ProtocolVersion{Version: 0, Handler: &testVersionServer{prefix: "0:"}},
+	)
+	s, err := NewServer(n, "tcp://127.0.0.1:0", WithCodec(&LineBasedFrameCodec{}))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"v1\nhi\n", "v1\n1:hi\n"},
+		{"v3\nhi;", "v2;2:hi;"},
+		{"v0\nhi\n", "error\n"},
+		{"vx\nhi\n", "error\n"},
+	} {
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		_, err = c.Write([]byte(tc.in))
+		must(err)
+		must(c.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, len(tc.out))
+		_, err = io.ReadFull(c, buf)
+		must(err)
+		if string(buf) != tc.out {
+			t.Fatalf("expected %q in reply to %q, got %q", tc.out, tc.in, buf)
+		}
+		must(c.Close())
+	}
+}
+
+type testVersionServer struct {
+	*EventServer
+	prefix string
+}
+
+func (t *testVersionServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return append([]byte(t.prefix), frame...), None
+}
+
+func TestNoiseIK(t *testing.T) {
+	server, err := GenerateNoiseKeypair(nil)
+	must(err)
+	client, err := GenerateNoiseKeypair(nil)
+	must(err)
+	prologue := []byte("gnet-test/1")
+	peers := make(chan [32]byte, 1)
+	enc := &NoiseIK{
+		Static:   server,
+		Prologue: prologue,
+		Authorize: func(c Conn, peer [32]byte, payload []byte) error {
+			if string(payload) != "token" {
+				return errors.New("invalid token")
+			}
+			peers <- peer
+			return nil
+		},
+	}
+	codec := NewLengthFieldBasedFrameCodec(
+		EncoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 2},
+		DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 2, InitialBytesToStrip: 2})
+	s, err := NewServer(&testNoiseServer{}, "tcp://127.0.0.1:0", WithCodec(codec), WithEncryption(enc))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+
+	handshake := func(token string) (net.Conn, FrameCipher, error) {
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		must(c.SetDeadline(time.Now().Add(time.Second)))
+		i := NewNoiseIKInitiator(client, server.Public, prologue, nil)
+		msg, err := i.WriteMessage([]byte(token))
+		must(err)
+		must(writeTestFrame(c, msg))
+		if msg, err = readTestFrame(c); err != nil {
+			return c, nil, err
+		}
+		fc, _, err := i.ReadMessage(msg)
+		return c, fc, err
+	}
+
+	c, fc, err := handshake("token")
+	must(err)
+	defer c.Close()
+	if peer := <-peers; peer != client.Public {
+		t.Fatalf("expected the static key of the client, got %x", peer)
+	}
+	// The frame written by AsyncWrite before the handshake completes is sent encrypted once it does.
+	frame, err := readTestFrame(c)
+	must(err)
+	if opened, err := fc.Open(frame); err != nil || string(opened) != "welcome" {
+		t.Fatalf("expected the welcome frame, got %q, %v", opened, err)
+	}
+	for _, text := range []string{"hello", "world"} {
+		sealed, _ := fc.Seal([]byte(text))
+		must(writeTestFrame(c, sealed))
+		frame, err := readTestFrame(c)
+		must(err)
+		opened, err := fc.Open(frame)
+		must(err)
+		if string(opened) != text {
+			t.Fatalf("expected %q to be echoed, got %q", text, opened)
+		}
+	}
+	sealed, _ := fc.Seal([]byte("forged"))
+	sealed[0] ^= 1
+	must(writeTestFrame(c, sealed))
+	if _, err = readTestFrame(c); err != io.EOF {
+		t.Fatalf("expected the connection to be closed upon a forged frame, got %v", err)
+	}
+
+	rejected, _, err := handshake("wrong")
+	defer rejected.Close()
+	if err != io.EOF {
+		t.Fatalf("expected the connection to be closed upon an invalid token, got %v", err)
+	}
+}
+
+func writeTestFrame(c net.Conn, frame []byte) error {
+	buf := make([]byte, 2, 2+len(frame))
+	binary.BigEndian.PutUint16(buf, uint16(len(frame)))
+	_, err := c.Write(append(buf, frame...))
+	return err
+}
+
+func readTestFrame(c net.Conn) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(n[:]))
+	_, err := io.ReadFull(c, frame)
+	return frame, err
+}
+
+type testNoiseServer struct {
+	*EventServer
+}
+
+func (t *testNoiseServer) OnOpened(c Conn) (out []byte, action Action) {
+	_ = c.AsyncWrite([]byte("welcome"))
+	return
+}
+
+func (t *testNoiseServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return append([]byte(nil), frame...), None
+}
@@ -0,0 +1,1098 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package gnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFDPassing(t *testing.T) {
+	testFDPassing("memory", "fd-passing")
+}
+
+type testFDPassingServer struct {
+	*EventServer
+	svr    Server
+	frames []string
+}
+
+func (t *testFDPassingServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testFDPassingServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+func (t *testFDPassingServer) OnFileDescriptors(c Conn, fds []int) (action Action) {
+	// Pass the first file descriptor back and close all of them.
+	must(c.SendFD(fds[0], []byte("pong")))
+	for _, fd := range fds {
+		must(unix.Close(fd))
+	}
+	return
+}
+func (t *testFDPassingServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.frames = append(t.frames, string(frame))
+	return
+}
+
+func testFDPassing(network, addr string) {
+	events := new(testFDPassingServer)
+	must(Serve(events, network+"://"+addr, WithTestMode(true)))
+	conn, err := DialMemory(addr)
+	must(err)
+	uc := conn.(*memoryConn).Conn.(*net.UnixConn)
+	must(events.svr.PollOnce(time.Second))
+
+	r, w, err := os.Pipe()
+	must(err)
+	defer r.Close()
+	_, _, err = uc.WriteMsgUnix([]byte("ping"), unix.UnixRights(int(w.Fd())), nil)
+	must(err)
+	must(w.Close())
+	must(events.svr.PollOnce(time.Second))
+	if len(events.frames) != 1 || events.frames[0] != "ping" {
+		panic(fmt.Sprintf("expected frame \"ping\", got %q", events.frames))
+	}
+
+	must(uc.SetReadDeadline(time.Now().Add(time.Second)))
+	buf, oob := make([]byte, 16), make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	must(err)
+	if string(buf[:n]) != "pong" {
+		panic(fmt.Sprintf("expected \"pong\", got %q", buf[:n]))
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	must(err)
+	if len(msgs) != 1 {
+		panic(fmt.Sprintf("expected 1 control message, got %d", len(msgs)))
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	must(err)
+	// The file descriptor passed back is the write end of the pipe.
+	f := os.NewFile(uintptr(fds[0]), "pipe")
+	_, err = f.Write([]byte("hello"))
+	must(err)
+	must(f.Close())
+	n, err = r.Read(buf)
+	must(err)
+	if string(buf[:n]) != "hello" {
+		panic(fmt.Sprintf("expected \"hello\", got %q", buf[:n]))
+	}
+
+	must(conn.Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestAcceptOverload(t *testing.T) {
+	testAcceptOverload("memory", "accept-overload")
+}
+
+type testAcceptOverloadServer struct {
+	*EventServer
+	svr       Server
+	overloads []bool
+}
+
+func (t *testAcceptOverloadServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testAcceptOverloadServer) OnOverload(overloaded bool) (action Action) {
+	t.overloads = append(t.overloads, overloaded)
+	return
+}
+func (t *testAcceptOverloadServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+
+func testAcceptOverload(network, addr string) {
+	events := new(testAcceptOverloadServer)
+	config := &AcceptOverload{MaxAcceptRate: 2, Response: []byte("busy")}
+	must(Serve(events, network+"://"+addr, WithTestMode(true), WithAcceptOverload(config)))
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := DialMemory(addr)
+		must(err)
+		conns = append(conns, conn)
+	}
+	// The third connection exceeds the accept rate, so it is shed with the response.
+	must(conns[2].SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 16)
+	n, err := conns[2].Read(buf)
+	must(err)
+	if string(buf[:n]) != "busy" {
+		panic(fmt.Sprintf("expected \"busy\", got %q", buf[:n]))
+	}
+	if _, err = conns[2].Read(buf); err != io.EOF {
+		panic(fmt.Sprintf("expected EOF, got %v", err))
+	}
+	stats := events.svr.AcceptOverloadStats()
+	if !stats.Overloaded || stats.Episodes != 1 || stats.Shed != 1 {
+		panic(fmt.Sprintf("unexpected stats of accept overload protection: %+v", stats))
+	}
+	if len(events.overloads) != 1 || !events.overloads[0] {
+		panic(fmt.Sprintf("expected OnOverload to fire once with true, got %v", events.overloads))
+	}
+	must(events.svr.PollOnce(time.Second))
+	if n := events.svr.CountConnections(); n != 2 {
+		panic(fmt.Sprintf("expected 2 connections, got %d", n))
+	}
+	must(conns[0].Close())
+	must(conns[1].Close())
+	if err = events.svr.PollOnce(time.Second); err != ErrServerShutdown {
+		panic(fmt.Sprintf("expected ErrServerShutdown, got %v", err))
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	opts := []Option{WithTestMode(true), WithIPTOS(46 << 2), WithIPTTL(42)}
+	if runtime.GOOS == "linux" {
+		opts = append(opts, WithBindToDevice("lo"))
+	}
+	events := &testOptionsServer{}
+	must(Serve(events, "tcp4://127.0.0.1:9991", opts...))
+	defer events.svr.svr.stopTestLoop()
+	fd := events.svr.svr.ln.fd
+	if tos, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS); err != nil || tos != 46<<2 {
+		t.Fatalf("expected IP_TOS %d, got %d, %v", 46<<2, tos, err)
+	}
+	if ttl, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL); err != nil || ttl != 42 {
+		t.Fatalf("expected IP_TTL 42, got %d, %v", ttl, err)
+	}
+	if err := Serve(events, "memory://sockopts", WithIPTTL(42)); err == nil {
+		t.Fatal("expected an error for IP_TTL on memory network")
+	}
+}
+
+func TestLoopRestart(t *testing.T) {
+	events := &testLoopRestartServer{loopErrs: make(chan error, 1), closeErrs: make(chan error, 1)}
+	s, err := NewServer(events, "memory://loop-restart", WithLoopRestart(LoopRestartCloseConns))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := DialMemory("loop-restart")
+	must(err)
+	defer c.Close()
+	echo := func(c net.Conn) {
+		_, err := c.Write([]byte("ping"))
+		must(err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		must(err)
+	}
+	echo(c)
+
+	boom := errors.New("boom")
+	must(s.svr.loopAt(0).poller.Trigger(func() error { return boom }))
+	if err = <-events.loopErrs; err != boom {
+		t.Fatalf("expected the error of the loop, got %v", err)
+	}
+	if err = <-events.closeErrs; err != ErrLoopRestarted {
+		t.Fatalf("expected the connection to be closed with ErrLoopRestarted, got %v", err)
+	}
+	c2, err := DialMemory("loop-restart")
+	must(err)
+	defer c2.Close()
+	echo(c2)
+}
+
+type testLoopRestartServer struct {
+	*EventServer
+	loopErrs  chan error
+	closeErrs chan error
+}
+
+func (t *testLoopRestartServer) OnLoopError(loopIdx int, err error) (action Action) {
+	if loopIdx == 0 {
+		t.loopErrs <- err
+	}
+	return
+}
+
+func (t *testLoopRestartServer) OnClosed(c Conn, err error) (action Action) {
+	select {
+	case t.closeErrs <- err:
+	default:
+	}
+	return
+}
+
+func (t *testLoopRestartServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return frame, None
+}
+
+func TestTransport(t *testing.T) {
+	if lookupTransport("test-transport") == nil {
+		RegisterTransport("test-transport", &testTransport{})
+	}
+	tr := lookupTransport("test-transport").(*testTransport)
+	*tr = testTransport{}
+	path := fmt.Sprintf("/tmp/gnet-transport-%d.sock", os.Getpid())
+	s, err := NewServer(&testNewServer{}, "test-transport://"+path)
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	if s.Addr.Network() != "unix" || s.Addr.String() != path {
+		t.Fatalf("expected the listener address of the transport, got %v", s.Addr)
+	}
+	c, err := net.Dial("unix", path)
+	must(err)
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	_, err = io.ReadFull(c, make([]byte, 5))
+	must(err)
+	must(c.Close())
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&tr.accepts) != 1 || atomic.LoadInt32(&tr.reads) == 0 ||
+		atomic.LoadInt32(&tr.writes) == 0 || atomic.LoadInt32(&tr.closes) != 1 {
+		t.Fatalf("expected all the I/O through the transport, got %+v", tr)
+	}
+}
+
+// testTransport is a transport over Unix domain sockets counting the calls.
+type testTransport struct {
+	accepts, reads, writes, closes int32
+}
+
+func (tr *testTransport) Listen(addr string) (int, net.Addr, error) {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+	_ = os.Remove(addr)
+	if err = unix.Bind(fd, &unix.SockaddrUnix{Name: addr}); err == nil {
+		err = unix.Listen(fd, 128)
+	}
+	if err == nil {
+		err = unix.SetNonblock(fd, true)
+	}
+	if err != nil {
+		_ = unix.Close(fd)
+		return -1, nil, err
+	}
+	return fd, &net.UnixAddr{Name: addr, Net: "unix"}, nil
+}
+
+func (tr *testTransport) Accept(fd int) (int, net.Addr, error) {
+	nfd, _, err := unix.Accept(fd)
+	if err != nil {
+		return -1, nil, err
+	}
+	atomic.AddInt32(&tr.accepts, 1)
+	return nfd, &net.UnixAddr{Net: "unix"}, unix.SetNonblock(nfd, true)
+}
+
+func (tr *testTransport) Read(fd int, p []byte) (int, error) {
+	atomic.AddInt32(&tr.reads, 1)
+	return unix.Read(fd, p)
+}
+
+func (tr *testTransport) Write(fd int, p []byte) (int, error) {
+	atomic.AddInt32(&tr.writes, 1)
+	return unix.Write(fd, p)
+}
+
+func (tr *testTransport) Close(fd int) error {
+	atomic.AddInt32(&tr.closes, 1)
+	return unix.Close(fd)
+}
+
+func TestVsock(t *testing.T) {
+	if _, err := DialVsock("host:80"); err == nil {
+		t.Fatal("expected an error for the invalid vsock address")
+	}
+	for addr, want := range map[string]*VsockAddr{
+		"2:5000":  {CID: 2, Port: 5000},
+		":5000":   {CID: 1<<32 - 1, Port: 5000},
+		"2":       nil,
+		"host:80": nil,
+	} {
+		got, err := parseVsockAddr(addr)
+		if want == nil && err == nil || want != nil && (err != nil || *got != *want) {
+			t.Fatalf("parseVsockAddr(%q) = %v, %v, expected %v", addr, got, err, want)
+		}
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("AF_VSOCK is only supported on Linux")
+	}
+	s, err := NewServer(&testNewServer{}, "vsock://:4294967295")
+	if err != nil {
+		t.Skipf("AF_VSOCK is not available: %v", err)
+	}
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	addr, ok := s.Addr.(*VsockAddr)
+	if !ok || addr.Port == VsockCIDAny {
+		t.Fatalf("expected the bound vsock address, got %v", s.Addr)
+	}
+	c, err := DialVsock(fmt.Sprintf("%d:%d", VsockCIDLocal, addr.Port))
+	if err != nil {
+		t.Skipf("vsock loopback is not available: %v", err)
+	}
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	must(c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = io.ReadFull(c, make([]byte, 5))
+	must(err)
+}
+
+func TestTransparent(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("IP_TRANSPARENT is only supported on Linux")
+	}
+	events := &testTransparentServer{dst: make(chan net.Addr, 1)}
+	s, err := NewServer(events, "udp://127.0.0.1:0", WithTransparent(true))
+	if err != nil {
+		t.Skipf("IP_TRANSPARENT is not permitted: %v", err)
+	}
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("udp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	// Without TPROXY rules in place, the original destination is the address of the listener.
+	select {
+	case dst := <-events.dst:
+		if dst == nil || dst.String() != s.Addr.String() {
+			t.Fatalf("expected the original destination %v, got %v", s.Addr, dst)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the packet")
+	}
+}
+
+type testTransparentServer struct {
+	*EventServer
+	dst chan net.Addr
+}
+
+func (t *testTransparentServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.dst <- c.OriginalDst()
+	return
+}
+
+func TestOutboundLimit(t *testing.T) {
+	const (
+		limit = 64 * 1024
+		size  = 16 * 1024 * 1024
+	)
+	t.Run("block-reads", func(t *testing.T) {
+		events := &testOutboundServer{size: size, closed: make(chan error, 1)}
+		s, err := NewServer(events, "tcp://127.0.0.1:0", WithOutboundLimit(limit, OutboundBlockReads))
+		must(err)
+		must(s.Start())
+		defer func() {
+			must(s.Stop(context.Background()))
+		}()
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		defer c.Close()
+		_, err = c.Write([]byte("a"))
+		must(err)
+		time.Sleep(100 * time.Millisecond)
+		_, err = c.Write([]byte("b"))
+		must(err)
+		time.Sleep(100 * time.Millisecond)
+		if n := atomic.LoadInt32(&events.reacts); n != 1 {
+			t.Fatalf("expected reads to be blocked after the first response, got %d reacts", n)
+		}
+		must(c.SetReadDeadline(time.Now().Add(10 * time.Second)))
+		_, err = io.ReadFull(c, make([]byte, 2*size))
+		must(err)
+		if n := atomic.LoadInt32(&events.reacts); n != 2 {
+			t.Fatalf("expected reads to resume once the outbound buffer is drained, got %d reacts", n)
+		}
+	})
+	t.Run("drop", func(t *testing.T) {
+		events := &testOutboundServer{size: size, closed: make(chan error, 1)}
+		s, err := NewServer(events, "tcp://127.0.0.1:0", WithOutboundLimit(limit, OutboundDrop))
+		must(err)
+		must(s.Start())
+		defer func() {
+			must(s.Stop(context.Background()))
+		}()
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		defer c.Close()
+		_, err = c.Write([]byte("a"))
+		must(err)
+		if err = <-events.closed; err != ErrOutboundFull {
+			t.Fatalf("expected ErrOutboundFull, got %v", err)
+		}
+		must(c.SetReadDeadline(time.Now().Add(10 * time.Second)))
+		n, _ := io.Copy(ioutil.Discard, c)
+		if n >= size {
+			t.Fatalf("expected the response to be dropped, got %d bytes", n)
+		}
+	})
+	t.Run("callback", func(t *testing.T) {
+		events := &testOutboundCallbackServer{
+			testOutboundServer: testOutboundServer{size: size, closed: make(chan error, 1)},
+			buffered:           make(chan int, 1),
+		}
+		s, err := NewServer(events, "tcp://127.0.0.1:0", WithOutboundLimit(limit, OutboundCallback))
+		must(err)
+		must(s.Start())
+		defer func() {
+			must(s.Stop(context.Background()))
+		}()
+		c, err := net.Dial("tcp", s.Addr.String())
+		must(err)
+		defer c.Close()
+		_, err = c.Write([]byte("a"))
+		must(err)
+		if buffered := <-events.buffered; buffered <= limit {
+			t.Fatalf("expected more than %d bytes buffered, got %d", limit, buffered)
+		}
+		if err = <-events.closed; err != ErrOutboundFull {
+			t.Fatalf("expected ErrOutboundFull, got %v", err)
+		}
+	})
+	if _, err := NewServer(&testOutboundServer{}, "tcp://127.0.0.1:0", WithOutboundLimit(limit, OutboundCallback)); err == nil {
+		t.Fatal("expected OutboundCallback to require OutboundFullHandler")
+	}
+}
+
+type testOutboundServer struct {
+	*EventServer
+	size   int
+	reacts int32
+	closed chan error
+}
+
+func (t *testOutboundServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	atomic.AddInt32(&t.reacts, 1)
+	return make([]byte, t.size), None
+}
+
+func (t *testOutboundServer) OnClosed(c Conn, err error) (action Action) {
+	t.closed <- err
+	return
+}
+
+type testOutboundCallbackServer struct {
+	testOutboundServer
+	buffered chan int
+}
+
+func (t *testOutboundCallbackServer) OnOutboundFull(c Conn, buffered int) (action Action) {
+	t.buffered <- buffered
+	return Close
+}
+
+func TestWriteStallTimeout(t *testing.T) {
+	const (
+		timeout = 100 * time.Millisecond
+		size    = 16 * 1024 * 1024
+	)
+	events := &testWriteStallServer{
+		testOutboundServer: testOutboundServer{size: size, closed: make(chan error, 1)},
+		stalled:            make(chan time.Duration, 2),
+	}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithWriteStallTimeout(timeout))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+
+	// The peer reading the response within the timeout isn't stalled, although the response is written partially.
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	// Keep the kernel from taking in the whole response on behalf of the peer not reading it.
+	must(c.(*net.TCPConn).SetReadBuffer(64 * 1024))
+	_, err = c.Write([]byte("a"))
+	must(err)
+	must(c.SetReadDeadline(time.Now().Add(10 * time.Second)))
+	_, err = io.ReadFull(c, make([]byte, size))
+	must(err)
+	time.Sleep(2 * timeout)
+	select {
+	case d := <-events.stalled:
+		t.Fatalf("expected the reading peer not to stall, stalled for %v", d)
+	default:
+	}
+
+	// The peer not reading the response stalls, OnWriteStall keeps it once, then closes it.
+	_, err = c.Write([]byte("b"))
+	must(err)
+	for i := 0; i < 2; i++ {
+		if d := <-events.stalled; d < timeout*7/8 {
+			t.Fatalf("expected to stall for at least %v, stalled for %v", timeout*7/8, d)
+		}
+	}
+	if err = <-events.closed; err != ErrWriteStall {
+		t.Fatalf("expected ErrWriteStall, got %v", err)
+	}
+}
+
+type testWriteStallServer struct {
+	testOutboundServer
+	stalls  int
+	stalled chan time.Duration
+}
+
+func (t *testWriteStallServer) OnWriteStall(c Conn, stalled time.Duration, buffered int) (action Action) {
+	t.stalled <- stalled
+	if t.stalls++; t.stalls == 1 {
+		return None
+	}
+	return Close
+}
+
+func TestUrgentData(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("urgent data is only supported on Linux")
+	}
+	events := &testUrgentDataServer{closed: make(chan error, 1)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0")
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	sendUrgent := func(b byte) {
+		rc, err := c.(*net.TCPConn).SyscallConn()
+		must(err)
+		must(rc.Write(func(fd uintptr) bool {
+			_, err := unix.SendmsgN(int(fd), []byte{b}, nil, nil, unix.MSG_OOB)
+			must(err)
+			return true
+		}))
+	}
+	must(c.SetReadDeadline(time.Now().Add(10 * time.Second)))
+
+	// The urgent byte is handed over to OnUrgentData, rather than being read along with the inbound data.
+	_, err = c.Write([]byte("ab"))
+	must(err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	sendUrgent('!')
+	buf = make([]byte, 3)
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	if string(buf) != "<!>" {
+		t.Fatalf("expected the reply to the urgent data, got %q", buf)
+	}
+
+	// OnUrgentData closes the connection.
+	sendUrgent('q')
+	if err = <-events.closed; err != nil {
+		t.Fatalf("expected the connection to be closed without an error, got %v", err)
+	}
+	// The connection may be reset rather than shut down, since the urgent byte is still in the receive queue.
+	if _, err = c.Read(buf); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+type testUrgentDataServer struct {
+	*EventServer
+	closed chan error
+}
+
+func (t *testUrgentDataServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	out = frame
+	return
+}
+
+func (t *testUrgentDataServer) OnUrgentData(c Conn, b byte) (out []byte, action Action) {
+	if b == 'q' {
+		return nil, Close
+	}
+	return []byte{'<', b, '>'}, None
+}
+
+func (t *testUrgentDataServer) OnClosed(c Conn, err error) (action Action) {
+	t.closed <- err
+	return
+}
+
+func TestBuffered(t *testing.T) {
+	events := &testBufferedServer{buffered: make(chan [2]int, 1)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithCodec(new(LineBasedFrameCodec)))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("ab\ncd"))
+	must(err)
+	buffered := <-events.buffered
+	if buffered[0] != 2 {
+		t.Fatalf("expected 2 bytes of inbound data buffered, got %d", buffered[0])
+	}
+	if buffered[1] <= 0 || buffered[1] >= 16*1024*1024 {
+		t.Fatalf("expected part of the outbound data buffered, got %d bytes", buffered[1])
+	}
+}
+
+type testBufferedServer struct {
+	*EventServer
+	buffered chan [2]int
+}
+
+func (t *testBufferedServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	inbound := c.InboundBuffered()
+	_, _ = c.Write(make([]byte, 16*1024*1024))
+	t.buffered <- [2]int{inbound, c.OutboundBuffered()}
+	return
+}
+
+func TestLoopAffinity(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("loop affinity is only supported on Linux")
+	}
+	events := &testAffinityServer{loops: make(chan *eventloop, 1)}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithLoopAffinity(true), WithNumEventLoop(runtime.NumCPU()))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	if len(s.svr.cpuLoops) == 0 {
+		t.Fatal("expected the event-loops to be pinned to CPUs")
+	}
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	must(err)
+	must(c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = io.ReadFull(c, make([]byte, 5))
+	must(err)
+	if el := <-events.loops; s.svr.cpuLoops[el.cpu] != el {
+		t.Fatalf("expected the connection to be served by the event-loop pinned to CPU %d", el.cpu)
+	}
+}
+
+type testAffinityServer struct {
+	*EventServer
+	loops chan *eventloop
+}
+
+func (t *testAffinityServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.loops <- c.(*conn).loop
+	return frame, None
+}
+
+func TestSignals(t *testing.T) {
+	h := &testSignalServer{reloads: make(chan os.Signal, 1)}
+	s, err := NewServer(h, "tcp://127.0.0.1:0",
+		WithGracefulSignals(unix.SIGUSR2), WithReloadSignals(unix.SIGUSR1))
+	must(err)
+	must(s.Start())
+	must(unix.Kill(os.Getpid(), unix.SIGUSR1))
+	select {
+	case sig := <-h.reloads:
+		if sig != unix.SIGUSR1 {
+			t.Fatalf("expected OnReload upon SIGUSR1, got %v", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnReload didn't fire")
+	}
+	must(unix.Kill(os.Getpid(), unix.SIGUSR2))
+	s.Wait()
+
+	if _, err = NewServer(new(EventServer), "tcp://127.0.0.1:0", WithReloadSignals(unix.SIGHUP)); err == nil {
+		t.Fatal("expected the reload signals to require ReloadHandler")
+	}
+}
+
+type testSignalServer struct {
+	*EventServer
+	reloads chan os.Signal
+}
+
+func (t *testSignalServer) OnReload(server Server, sig os.Signal) {
+	t.reloads <- sig
+}
+
+func TestMaxReadsPerLoopIteration(t *testing.T) {
+	for _, n := range []int{0, 8} {
+		events := new(testMaxReadsServer)
+		must(Serve(events, "tcp://127.0.0.1:0", WithTestMode(true), WithMaxReadsPerLoopIteration(n)))
+		c, err := net.Dial("tcp", events.svr.Addr.String())
+		must(err)
+		must(events.svr.PollOnce(time.Second))
+		_, err = c.Write(make([]byte, 0x18000))
+		must(err)
+		time.Sleep(100 * time.Millisecond)
+		must(events.svr.PollOnce(time.Second))
+		if n == 0 && events.reacts != 1 {
+			t.Fatalf("expected the connection to be read once by default, got %d reacts", events.reacts)
+		}
+		if n == 8 && events.reacts < 2 {
+			t.Fatalf("expected the connection to be read until drained, got %d reacts", events.reacts)
+		}
+		must(c.Close())
+		for err == nil {
+			err = events.svr.PollOnce(time.Second)
+		}
+		if err != ErrServerShutdown {
+			t.Fatalf("expected ErrServerShutdown, got %v", err)
+		}
+	}
+}
+
+type testMaxReadsServer struct {
+	*EventServer
+	svr    Server
+	reacts int
+}
+
+func (t *testMaxReadsServer) OnInitComplete(svr Server) (action Action) {
+	t.svr = svr
+	return
+}
+func (t *testMaxReadsServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	t.reacts++
+	return
+}
+func (t *testMaxReadsServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+
+func TestKernelZeroCopyLinger(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("MSG_ZEROCOPY is only available on Linux")
+	}
+	events := &testZeroCopyLingerServer{payload: make([]byte, 16<<20), closed: make(chan struct{})}
+	for i := range events.payload {
+		events.payload[i] = byte(i * 7)
+	}
+	s, err := NewServer(events, "tcp://127.0.0.1:0", WithNumEventLoop(1), WithKernelZeroCopySend(64<<10))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	must(c.(*net.TCPConn).SetReadBuffer(64 << 10))
+	<-events.closed
+	var el *eventloop
+	s.svr.subLoopGroup.iterate(func(i int, loop *eventloop) bool {
+		el = loop
+		return false
+	})
+	lingering := func() (n int) {
+		el.runSync(func() {
+			n = len(el.lingering)
+		})
+		return
+	}
+	// The socket is kept open while the data sent with MSG_ZEROCOPY is stuck in it, as the client isn't reading.
+	if n := lingering(); n != 1 {
+		t.Fatalf("expected the closed connection to linger, got %d lingering sockets", n)
+	}
+	must(c.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	buf, err := ioutil.ReadAll(c)
+	must(err)
+	if len(buf) == 0 || !bytes.Equal(buf, events.payload[:len(buf)]) {
+		t.Fatalf("expected a prefix of the payload followed by EOF, got %d bytes", len(buf))
+	}
+	for i := 0; lingering() != 0; i++ {
+		if i == 100 {
+			t.Fatal("expected the lingering socket to be closed once the sends complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testZeroCopyLingerServer struct {
+	*EventServer
+	payload []byte
+	closed  chan struct{}
+}
+
+func (t *testZeroCopyLingerServer) OnOpened(c Conn) (out []byte, action Action) {
+	// The chunks are sent from a buffer which is overwritten right after the sends, see React.
+	scratch := append([]byte(nil), t.payload...)
+	for i := 0; i < len(scratch); i += 256 << 10 {
+		must(c.AsyncWrite(scratch[i : i+256<<10]))
+	}
+	c.SetContext(scratch)
+	must(c.Wake())
+	return
+}
+
+func (t *testZeroCopyLingerServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	scratch := c.Context().([]byte)
+	for i := range scratch {
+		scratch[i] = 0
+	}
+	return nil, Close
+}
+
+func (t *testZeroCopyLingerServer) OnClosed(c Conn, err error) (action Action) {
+	close(t.closed)
+	return
+}
+
+func TestPollTimeout(t *testing.T) {
+	s, err := NewServer(&EventServer{}, "tcp://127.0.0.1:0", WithNumEventLoop(1), WithPollTimeout(time.Microsecond))
+	must(err)
+	must(s.Start())
+	time.Sleep(200 * time.Millisecond)
+	iterations := s.svr.expvarTotals().iterations
+	must(s.Stop(context.Background()))
+	// The timeout is rounded up to 1ms on Linux rather than polling without blocking.
+	if iterations > 1000 {
+		t.Fatalf("expected the idle event-loop to block for the poll timeout, got %d iterations in 200ms", iterations)
+	}
+}
+
+type testConnExtServer struct {
+	*EventServer
+	plain chan bool
+}
+
+func (t *testConnExtServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	cc := c.(*conn)
+	plain := cc.ext == nil
+	c.SetLabel("tenant", "a")
+	t.plain <- plain && cc.ext != nil
+	return frame, None
+}
+
+func TestConnExtension(t *testing.T) {
+	// The optional state is kept out of the connection struct, see connExt.
+	if connStructSize > 320 {
+		t.Fatalf("expected the connection struct to take at most 320 bytes, got %d", connStructSize)
+	}
+	ts := &testConnExtServer{EventServer: &EventServer{}, plain: make(chan bool, 1)}
+	s, err := NewServer(ts, "tcp://127.0.0.1:0", WithNumEventLoop(1))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	c, err := net.Dial("tcp", s.Addr.String())
+	must(err)
+	defer c.Close()
+	_, err = c.Write([]byte("ping"))
+	must(err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	must(err)
+	if !<-ts.plain {
+		t.Fatal("expected a plain connection to allocate its extension only once a label is set")
+	}
+}
+
+func TestMassiveConnections(t *testing.T) {
+	s, err := NewServer(&testMassiveServer{&EventServer{}}, "tcp://127.0.0.1:0",
+		WithMassiveConnections(true), WithNumEventLoop(4), WithCodec(new(LineBasedFrameCodec)))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	// The counters are published in batches, thus the stats are polled for.
+	waitStats := func(ok func(ConnMemoryStats) bool) ConnMemoryStats {
+		stats := s.ConnMemoryStats()
+		for deadline := time.Now().Add(time.Second); !ok(stats) && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+			stats = s.ConnMemoryStats()
+		}
+		return stats
+	}
+
+	const n = 16
+	conns := make([]net.Conn, n)
+	buf := make([]byte, 64)
+	for i := range conns {
+		conns[i], err = net.Dial("tcp", s.Addr.String())
+		must(err)
+		defer conns[i].Close()
+		_, err = conns[i].Write([]byte("ping\n"))
+		must(err)
+		_, err = io.ReadFull(conns[i], buf[:5])
+		must(err)
+	}
+	if stats := waitStats(func(stats ConnMemoryStats) bool {
+		return stats.Connections == n
+	}); stats.Connections != n || stats.BufferBytes != 0 || stats.PerConn() <= 0 {
+		t.Fatalf("expected %d connections holding no buffers, got %+v", n, stats)
+	}
+
+	// The partial line is left over in the inbound buffer until the line is complete.
+	_, err = conns[0].Write([]byte("partial"))
+	must(err)
+	if stats := waitStats(func(stats ConnMemoryStats) bool {
+		return stats.BufferBytes > 0
+	}); stats.BufferBytes <= 0 {
+		t.Fatalf("expected the partial line to be buffered, got %+v", stats)
+	}
+	_, err = conns[0].Write([]byte("\n"))
+	must(err)
+	_, err = io.ReadFull(conns[0], buf[:8])
+	must(err)
+	if string(buf[:8]) != "partial\n" {
+		t.Fatalf("expected partial, got %q", buf[:8])
+	}
+	if stats := waitStats(func(stats ConnMemoryStats) bool {
+		return stats.BufferBytes == 0
+	}); stats.BufferBytes != 0 {
+		t.Fatalf("expected the drained buffers to be given back, got %+v", stats)
+	}
+}
+
+func TestLazyBuffers(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	s, err := NewServer(&testMassiveServer{&EventServer{}}, "tcp://127.0.0.1:0",
+		WithLazyBuffers(idle), WithNumEventLoop(2), WithCodec(new(LineBasedFrameCodec)))
+	must(err)
+	must(s.Start())
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	waitStats := func(ok func(ConnMemoryStats) bool) ConnMemoryStats {
+		stats := s.ConnMemoryStats()
+		for deadline := time.Now().Add(5 * idle); !ok(stats) && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+			stats = s.ConnMemoryStats()
+		}
+		return stats
+	}
+
+	const n = 4
+	conns := make([]net.Conn, n)
+	buf := make([]byte, 64)
+	for i := range conns {
+		conns[i], err = net.Dial("tcp", s.Addr.String())
+		must(err)
+		defer conns[i].Close()
+		_, err = conns[i].Write([]byte("ping\n"))
+		must(err)
+		_, err = io.ReadFull(conns[i], buf[:5])
+		must(err)
+	}
+	if stats := waitStats(func(stats ConnMemoryStats) bool {
+		return stats.Connections == n
+	}); stats.Connections != n || stats.BufferBytes != 0 {
+		t.Fatalf("expected %d connections holding no buffers, got %+v", n, stats)
+	}
+
+	_, err = conns[0].Write([]byte("partial"))
+	must(err)
+	if stats := waitStats(func(stats ConnMemoryStats) bool {
+		return stats.BufferBytes > 0
+	}); stats.BufferBytes <= 0 {
+		t.Fatalf("expected the partial line to be buffered, got %+v", stats)
+	}
+	start := time.Now()
+	_, err = conns[0].Write([]byte("\n"))
+	must(err)
+	_, err = io.ReadFull(conns[0], buf[:8])
+	must(err)
+	// The drained buffer is kept until the connection has been idle for a sweep.
+	if stats := s.ConnMemoryStats(); stats.BufferBytes <= 0 && time.Since(start) < idle {
+		t.Fatalf("expected the drained buffer to be kept while the connection is active, got %+v", stats)
+	}
+	if stats := waitStats(func(stats ConnMemoryStats) bool {
+		return stats.BufferBytes == 0
+	}); stats.BufferBytes != 0 {
+		t.Fatalf("expected the buffer of the idle connection to be given back, got %+v", stats)
+	}
+}
+
+type testMassiveServer struct {
+	*EventServer
+}
+
+func (t *testMassiveServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return frame, None
+}
+
+func TestPreflight(t *testing.T) {
+	s, err := NewServer(new(EventServer), "tcp://127.0.0.1:0", WithReusePort(true), WithNumEventLoop(2))
+	must(err)
+	must(s.Preflight())
+	must(s.Start())
+	must(s.Stop(context.Background()))
+	var pe *PreflightError
+	if err = s.Preflight(); !errors.As(err, &pe) || len(pe.Failures) != 1 || pe.Failures[0].Check != PreflightListener {
+		t.Fatalf("expected the listener check to fail after shutdown, got %v", err)
+	}
+
+	var rlim unix.Rlimit
+	must(unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim))
+	if uint64(rlim.Cur) >= 1<<30 {
+		t.Skip("RLIMIT_NOFILE is virtually unlimited")
+	}
+	s, err = NewServer(new(EventServer), "tcp://127.0.0.1:0", WithExpectedConnections(int(rlim.Cur)))
+	must(err)
+	defer func() {
+		must(s.Stop(context.Background()))
+	}()
+	if err = s.Preflight(); !errors.As(err, &pe) || len(pe.Failures) != 1 || pe.Failures[0].Check != PreflightNOFILE {
+		t.Fatalf("expected the nofile check to fail, got %v", err)
+	}
+}
+
+func TestAutoAdjustNOFILE(t *testing.T) {
+	var rlim unix.Rlimit
+	must(unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim))
+	if rlim.Max <= 512 {
+		t.Skip("the hard limit of RLIMIT_NOFILE is too low")
+	}
+	defer func() {
+		must(unix.Setrlimit(unix.RLIMIT_NOFILE, &rlim))
+	}()
+	lowered := rlim
+	lowered.Cur = 512
+	must(unix.Setrlimit(unix.RLIMIT_NOFILE, &lowered))
+	s, err := NewServer(new(EventServer), "tcp://127.0.0.1:0", WithAutoAdjustNOFILE(true))
+	must(err)
+	must(s.Stop(context.Background()))
+	var raised unix.Rlimit
+	must(unix.Getrlimit(unix.RLIMIT_NOFILE, &raised))
+	if raised.Cur != rlim.Max && runtime.GOOS != "darwin" {
+		t.Fatalf("expected the soft limit to be raised to %d, got %d", rlim.Max, raised.Cur)
+	}
+}
@@ -8,5 +8,6 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/smallnest/goframe v1.0.0
 	github.com/valyala/bytebufferpool v1.0.0
+	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
 	golang.org/x/sys v0.0.0-20200331124033-c3d80250170d
 )
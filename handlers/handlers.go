@@ -0,0 +1,179 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package handlers provides reference implementations of gnet.EventHandler for the classic simple services,
+// namely echo (RFC 862), discard (RFC 863), chargen (RFC 864) and time (RFC 868). They are the canonical handlers
+// to start from when writing a new server, and to measure performance regressions of gnet against, see the
+// benchmarks in this package which run them with the load generator of the bench package.
+//
+// All of them work with both stream and datagram networks, and with the default codec, which passes the inbound
+// data through as-is.
+package handlers
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet"
+)
+
+// Echo writes back every frame it receives.
+type Echo struct {
+	*gnet.EventServer
+}
+
+// React writes the frame back to the connection.
+func (h *Echo) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	out = frame
+	return
+}
+
+// Discard throws away every frame it receives and never writes anything.
+type Discard struct {
+	*gnet.EventServer
+}
+
+// React discards the frame.
+func (h *Discard) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	return
+}
+
+// epochOffset is the number of seconds from 1900-01-01 00:00:00 UTC to the Unix epoch.
+const epochOffset = 2208988800
+
+// Time writes the current time as the 32-bit big-endian number of seconds since 1900-01-01 00:00:00 UTC.
+// On stream networks, it writes the time as soon as a connection is opened and then closes the connection,
+// on datagram networks, it replies to every datagram with the time.
+type Time struct {
+	*gnet.EventServer
+
+	// Now returns the current time, time.Now is used when it is nil.
+	Now func() time.Time
+}
+
+func (h *Time) now() []byte {
+	now := time.Now
+	if h.Now != nil {
+		now = h.Now
+	}
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(now().Unix()+epochOffset))
+	return buf
+}
+
+// OnOpened writes the time to the stream connection and closes it.
+func (h *Time) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+	return h.now(), gnet.Close
+}
+
+// React replies to the datagram with the time.
+func (h *Time) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	out = h.now()
+	return
+}
+
+// chargenLineLen is the length of a chargen line without the trailing CRLF.
+const chargenLineLen = 72
+
+// chargenPattern holds the 95 printable ASCII characters twice, so that every line is a sub-slice of it.
+var chargenPattern = func() []byte {
+	p := make([]byte, 0, 2*95)
+	for i := 0; i < 2; i++ {
+		for c := byte(' '); c <= '~'; c++ {
+			p = append(p, c)
+		}
+	}
+	return p
+}()
+
+// Chargen generates the rotating lines of the 95 printable ASCII characters, each line has 72 characters
+// followed by CRLF and starts one character after the previous line.
+//
+// On stream networks, it writes Lines lines to every connection on every tick, so that the data rate of a
+// connection is bounded, which requires the server to run with WithTicker(true). On datagram networks, it replies
+// to every datagram with one line.
+type Chargen struct {
+	*gnet.EventServer
+
+	// Interval is the interval between ticks, it defaults to 10 milliseconds.
+	Interval time.Duration
+
+	// Lines is the number of lines written to every connection on every tick, it defaults to 64.
+	Lines int
+
+	mu    sync.Mutex
+	conns map[gnet.Conn]int // connection -> index of the next line
+	udp   int
+}
+
+// next appends n lines starting from the given index and returns the index of the line following them.
+func (h *Chargen) next(buf []byte, index, n int) ([]byte, int) {
+	for i := 0; i < n; i++ {
+		buf = append(buf, chargenPattern[index:index+chargenLineLen]...)
+		buf = append(buf, '\r', '\n')
+		if index++; index == 95 {
+			index = 0
+		}
+	}
+	return buf, index
+}
+
+// OnOpened registers the stream connection for being written on ticks.
+func (h *Chargen) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+	h.mu.Lock()
+	if h.conns == nil {
+		h.conns = make(map[gnet.Conn]int)
+	}
+	h.conns[c] = 0
+	h.mu.Unlock()
+	return
+}
+
+// OnClosed unregisters the stream connection.
+func (h *Chargen) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+	h.mu.Lock()
+	delete(h.conns, c)
+	h.mu.Unlock()
+	return
+}
+
+// React discards the inbound data of stream connections and replies to datagrams with one line.
+func (h *Chargen) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	if c.ID() != 0 {
+		return
+	}
+	h.mu.Lock()
+	out, h.udp = h.next(nil, h.udp, 1)
+	h.mu.Unlock()
+	return
+}
+
+// Tick writes the next lines to every stream connection.
+func (h *Chargen) Tick() (delay time.Duration, action gnet.Action) {
+	lines := h.Lines
+	if lines <= 0 {
+		lines = 64
+	}
+	type write struct {
+		c   gnet.Conn
+		buf []byte
+	}
+	h.mu.Lock()
+	writes := make([]write, 0, len(h.conns))
+	for c, index := range h.conns {
+		w := write{c: c}
+		w.buf, h.conns[c] = h.next(make([]byte, 0, lines*(chargenLineLen+2)), index, lines)
+		writes = append(writes, w)
+	}
+	h.mu.Unlock()
+	// Write outside the lock, AsyncWrite may block on the event-loop which could be waiting for the lock.
+	for _, w := range writes {
+		_ = w.c.AsyncWrite(w.buf)
+	}
+	if delay = h.Interval; delay <= 0 {
+		delay = 10 * time.Millisecond
+	}
+	return
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet"
+	"github.com/panjf2000/gnet/bench"
+)
+
+func serve(tb testing.TB, handler gnet.EventHandler, network string, opts ...gnet.Option) (addr string, stop func()) {
+	s, err := gnet.NewServer(handler, network+"://127.0.0.1:0", opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	return s.Addr.String(), func() {
+		if err := s.Stop(context.Background()); err != nil {
+			tb.Error(err)
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	addr, stop := serve(t, new(Echo), "tcp")
+	defer stop()
+	report, err := bench.Run(bench.Config{
+		Addr:        addr,
+		Connections: 2,
+		Pipeline:    4,
+		Sizes:       bench.UniformSize{Min: 1, Max: 1024},
+		Requests:    200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors != 0 || report.Requests != 200 || report.BytesSent != report.BytesReceived {
+		t.Fatalf("unexpected report: %v", report)
+	}
+}
+
+func TestTime(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	addr, stop := serve(t, &Time{Now: func() time.Time { return now }}, "tcp")
+	defer stop()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 4 || binary.BigEndian.Uint32(buf) != 3786825600 {
+		t.Fatalf("unexpected time: %v", buf)
+	}
+}
+
+func TestChargen(t *testing.T) {
+	addr, stop := serve(t, &Chargen{Lines: 2}, "tcp", gnet.WithTicker(true))
+	defer stop()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	for i := 0; i < 100; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(line) != chargenLineLen+2 || line[0] != byte(' '+i%95) || line[chargenLineLen:] != "\r\n" {
+			t.Fatalf("unexpected line %d: %q", i, line)
+		}
+	}
+}
+
+func TestChargenUDP(t *testing.T) {
+	addr, stop := serve(t, new(Chargen), "udp")
+	defer stop()
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 128)
+	for i := 0; i < 2; i++ {
+		if _, err = c.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != chargenLineLen+2 || buf[0] != byte(' '+i) {
+			t.Fatalf("unexpected datagram %d: %q", i, buf[:n])
+		}
+	}
+}
+
+// BenchmarkEcho measures the round trips of messages of various sizes through Echo.
+func BenchmarkEcho(b *testing.B) {
+	addr, stop := serve(b, new(Echo), "tcp", gnet.WithMulticore(true))
+	defer stop()
+	for _, bm := range []struct {
+		name  string
+		conns int
+		size  int
+	}{
+		{"1conn-64B", 1, 64},
+		{"16conns-64B", 16, 64},
+		{"16conns-4KB", 16, 4096},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			bench.Benchmark(b, bench.Config{
+				Addr:        addr,
+				Connections: bm.conns,
+				Pipeline:    8,
+				Sizes:       bench.FixedSize(bm.size),
+			})
+		})
+	}
+}
+
+// BenchmarkDiscard measures the inbound throughput of Discard.
+func BenchmarkDiscard(b *testing.B) {
+	addr, stop := serve(b, new(Discard), "tcp")
+	defer stop()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 4096)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = c.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkChargen measures the outbound throughput of Chargen.
+func BenchmarkChargen(b *testing.B) {
+	addr, stop := serve(b, &Chargen{Interval: time.Millisecond, Lines: 256}, "tcp", gnet.WithTicker(true))
+	defer stop()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 4096)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = io.ReadFull(c, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPunchAttempts is the number of the rounds of sends of Server.Punch if HolePunch.Attempts is not set.
+	DefaultPunchAttempts = 10
+
+	// DefaultPunchInterval is the interval between the rounds of sends of Server.Punch if HolePunch.Interval
+	// is not set.
+	DefaultPunchInterval = 100 * time.Millisecond
+)
+
+// STUN message layout, see RFC 5389.
+const (
+	stunHeaderSize       = 20
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingResponse  = 0x0101
+	stunXorMappedAddress = 0x0020
+	stunFamilyIPv4       = 0x01
+	stunFamilyIPv6       = 0x02
+	stunMappedIPv4Size   = 8
+	stunMappedIPv6Size   = 20
+)
+
+// IsSTUNBindingRequest reports whether the UDP packet is a STUN Binding request, see RFC 5389, e.g. for answering
+// the peers discovering their server-reflexive addresses via AppendSTUNBindingResponse on the port of the server.
+func IsSTUNBindingRequest(packet []byte) bool {
+	if len(packet) < stunHeaderSize || packet[0]&0xc0 != 0 {
+		return false
+	}
+	size := int(binary.BigEndian.Uint16(packet[2:]))
+	return binary.BigEndian.Uint16(packet) == stunBindingRequest &&
+		binary.BigEndian.Uint32(packet[4:]) == stunMagicCookie &&
+		size%4 == 0 && size == len(packet)-stunHeaderSize
+}
+
+// AppendSTUNBindingResponse appends to dst the STUN Binding success response to the Binding request, carrying addr
+// in an XOR-MAPPED-ADDRESS attribute, and returns the extended buffer, addr is usually Conn.RemoteAddr, namely
+// the address of the peer as seen through its NATs. The response is not authenticated, just like those of the public
+// STUN servers. It returns dst as is if the request is not a Binding request or addr is neither TCP nor UDP.
+func AppendSTUNBindingResponse(dst, request []byte, addr net.Addr) []byte {
+	ip, port := addrIPPort(addr)
+	if !IsSTUNBindingRequest(request) || ip == nil {
+		return dst
+	}
+	family, size := stunFamilyIPv6, stunMappedIPv6Size
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, family, size = ip4, stunFamilyIPv4, stunMappedIPv4Size
+	}
+	var header [stunHeaderSize + 4]byte
+	binary.BigEndian.PutUint16(header[0:], stunBindingResponse)
+	binary.BigEndian.PutUint16(header[2:], uint16(4+size))
+	// The magic cookie and the transaction ID are echoed back.
+	copy(header[4:stunHeaderSize], request[4:stunHeaderSize])
+	binary.BigEndian.PutUint16(header[stunHeaderSize:], stunXorMappedAddress)
+	binary.BigEndian.PutUint16(header[stunHeaderSize+2:], uint16(size))
+	dst = append(dst, header[:]...)
+
+	// The port is XOR'ed with the most significant 16 bits of the magic cookie, and the address with the magic
+	// cookie followed by the transaction ID.
+	dst = append(dst, 0, byte(family), 0, 0)
+	binary.BigEndian.PutUint16(dst[len(dst)-2:], uint16(port)^(stunMagicCookie>>16))
+	for i, b := range ip {
+		dst = append(dst, b^request[4+i])
+	}
+	return dst
+}
+
+// HolePunch sets up the punch-through sends of Server.Punch.
+type HolePunch struct {
+	// Candidates are the addresses of the peer exchanged via the signaling, such as its host, server-reflexive and
+	// relayed addresses.
+	Candidates []net.Addr
+
+	// Payload is the datagram sent to every candidate, which is up to the protocol of the application, e.g. a STUN
+	// Binding request for the ICE connectivity checks.
+	Payload []byte
+
+	// Attempts is the number of the rounds of sends, DefaultPunchAttempts if it is not set.
+	Attempts int
+
+	// Interval is the interval between the rounds of sends, DefaultPunchInterval if it is not set.
+	Interval time.Duration
+}
+
+// Punch punches holes through the NATs between the UDP server and a peer, which does the same towards the server at
+// the same time: every round sends HolePunch.Payload from the socket of the server to all the candidate addresses of
+// the peer back to back, and the rounds go on at HolePunch.Interval until HolePunch.Attempts rounds are taken, stop
+// is invoked or the server shuts down. The first round is taken before Punch returns, and the failed sends are
+// ignored since the candidates are expected to be unreachable but for some of them. It can be invoked from any
+// goroutine, and fails with ErrProtocolNotSupported if the server doesn't listen on UDP.
+func (s Server) Punch(p HolePunch) (stop func(), err error) {
+	ln := s.svr.ln.packetListener()
+	if ln == nil {
+		return nil, ErrProtocolNotSupported
+	}
+	pconn := ln.pconn
+	attempts, interval := p.Attempts, p.Interval
+	if attempts <= 0 {
+		attempts = DefaultPunchAttempts
+	}
+	if interval <= 0 {
+		interval = DefaultPunchInterval
+	}
+	candidates := append([]net.Addr(nil), p.Candidates...)
+	payload := append([]byte(nil), p.Payload...)
+
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+	}
+	var round func()
+	round = func() {
+		select {
+		case <-done:
+			return
+		case <-s.svr.shutdown:
+			return
+		default:
+		}
+		for _, addr := range candidates {
+			_, _ = pconn.WriteTo(payload, addr)
+		}
+		if attempts--; attempts > 0 {
+			time.AfterFunc(interval, round)
+		}
+	}
+	round()
+	return stop, nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build netbsd freebsd dragonfly
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// acceptFilterArgSize is the size of struct accept_filter_arg, which holds the name of the filter in the first
+// 16 bytes and its argument in the rest.
+const acceptFilterArgSize = 256
+
+// SetAcceptFilter attaches the accept filter with the given name to the listening socket (SO_ACCEPTFILTER),
+// e.g. "dataready" or "httpready", so that the connections are only reported by accept once the filter is
+// satisfied, the kernel module of the filter must be loaded.
+func SetAcceptFilter(fd int, name string) error {
+	var arg [acceptFilterArgSize]byte
+	copy(arg[:15], name)
+	return unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_ACCEPTFILTER, string(arg[:]))
+}
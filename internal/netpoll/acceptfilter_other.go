@@ -0,0 +1,14 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// SetAcceptFilter is not available on Linux and macOS, which have no SO_ACCEPTFILTER.
+func SetAcceptFilter(fd int, name string) error {
+	return unix.ENOPROTOOPT
+}
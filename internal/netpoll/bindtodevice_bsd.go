@@ -0,0 +1,14 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd dragonfly
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// SetBindToDevice is not available on BSD-like systems, which have no SO_BINDTODEVICE.
+func SetBindToDevice(fd int, ifname string) error {
+	return unix.ENOPROTOOPT
+}
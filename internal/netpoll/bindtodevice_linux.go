@@ -0,0 +1,13 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// SetBindToDevice binds the socket to the network interface with the given name (SO_BINDTODEVICE),
+// so that only the packets received on the interface are processed by the socket.
+func SetBindToDevice(fd int, ifname string) error {
+	return unix.BindToDevice(fd, ifname)
+}
@@ -8,7 +8,8 @@
 package netpoll
 
 import (
-	"log"
+	"os"
+	"time"
 	"unsafe"
 
 	"github.com/panjf2000/gnet/internal"
@@ -17,9 +18,13 @@ import (
 
 // Poller represents a poller which is in charge of monitoring file-descriptors.
 type Poller struct {
-	fd            int    // epoll fd
-	wfd           int    // wake fd
-	wfdBuf        []byte // wfd buffer to read packet
+	fd            int           // epoll fd
+	wfd           int           // wake fd
+	wfdBuf        []byte        // wfd buffer to read packet
+	timeout       time.Duration // timeout of epoll_wait, negative means infinite
+	eventsCap     int           // maximum number of events returned by one epoll_wait, 0 means unlimited
+	batchHook     func()        // invoked after every batch of events and jobs
+	wakeHook      func()        // invoked before every batch of events and jobs
 	asyncJobQueue internal.AsyncJobQueue
 }
 
@@ -31,6 +36,7 @@ func OpenPoller() (*Poller, error) {
 		return nil, err
 	}
 	poller.fd = epollFD
+	poller.timeout = -1
 	r0, _, errno := unix.Syscall(unix.SYS_EVENTFD2, unix.O_CLOEXEC, unix.O_NONBLOCK, 0)
 	if errno != 0 {
 		_ = unix.Close(epollFD)
@@ -63,42 +69,98 @@ var (
 // Trigger wakes up the poller blocked in waiting for network-events and runs jobs in asyncJobQueue.
 func (p *Poller) Trigger(job internal.Job) error {
 	if p.asyncJobQueue.Push(job) == 1 {
-		_, err := unix.Write(p.wfd, b)
-		return err
+		return p.Wake()
 	}
 	return nil
 }
 
+// Wake wakes up the poller blocked in waiting for network-events, so that it runs the jobs left in asyncJobQueue.
+func (p *Poller) Wake() error {
+	_, err := unix.Write(p.wfd, b)
+	return err
+}
+
+// SetPollTimeout sets up the timeout of every epoll_wait in Polling, a non-positive timeout means infinite, and
+// a positive one is rounded up to milliseconds.
+func (p *Poller) SetPollTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = -1
+	}
+	p.timeout = timeout
+}
+
+// SetEventsCap sets up the maximum number of events handled in one iteration of Polling,
+// a non-positive cap means that the event-list keeps growing whenever it's filled up.
+func (p *Poller) SetEventsCap(eventsCap int) {
+	p.eventsCap = eventsCap
+}
+
 // Polling blocks the current goroutine, waiting for network-events.
 func (p *Poller) Polling(callback func(fd int, ev uint32) error) (err error) {
-	el := newEventList(InitEvents)
-	var wakenUp bool
+	el := newEventList(initEventsSize(p.eventsCap))
+	var n int
 	for {
-		n, err0 := unix.EpollWait(p.fd, el.events, -1)
-		if err0 != nil && err0 != unix.EINTR {
-			log.Println(err0)
-			continue
+		if n, err = p.poll(el, p.timeout, callback); err != nil {
+			return
 		}
-		for i := 0; i < n; i++ {
-			if fd := int(el.events[i].Fd); fd != p.wfd {
-				if err = callback(fd, el.events[i].Events); err != nil {
-					return
-				}
-			} else {
-				wakenUp = true
-				_, _ = unix.Read(p.wfd, p.wfdBuf)
-			}
+		if n == el.size && (p.eventsCap <= 0 || el.size < p.eventsCap) {
+			el.increase(p.eventsCap)
 		}
-		if wakenUp {
-			wakenUp = false
-			if err = p.asyncJobQueue.ForEach(); err != nil {
+	}
+}
+
+// SetBatchHook sets up the hook invoked after the events returned by every epoll_wait call and the jobs
+// in asyncJobQueue are handled, e.g. for publishing the state updated by the batch, it must be set up
+// before polling.
+func (p *Poller) SetBatchHook(hook func()) {
+	p.batchHook = hook
+}
+
+// SetWakeHook sets up the hook invoked when every epoll_wait call returns, before the events and the jobs in
+// asyncJobQueue are handled, e.g. for measuring the time spent on handling them, it must be set up before polling.
+func (p *Poller) SetWakeHook(hook func()) {
+	p.wakeHook = hook
+}
+
+// PollOnce waits for network-events for at most the given timeout, a negative timeout means waiting indefinitely,
+// and then handles the network-events and the jobs in asyncJobQueue, just like one iteration of Polling.
+func (p *Poller) PollOnce(timeout time.Duration, callback func(fd int, ev uint32) error) (err error) {
+	_, err = p.poll(newEventList(initEventsSize(p.eventsCap)), timeout, callback)
+	return
+}
+
+func (p *Poller) poll(el *eventList, timeout time.Duration, callback func(fd int, ev uint32) error) (n int, err error) {
+	msec := -1
+	if timeout >= 0 {
+		// Round up to the millisecond resolution of epoll_wait, so that the timeouts below 1ms don't turn into
+		// busy polling.
+		msec = int((timeout + time.Millisecond - 1) / time.Millisecond)
+	}
+	n, err0 := unix.EpollWait(p.fd, el.events, msec)
+	if err0 != nil && err0 != unix.EINTR {
+		return 0, os.NewSyscallError("epoll_wait", err0)
+	}
+	if p.wakeHook != nil {
+		p.wakeHook()
+	}
+	var wakenUp bool
+	for i := 0; i < n; i++ {
+		if fd := int(el.events[i].Fd); fd != p.wfd {
+			if err = callback(fd, el.events[i].Events); err != nil {
 				return
 			}
+		} else {
+			wakenUp = true
+			_, _ = unix.Read(p.wfd, p.wfdBuf)
 		}
-		if n == el.size {
-			el.increase()
-		}
 	}
+	if wakenUp {
+		err = p.asyncJobQueue.ForEach()
+	}
+	if p.batchHook != nil {
+		p.batchHook()
+	}
+	return
 }
 
 const (
@@ -117,6 +179,13 @@ func (p *Poller) AddRead(fd int) error {
 	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readEvents})
 }
 
+// AddReadExclusive registers the given file-descriptor with readable event to the poller with EPOLLEXCLUSIVE,
+// so that only one of the pollers sharing the file-descriptor is woken up for every event, e.g. for a listener
+// shared by the event-loops.
+func (p *Poller) AddReadExclusive(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: unix.EPOLLIN | unix.EPOLLEXCLUSIVE})
+}
+
 // AddWrite registers the given file-descriptor with writable event to the poller.
 func (p *Poller) AddWrite(fd int) error {
 	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: writeEvents})
@@ -132,6 +201,25 @@ func (p *Poller) ModReadWrite(fd int) error {
 	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readWriteEvents})
 }
 
+// ModWrite renews the given file-descriptor with writable event only in the poller, watch its readable event
+// again via ModRead.
+func (p *Poller) ModWrite(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: writeEvents})
+}
+
+// ModNone renews the given file-descriptor with no events in the poller, so that it stays registered without being
+// reported until it is renewed via ModRead, ModReadWrite or ModWrite. EPOLLERR and EPOLLHUP can't be unsubscribed
+// from, they are edge-triggered so as to be reported once at most.
+func (p *Poller) ModNone(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: unix.EPOLLET})
+}
+
+// DeleteRead stops watching the readable event of the given file-descriptor registered with readable event only,
+// watch it again via AddRead.
+func (p *Poller) DeleteRead(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
 // Delete removes the given file-descriptor from the poller.
 func (p *Poller) Delete(fd int) error {
 	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil)
@@ -8,7 +8,8 @@
 package netpoll
 
 import (
-	"log"
+	"os"
+	"time"
 
 	"github.com/panjf2000/gnet/internal"
 	"golang.org/x/sys/unix"
@@ -17,6 +18,10 @@ import (
 // Poller represents a poller which is in charge of monitoring file-descriptors.
 type Poller struct {
 	fd            int
+	timeout       time.Duration // timeout of kevent, negative means infinite
+	eventsCap     int           // maximum number of events returned by one kevent, 0 means unlimited
+	batchHook     func()        // invoked after every batch of events and jobs
+	wakeHook      func()        // invoked before every batch of events and jobs
 	asyncJobQueue internal.AsyncJobQueue
 }
 
@@ -28,6 +33,7 @@ func OpenPoller() (*Poller, error) {
 		return nil, err
 	}
 	poller.fd = kfd
+	poller.timeout = -1
 	_, err = unix.Kevent(poller.fd, []unix.Kevent_t{{
 		Ident:  0,
 		Filter: unix.EVFILT_USER,
@@ -54,46 +60,102 @@ var wakeChanges = []unix.Kevent_t{{
 // Trigger wakes up the poller blocked in waiting for network-events and runs jobs in asyncJobQueue.
 func (p *Poller) Trigger(job internal.Job) error {
 	if p.asyncJobQueue.Push(job) == 1 {
-		_, err := unix.Kevent(p.fd, wakeChanges, nil, nil)
-		return err
+		return p.Wake()
 	}
 	return nil
 }
 
+// Wake wakes up the poller blocked in waiting for network-events, so that it runs the jobs left in asyncJobQueue.
+func (p *Poller) Wake() error {
+	_, err := unix.Kevent(p.fd, wakeChanges, nil, nil)
+	return err
+}
+
+// SetPollTimeout sets up the timeout of every kevent in Polling, a non-positive timeout means infinite.
+func (p *Poller) SetPollTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = -1
+	}
+	p.timeout = timeout
+}
+
+// SetEventsCap sets up the maximum number of events handled in one iteration of Polling,
+// a non-positive cap means that the event-list keeps growing whenever it's filled up.
+func (p *Poller) SetEventsCap(eventsCap int) {
+	p.eventsCap = eventsCap
+}
+
 // Polling blocks the current goroutine, waiting for network-events.
 func (p *Poller) Polling(callback func(fd int, filter int16) error) (err error) {
-	el := newEventList(InitEvents)
-	var wakenUp bool
+	el := newEventList(initEventsSize(p.eventsCap))
+	var n int
 	for {
-		n, err0 := unix.Kevent(p.fd, nil, el.events, nil)
-		if err0 != nil && err0 != unix.EINTR {
-			log.Println(err0)
-			continue
+		if n, err = p.poll(el, p.timeout, callback); err != nil {
+			return
 		}
-		var evFilter int16
-		for i := 0; i < n; i++ {
-			if fd := int(el.events[i].Ident); fd != 0 {
-				evFilter = el.events[i].Filter
-				if (el.events[i].Flags&unix.EV_EOF != 0) || (el.events[i].Flags&unix.EV_ERROR != 0) {
-					evFilter = EVFilterSock
-				}
-				if err = callback(fd, evFilter); err != nil {
-					return
-				}
-			} else {
-				wakenUp = true
-			}
+		if n == el.size && (p.eventsCap <= 0 || el.size < p.eventsCap) {
+			el.increase(p.eventsCap)
 		}
-		if wakenUp {
-			wakenUp = false
-			if err = p.asyncJobQueue.ForEach(); err != nil {
+	}
+}
+
+// SetBatchHook sets up the hook invoked after the events returned by every kevent call and the jobs
+// in asyncJobQueue are handled, e.g. for publishing the state updated by the batch, it must be set up
+// before polling.
+func (p *Poller) SetBatchHook(hook func()) {
+	p.batchHook = hook
+}
+
+// SetWakeHook sets up the hook invoked when every kevent call returns, before the events and the jobs in
+// asyncJobQueue are handled, e.g. for measuring the time spent on handling them, it must be set up before polling.
+func (p *Poller) SetWakeHook(hook func()) {
+	p.wakeHook = hook
+}
+
+// PollOnce waits for network-events for at most the given timeout, a negative timeout means waiting indefinitely,
+// and then handles the network-events and the jobs in asyncJobQueue, just like one iteration of Polling.
+func (p *Poller) PollOnce(timeout time.Duration, callback func(fd int, filter int16) error) (err error) {
+	_, err = p.poll(newEventList(initEventsSize(p.eventsCap)), timeout, callback)
+	return
+}
+
+func (p *Poller) poll(el *eventList, timeout time.Duration, callback func(fd int, filter int16) error) (n int, err error) {
+	var ts *unix.Timespec
+	if timeout >= 0 {
+		t := unix.NsecToTimespec(int64(timeout))
+		ts = &t
+	}
+	n, err0 := unix.Kevent(p.fd, nil, el.events, ts)
+	if err0 != nil && err0 != unix.EINTR {
+		return 0, os.NewSyscallError("kevent", err0)
+	}
+	if p.wakeHook != nil {
+		p.wakeHook()
+	}
+	var (
+		wakenUp  bool
+		evFilter int16
+	)
+	for i := 0; i < n; i++ {
+		if fd := int(el.events[i].Ident); fd != 0 {
+			evFilter = el.events[i].Filter
+			if (el.events[i].Flags&unix.EV_EOF != 0) || (el.events[i].Flags&unix.EV_ERROR != 0) {
+				evFilter = EVFilterSock
+			}
+			if err = callback(fd, evFilter); err != nil {
 				return
 			}
+		} else {
+			wakenUp = true
 		}
-		if n == el.size {
-			el.increase()
-		}
 	}
+	if wakenUp {
+		err = p.asyncJobQueue.ForEach()
+	}
+	if p.batchHook != nil {
+		p.batchHook()
+	}
+	return
 }
 
 // AddReadWrite registers the given file-descriptor with readable and writable events to the poller.
@@ -116,6 +178,12 @@ func (p *Poller) AddRead(fd int) error {
 	return nil
 }
 
+// AddReadExclusive registers the given file-descriptor with readable event to the poller, kqueue has no exclusive
+// wake-ups, thus it is equivalent to AddRead.
+func (p *Poller) AddReadExclusive(fd int) error {
+	return p.AddRead(fd)
+}
+
 // AddWrite registers the given file-descriptor with writable event to the poller.
 func (p *Poller) AddWrite(fd int) error {
 	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
@@ -128,6 +196,7 @@ func (p *Poller) AddWrite(fd int) error {
 // ModRead renews the given file-descriptor with readable event in the poller.
 func (p *Poller) ModRead(fd int) error {
 	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
+		{Ident: uint64(fd), Flags: unix.EV_ADD, Filter: unix.EVFILT_READ},
 		{Ident: uint64(fd), Flags: unix.EV_DELETE, Filter: unix.EVFILT_WRITE}}, nil, nil); err != nil {
 		return err
 	}
@@ -143,6 +212,41 @@ func (p *Poller) ModReadWrite(fd int) error {
 	return nil
 }
 
+// ModWrite renews the given file-descriptor with writable event only in the poller, watch its readable event
+// again via ModRead.
+func (p *Poller) ModWrite(fd int) error {
+	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
+		{Ident: uint64(fd), Flags: unix.EV_ADD, Filter: unix.EVFILT_WRITE},
+		{Ident: uint64(fd), Flags: unix.EV_DELETE, Filter: unix.EVFILT_READ}}, nil, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ModNone renews the given file-descriptor with no events in the poller, so that it stays registered without being
+// reported until it is renewed via ModRead, ModReadWrite or ModWrite.
+func (p *Poller) ModNone(fd int) error {
+	// Delete the filters one by one, since deleting a filter that isn't registered fails with ENOENT.
+	_, _ = unix.Kevent(p.fd, []unix.Kevent_t{
+		{Ident: uint64(fd), Flags: unix.EV_DELETE, Filter: unix.EVFILT_WRITE}}, nil, nil)
+	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
+		{Ident: uint64(fd), Flags: unix.EV_DELETE, Filter: unix.EVFILT_READ}}, nil, nil); err != nil &&
+		err != unix.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// DeleteRead stops watching the readable event of the given file-descriptor registered with readable event only,
+// watch it again via AddRead.
+func (p *Poller) DeleteRead(fd int) error {
+	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
+		{Ident: uint64(fd), Flags: unix.EV_DELETE, Filter: unix.EVFILT_READ}}, nil, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Delete removes the given file-descriptor from the poller.
 func (p *Poller) Delete(fd int) error {
 	return nil
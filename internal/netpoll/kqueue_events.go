@@ -29,7 +29,18 @@ func newEventList(size int) *eventList {
 	return &eventList{size, make([]unix.Kevent_t, size)}
 }
 
-func (el *eventList) increase() {
+func (el *eventList) increase(limit int) {
 	el.size <<= 1
+	if limit > 0 && el.size > limit {
+		el.size = limit
+	}
 	el.events = make([]unix.Kevent_t, el.size)
 }
+
+// initEventsSize returns the initial length of poller event-list within the given cap.
+func initEventsSize(eventsCap int) int {
+	if eventsCap > 0 && eventsCap < InitEvents {
+		return eventsCap
+	}
+	return InitEvents
+}
@@ -18,6 +18,39 @@ func SetKeepAlive(fd, secs int) error {
 	return nil
 }
 
+// SetIPTOS sets the type of service of the outgoing packets of the socket.
+func SetIPTOS(fd, tos int) error {
+	return errors.New("IP_TOS is not available")
+}
+
+// SetIPTTL sets the time-to-live of the outgoing packets of the socket.
+func SetIPTTL(fd, ttl int) error {
+	return errors.New("IP_TTL is not available")
+}
+
+// SetBindToDevice binds the socket to the network interface with the given name.
+func SetBindToDevice(fd int, ifname string) error {
+	return errors.New("SO_BINDTODEVICE is not available")
+}
+
+// SetAcceptFilter attaches the accept filter with the given name to the listening socket.
+func SetAcceptFilter(fd int, name string) error {
+	return errors.New("SO_ACCEPTFILTER is not available")
+}
+
+// SetTransparent enables transparent proxying on the socket.
+func SetTransparent(fd int) error {
+	return errors.New("IP_TRANSPARENT is not available")
+}
+
+// OrigDstSpace is the size of the buffer for the out-of-band data carrying the original destination.
+var OrigDstSpace = 0
+
+// ParseOrigDst returns the original destination of the packet carried by the out-of-band data.
+func ParseOrigDst(oob []byte) *net.UDPAddr {
+	return nil
+}
+
 // ReusePortListenPacket returns a net.PacketConn for UDP.
 func ReusePortListenPacket(proto, addr string) (net.PacketConn, error) {
 	return nil, errors.New("reuseport is not available")
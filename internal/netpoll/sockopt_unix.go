@@ -0,0 +1,33 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd dragonfly
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// SetIPTOS sets the type of service (the DSCP and ECN bits) of the outgoing packets of the socket, which is
+// IPV6_TCLASS on IPv6 sockets.
+func SetIPTOS(fd, tos int) error {
+	return setIPOption(fd, unix.IP_TOS, unix.IPV6_TCLASS, tos)
+}
+
+// SetIPTTL sets the time-to-live of the outgoing packets of the socket, which is the hop limit on IPv6 sockets.
+func SetIPTTL(fd, ttl int) error {
+	return setIPOption(fd, unix.IP_TTL, unix.IPV6_UNICAST_HOPS, ttl)
+}
+
+func setIPOption(fd, opt4, opt6, value int) error {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		// Dual-stack sockets also carry IPv4 traffic, which is subject to the IPv4 option on some systems.
+		_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, opt4, value)
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, opt6, value)
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, opt4, value)
+}
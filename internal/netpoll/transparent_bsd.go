@@ -0,0 +1,26 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd dragonfly
+
+package netpoll
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetTransparent is not available on BSD-like systems, which have no IP_TRANSPARENT.
+func SetTransparent(fd int) error {
+	return unix.ENOPROTOOPT
+}
+
+// OrigDstSpace is the size of the buffer for the out-of-band data carrying the original destination.
+var OrigDstSpace = 0
+
+// ParseOrigDst returns nil on BSD-like systems.
+func ParseOrigDst(oob []byte) *net.UDPAddr {
+	return nil
+}
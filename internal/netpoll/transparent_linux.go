@@ -0,0 +1,68 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package netpoll
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetTransparent enables transparent proxying on the socket (IP_TRANSPARENT), which lets it receive the traffic
+// redirected by TPROXY, it also makes the UDP socket report the original destination of every packet
+// (IP_RECVORIGDSTADDR), which is parsed by ParseOrigDst.
+func SetTransparent(fd int) error {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	sotype, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return err
+	}
+	level, transparent, recvOrigDst := unix.SOL_IP, unix.IP_TRANSPARENT, unix.IP_RECVORIGDSTADDR
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		// Dual-stack sockets also carry IPv4 traffic, which is subject to the IPv4 options.
+		_ = unix.SetsockoptInt(fd, level, transparent, 1)
+		if sotype == unix.SOCK_DGRAM {
+			_ = unix.SetsockoptInt(fd, level, recvOrigDst, 1)
+		}
+		level, transparent, recvOrigDst = unix.SOL_IPV6, unix.IPV6_TRANSPARENT, unix.IPV6_RECVORIGDSTADDR
+	}
+	if err = unix.SetsockoptInt(fd, level, transparent, 1); err != nil || sotype != unix.SOCK_DGRAM {
+		return err
+	}
+	return unix.SetsockoptInt(fd, level, recvOrigDst, 1)
+}
+
+// OrigDstSpace is the size of the buffer for the out-of-band data carrying the original destination.
+var OrigDstSpace = unix.CmsgSpace(unix.SizeofSockaddrInet6)
+
+// ParseOrigDst returns the original destination of the packet carried by the out-of-band data received on
+// a transparent UDP socket, it returns nil if there is none.
+func ParseOrigDst(oob []byte) *net.UDPAddr {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR &&
+			len(m.Data) >= unix.SizeofSockaddrInet4:
+			// struct sockaddr_in: family, port in network byte order, address.
+			ip := make(net.IP, net.IPv4len)
+			copy(ip, m.Data[4:8])
+			return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(m.Data[2:4]))}
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR &&
+			len(m.Data) >= unix.SizeofSockaddrInet6:
+			// struct sockaddr_in6: family, port in network byte order, flow info, address, scope ID.
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, m.Data[8:24])
+			return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(m.Data[2:4]))}
+		}
+	}
+	return nil
+}
@@ -30,7 +30,8 @@ func (q *AsyncJobQueue) Push(job Job) (jobsNum int) {
 	return
 }
 
-// ForEach iterates this queue and executes each note with a given func.
+// ForEach iterates this queue and executes each note with a given func, the jobs following a failed one are put back
+// at the front of the queue.
 func (q *AsyncJobQueue) ForEach() (err error) {
 	q.lock.Lock()
 	jobs := q.jobs
@@ -38,6 +39,11 @@ func (q *AsyncJobQueue) ForEach() (err error) {
 	q.lock.Unlock()
 	for i := range jobs {
 		if err = jobs[i](); err != nil {
+			if rest := jobs[i+1:]; len(rest) > 0 {
+				q.lock.Lock()
+				q.jobs = append(rest, q.jobs...)
+				q.lock.Unlock()
+			}
 			return err
 		}
 	}
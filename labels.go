@@ -0,0 +1,166 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultMaxLabelValues is the maximum number of the distinct values of a label key, as well as the maximum
+	// number of the distinct label keys, aggregated by a server if Options.MaxLabelValues is not set.
+	DefaultMaxLabelValues = 64
+
+	// LabelOverflow is the key or value the labels beyond Options.MaxLabelValues are aggregated under.
+	LabelOverflow = "_other"
+)
+
+// LabelStats are the statistics of the connections with a label, see Conn.SetLabel and Server.LabelStats.
+type LabelStats struct {
+	// Key and Value are the label, either of them is LabelOverflow for the labels beyond Options.MaxLabelValues.
+	Key, Value string
+
+	// Connections is the number of the open connections with the label.
+	Connections int64
+
+	// BytesIn is the number of bytes read from the connections while they had the label.
+	BytesIn uint64
+
+	// BytesOut is the number of bytes written to the connections while they had the label.
+	BytesOut uint64
+}
+
+// labelCounters are the counters of a label, they are updated by the event-loops of the connections with the label.
+type labelCounters struct {
+	bytesIn     uint64
+	bytesOut    uint64
+	connections int64
+}
+
+// connLabel is a label of a connection along with the counters it is aggregated on.
+type connLabel struct {
+	key, value string
+	counters   *labelCounters
+}
+
+type labelID struct {
+	key, value string
+}
+
+// labelRegistry holds the counters of the labels of the connections of a server, the number of them is bounded by
+// MaxLabelValues, so that the labels taken from the peers, e.g. tenants, can't exhaust the memory.
+type labelRegistry struct {
+	mu       sync.RWMutex
+	counters map[labelID]*labelCounters
+	values   map[string]int // number of the distinct values of every key
+}
+
+// lookup returns the counters of the label, or the ones of the overflow label if there are too many labels.
+func (r *labelRegistry) lookup(key, value string, max int) *labelCounters {
+	id := labelID{key, value}
+	r.mu.RLock()
+	lc := r.counters[id]
+	r.mu.RUnlock()
+	if lc != nil {
+		return lc
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if lc = r.counters[id]; lc != nil {
+		return lc
+	}
+	if r.counters == nil {
+		r.counters, r.values = make(map[labelID]*labelCounters), make(map[string]int)
+	}
+	if _, ok := r.values[key]; !ok && len(r.values) >= max {
+		id = labelID{LabelOverflow, LabelOverflow}
+	} else if r.values[key] >= max {
+		id.value = LabelOverflow
+	}
+	if lc = r.counters[id]; lc == nil {
+		lc = new(labelCounters)
+		r.counters[id] = lc
+		r.values[id.key]++
+	}
+	return lc
+}
+
+func (r *labelRegistry) stats() (stats []LabelStats) {
+	r.mu.RLock()
+	for id, lc := range r.counters {
+		stats = append(stats, LabelStats{
+			Key:         id.key,
+			Value:       id.value,
+			Connections: atomic.LoadInt64(&lc.connections),
+			BytesIn:     atomic.LoadUint64(&lc.bytesIn),
+			BytesOut:    atomic.LoadUint64(&lc.bytesOut),
+		})
+	}
+	r.mu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Key != stats[j].Key {
+			return stats[i].Key < stats[j].Key
+		}
+		return stats[i].Value < stats[j].Value
+	})
+	return
+}
+
+// LabelStats returns the statistics of the connections aggregated by their labels, sorted by the keys and the values
+// of the labels. The labels no connection has any more are kept along with their byte counts.
+func (s Server) LabelStats() []LabelStats {
+	return s.svr.labels.stats()
+}
+
+// setLabel sets the label of a connection, moving it from the counters of the former value of the key if any.
+func (svr *server) setLabel(labels []connLabel, key, value string) []connLabel {
+	max := svr.opts.MaxLabelValues
+	if max <= 0 {
+		max = DefaultMaxLabelValues
+	}
+	lc := svr.labels.lookup(key, value, max)
+	atomic.AddInt64(&lc.connections, 1)
+	for i := range labels {
+		if labels[i].key == key {
+			atomic.AddInt64(&labels[i].counters.connections, -1)
+			labels[i].value, labels[i].counters = value, lc
+			return labels
+		}
+	}
+	return append(labels, connLabel{key, value, lc})
+}
+
+func labelValue(labels []connLabel, key string) string {
+	for _, l := range labels {
+		if l.key == key {
+			return l.value
+		}
+	}
+	return ""
+}
+
+func countLabelsIn(labels []connLabel, n int) {
+	for _, l := range labels {
+		atomic.AddUint64(&l.counters.bytesIn, uint64(n))
+	}
+}
+
+func countLabelsOut(labels []connLabel, n int) {
+	for _, l := range labels {
+		atomic.AddUint64(&l.counters.bytesOut, uint64(n))
+	}
+}
+
+// releaseLabels removes a closed connection from the counters of its labels.
+func releaseLabels(labels []connLabel) {
+	for _, l := range labels {
+		atomic.AddInt64(&l.counters.connections, -1)
+	}
+}
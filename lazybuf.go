@@ -0,0 +1,62 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"time"
+
+	prb "github.com/panjf2000/gnet/pool/ringbuffer"
+	"github.com/panjf2000/gnet/ringbuffer"
+)
+
+// emptyRingBuffer stands in for the ring-buffers of the connections given back to the pool. It is shared by all
+// the connections, thus it must never be written to, nor even reset, the connections take a ring-buffer from
+// the pool before writing, see bufferInbound.
+var emptyRingBuffer = ringbuffer.New(0)
+
+// putRingBuffer gives rb back to the pool unless it has no capacity, e.g. emptyRingBuffer, which would only be
+// replaced once taken from the pool again.
+func putRingBuffer(rb *ringbuffer.RingBuffer) {
+	if rb.Cap() > 0 {
+		prb.Put(rb)
+	}
+}
+
+// startBufferReaper starts the sweeps giving the drained ring-buffers of the idle connections back to the pool
+// every BufferIdleTimeout, if it is enabled, see WithLazyBuffers.
+func (svr *server) startBufferReaper() {
+	timeout := svr.opts.BufferIdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	var sweep func()
+	sweep = func() {
+		select {
+		case <-svr.shutdown:
+			return
+		default:
+		}
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			_ = el.post(busMessage{fn: el.loopReleaseIdleBuffers})
+			return true
+		})
+		time.AfterFunc(timeout, sweep)
+	}
+	time.AfterFunc(timeout, sweep)
+}
+
+// loopReleaseIdleBuffers gives back the drained ring-buffers of the connections that have been idle since
+// the previous sweep, and marks the others as idle for the next one.
+func (el *eventloop) loopReleaseIdleBuffers() {
+	for _, c := range el.connsByID {
+		if c.bufferActive {
+			c.bufferActive = false
+			continue
+		}
+		c.releaseBuffers()
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"sync"
 
+	"github.com/panjf2000/gnet/internal/netpoll"
 	"golang.org/x/sys/unix"
 )
 
@@ -22,12 +23,32 @@ type listener struct {
 	once          sync.Once
 	pconn         net.PacketConn
 	lnaddr        net.Addr
+	transport     Transport // custom transport of the listener, nil for the built-in networks
+	udp           *listener // UDP listener bound along with the TCP listener on the "tcp+udp" network
 	addr, network string
 }
 
+// listenTransport creates the listener with the custom transport.
+func (ln *listener) listenTransport(t Transport) error {
+	fd, lnaddr, err := t.Listen(ln.addr)
+	if err != nil {
+		return err
+	}
+	ln.fd, ln.lnaddr, ln.transport = fd, lnaddr, t
+	return nil
+}
+
 // system takes the net listener and detaches it from it's parent
 // event loop, grabs the file descriptor, and makes it non-blocking.
 func (ln *listener) system() error {
+	if ln.network == "memory" {
+		ln.fd = -1
+		return nil
+	}
+	if ln.transport != nil {
+		// The file descriptor comes from Transport.Listen.
+		return nil
+	}
 	var err error
 	switch netln := ln.ln.(type) {
 	case nil:
@@ -48,6 +69,39 @@ func (ln *listener) system() error {
 	return unix.SetNonblock(ln.fd, true)
 }
 
+// setSockopts sets up the socket options of the listener, which are inherited by the accepted connections.
+func (ln *listener) setSockopts(opts *Options) error {
+	if ln.fd < 0 {
+		return nil
+	}
+	if opts.BindToDevice != "" {
+		if err := netpoll.SetBindToDevice(ln.fd, opts.BindToDevice); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if opts.IPTOS != 0 {
+		if err := netpoll.SetIPTOS(ln.fd, opts.IPTOS); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if opts.IPTTL != 0 {
+		if err := netpoll.SetIPTTL(ln.fd, opts.IPTTL); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if opts.Transparent {
+		if err := netpoll.SetTransparent(ln.fd); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if opts.AcceptFilter != "" {
+		if err := netpoll.SetAcceptFilter(ln.fd, opts.AcceptFilter); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
 func (ln *listener) close() {
 	ln.once.Do(
 		func() {
@@ -60,8 +114,14 @@ func (ln *listener) close() {
 			if ln.pconn != nil {
 				sniffErrorAndLog(ln.pconn.Close())
 			}
+			if ln.transport != nil {
+				sniffErrorAndLog(ln.transport.Close(ln.fd))
+			}
 			if ln.network == "unix" {
 				sniffErrorAndLog(os.RemoveAll(ln.addr))
 			}
+			if ln.udp != nil {
+				ln.udp.close()
+			}
 		})
 }
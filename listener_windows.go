@@ -11,20 +11,77 @@ import (
 	"net"
 	"os"
 	"sync"
+	"syscall"
 )
 
+// ipv6TrafficClass is IPV6_TCLASS on Windows, which is missing in package syscall.
+const ipv6TrafficClass = 39
+
 type listener struct {
 	ln            net.Listener
 	once          sync.Once
 	pconn         net.PacketConn
 	lnaddr        net.Addr
+	udp           *listener // UDP listener bound along with the TCP listener on the "tcp+udp" network
 	addr, network string
 }
 
+// listenTransport fails as the custom transports are only supported on Unix-like systems.
+func (ln *listener) listenTransport(t Transport) error {
+	return ErrProtocolNotSupported
+}
+
 func (ln *listener) system() error {
 	return nil
 }
 
+// setSockopts sets up the socket options of the listener, which are inherited by the accepted connections.
+func (ln *listener) setSockopts(opts *Options) error {
+	if opts.IPTOS == 0 && opts.IPTTL == 0 {
+		return nil
+	}
+	var sc syscall.Conn
+	switch {
+	case ln.ln != nil:
+		sc, _ = ln.ln.(syscall.Conn)
+	case ln.pconn != nil:
+		sc, _ = ln.pconn.(syscall.Conn)
+	}
+	if sc == nil {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv6 := false
+	switch addr := ln.lnaddr.(type) {
+	case *net.TCPAddr:
+		ipv6 = addr.IP.To4() == nil
+	case *net.UDPAddr:
+		ipv6 = addr.IP.To4() == nil
+	}
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		level, tos, ttl := syscall.IPPROTO_IP, syscall.IP_TOS, syscall.IP_TTL
+		if ipv6 {
+			level, tos, ttl = syscall.IPPROTO_IPV6, ipv6TrafficClass, syscall.IPV6_UNICAST_HOPS
+		}
+		if opts.IPTOS != 0 {
+			if opErr = syscall.SetsockoptInt(syscall.Handle(fd), level, tos, opts.IPTOS); opErr != nil {
+				return
+			}
+		}
+		if opts.IPTTL != 0 {
+			opErr = syscall.SetsockoptInt(syscall.Handle(fd), level, ttl, opts.IPTTL)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", opErr)
+}
+
 func (ln *listener) close() {
 	ln.once.Do(func() {
 		if ln.ln != nil {
@@ -36,5 +93,8 @@ func (ln *listener) close() {
 		if ln.network == "unix" {
 			sniffErrorAndLog(os.RemoveAll(ln.addr))
 		}
+		if ln.udp != nil {
+			ln.udp.close()
+		}
 	})
 }
@@ -0,0 +1,43 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+// ListenerStats is the statistics of the TCP listener kept by the kernel, which tells the pressure on the accept
+// queue that never reaches the user space, e.g. for capacity planning.
+type ListenerStats struct {
+	// AcceptQueueLen is the number of the connections established but not accepted yet.
+	AcceptQueueLen int
+
+	// AcceptQueueCap is the capacity of the accept queue, namely the effective backlog of the listener.
+	AcceptQueueCap int
+
+	// ListenOverflows is the number of times an accept queue overflowed, system-wide.
+	ListenOverflows uint64
+
+	// ListenDrops is the number of the connection requests dropped by the listeners, system-wide.
+	ListenDrops uint64
+
+	// SyncookiesSent is the number of the SYN cookies sent when the SYN queues overflowed, system-wide.
+	SyncookiesSent uint64
+
+	// SyncookiesRecv is the number of the valid SYN cookies received, system-wide.
+	SyncookiesRecv uint64
+
+	// SyncookiesFailed is the number of the invalid SYN cookies received, system-wide.
+	SyncookiesFailed uint64
+}
+
+// ListenerStats samples the statistics of the TCP listener of the server, it is only supported on Linux, where the
+// accept queue is read from TCP_INFO of the listener and the system-wide counters from /proc/net/netstat.
+// It fails with ErrProtocolNotSupported on the other platforms and the networks other than TCP.
+func (s Server) ListenerStats() (ListenerStats, error) {
+	switch s.svr.ln.network {
+	case "tcp", "tcp4", "tcp6":
+		return s.svr.ln.stats()
+	}
+	return ListenerStats{}, ErrProtocolNotSupported
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package gnet
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func (ln *listener) stats() (stats ListenerStats, err error) {
+	info, err := unix.GetsockoptTCPInfo(ln.fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return stats, os.NewSyscallError("getsockopt", err)
+	}
+	// The accept queue of a listener is reported in the fields of the unacknowledged and selectively
+	// acknowledged segments.
+	stats.AcceptQueueLen = int(info.Unacked)
+	stats.AcceptQueueCap = int(info.Sacked)
+	ext, err := readTCPExt("/proc/net/netstat")
+	if err != nil {
+		return stats, err
+	}
+	stats.ListenOverflows = ext["ListenOverflows"]
+	stats.ListenDrops = ext["ListenDrops"]
+	stats.SyncookiesSent = ext["SyncookiesSent"]
+	stats.SyncookiesRecv = ext["SyncookiesRecv"]
+	stats.SyncookiesFailed = ext["SyncookiesFailed"]
+	return stats, nil
+}
+
+// readTCPExt reads the TcpExt counters from the given file in the format of /proc/net/netstat, which consists of
+// pairs of lines, the names of the counters followed by their values.
+func readTCPExt(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] != "TcpExt:" {
+			continue
+		}
+		if names == nil {
+			names = fields[1:]
+			continue
+		}
+		ext := make(map[string]uint64, len(names))
+		for i, v := range fields[1:] {
+			if i < len(names) {
+				ext[names[i]], _ = strconv.ParseUint(v, 10, 64)
+			}
+		}
+		return ext, nil
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]uint64{}, nil
+}
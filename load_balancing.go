@@ -4,6 +4,11 @@
 
 package gnet
 
+import (
+	"strconv"
+	"sync/atomic"
+)
+
 // LoadBalancing represents the the type of load-balancing algorithm.
 type LoadBalancing int
 
@@ -19,32 +24,69 @@ const (
 	SourceAddrHash
 )
 
+func (lb LoadBalancing) String() string {
+	switch lb {
+	case RoundRobin:
+		return "RoundRobin"
+	case LeastConnections:
+		return "LeastConnections"
+	case SourceAddrHash:
+		return "SourceAddrHash"
+	}
+	return "LoadBalancing(" + strconv.Itoa(int(lb)) + ")"
+}
+
 // IEventLoopGroup represents a set of event-loops.
 type (
 	IEventLoopGroup interface {
 		register(*eventloop)
 		next(int) *eventloop
+		index(int) *eventloop
 		iterate(func(int, *eventloop) bool)
 		len() int
+		resize(int)
+		active() int
+	}
+
+	// activeLoops is the number of the leading event-loops in a group that new connections are assigned to,
+	// zero means all of them.
+	activeLoops struct {
+		n int32
 	}
 
 	// roundRobinEventLoopGroup with RoundRobin algorithm.
 	roundRobinEventLoopGroup struct {
+		activeLoops
 		nextLoopIndex int
 		eventLoops    []*eventloop
 		size          int
 	}
 
 	// leastConnectionsEventLoopGroup with Least-Connections algorithm.
-	leastConnectionsEventLoopGroup []*eventloop
+	leastConnectionsEventLoopGroup struct {
+		activeLoops
+		eventLoops []*eventloop
+	}
 
 	// sourceAddrHashEventLoopGroup with Hash algorithm.
 	sourceAddrHashEventLoopGroup struct {
+		activeLoops
 		eventLoops []*eventloop
 		size       int
 	}
 )
 
+func (a *activeLoops) resize(n int) {
+	atomic.StoreInt32(&a.n, int32(n))
+}
+
+func (a *activeLoops) count(total int) int {
+	if n := int(atomic.LoadInt32(&a.n)); n > 0 && n < total {
+		return n
+	}
+	return total
+}
+
 func (g *roundRobinEventLoopGroup) register(el *eventloop) {
 	g.eventLoops = append(g.eventLoops, el)
 	g.size++
@@ -52,13 +94,18 @@ func (g *roundRobinEventLoopGroup) register(el *eventloop) {
 
 // next returns the eligible event-loop based on Round-Robin algorithm.
 func (g *roundRobinEventLoopGroup) next(_ int) (el *eventloop) {
-	el = g.eventLoops[g.nextLoopIndex]
-	if g.nextLoopIndex++; g.nextLoopIndex >= g.size {
+	if g.nextLoopIndex >= g.active() {
 		g.nextLoopIndex = 0
 	}
+	el = g.eventLoops[g.nextLoopIndex]
+	g.nextLoopIndex++
 	return
 }
 
+func (g *roundRobinEventLoopGroup) index(idx int) *eventloop {
+	return g.eventLoops[idx]
+}
+
 func (g *roundRobinEventLoopGroup) iterate(f func(int, *eventloop) bool) {
 	for i, el := range g.eventLoops {
 		if !f(i, el) {
@@ -71,13 +118,17 @@ func (g *roundRobinEventLoopGroup) len() int {
 	return g.size
 }
 
+func (g *roundRobinEventLoopGroup) active() int {
+	return g.count(g.size)
+}
+
 func (g *leastConnectionsEventLoopGroup) register(el *eventloop) {
-	*g = append(*g, el)
+	g.eventLoops = append(g.eventLoops, el)
 }
 
 // next returns the eligible event-loop based on least-connections algorithm.
 func (g *leastConnectionsEventLoopGroup) next(_ int) (el *eventloop) {
-	eventLoops := *g
+	eventLoops := g.eventLoops[:g.active()]
 	el = eventLoops[0]
 	leastConnCount := el.loadConnCount()
 	var (
@@ -93,9 +144,12 @@ func (g *leastConnectionsEventLoopGroup) next(_ int) (el *eventloop) {
 	return
 }
 
+func (g *leastConnectionsEventLoopGroup) index(idx int) *eventloop {
+	return g.eventLoops[idx]
+}
+
 func (g *leastConnectionsEventLoopGroup) iterate(f func(int, *eventloop) bool) {
-	eventLoops := *g
-	for i, el := range eventLoops {
+	for i, el := range g.eventLoops {
 		if !f(i, el) {
 			break
 		}
@@ -103,7 +157,11 @@ func (g *leastConnectionsEventLoopGroup) iterate(f func(int, *eventloop) bool) {
 }
 
 func (g *leastConnectionsEventLoopGroup) len() int {
-	return len(*g)
+	return len(g.eventLoops)
+}
+
+func (g *leastConnectionsEventLoopGroup) active() int {
+	return g.count(len(g.eventLoops))
 }
 
 func (g *sourceAddrHashEventLoopGroup) register(el *eventloop) {
@@ -113,7 +171,11 @@ func (g *sourceAddrHashEventLoopGroup) register(el *eventloop) {
 
 // next returns the eligible event-loop by taking the remainder of a given fd as the index of event-loop list.
 func (g *sourceAddrHashEventLoopGroup) next(hashCode int) *eventloop {
-	return g.eventLoops[hashCode%g.size]
+	return g.eventLoops[hashCode%g.active()]
+}
+
+func (g *sourceAddrHashEventLoopGroup) index(idx int) *eventloop {
+	return g.eventLoops[idx]
 }
 
 func (g *sourceAddrHashEventLoopGroup) iterate(f func(int, *eventloop) bool) {
@@ -127,3 +189,7 @@ func (g *sourceAddrHashEventLoopGroup) iterate(f func(int, *eventloop) bool) {
 func (g *sourceAddrHashEventLoopGroup) len() int {
 	return g.size
 }
+
+func (g *sourceAddrHashEventLoopGroup) active() int {
+	return g.count(g.size)
+}
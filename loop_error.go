@@ -0,0 +1,43 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// LoopRestartPolicy tells how to handle an event-loop that exits due to an unexpected error.
+type LoopRestartPolicy int
+
+const (
+	// LoopRestartNone shuts the server down when an event-loop exits due to an unexpected error.
+	LoopRestartNone LoopRestartPolicy = iota
+
+	// LoopRestartKeepConns restarts the event-loop, its connections stay registered and keep being served.
+	LoopRestartKeepConns
+
+	// LoopRestartCloseConns restarts the event-loop after closing its connections with ErrLoopRestarted.
+	LoopRestartCloseConns
+)
+
+// LoopErrorHandler is an optional interface of EventHandler for being notified of the event-loops that exit due to
+// unexpected errors, e.g. a failure of epoll_wait/kevent or of accepting connections, which are only logged otherwise.
+type LoopErrorHandler interface {
+	// OnLoopError fires within the failed event-loop before it is restarted according to Options.LoopRestart or
+	// the server is shut down, loopIdx is -1 for the loop accepting connections, i.e. the main reactor on Unix-like
+	// systems and the listener goroutine on Windows. Returning Shutdown shuts the server down regardless of the policy.
+	OnLoopError(loopIdx int, err error) (action Action)
+}
+
+// onLoopError reports whether the event-loop with the given index, which exits due to err, is to be restarted.
+func (svr *server) onLoopError(loopIdx int, err error) (restart bool) {
+	select {
+	case <-svr.shutdown:
+		// The loop exits due to the shutdown, e.g. its poller or listener is closed.
+		return false
+	default:
+	}
+	action := None
+	if svr.loopErrorHandler != nil {
+		action = svr.loopErrorHandler.OnLoopError(loopIdx, err)
+	}
+	return action != Shutdown && svr.opts.LoopRestart != LoopRestartNone
+}
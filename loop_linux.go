@@ -6,10 +6,24 @@
 
 package gnet
 
-import "github.com/panjf2000/gnet/internal/netpoll"
+import (
+	"github.com/panjf2000/gnet/internal/netpoll"
+	"github.com/panjf2000/gnet/pool/bytebuffer"
+	"golang.org/x/sys/unix"
+)
 
 func (el *eventloop) handleEvent(fd int, ev uint32) error {
 	if c, ok := el.connections[fd]; ok {
+		// The completions of zero-copy sends are reported as EPOLLERR, drain them before handling the other events.
+		if ev&unix.EPOLLERR != 0 && c.ext != nil && c.ext.zeroCopy != nil {
+			c.ext.zeroCopy.drain(c.fd)
+		}
+		// Urgent data is reported as EPOLLPRI for as long as it hasn't been read, read it ahead of the inbound data.
+		if ev&unix.EPOLLPRI != 0 {
+			if err := el.loopUrgent(c); err != nil || !c.opened {
+				return err
+			}
+		}
 		switch c.outboundBuffer.IsEmpty() {
 		// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
 		// sure what you're doing!
@@ -28,3 +42,28 @@ func (el *eventloop) handleEvent(fd int, ev uint32) error {
 	}
 	return el.loopAccept(fd)
 }
+
+// loopUrgent reads the byte of urgent data (MSG_OOB) of the connection and hands it over to UrgentDataHandler,
+// or discards it if the event handler isn't an UrgentDataHandler.
+func (el *eventloop) loopUrgent(c *conn) error {
+	var b [1]byte
+	n, _, err := unix.Recvfrom(c.fd, b[:], unix.MSG_OOB)
+	if err != nil || n == 0 {
+		// EINVAL if the urgent data has been passed by the inbound data read, or EAGAIN if it hasn't arrived yet.
+		return nil
+	}
+	if el.svr.urgentHandler == nil {
+		return nil
+	}
+	out, action := el.svr.urgentHandler.OnUrgentData(c, b[0])
+	if out != nil {
+		outFrame, bb, _ := c.encode(out)
+		el.eventHandler.PreWrite()
+		c.write(outFrame)
+		bytebuffer.Put(bb)
+		if !c.opened {
+			return nil
+		}
+	}
+	return el.handleAction(c, action)
+}
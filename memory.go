@@ -0,0 +1,64 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"net"
+	"sync"
+)
+
+// memoryAddr is the net.Addr of the in-memory transport.
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryConn overrides the addresses of the underlying connection with the memory address.
+type memoryConn struct {
+	net.Conn
+	addr memoryAddr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.addr }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.addr }
+
+// memoryServers holds all the servers serving on memory addresses.
+var memoryServers = struct {
+	sync.RWMutex
+	m map[string]*server
+}{m: make(map[string]*server)}
+
+func registerMemoryServer(name string, svr *server) error {
+	memoryServers.Lock()
+	defer memoryServers.Unlock()
+	if _, ok := memoryServers.m[name]; ok {
+		return ErrMemoryAddrInUse
+	}
+	memoryServers.m[name] = svr
+	return nil
+}
+
+func unregisterMemoryServer(name string, svr *server) {
+	memoryServers.Lock()
+	if memoryServers.m[name] == svr {
+		delete(memoryServers.m, name)
+	}
+	memoryServers.Unlock()
+}
+
+// DialMemory connects to the server serving on "memory://name", the returned connection drives the whole
+// event-loop and codec path of the server without going through the network stack, which makes it suitable
+// for fast and deterministic tests and fuzzing of codecs and event handlers.
+//
+// On Unix-like systems the connection is backed by socketpair(2), on Windows it is backed by net.Pipe.
+func DialMemory(name string) (net.Conn, error) {
+	memoryServers.RLock()
+	svr, ok := memoryServers.m[name]
+	memoryServers.RUnlock()
+	if !ok {
+		return nil, ErrMemoryAddrNotFound
+	}
+	return svr.dialMemory(name)
+}
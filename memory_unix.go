@@ -0,0 +1,64 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package gnet
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func (svr *server) dialMemory(name string) (net.Conn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	unix.CloseOnExec(fds[0])
+	unix.CloseOnExec(fds[1])
+	if err = unix.SetNonblock(fds[0], true); err != nil {
+		_, _ = unix.Close(fds[0]), unix.Close(fds[1])
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+
+	f := os.NewFile(uintptr(fds[1]), "memory://"+name)
+	c, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		_ = unix.Close(fds[0])
+		return nil, err
+	}
+
+	if !svr.waitAccept() {
+		_ = unix.Close(fds[0])
+		return &memoryConn{c, memoryAddr(name)}, nil
+	}
+	if ok, err := svr.admitConn(); !ok {
+		svr.shedConn(fds[0])
+		if err != nil {
+			svr.signalShutdown()
+		}
+		return &memoryConn{c, memoryAddr(name)}, nil
+	}
+	codec, action := svr.onAccepted(fds[0], memoryAddr(name))
+	if action != None {
+		_, _ = unix.Close(fds[0]), c.Close()
+		if action == Shutdown {
+			svr.signalShutdown()
+		}
+		return nil, ErrConnRejected
+	}
+
+	svr.dialMu.Lock()
+	err = svr.assignConn(fds[0], nil, memoryAddr(name), codec, nil)
+	svr.dialMu.Unlock()
+	if err != nil {
+		_, _ = unix.Close(fds[0]), c.Close()
+		return nil, err
+	}
+	return &memoryConn{c, memoryAddr(name)}, nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package gnet
+
+import "net"
+
+func (svr *server) dialMemory(name string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	if !svr.waitAccept() {
+		_ = local.Close()
+		return &memoryConn{remote, memoryAddr(name)}, nil
+	}
+	if ok, err := svr.admitConn(); !ok {
+		svr.shedConn(local)
+		if err != nil {
+			svr.signalShutdown(err)
+		}
+		return &memoryConn{remote, memoryAddr(name)}, nil
+	}
+	codec, action := svr.onAccepted(&memoryConn{local, memoryAddr(name)})
+	if action != None {
+		_, _ = local.Close(), remote.Close()
+		if action == Shutdown {
+			svr.signalShutdown(ErrServerShutdown)
+		}
+		return nil, ErrConnRejected
+	}
+	svr.dialMu.Lock()
+	svr.assignConn(&memoryConn{local, memoryAddr(name)}, codec, nil)
+	svr.dialMu.Unlock()
+	return &memoryConn{remote, memoryAddr(name)}, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import "encoding/binary"
+
+// MBAP header layout, see the Modbus Messaging on TCP/IP Implementation Guide.
+const (
+	modbusHeaderSize   = 7
+	modbusLengthOffset = 4
+	modbusMaxPDUSize   = 253
+	modbusExceptionBit = 0x80
+)
+
+// Modbus exception codes carried by the exception responses, see AppendModbusException.
+const (
+	ModbusIllegalFunction        byte = 0x01
+	ModbusIllegalDataAddress     byte = 0x02
+	ModbusIllegalDataValue       byte = 0x03
+	ModbusServerDeviceFailure    byte = 0x04
+	ModbusAcknowledge            byte = 0x05
+	ModbusServerDeviceBusy       byte = 0x06
+	ModbusGatewayPathUnavailable byte = 0x0A
+	ModbusGatewayTargetFailed    byte = 0x0B
+)
+
+// ModbusHeader is the MBAP header of a Modbus TCP ADU, but for the protocol identifier, which is always 0,
+// and the length, which follows from the PDU.
+type ModbusHeader struct {
+	// TransactionID pairs the responses with the requests, the responses carry the ones of their requests.
+	TransactionID uint16
+
+	// UnitID identifies the remote server behind a gateway, e.g. the address of a device on a serial line,
+	// the responses carry the ones of their requests.
+	UnitID uint8
+}
+
+// ParseModbusADU parses the Modbus TCP ADU, e.g. a frame decoded by ModbusCodec, and returns its PDU, namely
+// the function code followed by the data, which is a slice of the ADU. It fails with ErrInvalidModbusADU if
+// the protocol identifier is not 0 or the length doesn't match the size of the ADU.
+func ParseModbusADU(adu []byte) (h ModbusHeader, pdu []byte, err error) {
+	if len(adu) < modbusHeaderSize+1 || len(adu) > modbusHeaderSize+modbusMaxPDUSize ||
+		binary.BigEndian.Uint16(adu[2:]) != 0 ||
+		int(binary.BigEndian.Uint16(adu[modbusLengthOffset:])) != len(adu)-modbusHeaderSize+1 {
+		return h, nil, ErrInvalidModbusADU
+	}
+	h.TransactionID = binary.BigEndian.Uint16(adu)
+	h.UnitID = adu[modbusHeaderSize-1]
+	return h, adu[modbusHeaderSize:], nil
+}
+
+// AppendModbusADU appends to dst the Modbus TCP ADU of the PDU with the MBAP header, and returns the extended
+// buffer, e.g. for the responses in React, whose headers are usually those of the requests. It returns dst as is
+// if the PDU is empty or longer than 253 bytes.
+func AppendModbusADU(dst []byte, h ModbusHeader, pdu []byte) []byte {
+	if len(pdu) == 0 || len(pdu) > modbusMaxPDUSize {
+		return dst
+	}
+	var header [modbusHeaderSize]byte
+	binary.BigEndian.PutUint16(header[0:], h.TransactionID)
+	binary.BigEndian.PutUint16(header[modbusLengthOffset:], uint16(len(pdu)+1))
+	header[modbusHeaderSize-1] = h.UnitID
+	dst = append(dst, header[:]...)
+	return append(dst, pdu...)
+}
+
+// AppendModbusException appends to dst the Modbus TCP ADU of the exception response to the request with the given
+// function code, e.g. ModbusIllegalFunction for the function codes the server doesn't support, and returns
+// the extended buffer.
+func AppendModbusException(dst []byte, h ModbusHeader, function, code byte) []byte {
+	return AppendModbusADU(dst, h, []byte{function | modbusExceptionBit, code})
+}
+
+// ModbusCodec encodes/decodes the Modbus TCP ADUs, which are framed by the length in their MBAP headers.
+// Decode passes every ADU to React as is, use ParseModbusADU to get its header and PDU and AppendModbusADU to build
+// the response. Since the MBAP header carries no marker to resynchronize the stream with, Decode discards all
+// the buffered data if the header of an ADU is malformed, namely its protocol identifier is not 0 or its length is
+// out of range, and fails with ErrInvalidModbusADU, which closes the connection unless the event handler keeps it
+// via DecodeErrorHandler, in which case Decode goes on with the data arriving next, which starts with a new ADU as
+// the clients usually wait for the responses to their requests. Encode passes the ADUs through and fails with ErrInvalidModbusADU if they are
+// malformed, so that the broken responses are never written.
+type ModbusCodec struct {
+}
+
+// Encode ...
+func (cc *ModbusCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	if _, _, err := ParseModbusADU(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Decode ...
+func (cc *ModbusCodec) Decode(c Conn) ([]byte, error) {
+	header, err := c.Peek(modbusHeaderSize)
+	if err != nil {
+		return nil, ErrUnexpectedEOF
+	}
+	// The length counts the unit identifier and the PDU, which carries at least the function code.
+	length := int(binary.BigEndian.Uint16(header[modbusLengthOffset:]))
+	if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > modbusMaxPDUSize+1 {
+		c.ResetBuffer()
+		return nil, ErrInvalidModbusADU
+	}
+	buf, err := c.Next(modbusHeaderSize - 1 + length)
+	if err != nil {
+		return nil, ErrUnexpectedEOF
+	}
+	return buf, nil
+}
@@ -0,0 +1,288 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// noiseProtocolName is the name of the Noise protocol implemented by NoiseIK, which fits in the hash.
+const noiseProtocolName = "Noise_IK_25519_AESGCM_SHA256"
+
+const (
+	noiseKeySize = 32
+	noiseTagSize = 16
+)
+
+// NoiseKeypair is a Curve25519 key pair of the Noise protocol.
+type NoiseKeypair struct {
+	Public, Private [noiseKeySize]byte
+}
+
+// GenerateNoiseKeypair generates a key pair from random, crypto/rand.Reader is used if it is nil.
+func GenerateNoiseKeypair(random io.Reader) (kp NoiseKeypair, err error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	if _, err = io.ReadFull(random, kp.Private[:]); err != nil {
+		return
+	}
+	curve25519.ScalarBaseMult(&kp.Public, &kp.Private)
+	return
+}
+
+// NoiseIK is a FrameEncryption performing the handshake of the Noise IK pattern as the responder, with Curve25519,
+// AES-GCM and SHA-256, namely the Noise_IK_25519_AESGCM_SHA256 protocol, which provides the connections with mutual
+// authentication and forward secrecy without TLS and PKI, e.g. within an internal RPC mesh. The initiator knows
+// the static public key of the server beforehand, and sends its own static public key encrypted in the first frame,
+// see NoiseIKInitiator for the client side. Every frame is a Noise transport message once the handshake completes,
+// which carries 16 more bytes than the frame it encrypts.
+type NoiseIK struct {
+	// Static is the static key pair of the server.
+	Static NoiseKeypair
+
+	// Prologue is the data both sides must agree on, e.g. the name and the version of the protocol, it is
+	// authenticated by the handshake.
+	Prologue []byte
+
+	// Authorize checks the static public key of the initiator and the payload of its first frame, the connection
+	// is closed with the error if it fails. All the initiators are accepted if it is nil.
+	Authorize func(c Conn, peer [noiseKeySize]byte, payload []byte) error
+
+	// Random is the source of the ephemeral keys, crypto/rand.Reader is used if it is nil.
+	Random io.Reader
+}
+
+// Handshake reads the first frame of the initiator and replies with the second one, which completes the handshake.
+func (n *NoiseIK) Handshake(c Conn, frame []byte) (FrameCipher, []byte, error) {
+	if len(frame) < noiseKeySize+noiseKeySize+noiseTagSize+noiseTagSize {
+		return nil, nil, ErrNoiseHandshake
+	}
+	var s noiseSymmetricState
+	s.init(n.Prologue)
+	s.mixHash(n.Static.Public[:])
+
+	// -> e, es, s, ss
+	var re, rs [noiseKeySize]byte
+	copy(re[:], frame)
+	s.mixHash(re[:])
+	if err := s.mixDH(&n.Static.Private, &re); err != nil {
+		return nil, nil, err
+	}
+	peer, err := s.decryptAndHash(frame[noiseKeySize : noiseKeySize+noiseKeySize+noiseTagSize])
+	if err != nil {
+		return nil, nil, ErrNoiseHandshake
+	}
+	copy(rs[:], peer)
+	if err = s.mixDH(&n.Static.Private, &rs); err != nil {
+		return nil, nil, err
+	}
+	payload, err := s.decryptAndHash(frame[noiseKeySize+noiseKeySize+noiseTagSize:])
+	if err != nil {
+		return nil, nil, ErrNoiseHandshake
+	}
+	if n.Authorize != nil {
+		if err = n.Authorize(c, rs, payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// <- e, ee, se
+	e, err := GenerateNoiseKeypair(n.Random)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := append(make([]byte, 0, noiseKeySize+noiseTagSize), e.Public[:]...)
+	s.mixHash(e.Public[:])
+	if err = s.mixDH(&e.Private, &re); err != nil {
+		return nil, nil, err
+	}
+	if err = s.mixDH(&e.Private, &rs); err != nil {
+		return nil, nil, err
+	}
+	out = s.encryptAndHash(out, nil)
+	initiator, responder := s.split()
+	return &noiseCipher{send: responder, recv: initiator}, out, nil
+}
+
+// NoiseIKInitiator performs the handshake of NoiseIK as the initiator, namely on the client side: it writes
+// the first frame via WriteMessage, and reads the reply of the server via ReadMessage, which returns the cipher
+// of the frames following the handshake. A NoiseIKInitiator is meant for one handshake.
+type NoiseIKInitiator struct {
+	s      noiseSymmetricState
+	static NoiseKeypair
+	remote [noiseKeySize]byte
+	e      NoiseKeypair
+	random io.Reader
+}
+
+// NewNoiseIKInitiator instantiates an initiator with its own static key pair and the static public key of
+// the server, along with the prologue of the server, random is the source of the ephemeral key, crypto/rand.Reader
+// is used if it is nil.
+func NewNoiseIKInitiator(static NoiseKeypair, remote [noiseKeySize]byte, prologue []byte, random io.Reader) *NoiseIKInitiator {
+	i := &NoiseIKInitiator{static: static, remote: remote, random: random}
+	i.s.init(prologue)
+	i.s.mixHash(remote[:])
+	return i
+}
+
+// WriteMessage returns the first frame of the handshake carrying the payload, which is encrypted, but without
+// forward secrecy, e.g. a token checked by NoiseIK.Authorize.
+func (i *NoiseIKInitiator) WriteMessage(payload []byte) (out []byte, err error) {
+	// -> e, es, s, ss
+	if i.e, err = GenerateNoiseKeypair(i.random); err != nil {
+		return nil, err
+	}
+	out = append(out, i.e.Public[:]...)
+	i.s.mixHash(i.e.Public[:])
+	if err = i.s.mixDH(&i.e.Private, &i.remote); err != nil {
+		return nil, err
+	}
+	out = i.s.encryptAndHash(out, i.static.Public[:])
+	if err = i.s.mixDH(&i.static.Private, &i.remote); err != nil {
+		return nil, err
+	}
+	return i.s.encryptAndHash(out, payload), nil
+}
+
+// ReadMessage reads the reply of the server to the first frame and returns the cipher of the frames following
+// the handshake, along with the payload of the reply.
+func (i *NoiseIKInitiator) ReadMessage(msg []byte) (FrameCipher, []byte, error) {
+	// <- e, ee, se
+	if len(msg) < noiseKeySize+noiseTagSize {
+		return nil, nil, ErrNoiseHandshake
+	}
+	var re [noiseKeySize]byte
+	copy(re[:], msg)
+	i.s.mixHash(re[:])
+	if err := i.s.mixDH(&i.e.Private, &re); err != nil {
+		return nil, nil, err
+	}
+	if err := i.s.mixDH(&i.static.Private, &re); err != nil {
+		return nil, nil, err
+	}
+	payload, err := i.s.decryptAndHash(msg[noiseKeySize:])
+	if err != nil {
+		return nil, nil, ErrNoiseHandshake
+	}
+	initiator, responder := i.s.split()
+	return &noiseCipher{send: initiator, recv: responder}, payload, nil
+}
+
+// noiseSymmetricState is the SymmetricState of the Noise protocol framework.
+type noiseSymmetricState struct {
+	ck, h [sha256.Size]byte
+	k     cipher.AEAD
+	n     uint64
+}
+
+func (s *noiseSymmetricState) init(prologue []byte) {
+	copy(s.h[:], noiseProtocolName)
+	s.ck = s.h
+	s.mixHash(prologue)
+}
+
+func (s *noiseSymmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	_, _ = h.Write(s.h[:])
+	_, _ = h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+// mixDH mixes the Diffie-Hellman of the private key and the public key into the chaining key, rejecting
+// the public keys of small order, whose Diffie-Hellman is zero.
+func (s *noiseSymmetricState) mixDH(private, public *[noiseKeySize]byte) error {
+	var dh, zero [noiseKeySize]byte
+	curve25519.ScalarMult(&dh, private, public)
+	if subtle.ConstantTimeCompare(dh[:], zero[:]) == 1 {
+		return ErrNoiseHandshake
+	}
+	var k [sha256.Size]byte
+	s.ck, k = noiseHKDF(s.ck[:], dh[:])
+	s.k, s.n = newNoiseAEAD(k[:]), 0
+	return nil
+}
+
+func (s *noiseSymmetricState) encryptAndHash(dst, plaintext []byte) []byte {
+	n := len(dst)
+	dst = s.k.Seal(dst, noiseNonce(s.n), plaintext, s.h[:])
+	s.n++
+	s.mixHash(dst[n:])
+	return dst
+}
+
+func (s *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.k.Open(nil, noiseNonce(s.n), ciphertext, s.h[:])
+	if err != nil {
+		return nil, err
+	}
+	s.n++
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the ciphers of the transport messages sent by the initiator and by the responder.
+func (s *noiseSymmetricState) split() (initiator, responder cipher.AEAD) {
+	k1, k2 := noiseHKDF(s.ck[:], nil)
+	return newNoiseAEAD(k1[:]), newNoiseAEAD(k2[:])
+}
+
+// noiseHKDF derives two keys from the chaining key and the input key material.
+func noiseHKDF(ck, ikm []byte) (out1, out2 [sha256.Size]byte) {
+	mac := hmac.New(sha256.New, ck)
+	_, _ = mac.Write(ikm)
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	_, _ = mac.Write([]byte{1})
+	mac.Sum(out1[:0])
+	mac.Reset()
+	_, _ = mac.Write(out1[:])
+	_, _ = mac.Write([]byte{2})
+	mac.Sum(out2[:0])
+	return
+}
+
+func newNoiseAEAD(key []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// noiseNonce encodes the nonce of AES-GCM in the Noise protocol, namely 32 bits of zeros followed by the counter
+// in big-endian.
+func noiseNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+// noiseCipher encrypts and decrypts the transport messages of a connection once the handshake completes.
+type noiseCipher struct {
+	send, recv   cipher.AEAD
+	sendN, recvN uint64
+}
+
+func (nc *noiseCipher) Seal(frame []byte) ([]byte, error) {
+	out := nc.send.Seal(make([]byte, 0, len(frame)+noiseTagSize), noiseNonce(nc.sendN), frame, nil)
+	nc.sendN++
+	return out, nil
+}
+
+func (nc *noiseCipher) Open(frame []byte) ([]byte, error) {
+	out, err := nc.recv.Open(nil, noiseNonce(nc.recvN), frame, nil)
+	if err != nil {
+		return nil, err
+	}
+	nc.recvN++
+	return out, nil
+}
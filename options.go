@@ -4,7 +4,12 @@
 
 package gnet
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
 
 // Option is a function that will set up option.
 type Option func(opts *Options)
@@ -38,12 +43,220 @@ type Options struct {
 	// Ticker indicates whether the ticker has been set up.
 	Ticker bool
 
+	// TickerInitialDelay is the delay of the first Tick event after the server starts, see WithTickerSchedule.
+	TickerInitialDelay time.Duration
+
+	// TickerJitter is the fraction by which the delays returned by Tick are randomized, see WithTickerSchedule.
+	TickerJitter float64
+
 	// TCPKeepAlive (SO_KEEPALIVE) socket option.
 	TCPKeepAlive time.Duration
 
+	// BindToDevice is the name of the network interface that the listener is bound to (SO_BINDTODEVICE) on Linux,
+	// the listener accepts the traffic of all interfaces if it is empty.
+	BindToDevice string
+
+	// IPTOS is the type of service (IP_TOS/IPV6_TCLASS) of the packets sent by the server, it carries the DSCP value
+	// in the upper six bits, and the default of the system is kept if it is zero.
+	IPTOS int
+
+	// IPTTL is the time-to-live (IP_TTL/IPV6_UNICAST_HOPS) of the packets sent by the server,
+	// the default of the system is kept if it is zero.
+	IPTTL int
+
+	// Transparent enables transparent proxying (IP_TRANSPARENT) on the listener on Linux, which receives the traffic
+	// redirected by TPROXY, the original destination of every UDP packet is reported by Conn.OriginalDst.
+	Transparent bool
+
+	// UDPReadBufferSize is the size of the buffer every datagram is read into, namely the maximum size of
+	// the datagrams read in full, DefaultUDPReadBufferSize if it is not set, see WithUDPReadBufferSize.
+	UDPReadBufferSize int
+
+	// LoopAffinity pins every event-loop to one of the CPUs that the process may run on in turn on Linux, and assigns
+	// the accepted connections to the event-loop pinned to the CPU that handled their incoming packets, see
+	// WithLoopAffinity.
+	LoopAffinity bool
+
+	// AcceptFilter is the name of the accept filter (SO_ACCEPTFILTER) attached to the TCP listener on FreeBSD, NetBSD
+	// and DragonFly BSD, e.g. "dataready" or "httpready", see WithAcceptFilter.
+	AcceptFilter string
+
+	// PollTimeout is the timeout of every epoll_wait/kevent call of the event-loops on Unix-like systems,
+	// they block until events arrive if it is not positive. It is rounded up to milliseconds on Linux.
+	PollTimeout time.Duration
+
+	// PollEventsCap is the maximum number of events handled by an event-loop in one epoll_wait/kevent call on
+	// Unix-like systems, if it is not positive, the event-list starts small and grows whenever it's filled up.
+	PollEventsCap int
+
+	// MaxReadsPerLoopIteration is the maximum number of reads from a stream connection per readiness event on
+	// Unix-like systems, it defaults to 1 if it is not positive, see WithMaxReadsPerLoopIteration.
+	MaxReadsPerLoopIteration int
+
+	// MassiveConnections enables the profile for serving millions of mostly idle connections, see
+	// WithMassiveConnections.
+	MassiveConnections bool
+
+	// BufferIdleTimeout enables the lazy allocation of the ring-buffers of the stream connections, and is the idleness
+	// after which they are given back to the pool, see WithLazyBuffers.
+	BufferIdleTimeout time.Duration
+
+	// AutoAdjustNOFILE indicates whether to raise the soft limit of RLIMIT_NOFILE to the hard limit when the server
+	// is created, see WithAutoAdjustNOFILE.
+	AutoAdjustNOFILE bool
+
+	// ExpectedConnections is the number of the concurrent connections the server is expected to serve, which is not
+	// enforced but checked against RLIMIT_NOFILE by Server.Preflight, see WithExpectedConnections.
+	ExpectedConnections int
+
+	// LoopRestart is the policy of handling the event-loops that exit due to unexpected errors, see LoopErrorHandler.
+	LoopRestart LoopRestartPolicy
+
+	// WriteCoalescing indicates whether to merge the data written by AsyncWrite, see WithWriteCoalescing.
+	WriteCoalescing bool
+
+	// WriteCoalescingWindow is the maximum delay of the data written by AsyncWrite, the data written by
+	// AsyncWrite within the window is merged and flushed in one write, see WithWriteCoalescing.
+	WriteCoalescingWindow time.Duration
+
+	// WriteCoalescingMaxBytes is the size of the merged data that triggers a flush before the window elapses.
+	WriteCoalescingMaxBytes int
+
+	// LoopWriteBatching indicates whether to flush the data written to the connections of an event-loop once per
+	// iteration of the event-loop, see WithLoopWriteBatching.
+	LoopWriteBatching bool
+
+	// KernelZeroCopySendThreshold is the minimum size of the data of AsyncWrite that is sent with MSG_ZEROCOPY
+	// on Linux, kernel zero-copy send is disabled if it is not positive, see WithKernelZeroCopySend.
+	KernelZeroCopySendThreshold int
+
+	// HandshakeTimeout is the duration within which a stream connection must complete its handshake, otherwise
+	// it is closed with ErrHandshakeTimeout, see WithHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// PartialFrameTimeout is the duration for which a frame of a stream connection may stay incomplete, the timeout
+	// starts over whenever a frame is decoded, see WithPartialFrameTimeout.
+	PartialFrameTimeout time.Duration
+
+	// SlowReactThreshold is the duration beyond which an invocation of React, ReactBatch or OnTraffic is reported
+	// as slow, the slow React detection is disabled if it is not positive, see WithSlowReact.
+	SlowReactThreshold time.Duration
+
+	// SlowReactStack tells whether to capture the stack of the event-loop running a slow React.
+	SlowReactStack bool
+
+	// WatchdogTimeout is the duration beyond which an event-loop not responding to the watchdog is reported
+	// as blocked, the watchdog is disabled if it is not positive, see WithWatchdog.
+	WatchdogTimeout time.Duration
+
+	// LoopOverloadThreshold is the utilization (0-1) of an event-loop at which it is reported as overloaded,
+	// the utilization of the event-loops is not measured if it is not positive, see WithLoopOverload.
+	LoopOverloadThreshold float64
+
+	// OutboundLimit is the maximum number of bytes buffered in the outbound buffer of a stream connection on Unix-like
+	// systems, beyond which OutboundFullPolicy applies, the outbound buffer is unbounded if it is not positive.
+	// The writes are synchronous on Windows, where there is no outbound buffer.
+	OutboundLimit int
+
+	// OutboundFullPolicy tells what to do with the connections whose outbound buffer exceeds OutboundLimit.
+	OutboundFullPolicy OutboundFullPolicy
+
+	// WriteStallTimeout is the duration for which the oldest byte in the outbound buffer of a stream connection may
+	// stay unwritten, the timeout is disabled if it is not positive, see WithWriteStallTimeout.
+	WriteStallTimeout time.Duration
+
+	// GracefulSignals are the signals shutting the server down gracefully, see WithGracefulSignals.
+	GracefulSignals []os.Signal
+
+	// ReloadSignals are the signals firing ReloadHandler.OnReload, see WithReloadSignals.
+	ReloadSignals []os.Signal
+
+	// ShutdownFlushTimeout bounds the time spent on flushing the outbound data of the connections on shutdown,
+	// it defaults to DefaultShutdownFlushTimeout if it is zero, see WithShutdownFlushTimeout.
+	ShutdownFlushTimeout time.Duration
+
+	// SkipShutdownFlush indicates whether the outbound data of the connections is discarded on shutdown instead
+	// of being flushed before the connections are closed.
+	SkipShutdownFlush bool
+
+	// AcceptRateLimit is the maximum rate of accepting connections per second, enforced with a token bucket
+	// of AcceptRateBurst tokens, it is disabled if it is not positive, see WithAcceptRateLimit.
+	AcceptRateLimit float64
+
+	// AcceptRateBurst is the maximum number of connections accepted at once under AcceptRateLimit, at least one.
+	AcceptRateBurst int
+
+	// AcceptLimitPolicy tells what to do with the connections beyond AcceptRateLimit.
+	AcceptLimitPolicy AcceptLimitPolicy
+
+	// AcceptMode tells where the connections are accepted for the event-loops, see WithAcceptMode.
+	AcceptMode AcceptMode
+
+	// AcceptOverload sets up accept overload protection, it is disabled if it is nil.
+	AcceptOverload *AcceptOverload
+
+	// ConnScan sets up the connection scanner, it is disabled if it is nil.
+	ConnScan *ConnScan
+
 	// ICodec encodes and decodes TCP stream.
 	Codec ICodec
 
+	// FrameAccounting meters the sizes of the frames, it is disabled if it is nil.
+	FrameAccounting FrameAccountant
+
+	// FrameTracer traces a sample of the frames, it is disabled if it is nil.
+	FrameTracer *FrameTracer
+
+	// Expvar exports the counters of the server via expvar under the gnet.* keys.
+	Expvar bool
+
+	// Encryption sets up the FrameCipher of every stream connection, the frames aren't encrypted if it is nil.
+	Encryption FrameEncryption
+
+	// MaxLabelValues is the maximum number of the distinct values of a label key, and of the distinct label keys,
+	// aggregated in Server.LabelStats, it defaults to DefaultMaxLabelValues if it is not positive.
+	MaxLabelValues int
+
+	// Enricher looks up the information about the peer of every stream connection before it is opened, it is
+	// disabled if it is nil, see WithEnrichment.
+	Enricher Enricher
+
+	// EnrichmentTimeout is the deadline of the Enricher, the connections are opened without its result once it
+	// elapses.
+	EnrichmentTimeout time.Duration
+
+	// FrameOwnershipTransfer indicates whether the frame passed to React is owned by the event handler, if so,
+	// every frame is copied into a freshly allocated slice before React fires, so that it can be retained and
+	// used in other goroutines after React returns, otherwise, the frame is only valid within React.
+	FrameOwnershipTransfer bool
+
+	// ConnGoroutine enables hybrid mode, in which React runs in a goroutine of every stream connection rather than
+	// in its event-loop, see WithConnGoroutine.
+	ConnGoroutine bool
+
+	// ConnGoroutineQueue is the maximum number of the frames queued up for the goroutine of a connection in hybrid
+	// mode, it defaults to DefaultConnGoroutineQueue if it is not positive.
+	ConnGoroutineQueue int
+
+	// ConnQueuePolicy tells what to do with the frames decoded while the queue of a connection in hybrid mode is full.
+	ConnQueuePolicy ConnQueuePolicy
+
+	// FaultInjection sets up the fault-injection layer for simulating bad network conditions on stream
+	// connections, it is meant for testing only and should be nil in production.
+	FaultInjection *FaultInjection
+
+	// Audit receives one record per stream connection when it is closed, see AuditRecord and NewAuditWriter.
+	Audit AuditSink
+
+	// Recorder records the traffic of stream connections, see Recorder and Replay.
+	Recorder *Recorder
+
+	// TestMode indicates whether the server runs in test mode, if so, there is exactly one event-loop and no
+	// goroutine is started for it, Serve returns right after the initialization instead of blocking, and every
+	// event, including Tick, is handled synchronously within the caller of Server.PollOnce, which makes event
+	// handlers testable step by step without sleeps or races.
+	TestMode bool
+
 	// Logger is the customized logger for logging info, if it is not set,
 	// default standard logger from log package is used.
 	Logger Logger
@@ -98,6 +311,164 @@ func WithTicker(ticker bool) Option {
 	}
 }
 
+// WithTickerSchedule sets up the schedule of the ticker, the first Tick event fires after initialDelay, and every
+// delay returned by Tick is lengthened or shortened randomly by up to jitter times the delay, which must be within
+// [0, 1), so that the servers started at the same time don't tick in lockstep. Both are ignored in test mode,
+// where Tick fires on every PollOnce.
+func WithTickerSchedule(initialDelay time.Duration, jitter float64) Option {
+	return func(opts *Options) {
+		opts.TickerInitialDelay = initialDelay
+		opts.TickerJitter = jitter
+	}
+}
+
+// WithBindToDevice sets up SO_BINDTODEVICE socket option, which pins the listener to the given network interface
+// on multi-homed hosts. It is only supported on Linux, where it may require CAP_NET_RAW before Linux 5.7.
+func WithBindToDevice(ifname string) Option {
+	return func(opts *Options) {
+		opts.BindToDevice = ifname
+	}
+}
+
+// WithIPTOS sets up IP_TOS (IPV6_TCLASS on IPv6) socket option, which marks the packets sent by the server with
+// the given type of service, e.g. WithIPTOS(46 << 2) marks them with DSCP EF (expedited forwarding).
+func WithIPTOS(tos int) Option {
+	return func(opts *Options) {
+		opts.IPTOS = tos
+	}
+}
+
+// WithIPTTL sets up IP_TTL (IPV6_UNICAST_HOPS on IPv6) socket option.
+func WithIPTTL(ttl int) Option {
+	return func(opts *Options) {
+		opts.IPTTL = ttl
+	}
+}
+
+// WithTransparent sets up IP_TRANSPARENT and IP_RECVORIGDSTADDR socket options for transparent proxies on Linux,
+// the process needs CAP_NET_ADMIN.
+func WithTransparent(transparent bool) Option {
+	return func(opts *Options) {
+		opts.Transparent = transparent
+	}
+}
+
+// WithUDPReadBufferSize sets the size of the buffer every datagram is read into to size bytes, which must be
+// within [1, MaxUDPReadBufferSize], the datagrams exceeding it are dropped and reported to the TruncatedDatagramHandler
+// of the event handler, or logged otherwise, instead of being handed over to React truncated. The default fits
+// the largest datagrams, namely jumbo frames up to 64KiB, a smaller one saves memory for the protocols bounding
+// the size of their datagrams, e.g. 1500 bytes, as every event-loop reading datagrams holds such a buffer.
+func WithUDPReadBufferSize(size int) Option {
+	return func(opts *Options) {
+		opts.UDPReadBufferSize = size
+	}
+}
+
+// WithLoopAffinity sets up loop affinity, which locks every event-loop to an OS thread pinned to one CPU, and
+// assigns every connection accepted by the main reactor to the event-loop pinned to the CPU that handled its incoming
+// packets (SO_INCOMING_CPU), which keeps the softirq processing the packets of a connection, its event-loop and the
+// event handler on the same CPU for cache locality. The connections fall back to the load-balancing algorithm if
+// there is no active event-loop pinned to that CPU, so it works best with one event-loop per CPU and with
+// the receive queues of the NIC steered to the CPUs (RSS/RPS).
+func WithLoopAffinity(affinity bool) Option {
+	return func(opts *Options) {
+		opts.LoopAffinity = affinity
+	}
+}
+
+// WithAcceptFilter attaches the accept filter with the given name to the TCP listener on FreeBSD, NetBSD and
+// DragonFly BSD, which holds the connections back in the kernel until the filter is satisfied, e.g. until data
+// arrives with "dataready" or until a complete HTTP request arrives with "httpready", so that the event-loops don't
+// spend a wakeup on connections with nothing to read yet. The kernel module of the filter, e.g. accf_data, must
+// be loaded, otherwise the server fails to start.
+func WithAcceptFilter(name string) Option {
+	return func(opts *Options) {
+		opts.AcceptFilter = name
+	}
+}
+
+// WithPollTimeout sets up the timeout of waiting for events in the event-loops.
+func WithPollTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.PollTimeout = timeout
+	}
+}
+
+// WithPollEventsCap sets up the maximum number of events handled in one wait of the event-loops.
+func WithPollEventsCap(eventsCap int) Option {
+	return func(opts *Options) {
+		opts.PollEventsCap = eventsCap
+	}
+}
+
+// WithMaxReadsPerLoopIteration sets up the maximum number of reads from a stream connection whenever it becomes
+// readable, the event-loop keeps reading and firing React until the socket is drained, the connection is closed
+// or n reads are done, and moves on to the other connections ready in the same iteration afterwards, the rest
+// of the inbound data is read in the next iterations. By default every connection is read once per iteration,
+// which keeps a single fast sender from monopolizing an event-loop, raising it saves the epoll_wait/kevent calls
+// of draining the bulk transfers at the cost of the tail latency of the other connections sharing the event-loop.
+// It has no effect on Windows, where every connection is read by its own goroutine.
+func WithMaxReadsPerLoopIteration(n int) Option {
+	return func(opts *Options) {
+		opts.MaxReadsPerLoopIteration = n
+	}
+}
+
+// WithMassiveConnections enables the profile for serving millions of mostly idle stream connections per node,
+// e.g. for push notifications, which trades some throughput of the busy connections for the memory of the idle
+// ones: every event-loop accepts connections from the listener rather than a main reactor handing them over,
+// with EPOLLEXCLUSIVE on Linux so that an incoming connection wakes up one of the event-loops rather than all of
+// them, and the connections hold no ring-buffers until the first byte is left over in either direction, and give
+// them back as soon as they are drained. The event-loops can't be resized thus, and the load-balancing algorithm
+// doesn't apply. Server.ConnMemoryStats tells the memory held per connection. It has no effect on Windows, where
+// every connection is read by its own goroutine.
+func WithMassiveConnections(enabled bool) Option {
+	return func(opts *Options) {
+		opts.MassiveConnections = enabled
+	}
+}
+
+// WithLazyBuffers defers taking the ring-buffers of a stream connection from the pool until the first byte is left
+// over in either direction, and gives the drained ones back once the connection has been idle for idleTimeout, which
+// cuts the memory held by the silent connections of e.g. the notification servers without the trade-offs of
+// WithMassiveConnections, that gives the ring-buffers back as soon as they are drained. The idle connections are
+// swept every idleTimeout, so a ring-buffer is given back after one to two idleTimeout of idleness. The lazy
+// allocation is disabled if idleTimeout is not positive. Only the inbound ring-buffer is lazy on Windows, where
+// the outbound data is written synchronously.
+func WithLazyBuffers(idleTimeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.BufferIdleTimeout = idleTimeout
+	}
+}
+
+// WithAutoAdjustNOFILE raises the soft limit of RLIMIT_NOFILE to the hard limit when the server is created, before
+// the listener is bound, and logs the raise, since the default soft limit of 1024 on most Linux distributions caps
+// the connections far below what the server can serve. The limit is raised for the whole process and is never
+// lowered. A failure to raise it is logged rather than failing the server, e.g. on macOS, where the soft limit can't
+// exceed kern.maxfilesperproc while the hard limit is usually unlimited, and Server.Preflight tells whether
+// the limit leaves room for the expected connections. It has no effect on Windows, where there is no RLIMIT_NOFILE.
+func WithAutoAdjustNOFILE(adjust bool) Option {
+	return func(opts *Options) {
+		opts.AutoAdjustNOFILE = adjust
+	}
+}
+
+// WithExpectedConnections sets up the number of the concurrent connections the server is expected to serve, e.g.
+// the peak of the load tests, for which Server.Preflight checks that RLIMIT_NOFILE leaves room. The connections are
+// not limited to it.
+func WithExpectedConnections(n int) Option {
+	return func(opts *Options) {
+		opts.ExpectedConnections = n
+	}
+}
+
+// WithLoopRestart sets up the policy of handling the event-loops that exit due to unexpected errors.
+func WithLoopRestart(policy LoopRestartPolicy) Option {
+	return func(opts *Options) {
+		opts.LoopRestart = policy
+	}
+}
+
 // WithCodec sets up a codec to handle TCP stream.
 func WithCodec(codec ICodec) Option {
 	return func(opts *Options) {
@@ -105,9 +476,518 @@ func WithCodec(codec ICodec) Option {
 	}
 }
 
+// WithFrameOwnershipTransfer sets up ownership transfer of the frames passed to React.
+func WithFrameOwnershipTransfer(transfer bool) Option {
+	return func(opts *Options) {
+		opts.FrameOwnershipTransfer = transfer
+	}
+}
+
+// WithConnGoroutine enables hybrid mode, in which the I/O and the framing of the stream connections stay within
+// the event-loops, while React runs in a goroutine dedicated to every connection, fed with the decoded frames via
+// a bounded queue, so that React may block, e.g. on a database query, without stalling the other connections of
+// the event-loop. By default, the event-loop stops reading from a connection while its queue is full, until
+// the goroutine catches up, see WithConnGoroutineQueue. The frames passed to React are owned by the event handler, and the out return value
+// is written via AsyncWrite. Since React doesn't run within the event-loop, it may only use the methods of Conn
+// which are safe for concurrent use, such as AsyncWrite, Wake and Close, along with Context and the addresses,
+// which stay valid until React returns as the goroutine retains the connection, see Conn.Retain. The wake-ups fire
+// React within the goroutine too, while the other events, e.g. OnOpened and OnClosed, still fire within
+// the event-loop, thus OnClosed may fire while React is running, the frames left in the queue of a closed connection
+// are dropped. It doesn't support TrafficHandler, BatchHandler and ReadBufferProvider, nor UDP.
+func WithConnGoroutine(enabled bool) Option {
+	return func(opts *Options) {
+		opts.ConnGoroutine = enabled
+	}
+}
+
+// WithConnGoroutineQueue bounds the queue of the frames pending React of every connection in hybrid mode to size
+// frames, see WithConnGoroutine, which keeps a client flooding the server with requests from ballooning the memory
+// of the goroutines, the frames decoded while the queue is full are handled per policy. The frames dropped and
+// the connections closed by policy are counted by Server.ConnQueueStats.
+func WithConnGoroutineQueue(size int, policy ConnQueuePolicy) Option {
+	return func(opts *Options) {
+		opts.ConnGoroutineQueue = size
+		opts.ConnQueuePolicy = policy
+	}
+}
+
+// WithWriteCoalescing sets up write coalescing, which merges the data of the AsyncWrite calls on a connection
+// into bigger write(2) calls: the merged data is flushed when window elapses, when it reaches maxBytes or when
+// the connection writes synchronously, whichever comes first. A zero window merges the AsyncWrite calls handled
+// within the same wake-up of the event-loop, and a non-positive maxBytes doesn't bound the merged data.
+// It trades a little latency for fewer system calls for protocols emitting many small frames per request.
+func WithWriteCoalescing(window time.Duration, maxBytes int) Option {
+	return func(opts *Options) {
+		opts.WriteCoalescingWindow = window
+		opts.WriteCoalescingMaxBytes = maxBytes
+		opts.WriteCoalescing = true
+	}
+}
+
+// WithLoopWriteBatching sets up write batching, which holds the data written to the stream connections of
+// an event-loop, synchronously or by AsyncWrite, until the event-loop has handled all the events of an iteration,
+// then flushes the data of every connection in one write(2) call in a single pass over the connections written to.
+// It trades the latency of handling one batch of events for fewer system calls for the servers handling many
+// pipelined requests per wake-up, e.g. Redis-like protocols. It must not be set along with write coalescing.
+func WithLoopWriteBatching(enabled bool) Option {
+	return func(opts *Options) {
+		opts.LoopWriteBatching = enabled
+	}
+}
+
+// WithKernelZeroCopySend sets up kernel zero-copy send (SO_ZEROCOPY/MSG_ZEROCOPY) for the data of AsyncWrite
+// calls on TCP connections which is at least thresholdBytes long, the kernel sends such data right from the
+// buffer instead of copying it, which cuts CPU usage when streaming large payloads like media or files.
+// The buffers passed to AsyncWrite are retained until the kernel reports the completion of the sends on the error
+// queue of the socket, so they must not be modified after AsyncWrite is invoked. It is a no-op except on Linux 4.14+,
+// and the kernel falls back to copying for the sends that can't be done with zero-copy, e.g. over loopback.
+func WithKernelZeroCopySend(thresholdBytes int) Option {
+	return func(opts *Options) {
+		opts.KernelZeroCopySendThreshold = thresholdBytes
+	}
+}
+
+// WithHandshakeTimeout sets up the handshake timeout, which prevents slow-loris style exhaustion of file descriptors
+// by closing the connections that haven't completed the handshake of the protocol within the timeout. The handshake
+// is completed when the codec reports so if it implements HandshakeReporter, otherwise, when the first frame is
+// decoded, or when OnTraffic consumes inbound data for the first time if the event handler is a TrafficHandler,
+// or when OnHandshake accepts the handshake if the event handler is a HandshakeHandler.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.HandshakeTimeout = timeout
+	}
+}
+
+// WithPartialFrameTimeout sets up the partial frame timeout, which prevents the clients sending an incomplete frame,
+// e.g. a length prefix and nothing else, from holding the buffers forever. When a frame stays incomplete for longer
+// than the timeout, OnDecodeError fires with ErrPartialFrameTimeout if the event handler is a DecodeErrorHandler,
+// otherwise the connection is closed with ErrPartialFrameTimeout. A frame is incomplete as long as the inbound data
+// of the connection, or the data consumed by OnTraffic if the event handler is a TrafficHandler, is left over.
+func WithPartialFrameTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.PartialFrameTimeout = timeout
+	}
+}
+
+// WithSlowReact sets up the slow React detection, which measures every invocation of React, ReactBatch and OnTraffic
+// on stream connections and reports those taking longer than threshold, since a slow event handler stalls all the
+// other connections of its event-loop. The slow invocations fire OnSlowReact if the event handler is
+// a SlowReactHandler, or are logged otherwise, and are counted by Server.SlowReacts. With captureStack, a sampler
+// goroutine checks the event-loops twice per threshold and captures the stack of the event-loops running a React
+// for longer than threshold, which is handed over along with the report, so that it shows where the event handler
+// was stuck rather than where it returned. Capturing a stack stops the world, the sampler does it once per slow
+// invocation at most.
+func WithSlowReact(threshold time.Duration, captureStack bool) Option {
+	return func(opts *Options) {
+		opts.SlowReactThreshold = threshold
+		opts.SlowReactStack = captureStack
+	}
+}
+
+// WithWatchdog sets up the watchdog, which detects the event-loops blocked for longer than timeout, e.g. by an event
+// handler stuck in a deadlock or on a blocking call, which silently stalls all the connections of the event-loop.
+// The watchdog goroutine posts a no-op job to every event-loop four times per timeout, and reports the event-loops
+// that haven't run the job within timeout, once per blocking, via OnLoopBlocked if the event handler is
+// a WatchdogHandler, or via the logger otherwise, along with the ID of the connection last handled by the event-loop
+// and a dump of all the goroutines. The watchdog doesn't run in test mode.
+func WithWatchdog(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.WatchdogTimeout = timeout
+	}
+}
+
+// WithLoopOverload measures the utilization of every event-loop, namely the fraction of the time it spends on handling
+// events rather than waiting for them over every second, see Server.LoopUtilization, and reports the event-loops
+// whose utilization reaches threshold every second for as long as they stay overloaded, via OnLoopOverload if
+// the event handler is a LoopOverloadHandler, or via the logger once per overload otherwise. It gives the autoscaling
+// controllers a signal of the saturation of the event-loops, which is hidden by the CPU usage of the process when
+// only some of the event-loops are saturated, e.g. by a few busy connections.
+func WithLoopOverload(threshold float64) Option {
+	return func(opts *Options) {
+		opts.LoopOverloadThreshold = threshold
+	}
+}
+
+// WithWriteStallTimeout sets up the write stall timeout, which tells the peers that stopped reading from the servers
+// that are just busy: once the oldest byte in the outbound buffer of a stream connection has been waiting for longer
+// than the timeout, namely the peer hasn't read it meanwhile, OnWriteStall fires if the event handler is
+// a WriteStallHandler, otherwise the connection is closed with ErrWriteStall. The data written by the socket counts
+// as read even if it is written partially, while the data merged by write coalescing only counts once it is flushed.
+// The age of the oldest byte is tracked with a precision of an eighth of the timeout. On Windows, where the writes
+// are synchronous, the timeout is the write deadline of every write, the connection is closed once a write exceeds
+// it, and OnWriteStall doesn't fire since the write can't be resumed.
+func WithWriteStallTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.WriteStallTimeout = timeout
+	}
+}
+
+// WithFrameAccounting sets up the frame accountant, which is told the decoded and encoded sizes of every frame
+// handled by the codec.
+func WithFrameAccounting(accountant FrameAccountant) Option {
+	return func(opts *Options) {
+		opts.FrameAccounting = accountant
+	}
+}
+
+// WithFrameTracer sets up the frame tracer, which traces a sample of the frames decoded by the codec and written
+// by the event handler.
+func WithFrameTracer(tracer *FrameTracer) Option {
+	return func(opts *Options) {
+		opts.FrameTracer = tracer
+	}
+}
+
+// WithExpvar exports the basic counters of the server via the expvar package, namely gnet.accepted, gnet.active,
+// gnet.bytes_in, gnet.bytes_out and gnet.loop_iterations, which are the numbers of the connections opened so far
+// and of the ones open now, of the bytes read from and written to the stream connections and of the batches of
+// events handled by the event-loops. They are the sums over all the servers set up with WithExpvar in the process,
+// including the ones that have stopped but for gnet.active, and they are served as JSON by the /debug/vars handler
+// of expvar, so that the servers can be monitored without any dependency.
+func WithExpvar(expvar bool) Option {
+	return func(opts *Options) {
+		opts.Expvar = expvar
+	}
+}
+
+// WithEncryption encrypts the frames of every stream connection with the FrameCipher set up by a handshake of enc,
+// e.g. NoiseIK, the encryption is applied after framing, namely to the frames decoded by the codec and to the ones
+// encoded by it. The frames decoded during the handshake are handed over to enc rather than the event handler, and
+// then to OnHandshake if the event handler is a HandshakeHandler, both of them must complete within HandshakeTimeout
+// if it is set. The output of OnOpened is written as is, and the frames written before the handshake completes
+// are discarded. The inbound data consumed by OnTraffic isn't decrypted, as it isn't decoded by the codec.
+func WithEncryption(enc FrameEncryption) Option {
+	return func(opts *Options) {
+		opts.Encryption = enc
+	}
+}
+
+// WithMaxLabelValues bounds the cardinality of the labels set via Conn.SetLabel, namely the number of the distinct
+// values of every label key and the number of the distinct label keys, to max, the labels beyond it are aggregated
+// under LabelOverflow in Server.LabelStats, so that the labels taken from the peers can't exhaust the memory.
+func WithMaxLabelValues(max int) Option {
+	return func(opts *Options) {
+		opts.MaxLabelValues = max
+	}
+}
+
+// WithEnrichment sets up enricher looking up the information about the peer of every stream connection, e.g.
+// GeoIP, reverse DNS or threat intelligence, off the event-loops right after the connection is accepted, so that
+// the event handler has it at hand from OnOpened on, via Conn.Enrichment, without blocking the event-loops.
+// The connection is handed over to its event-loop, and thus opened and read from, once the enricher returns or
+// timeout elapses, whichever comes first, the connections waiting for the enricher count as accepted but not opened
+// yet for accept overload protection.
+func WithEnrichment(enricher Enricher, timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.Enricher = enricher
+		opts.EnrichmentTimeout = timeout
+	}
+}
+
+// WithOutboundLimit limits the outbound buffer of every stream connection to maxBytes, which makes the memory
+// usage predictable with peers reading slower than the server writes, e.g. when React keeps returning large
+// responses, the connections beyond the limit are handled per policy.
+func WithOutboundLimit(maxBytes int, policy OutboundFullPolicy) Option {
+	return func(opts *Options) {
+		opts.OutboundLimit = maxBytes
+		opts.OutboundFullPolicy = policy
+	}
+}
+
+// WithGracefulSignals shuts the server down gracefully upon any of the given signals, e.g. syscall.SIGTERM and
+// syscall.SIGINT, just like Stop does, so that the simple services don't need their own signal handling.
+// The signals are not handled in test mode.
+func WithGracefulSignals(sigs ...os.Signal) Option {
+	return func(opts *Options) {
+		opts.GracefulSignals = sigs
+	}
+}
+
+// WithReloadSignals fires ReloadHandler.OnReload upon any of the given signals, e.g. syscall.SIGHUP, for reloading
+// the configuration of the service, the event handler must implement ReloadHandler. The signals are not handled
+// in test mode.
+func WithReloadSignals(sigs ...os.Signal) Option {
+	return func(opts *Options) {
+		opts.ReloadSignals = sigs
+	}
+}
+
+// WithShutdownFlushTimeout sets up the maximum duration of flushing the outbound data of all the connections
+// on shutdown, the connections whose outbound data isn't flushed in time are closed with the data left behind.
+func WithShutdownFlushTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.ShutdownFlushTimeout = timeout
+	}
+}
+
+// WithSkipShutdownFlush sets up whether to discard the outbound data of the connections on shutdown, which closes
+// them right away instead of waiting for the slow peers to read what is buffered.
+func WithSkipShutdownFlush(skip bool) Option {
+	return func(opts *Options) {
+		opts.SkipShutdownFlush = skip
+	}
+}
+
+// WithAcceptRateLimit limits the rate of accepting connections to rps per second with bursts of up to burst
+// connections, the connections beyond the limit are handled per AcceptLimitPolicy.
+func WithAcceptRateLimit(rps float64, burst int) Option {
+	return func(opts *Options) {
+		opts.AcceptRateLimit = rps
+		opts.AcceptRateBurst = burst
+	}
+}
+
+// WithAcceptLimitPolicy sets up the policy for the connections beyond the accept rate limit.
+func WithAcceptLimitPolicy(policy AcceptLimitPolicy) Option {
+	return func(opts *Options) {
+		opts.AcceptLimitPolicy = policy
+	}
+}
+
+// WithAcceptMode sets up where the connections are accepted for the event-loops: on the main reactor in a goroutine
+// of its own by default, on the main reactor locked to an OS thread of its own, or on event-loop 0 without a main
+// reactor. It only applies to the stream networks without ReusePort and MassiveConnections, with which all
+// the event-loops accept connections from the listener themselves.
+func WithAcceptMode(mode AcceptMode) Option {
+	return func(opts *Options) {
+		opts.AcceptMode = mode
+	}
+}
+
+// WithConnScan sets up the connection scanner, which inspects every stream connection periodically with
+// scan.Inspect, e.g. for closing the connections idle for too long.
+func WithConnScan(scan *ConnScan) Option {
+	return func(opts *Options) {
+		opts.ConnScan = scan
+	}
+}
+
+// WithAcceptOverload sets up accept overload protection.
+func WithAcceptOverload(config *AcceptOverload) Option {
+	return func(opts *Options) {
+		opts.AcceptOverload = config
+	}
+}
+
+// WithFaultInjection sets up the fault-injection layer.
+func WithFaultInjection(fi *FaultInjection) Option {
+	return func(opts *Options) {
+		opts.FaultInjection = fi
+	}
+}
+
+// WithAudit sets up the sink of the audit records of connections.
+func WithAudit(sink AuditSink) Option {
+	return func(opts *Options) {
+		opts.Audit = sink
+	}
+}
+
+// WithRecorder sets up a recorder for capturing the traffic of connections.
+func WithRecorder(recorder *Recorder) Option {
+	return func(opts *Options) {
+		opts.Recorder = recorder
+	}
+}
+
+// WithTestMode sets up test mode, in which the server is driven manually by Server.PollOnce.
+func WithTestMode(testMode bool) Option {
+	return func(opts *Options) {
+		opts.TestMode = testMode
+	}
+}
+
 // WithLogger sets up a customized logger.
 func WithLogger(logger Logger) Option {
 	return func(opts *Options) {
 		opts.Logger = logger
 	}
 }
+
+// String returns the options in JSON, see MarshalJSON.
+func (opts Options) String() string {
+	b, _ := opts.MarshalJSON()
+	return string(b)
+}
+
+// MarshalJSON encodes the options in JSON for dumping the configuration of a server, durations are formatted
+// as strings, the codec and the logger are represented by their types, and the fault-injection layer, the
+// audit sink and the recorder only by whether they are set up.
+func (opts Options) MarshalJSON() ([]byte, error) {
+	type acceptOverload struct {
+		MaxAcceptRate     int
+		MaxPendingAccepts int
+		DropRate          float64
+		ResponseSize      int
+		Cooldown          string
+	}
+	var ao *acceptOverload
+	if opts.AcceptOverload != nil {
+		ao = &acceptOverload{
+			MaxAcceptRate:     opts.AcceptOverload.MaxAcceptRate,
+			MaxPendingAccepts: opts.AcceptOverload.MaxPendingAccepts,
+			DropRate:          opts.AcceptOverload.DropRate,
+			ResponseSize:      len(opts.AcceptOverload.Response),
+			Cooldown:          opts.AcceptOverload.Cooldown.String(),
+		}
+	}
+	var scan string
+	if opts.ConnScan != nil {
+		scan = opts.ConnScan.Interval.String()
+	}
+	return json.Marshal(struct {
+		Multicore                   bool
+		LB                          string
+		NumEventLoop                int
+		ReusePort                   bool
+		Ticker                      bool
+		TickerInitialDelay          string
+		TickerJitter                float64
+		TCPKeepAlive                string
+		BindToDevice                string
+		IPTOS                       int
+		IPTTL                       int
+		Transparent                 bool
+		UDPReadBufferSize           int
+		LoopAffinity                bool
+		AcceptFilter                string
+		PollTimeout                 string
+		PollEventsCap               int
+		MaxReadsPerLoopIteration    int
+		MassiveConnections          bool
+		BufferIdleTimeout           string
+		AutoAdjustNOFILE            bool
+		ExpectedConnections         int
+		LoopRestart                 LoopRestartPolicy
+		WriteCoalescing             bool
+		WriteCoalescingWindow       string
+		WriteCoalescingMaxBytes     int
+		LoopWriteBatching           bool
+		KernelZeroCopySendThreshold int
+		HandshakeTimeout            string
+		PartialFrameTimeout         string
+		SlowReactThreshold          string
+		SlowReactStack              bool
+		WatchdogTimeout             string
+		LoopOverloadThreshold       float64
+		OutboundLimit               int
+		OutboundFullPolicy          OutboundFullPolicy
+		WriteStallTimeout           string
+		GracefulSignals             []string
+		ReloadSignals               []string
+		ShutdownFlushTimeout        string
+		SkipShutdownFlush           bool
+		AcceptRateLimit             float64
+		AcceptRateBurst             int
+		AcceptLimitPolicy           AcceptLimitPolicy
+		AcceptMode                  AcceptMode
+		AcceptOverload              *acceptOverload
+		ConnScan                    string
+		Codec                       string
+		FrameAccounting             bool
+		FrameTracer                 bool
+		Expvar                      bool
+		Encryption                  bool
+		MaxLabelValues              int
+		Enricher                    bool
+		EnrichmentTimeout           string
+		FrameOwnershipTransfer      bool
+		ConnGoroutine               bool
+		ConnGoroutineQueue          int
+		ConnQueuePolicy             ConnQueuePolicy
+		FaultInjection              bool
+		Audit                       bool
+		Recorder                    bool
+		TestMode                    bool
+		Logger                      string
+	}{
+		Multicore:                   opts.Multicore,
+		LB:                          opts.LB.String(),
+		NumEventLoop:                opts.NumEventLoop,
+		ReusePort:                   opts.ReusePort,
+		Ticker:                      opts.Ticker,
+		TickerInitialDelay:          opts.TickerInitialDelay.String(),
+		TickerJitter:                opts.TickerJitter,
+		TCPKeepAlive:                opts.TCPKeepAlive.String(),
+		BindToDevice:                opts.BindToDevice,
+		IPTOS:                       opts.IPTOS,
+		IPTTL:                       opts.IPTTL,
+		Transparent:                 opts.Transparent,
+		UDPReadBufferSize:           opts.UDPReadBufferSize,
+		LoopAffinity:                opts.LoopAffinity,
+		AcceptFilter:                opts.AcceptFilter,
+		PollTimeout:                 opts.PollTimeout.String(),
+		PollEventsCap:               opts.PollEventsCap,
+		MaxReadsPerLoopIteration:    opts.MaxReadsPerLoopIteration,
+		MassiveConnections:          opts.MassiveConnections,
+		BufferIdleTimeout:           opts.BufferIdleTimeout.String(),
+		AutoAdjustNOFILE:            opts.AutoAdjustNOFILE,
+		ExpectedConnections:         opts.ExpectedConnections,
+		LoopRestart:                 opts.LoopRestart,
+		WriteCoalescing:             opts.WriteCoalescing,
+		WriteCoalescingWindow:       opts.WriteCoalescingWindow.String(),
+		WriteCoalescingMaxBytes:     opts.WriteCoalescingMaxBytes,
+		LoopWriteBatching:           opts.LoopWriteBatching,
+		KernelZeroCopySendThreshold: opts.KernelZeroCopySendThreshold,
+		HandshakeTimeout:            opts.HandshakeTimeout.String(),
+		PartialFrameTimeout:         opts.PartialFrameTimeout.String(),
+		SlowReactThreshold:          opts.SlowReactThreshold.String(),
+		SlowReactStack:              opts.SlowReactStack,
+		WatchdogTimeout:             opts.WatchdogTimeout.String(),
+		LoopOverloadThreshold:       opts.LoopOverloadThreshold,
+		OutboundLimit:               opts.OutboundLimit,
+		OutboundFullPolicy:          opts.OutboundFullPolicy,
+		WriteStallTimeout:           opts.WriteStallTimeout.String(),
+		GracefulSignals:             signalNames(opts.GracefulSignals),
+		ReloadSignals:               signalNames(opts.ReloadSignals),
+		ShutdownFlushTimeout:        opts.ShutdownFlushTimeout.String(),
+		SkipShutdownFlush:           opts.SkipShutdownFlush,
+		AcceptRateLimit:             opts.AcceptRateLimit,
+		AcceptRateBurst:             opts.AcceptRateBurst,
+		AcceptLimitPolicy:           opts.AcceptLimitPolicy,
+		AcceptMode:                  opts.AcceptMode,
+		AcceptOverload:              ao,
+		ConnScan:                    scan,
+		Codec:                       typeName(opts.Codec),
+		FrameAccounting:             opts.FrameAccounting != nil,
+		FrameTracer:                 opts.FrameTracer != nil,
+		Expvar:                      opts.Expvar,
+		Encryption:                  opts.Encryption != nil,
+		MaxLabelValues:              opts.MaxLabelValues,
+		Enricher:                    opts.Enricher != nil,
+		EnrichmentTimeout:           opts.EnrichmentTimeout.String(),
+		FrameOwnershipTransfer:      opts.FrameOwnershipTransfer,
+		ConnGoroutine:               opts.ConnGoroutine,
+		ConnGoroutineQueue:          opts.ConnGoroutineQueue,
+		ConnQueuePolicy:             opts.ConnQueuePolicy,
+		FaultInjection:              opts.FaultInjection != nil,
+		Audit:                       opts.Audit != nil,
+		Recorder:                    opts.Recorder != nil,
+		TestMode:                    opts.TestMode,
+		Logger:                      typeName(opts.Logger),
+	})
+}
+
+func signalNames(sigs []os.Signal) []string {
+	names := make([]string, len(sigs))
+	for i, sig := range sigs {
+		names[i] = sig.String()
+	}
+	return names
+}
+
+func typeName(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// effectiveOptions returns the options of the server with the defaults resolved.
+func (svr *server) effectiveOptions(numEventLoop int) Options {
+	opts := *svr.opts
+	opts.NumEventLoop = numEventLoop
+	opts.Codec = svr.codec
+	opts.Logger = svr.logger
+	return opts
+}
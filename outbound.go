@@ -0,0 +1,25 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// OutboundFullPolicy tells what to do with a stream connection whose outbound buffer exceeds the outbound limit,
+// i.e. a connection whose peer doesn't read as fast as the server writes, see WithOutboundLimit.
+type OutboundFullPolicy int
+
+const (
+	// OutboundBlockReads stops reading from the connection until its outbound buffer is drained, so that the peer
+	// can't make the server produce more outbound data until it has read what is buffered. The data written in the
+	// meantime, e.g. by AsyncWrite, is still buffered.
+	OutboundBlockReads OutboundFullPolicy = iota
+
+	// OutboundDrop drops the data that doesn't fit into the outbound buffer along with all the data written after it,
+	// and closes the connection with ErrOutboundFull.
+	OutboundDrop
+
+	// OutboundCallback buffers the data and invokes OnOutboundFull of the event handler, which must implement
+	// OutboundFullHandler, once the outbound buffer exceeds the limit, it fires again after the outbound buffer
+	// is drained and exceeds the limit once more.
+	OutboundCallback
+)
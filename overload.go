@@ -0,0 +1,126 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shedWriteTimeout bounds the time of writing AcceptOverload.Response to a shed connection where writes may block.
+const shedWriteTimeout = 10 * time.Millisecond
+
+// AcceptOverload is the configuration of accept overload protection, which guards the event-loops against accept
+// storms: once the accept rate or the number of pending accepts exceeds its threshold, the server enters shed mode,
+// in which new connections are closed right after being accepted, optionally with a fixed response, until both
+// drop back below the thresholds and the cooldown elapses. Set it up via WithAcceptOverload.
+type AcceptOverload struct {
+	// MaxAcceptRate is the number of connections accepted per second beyond which the server is overloaded,
+	// it is unlimited if it is not positive.
+	MaxAcceptRate int
+
+	// MaxPendingAccepts is the number of the connections which have been accepted but not opened by their
+	// event-loops yet beyond which the server is overloaded, it is unlimited if it is not positive.
+	MaxPendingAccepts int
+
+	// DropRate is the probability (0-1) of shedding a new connection in shed mode,
+	// all of them are shed if it is not within (0, 1).
+	DropRate float64
+
+	// Response is written to every shed connection before it is closed if it is not empty,
+	// e.g. an HTTP 503 response.
+	Response []byte
+
+	// Cooldown is the minimum duration of shed mode after the thresholds were exceeded for the last time.
+	Cooldown time.Duration
+}
+
+// AcceptOverloadStats is the statistics of accept overload protection.
+type AcceptOverloadStats struct {
+	// Overloaded indicates whether the server is in shed mode, it is updated upon accepting connections.
+	Overloaded bool
+
+	// Episodes is the number of times the server has entered shed mode.
+	Episodes uint64
+
+	// Shed is the number of connections that have been shed.
+	Shed uint64
+}
+
+// acceptGuard implements accept overload protection, it may be used by multiple goroutines accepting connections.
+type acceptGuard struct {
+	mu          sync.Mutex
+	config      *AcceptOverload
+	rand        *rand.Rand
+	windowStart time.Time // start of the current one-second window of accept rate
+	accepts     int       // number of connections accepted in the current window
+	until       time.Time // end of the cooldown of shed mode
+	stats       AcceptOverloadStats
+}
+
+func newAcceptGuard(config *AcceptOverload) *acceptGuard {
+	if config == nil {
+		return nil
+	}
+	return &acceptGuard{config: config, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// admit decides whether to admit a newly accepted connection, changed reports whether the server has just entered
+// or left shed mode, which is told by overloaded.
+func (g *acceptGuard) admit(pending int32) (ok, changed, overloaded bool) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.windowStart) >= time.Second {
+		g.windowStart, g.accepts = now, 0
+	}
+	g.accepts++
+	c := g.config
+	if (c.MaxAcceptRate > 0 && g.accepts > c.MaxAcceptRate) ||
+		(c.MaxPendingAccepts > 0 && int(pending) > c.MaxPendingAccepts) {
+		if !g.stats.Overloaded {
+			g.stats.Overloaded, changed = true, true
+			g.stats.Episodes++
+		}
+		g.until = now.Add(c.Cooldown)
+	} else if g.stats.Overloaded && !now.Before(g.until) {
+		g.stats.Overloaded, changed = false, true
+	}
+	overloaded = g.stats.Overloaded
+	if !overloaded || (c.DropRate > 0 && c.DropRate < 1 && g.rand.Float64() >= c.DropRate) {
+		return true, changed, overloaded
+	}
+	g.stats.Shed++
+	return false, changed, overloaded
+}
+
+func (g *acceptGuard) snapshot() AcceptOverloadStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
+
+// admitConn applies accept overload protection to a newly accepted connection, the connection must be shed
+// by the caller if it is not admitted. It returns ErrServerShutdown if OnOverload tells to shut the server down.
+func (svr *server) admitConn() (ok bool, err error) {
+	if svr.overload == nil {
+		return true, nil
+	}
+	ok, changed, overloaded := svr.overload.admit(atomic.LoadInt32(&svr.pendingAccepts))
+	if changed && svr.overloadHandler != nil && svr.overloadHandler.OnOverload(overloaded) == Shutdown {
+		return false, ErrServerShutdown
+	}
+	return
+}
+
+// AcceptOverloadStats returns the statistics of accept overload protection, see WithAcceptOverload.
+func (s Server) AcceptOverloadStats() AcceptOverloadStats {
+	if s.svr.overload == nil {
+		return AcceptOverloadStats{}
+	}
+	return s.svr.overload.snapshot()
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import "strings"
+
+// The checks of Server.Preflight.
+const (
+	// PreflightListener checks that the listener of the server is bound and open.
+	PreflightListener = "listener"
+
+	// PreflightNOFILE checks that the soft limit of RLIMIT_NOFILE leaves room for the file descriptors open so far,
+	// those of the event-loops and Options.ExpectedConnections, on Unix-like systems.
+	PreflightNOFILE = "nofile"
+
+	// PreflightReusePort checks that SO_REUSEPORT is in effect on the listener with Options.ReusePort, on Unix-like
+	// systems.
+	PreflightReusePort = "reuseport"
+)
+
+// PreflightFailure is a failed check of Server.Preflight.
+type PreflightFailure struct {
+	// Check is the name of the check, e.g. PreflightNOFILE.
+	Check string
+
+	// Reason tells what is wrong.
+	Reason string
+}
+
+// PreflightError is returned by Server.Preflight when some of its checks fail.
+type PreflightError struct {
+	// Failures are the failed checks in the order of the checks.
+	Failures []PreflightFailure
+}
+
+func (e *PreflightError) Error() string {
+	reasons := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		reasons[i] = f.Check + ": " + f.Reason
+	}
+	return "preflight failed: " + strings.Join(reasons, "; ")
+}
+
+// Preflight checks the environment of a server created by NewServer before it is started, so that
+// the misconfigurations fail fast at deploy time rather than under load, and returns a *PreflightError listing
+// all the failed checks, see PreflightListener, PreflightNOFILE and PreflightReusePort. The address has been bound
+// by NewServer, which fails if it is not available. Preflight doesn't change anything, and it can be invoked from
+// any goroutine, though the file descriptors of the event-loops and the connections are counted twice once
+// the server is started.
+func (s Server) Preflight() error {
+	svr := s.svr
+	var failures []PreflightFailure
+	fail := func(check, reason string) {
+		if reason != "" {
+			failures = append(failures, PreflightFailure{check, reason})
+		}
+	}
+	var reason string
+	select {
+	case <-svr.shutdown:
+		reason = "the server has been shut down"
+	default:
+		reason = svr.ln.preflight()
+	}
+	fail(PreflightListener, reason)
+	fail(PreflightNOFILE, svr.preflightNOFILE(s.NumEventLoop))
+	// The socket options of a listener that is not usable are beside the point.
+	if svr.opts.ReusePort && reason == "" {
+		fail(PreflightReusePort, svr.ln.preflightReusePort())
+	}
+	if len(failures) > 0 {
+		return &PreflightError{failures}
+	}
+	return nil
+}
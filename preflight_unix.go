@@ -0,0 +1,99 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package gnet
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preflight returns why the listener is not usable, or an empty string if it is bound.
+func (ln *listener) preflight() string {
+	if ln.network == "memory" || ln.transport != nil {
+		return ""
+	}
+	for l := ln; l != nil; l = l.udp {
+		if _, err := unix.Getsockname(l.fd); err != nil {
+			return fmt.Sprintf("the listener on %s is not bound: %v", l.lnaddr, err)
+		}
+	}
+	return ""
+}
+
+// preflightReusePort returns why SO_REUSEPORT is not in effect on the listener, or an empty string if it is.
+func (ln *listener) preflightReusePort() string {
+	if ln.network == "memory" || ln.network == "unix" || ln.transport != nil {
+		return ""
+	}
+	for l := ln; l != nil; l = l.udp {
+		on, err := unix.GetsockoptInt(l.fd, unix.SOL_SOCKET, unix.SO_REUSEPORT)
+		if err != nil {
+			return fmt.Sprintf("the kernel doesn't support SO_REUSEPORT: %v", err)
+		}
+		if on == 0 {
+			return fmt.Sprintf("SO_REUSEPORT is not set on the listener on %s", l.lnaddr)
+		}
+	}
+	return ""
+}
+
+// preflightNOFILE returns why the soft limit of RLIMIT_NOFILE leaves no room for the file descriptors needed,
+// or an empty string if it does.
+func (svr *server) preflightNOFILE(numEventLoop int) string {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		return fmt.Sprintf("failed to get RLIMIT_NOFILE: %v", err)
+	}
+	// Every event-loop holds a poller and its wakeup descriptor, and so does the main reactor.
+	open, loops, conns := countOpenFiles(), 2*(numEventLoop+1), svr.opts.ExpectedConnections
+	if svr.ln.network == "memory" {
+		conns = 0
+	}
+	if need := uint64(open + loops + conns); need > uint64(rlim.Cur) {
+		return fmt.Sprintf("the soft limit %d is below the %d file descriptors needed: %d open, %d for the event-loops "+
+			"and %d expected connections, the hard limit is %d", rlim.Cur, need, open, loops, conns, rlim.Max)
+	}
+	return ""
+}
+
+// countOpenFiles counts the file descriptors open in the process, or returns 0 if they can't be listed.
+func countOpenFiles() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		_ = f.Close()
+		if err == nil {
+			// The descriptor of the directory itself is listed as well.
+			return len(names) - 1
+		}
+	}
+	return 0
+}
+
+// raiseNOFILE raises the soft limit of RLIMIT_NOFILE to the hard limit, see WithAutoAdjustNOFILE.
+func raiseNOFILE(logger Logger) {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		logger.Printf("failed to get RLIMIT_NOFILE: %v\n", err)
+		return
+	}
+	if rlim.Cur >= rlim.Max {
+		return
+	}
+	soft := rlim.Cur
+	rlim.Cur = rlim.Max
+	if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		logger.Printf("failed to raise the soft limit of RLIMIT_NOFILE from %d to %d: %v\n", soft, rlim.Cur, err)
+		return
+	}
+	logger.Printf("raised the soft limit of RLIMIT_NOFILE from %d to %d\n", soft, rlim.Cur)
+}
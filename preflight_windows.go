@@ -0,0 +1,28 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package gnet
+
+// preflight returns why the listener is not usable, or an empty string if it is open.
+func (ln *listener) preflight() string {
+	if ln.network != "memory" && ln.ln == nil && ln.pconn == nil {
+		return "the listener is not open"
+	}
+	return ""
+}
+
+// preflightReusePort always succeeds on Windows, where there is no SO_REUSEPORT.
+func (ln *listener) preflightReusePort() string {
+	return ""
+}
+
+// preflightNOFILE always succeeds on Windows, where there is no RLIMIT_NOFILE.
+func (svr *server) preflightNOFILE(numEventLoop int) string {
+	return ""
+}
+
+// raiseNOFILE does nothing on Windows, where there is no RLIMIT_NOFILE.
+func raiseNOFILE(logger Logger) {}
@@ -0,0 +1,159 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package pubsub provides a topic-based publish/subscribe layer for gnet servers, which is the building block of
+// chat rooms, notification pushers and the like.
+//
+// Subscribers are sharded by the event-loops owning them and every shard is only touched within its own
+// event-loop, so subscribing doesn't need any lock. A published frame is encoded only once and then handed over
+// to the event-loops that have subscribers of the topic via gnet.Server.PostLoop, where it is written to every
+// subscriber in a batch.
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/panjf2000/gnet"
+)
+
+// Broker dispatches the frames published to topics to the connections subscribing to them.
+type Broker struct {
+	svr    gnet.Server
+	codec  gnet.ICodec
+	shards []shard
+
+	mu     sync.RWMutex
+	active map[string][]int // topic -> number of subscribers per event-loop
+}
+
+// shard holds the subscribers owned by one event-loop, topic -> connection id -> connection.
+type shard map[string]map[uint64]gnet.Conn
+
+// New instantiates a broker for the given server, it is usually invoked in OnInitComplete.
+// The published frames are encoded by the given codec, which must not depend on the connection
+// as it's invoked with a nil connection, and they are written as-is if the codec is nil.
+func New(svr gnet.Server, codec gnet.ICodec) *Broker {
+	b := &Broker{
+		svr:    svr,
+		codec:  codec,
+		shards: make([]shard, svr.NumEventLoop),
+		active: make(map[string][]int),
+	}
+	for i := range b.shards {
+		b.shards[i] = make(shard)
+	}
+	return b
+}
+
+// Subscribe subscribes the connection to the topic, it must be invoked within the event-loop owning
+// the connection, namely within the event callbacks of the connection.
+func (b *Broker) Subscribe(c gnet.Conn, topic string) {
+	idx := b.svr.LoopIndex(c.ID())
+	subs := b.shards[idx][topic]
+	if subs == nil {
+		subs = make(map[uint64]gnet.Conn)
+		b.shards[idx][topic] = subs
+	}
+	if _, ok := subs[c.ID()]; ok {
+		return
+	}
+	subs[c.ID()] = c
+	b.activate(topic, idx, 1)
+}
+
+// Unsubscribe unsubscribes the connection from the topic, it must be invoked within the event-loop owning
+// the connection.
+func (b *Broker) Unsubscribe(c gnet.Conn, topic string) {
+	b.remove(b.svr.LoopIndex(c.ID()), topic, c.ID())
+}
+
+// UnsubscribeAll unsubscribes the connection from all topics, it must be invoked within the event-loop owning
+// the connection, usually in OnClosed. Closed connections are also unsubscribed by the next publish.
+func (b *Broker) UnsubscribeAll(c gnet.Conn) {
+	idx := b.svr.LoopIndex(c.ID())
+	for topic := range b.shards[idx] {
+		b.remove(idx, topic, c.ID())
+	}
+}
+
+// Publish publishes the frame to all subscribers of the topic, it can be invoked from any goroutine.
+// The frame is copied, so the caller is free to reuse it after Publish returns.
+func (b *Broker) Publish(topic string, frame []byte) error {
+	out := make([]byte, len(frame))
+	copy(out, frame)
+	if b.codec != nil {
+		var err error
+		if out, err = b.codec.Encode(nil, out); err != nil {
+			return err
+		}
+	}
+
+	b.mu.RLock()
+	counts := b.active[topic]
+	var loops []int
+	for idx, n := range counts {
+		if n > 0 {
+			loops = append(loops, idx)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, idx := range loops {
+		idx := idx
+		if err := b.svr.PostLoop(idx, func() {
+			for id, c := range b.shards[idx][topic] {
+				if _, err := c.Write(out); err != nil {
+					b.remove(idx, topic, id)
+				}
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribers returns the number of subscribers of the topic.
+func (b *Broker) Subscribers(topic string) (n int) {
+	b.mu.RLock()
+	for _, count := range b.active[topic] {
+		n += count
+	}
+	b.mu.RUnlock()
+	return
+}
+
+func (b *Broker) remove(idx int, topic string, id uint64) {
+	subs := b.shards[idx][topic]
+	if _, ok := subs[id]; !ok {
+		return
+	}
+	delete(subs, id)
+	if len(subs) == 0 {
+		delete(b.shards[idx], topic)
+	}
+	b.activate(topic, idx, -1)
+}
+
+// activate updates the number of subscribers of the topic within the event-loop.
+func (b *Broker) activate(topic string, idx, delta int) {
+	b.mu.Lock()
+	counts := b.active[topic]
+	if counts == nil {
+		counts = make([]int, len(b.shards))
+		b.active[topic] = counts
+	}
+	counts[idx] += delta
+	empty := true
+	for _, n := range counts {
+		if n > 0 {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		delete(b.active, topic)
+	}
+	b.mu.Unlock()
+}
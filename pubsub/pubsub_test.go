@@ -0,0 +1,112 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet"
+)
+
+type chatServer struct {
+	*gnet.EventServer
+	broker *Broker
+	ready  chan struct{}
+	stop   int32
+}
+
+func (cs *chatServer) OnInitComplete(svr gnet.Server) (action gnet.Action) {
+	cs.broker = New(svr, new(gnet.LineBasedFrameCodec))
+	close(cs.ready)
+	return
+}
+
+func (cs *chatServer) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+	cs.broker.UnsubscribeAll(c)
+	return
+}
+
+func (cs *chatServer) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	switch {
+	case bytes.HasPrefix(frame, []byte("sub ")):
+		cs.broker.Subscribe(c, string(frame[4:]))
+		out = []byte("ok")
+	case bytes.HasPrefix(frame, []byte("pub ")):
+		parts := bytes.SplitN(frame[4:], []byte(" "), 2)
+		if err := cs.broker.Publish(string(parts[0]), parts[1]); err != nil {
+			panic(err)
+		}
+	}
+	return
+}
+
+func (cs *chatServer) Tick() (delay time.Duration, action gnet.Action) {
+	delay = time.Millisecond * 100
+	if atomic.LoadInt32(&cs.stop) == 1 {
+		action = gnet.Shutdown
+	}
+	return
+}
+
+func TestBroker(t *testing.T) {
+	cs := &chatServer{ready: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- gnet.Serve(cs, "tcp://:9982", gnet.WithNumEventLoop(2), gnet.WithTicker(true),
+			gnet.WithCodec(new(gnet.LineBasedFrameCodec)))
+	}()
+	<-cs.ready
+	defer atomic.StoreInt32(&cs.stop, 1)
+	time.Sleep(time.Millisecond * 50)
+
+	var readers []*bufio.Reader
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:9982")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+		readers = append(readers, bufio.NewReader(conn))
+		topic := "news"
+		if i == 3 {
+			topic = "sports"
+		}
+		if _, err = conn.Write([]byte("sub " + topic + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if line, err := readers[i].ReadString('\n'); err != nil || line != "ok\n" {
+			t.Fatalf("unexpected reply to subscribing: %q, %v", line, err)
+		}
+	}
+	if n := cs.broker.Subscribers("news"); n != 3 {
+		t.Fatalf("expected 3 subscribers, got %d", n)
+	}
+	if err := cs.broker.Publish("news", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.broker.Publish("sports", []byte("goal")); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range readers {
+		expected := "hello\n"
+		if i == 3 {
+			expected = "goal\n"
+		}
+		if line, err := r.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("subscriber %d: expected %q, got %q, %v", i, expected, line, err)
+		}
+	}
+
+	atomic.StoreInt32(&cs.stop, 1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"sync"
+	"time"
+)
+
+// AcceptLimitPolicy tells what to do with the connections beyond the accept rate limit, see WithAcceptRateLimit.
+type AcceptLimitPolicy int
+
+const (
+	// AcceptLimitDefer leaves the connections beyond the limit in the backlog of the listener until they are
+	// admitted by the limit, the kernel refuses the further connections once the backlog is full.
+	AcceptLimitDefer AcceptLimitPolicy = iota
+
+	// AcceptLimitClose accepts the connections beyond the limit and closes them right away.
+	AcceptLimitClose
+)
+
+// tokenBucket is a token bucket limiting the rate of accepting connections,
+// it may be used by multiple goroutines accepting connections.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take takes a token from the bucket and returns zero, or returns the time to wait for the next token
+// if the bucket is empty, the bucket admits everything if it is nil.
+func (b *tokenBucket) take() (wait time.Duration) {
+	if b == nil {
+		return 0
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens += now.Sub(b.last).Seconds() * b.rate; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	if wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second)); wait <= 0 {
+		wait = time.Nanosecond
+	}
+	return
+}
+
+// waitAccept blocks until the accept rate limit admits a new connection if the policy is AcceptLimitDefer,
+// and reports whether the connection is admitted.
+func (svr *server) waitAccept() bool {
+	for {
+		wait := svr.acceptLimit.take()
+		if wait == 0 {
+			return true
+		}
+		if svr.opts.AcceptLimitPolicy == AcceptLimitClose {
+			return false
+		}
+		time.Sleep(wait)
+	}
+}
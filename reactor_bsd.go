@@ -6,44 +6,62 @@
 
 package gnet
 
-import "github.com/panjf2000/gnet/internal/netpoll"
+import (
+	"runtime"
+
+	"github.com/panjf2000/gnet/internal/netpoll"
+)
 
 func (svr *server) activateMainReactor() {
+	if svr.opts.AcceptMode == AcceptOnDedicatedThread {
+		runtime.LockOSThread()
+	}
 	defer svr.signalShutdown()
 
-	svr.logger.Printf("main reactor exits with error:%v\n", svr.mainLoop.poller.Polling(func(fd int, filter int16) error {
-		return svr.acceptNewConnection(fd)
-	}))
+	svr.mainLoop.run(func() error {
+		return svr.mainLoop.poller.Polling(func(fd int, filter int16) error {
+			return svr.acceptNewConnection(fd)
+		})
+	})
 }
 
 func (svr *server) activateSubReactor(el *eventloop) {
+	el.pin()
 	defer svr.signalShutdown()
 
 	if el.idx == 0 && svr.opts.Ticker {
 		go el.loopTicker()
 	}
 
-	svr.logger.Printf("event-loop:%d exits with error:%v\n", el.idx, el.poller.Polling(func(fd int, filter int16) error {
-		if c, ack := el.connections[fd]; ack {
-			if filter == netpoll.EVFilterSock {
-				return el.loopCloseConn(c, nil)
-			}
-			switch c.outboundBuffer.IsEmpty() {
-			// Don't change the ordering of processing EVFILT_WRITE | EVFILT_READ | EV_ERROR/EV_EOF unless you're 100%
-			// sure what you're doing!
-			// Re-ordering can easily introduce bugs and bad side-effects, as I found out painfully in the past.
-			case false:
-				if filter == netpoll.EVFilterWrite {
-					return el.loopWrite(c)
+	el.run(func() error {
+		return el.poller.Polling(func(fd int, filter int16) error {
+			if c, ack := el.connections[fd]; ack {
+				if filter == netpoll.EVFilterSock {
+					return el.loopCloseConn(c, nil)
 				}
-				return nil
-			case true:
-				if filter == netpoll.EVFilterRead {
-					return el.loopRead(c)
+				switch c.outboundBuffer.IsEmpty() {
+				// Don't change the ordering of processing EVFILT_WRITE | EVFILT_READ | EV_ERROR/EV_EOF unless you're 100%
+				// sure what you're doing!
+				// Re-ordering can easily introduce bugs and bad side-effects, as I found out painfully in the past.
+				case false:
+					if filter == netpoll.EVFilterWrite {
+						return el.loopWrite(c)
+					}
+					return nil
+				case true:
+					if filter == netpoll.EVFilterRead {
+						return el.loopRead(c)
+					}
+					return nil
 				}
-				return nil
 			}
-		}
-		return nil
-	}))
+			if el.isPacketFD(fd) {
+				return el.loopReadUDP(fd)
+			}
+			if el == svr.acceptor && fd == svr.ln.fd {
+				return svr.acceptNewConnection(fd)
+			}
+			return nil
+		})
+	})
 }
@@ -6,17 +6,28 @@
 
 package gnet
 
-import "github.com/panjf2000/gnet/internal/netpoll"
+import (
+	"runtime"
+
+	"github.com/panjf2000/gnet/internal/netpoll"
+	"golang.org/x/sys/unix"
+)
 
 func (svr *server) activateMainReactor() {
+	if svr.opts.AcceptMode == AcceptOnDedicatedThread {
+		runtime.LockOSThread()
+	}
 	defer svr.signalShutdown()
 
-	svr.logger.Printf("main reactor exits with error:%v\n", svr.mainLoop.poller.Polling(func(fd int, ev uint32) error {
-		return svr.acceptNewConnection(fd)
-	}))
+	svr.mainLoop.run(func() error {
+		return svr.mainLoop.poller.Polling(func(fd int, ev uint32) error {
+			return svr.acceptNewConnection(fd)
+		})
+	})
 }
 
 func (svr *server) activateSubReactor(el *eventloop) {
+	el.pin()
 	defer func() {
 		if el.idx == 0 && svr.opts.Ticker {
 			close(svr.ticktock)
@@ -28,24 +39,42 @@ func (svr *server) activateSubReactor(el *eventloop) {
 		go el.loopTicker()
 	}
 
-	svr.logger.Printf("event-loop:%d exits with error:%v\n", el.idx, el.poller.Polling(func(fd int, ev uint32) error {
-		if c, ack := el.connections[fd]; ack {
-			switch c.outboundBuffer.IsEmpty() {
-			// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
-			// sure what you're doing!
-			// Re-ordering can easily introduce bugs and bad side-effects, as I found out painfully in the past.
-			case false:
-				if ev&netpoll.OutEvents != 0 {
-					return el.loopWrite(c)
+	el.run(func() error {
+		return el.poller.Polling(func(fd int, ev uint32) error {
+			if c, ack := el.connections[fd]; ack {
+				// The completions of zero-copy sends are reported as EPOLLERR, drain them before handling the other events.
+				if ev&unix.EPOLLERR != 0 && c.ext != nil && c.ext.zeroCopy != nil {
+					c.ext.zeroCopy.drain(c.fd)
+				}
+				// Urgent data is reported as EPOLLPRI for as long as it hasn't been read, read it ahead of the inbound data.
+				if ev&unix.EPOLLPRI != 0 {
+					if err := el.loopUrgent(c); err != nil || !c.opened {
+						return err
+					}
 				}
-				return nil
-			case true:
-				if ev&netpoll.InEvents != 0 {
-					return el.loopRead(c)
+				switch c.outboundBuffer.IsEmpty() {
+				// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
+				// sure what you're doing!
+				// Re-ordering can easily introduce bugs and bad side-effects, as I found out painfully in the past.
+				case false:
+					if ev&netpoll.OutEvents != 0 {
+						return el.loopWrite(c)
+					}
+					return nil
+				case true:
+					if ev&netpoll.InEvents != 0 {
+						return el.loopRead(c)
+					}
+					return nil
 				}
-				return nil
 			}
-		}
-		return nil
-	}))
+			if el.isPacketFD(fd) {
+				return el.loopReadUDP(fd)
+			}
+			if el == svr.acceptor && fd == svr.ln.fd {
+				return svr.acceptNewConnection(fd)
+			}
+			return nil
+		})
+	})
 }
@@ -0,0 +1,47 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import "sync/atomic"
+
+// readHold is the state of pausing reading from a connection via Conn.PauseRead, it is independent of the pauses
+// made by gnet itself, e.g. by ConnQueueBlockReads or OutboundBlockReads, reading resumes once all of them are lifted.
+type readHold struct {
+	held   int32         // 1 while reading is paused by PauseRead
+	resume chan struct{} // wakes the goroutine reading from the connection up on resuming, used on Windows
+}
+
+// pause marks reading paused and reports whether it was not paused.
+func (h *readHold) pause() bool {
+	return atomic.CompareAndSwapInt32(&h.held, 0, 1)
+}
+
+// release marks reading resumed and reports whether it was paused.
+func (h *readHold) release() bool {
+	if !atomic.CompareAndSwapInt32(&h.held, 1, 0) {
+		return false
+	}
+	select {
+	case h.resume <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// paused reports whether reading is paused.
+func (h *readHold) paused() bool {
+	return atomic.LoadInt32(&h.held) != 0
+}
+
+// wait blocks while reading is paused, until it is resumed or closed is closed.
+func (h *readHold) wait(closed <-chan struct{}) {
+	for h.paused() {
+		select {
+		case <-h.resume:
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RecordKind is the kind of a traffic record.
+type RecordKind byte
+
+const (
+	// RecordOpen indicates that a connection has been opened.
+	RecordOpen RecordKind = iota + 1
+
+	// RecordInbound carries the data read from a connection.
+	RecordInbound
+
+	// RecordOutbound carries the data written to a connection.
+	RecordOutbound
+
+	// RecordClose indicates that a connection has been closed.
+	RecordClose
+)
+
+// Record is a single entry of the recorded traffic.
+type Record struct {
+	// Kind is the kind of the record.
+	Kind RecordKind
+
+	// ConnID identifies the connection within the recording, it starts from 1.
+	ConnID uint64
+
+	// Time is the moment the record was taken.
+	Time time.Time
+
+	// Data is the inbound or outbound data, it is nil for RecordOpen and RecordClose.
+	Data []byte
+}
+
+// recordMagic is written at the beginning of every recording.
+const recordMagic = "gnetrec1"
+
+// recordHeaderSize is the size of the header of a record: kind(1) + conn id(8) + unix nanoseconds(8) + length(4).
+const recordHeaderSize = 21
+
+// ErrInvalidRecording occurs when reading a recording that is not written by a Recorder.
+var ErrInvalidRecording = errors.New("invalid traffic recording")
+
+// RecorderConfig is the configuration of a Recorder.
+type RecorderConfig struct {
+	// Filter selects the connections to record, all connections are if it is nil.
+	Filter func(c Conn) bool
+
+	// SampleRate is the fraction (0-1) of the selected connections to record,
+	// all of them are recorded if it is not within (0, 1).
+	SampleRate float64
+
+	// Seed is the seed of the random source used for sampling.
+	Seed int64
+}
+
+// Recorder captures the inbound and outbound byte streams of the connections of a server into a simple
+// framed format which can be read by RecordReader and fed back to event handlers via Replay, so that
+// protocol issues seen in production can be debugged offline. Set it up via WithRecorder.
+//
+// Records are buffered, invoke Flush after the server stops to make sure they are all written.
+type Recorder struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	err    error
+	config RecorderConfig
+	rand   *rand.Rand
+	seq    uint64
+	header [recordHeaderSize]byte
+}
+
+// NewRecorder instantiates a recorder writing to the given writer.
+func NewRecorder(w io.Writer, config RecorderConfig) *Recorder {
+	r := &Recorder{w: bufio.NewWriter(w), config: config, rand: rand.New(rand.NewSource(config.Seed))}
+	_, r.err = r.w.WriteString(recordMagic)
+	return r
+}
+
+// Flush writes the buffered records to the underlying writer and returns the first error
+// that occurred while recording, the recording stops after an error.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	return r.err
+}
+
+// open decides whether to record the connection and returns its id in the recording, or zero if it is not recorded.
+func (r *Recorder) open(c Conn) uint64 {
+	if r.config.Filter != nil && !r.config.Filter(c) {
+		return 0
+	}
+	r.mu.Lock()
+	if rate := r.config.SampleRate; rate > 0 && rate < 1 && r.rand.Float64() >= rate {
+		r.mu.Unlock()
+		return 0
+	}
+	r.seq++
+	id := r.seq
+	r.mu.Unlock()
+	r.record(RecordOpen, id, nil)
+	return id
+}
+
+func (r *Recorder) record(kind RecordKind, id uint64, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.header[0] = byte(kind)
+	binary.BigEndian.PutUint64(r.header[1:], id)
+	binary.BigEndian.PutUint64(r.header[9:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(r.header[17:], uint32(len(data)))
+	if _, r.err = r.w.Write(r.header[:]); r.err == nil {
+		_, r.err = r.w.Write(data)
+	}
+}
+
+// RecordReader reads the records written by a Recorder.
+type RecordReader struct {
+	r      *bufio.Reader
+	header [recordHeaderSize]byte
+	magic  bool
+}
+
+// NewRecordReader instantiates a record reader reading from the given reader.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF when there are no more records.
+func (rr *RecordReader) Next() (*Record, error) {
+	if !rr.magic {
+		magic := make([]byte, len(recordMagic))
+		if _, err := io.ReadFull(rr.r, magic); err != nil || string(magic) != recordMagic {
+			return nil, ErrInvalidRecording
+		}
+		rr.magic = true
+	}
+	if _, err := io.ReadFull(rr.r, rr.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrInvalidRecording
+		}
+		return nil, err
+	}
+	rec := &Record{
+		Kind:   RecordKind(rr.header[0]),
+		ConnID: binary.BigEndian.Uint64(rr.header[1:]),
+		Time:   time.Unix(0, int64(binary.BigEndian.Uint64(rr.header[9:]))),
+	}
+	if size := binary.BigEndian.Uint32(rr.header[17:]); size > 0 {
+		rec.Data = make([]byte, size)
+		if _, err := io.ReadFull(rr.r, rec.Data); err != nil {
+			return nil, ErrInvalidRecording
+		}
+	}
+	return rec, nil
+}
+
+// replayPollTimeout bounds the time of waiting for the event caused by a replayed record.
+const replayPollTimeout = time.Second
+
+var replaySeq int32
+
+// Replay feeds the recorded inbound traffic back through the codec and the event handler, every recorded
+// connection is re-established via the in-memory transport and receives the same chunks of data in the same
+// order as recorded, while the outbound data produced by the event handler is discarded.
+// The server runs in test mode, so all event callbacks are invoked within the calling goroutine.
+// Replay returns when all records have been replayed or the event handler shuts the server down.
+func Replay(r io.Reader, eventHandler EventHandler, opts ...Option) error {
+	name := "replay-" + strconv.Itoa(int(atomic.AddInt32(&replaySeq, 1)))
+	// Test mode runs exactly one event-loop, so the options of the event-loops are overridden as well.
+	testMode := func(opts *Options) {
+		opts.TestMode, opts.Multicore, opts.NumEventLoop, opts.ReusePort = true, false, 0, false
+	}
+	if err := Serve(eventHandler, "memory://"+name, append(opts, testMode)...); err != nil {
+		return err
+	}
+	memoryServers.RLock()
+	svr, ok := memoryServers.m[name]
+	memoryServers.RUnlock()
+	if !ok {
+		// The event handler shut the server down in OnInitComplete.
+		return nil
+	}
+
+	conns := make(map[uint64]net.Conn)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+		if !svr.stopped {
+			svr.stopTestLoop()
+		}
+	}()
+
+	rr := NewRecordReader(r)
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c := conns[rec.ConnID]
+		switch {
+		case rec.Kind == RecordOpen && c == nil:
+			if c, err = svr.dialMemory(name); err != nil {
+				return err
+			}
+			conns[rec.ConnID] = c
+			go func(c net.Conn) {
+				_, _ = io.Copy(ioutil.Discard, c)
+			}(c)
+		case rec.Kind == RecordInbound && c != nil:
+			if _, err = c.Write(rec.Data); err != nil {
+				return err
+			}
+		case rec.Kind == RecordClose && c != nil:
+			delete(conns, rec.ConnID)
+			if err = c.Close(); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err = svr.pollOnce(replayPollTimeout); err != nil {
+			if err == ErrServerShutdown {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// connRefsClosed is the bit of connRefs telling that the connection has been closed.
+const connRefsClosed = 1 << 30
+
+// connRefs holds the number of the references to a connection retained by Conn.Retain, along with whether the
+// connection has been closed. The state of the connection used outside the event-loop, namely its context and
+// addresses, is released by whichever of closing the connection and releasing the last reference comes last.
+type connRefs int32
+
+// retain adds a reference unless the connection has been closed.
+func (r *connRefs) retain() error {
+	for {
+		refs := atomic.LoadInt32((*int32)(r))
+		if refs&connRefsClosed != 0 {
+			return ErrConnClosed
+		}
+		if atomic.CompareAndSwapInt32((*int32)(r), refs, refs+1) {
+			return nil
+		}
+	}
+}
+
+// release drops a reference and reports whether the connection is closed and no longer referenced.
+func (r *connRefs) release() bool {
+	for {
+		refs := atomic.LoadInt32((*int32)(r))
+		if refs&^connRefsClosed == 0 {
+			panic("gnet: Conn.Release without Conn.Retain")
+		}
+		if atomic.CompareAndSwapInt32((*int32)(r), refs, refs-1) {
+			return refs-1 == connRefsClosed
+		}
+	}
+}
+
+// close marks the connection closed and reports whether it is no longer referenced.
+func (r *connRefs) close() bool {
+	return atomic.AddInt32((*int32)(r), connRefsClosed) == connRefsClosed
+}
+
+// closed reports whether the connection has been closed.
+func (r *connRefs) closed() bool {
+	return atomic.LoadInt32((*int32)(r))&connRefsClosed != 0
+}
+
+// closedGone is the channel returned by Conn.Gone of the connections closed before it is first called.
+var closedGone = make(chan struct{})
+
+func init() {
+	close(closedGone)
+}
+
+// connGone holds the channel of Conn.Gone, which is made on demand, since most connections are never observed.
+type connGone struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	closed bool
+}
+
+// done returns the channel closed once the connection is closed.
+func (g *connGone) done() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ch == nil {
+		if g.closed {
+			return closedGone
+		}
+		g.ch = make(chan struct{})
+	}
+	return g.ch
+}
+
+// close closes the channel if it has been made and marks the connection closed.
+func (g *connGone) close() {
+	g.mu.Lock()
+	g.closed = true
+	if g.ch != nil {
+		close(g.ch)
+	}
+	g.mu.Unlock()
+}
@@ -4,10 +4,15 @@
 // Use of this source code is governed by a MIT-style
 // license that can be found in the LICENSE file.
 
+// Package ringbuffer provides the growable ring-buffer used by gnet for the inbound and outbound data of
+// the connections, which is also supported for reuse outside gnet, e.g. by custom transports and tests.
+// The buffer grows on demand to the next power of two and never shrinks unless Shrink is invoked.
+// A RingBuffer is not safe for concurrent use.
 package ringbuffer
 
 import (
 	"errors"
+	"io"
 	"unsafe"
 
 	"github.com/panjf2000/gnet/internal"
@@ -112,6 +117,33 @@ func (r *RingBuffer) Shift(n int) {
 	}
 }
 
+// Peek returns the next n bytes without moving the "read" pointer, in two slices since they may wrap around the end
+// of the buffer, tail is nil unless they do. It fails with io.ErrShortBuffer if there are fewer than n bytes.
+// The slices are only valid until the next write.
+func (r *RingBuffer) Peek(n int) (head []byte, tail []byte, err error) {
+	if n < 0 || n > r.Length() {
+		return nil, nil, io.ErrShortBuffer
+	}
+	head, tail = r.LazyRead(n)
+	return
+}
+
+// Discard skips the next n bytes, it returns the number of bytes discarded, along with ErrIsEmpty if there are
+// fewer than n bytes, in which case all of them are discarded.
+func (r *RingBuffer) Discard(n int) (discarded int, err error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	discarded = r.Length()
+	if n < discarded {
+		discarded = n
+	} else if n > discarded {
+		err = ErrIsEmpty
+	}
+	r.Shift(discarded)
+	return
+}
+
 // Read reads up to len(p) bytes into p. It returns the number of bytes read (0 <= n <= len(p)) and any error
 // encountered.
 // Even if Read returns n < len(p), it may use all of p as scratch space during the call.
@@ -225,6 +257,63 @@ func (r *RingBuffer) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// ReadFrom reads data from rd until EOF or an error and writes it to the buffer, which grows as needed, it returns
+// the number of bytes read. EOF is not reported as an error. It implements io.ReaderFrom.
+func (r *RingBuffer) ReadFrom(rd io.Reader) (n int64, err error) {
+	for empty := 0; ; {
+		if r.Free() == 0 {
+			r.malloc(minGrowth(r.size))
+		} else if r.isEmpty {
+			r.Reset()
+		}
+		var p []byte
+		if r.w >= r.r {
+			p = r.buf[r.w:]
+		} else {
+			p = r.buf[r.w:r.r]
+		}
+		m, e := rd.Read(p)
+		if m < 0 || m > len(p) {
+			panic("ringbuffer: reader returned invalid count")
+		}
+		if m > 0 {
+			r.w = (r.w + m) & r.mask
+			r.isEmpty = false
+			n += int64(m)
+			empty = 0
+		} else if empty++; e == nil && empty >= maxEmptyReads {
+			return n, io.ErrNoProgress
+		}
+		if e == io.EOF {
+			return n, nil
+		}
+		if e != nil {
+			return n, e
+		}
+	}
+}
+
+// WriteTo writes the data in the buffer to w until the buffer is drained or an error occurs, it returns the number
+// of bytes written, which are removed from the buffer. It implements io.WriterTo.
+func (r *RingBuffer) WriteTo(w io.Writer) (n int64, err error) {
+	for !r.isEmpty {
+		head, _ := r.LazyReadAll()
+		m, e := w.Write(head)
+		if m < 0 || m > len(head) {
+			panic("ringbuffer: writer returned invalid count")
+		}
+		r.Shift(m)
+		n += int64(m)
+		if e != nil {
+			return n, e
+		}
+		if m < len(head) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return
+}
+
 // WriteByte writes one byte into buffer
 func (r *RingBuffer) WriteByte(c byte) error {
 	if r.Free() < 1 {
@@ -347,6 +436,33 @@ func (r *RingBuffer) WithByteBuffer(b []byte) *bytebuffer.ByteBuffer {
 	return bb
 }
 
+// Grow grows the buffer if necessary to guarantee space for another n bytes, so that they can be written without
+// another allocation.
+func (r *RingBuffer) Grow(n int) {
+	if free := r.Free(); n > free {
+		r.malloc(n - free)
+	}
+}
+
+// Shrink shrinks the buffer to the least power of two not less than size, or than the length of the data in
+// the buffer if it is greater, so that the memory grown for a burst can be released. If size is not positive and
+// the buffer is empty, the underlying buffer is released entirely, as if the ring-buffer was created by New(0).
+func (r *RingBuffer) Shrink(size int) {
+	length := r.Length()
+	if size <= 0 && length == 0 {
+		*r = RingBuffer{isEmpty: true}
+		return
+	}
+	if size < length {
+		size = length
+	}
+	newCap := internal.CeilToPowerOfTwo(size)
+	if newCap >= r.size {
+		return
+	}
+	r.realloc(newCap)
+}
+
 // IsFull returns this ringbuffer is full.
 func (r *RingBuffer) IsFull() bool {
 	return r.r == r.w && !r.isEmpty
@@ -365,13 +481,32 @@ func (r *RingBuffer) Reset() {
 }
 
 func (r *RingBuffer) malloc(cap int) {
-	newCap := internal.CeilToPowerOfTwo(r.size + cap)
+	r.realloc(internal.CeilToPowerOfTwo(r.size + cap))
+}
+
+// realloc moves the data to a new buffer of newCap bytes, which must be a power of two not less than the length of
+// the data.
+func (r *RingBuffer) realloc(newCap int) {
 	newBuf := make([]byte, newCap)
 	oldLen := r.Length()
 	_, _ = r.Read(newBuf)
 	r.r = 0
-	r.w = oldLen
+	r.w = oldLen & (newCap - 1)
 	r.size = newCap
 	r.mask = newCap - 1
 	r.buf = newBuf
+	r.isEmpty = oldLen == 0
+}
+
+const (
+	minReadGrowth = 512 // minimum number of bytes ReadFrom grows the buffer by
+	maxEmptyReads = 100 // maximum number of consecutive empty reads ReadFrom tolerates
+)
+
+// minGrowth returns the number of bytes ReadFrom grows a buffer of size bytes by, which doubles it.
+func minGrowth(size int) int {
+	if size < minReadGrowth {
+		return minReadGrowth
+	}
+	return size
 }
@@ -6,8 +6,11 @@ package ringbuffer
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestRingBuffer_Write(t *testing.T) {
@@ -457,3 +460,125 @@ func TestRingBuffer_ByteInterface(t *testing.T) {
 		t.Fatalf("expect IsFull is false but got true")
 	}
 }
+
+func TestRingBuffer_PeekDiscard(t *testing.T) {
+	rb := New(8)
+	_, _ = rb.WriteString("abcdef")
+	_, _ = rb.Discard(4)
+	_, _ = rb.WriteString("ghij")
+
+	// The data wraps around the end of the buffer.
+	head, tail, err := rb.Peek(5)
+	if err != nil || string(head)+string(tail) != "efghi" || tail == nil {
+		t.Fatalf("expect efghi across the end but got %q %q, %v. r.w=%d, r.r=%d", head, tail, err, rb.w, rb.r)
+	}
+	if _, _, err = rb.Peek(7); err != io.ErrShortBuffer {
+		t.Fatalf("expect io.ErrShortBuffer but got %v", err)
+	}
+	if n, err := rb.Discard(5); n != 5 || err != nil {
+		t.Fatalf("expect discard 5 bytes but got %d, %v", n, err)
+	}
+	if n, err := rb.Discard(5); n != 1 || err != ErrIsEmpty || !rb.IsEmpty() {
+		t.Fatalf("expect discard 1 byte with ErrIsEmpty but got %d, %v", n, err)
+	}
+}
+
+func TestRingBuffer_ReadFromWriteTo(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 1000))
+	rb := New(0)
+	n, err := rb.ReadFrom(iotest.OneByteReader(bytes.NewReader(data[:7])))
+	if n != 7 || err != nil {
+		t.Fatalf("expect read 7 bytes but got %d, %v", n, err)
+	}
+	_, _ = rb.Discard(5)
+	// The data wraps around the end of the buffer and the buffer grows.
+	if n, err = rb.ReadFrom(bytes.NewReader(data[7:])); n != int64(len(data)-7) || err != nil {
+		t.Fatalf("expect read %d bytes but got %d, %v", len(data)-7, n, err)
+	}
+	var out bytes.Buffer
+	if n, err = rb.WriteTo(&shortWriter{&out, 3}); n != 3 || err != io.ErrShortWrite {
+		t.Fatalf("expect write 3 bytes with io.ErrShortWrite but got %d, %v", n, err)
+	}
+	if n, err = rb.WriteTo(&out); n != int64(len(data)-8) || err != nil || !rb.IsEmpty() {
+		t.Fatalf("expect write %d bytes but got %d, %v", len(data)-8, n, err)
+	}
+	if !bytes.Equal(out.Bytes(), data[5:]) {
+		t.Fatal("expect the data read from the reader written to the writer")
+	}
+}
+
+// shortWriter writes no more than n bytes per call.
+type shortWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+	return w.w.Write(p)
+}
+
+func TestRingBuffer_GrowShrink(t *testing.T) {
+	rb := New(4)
+	_, _ = rb.WriteString("abc")
+	rb.Grow(10)
+	if rb.Free() < 10 || rb.Cap() != 16 {
+		t.Fatalf("expect free 10 bytes at least but got %d, cap %d", rb.Free(), rb.Cap())
+	}
+	_, _ = rb.WriteString(strings.Repeat("x", 100))
+	_, _ = rb.Discard(99)
+	rb.Shrink(0)
+	if rb.Cap() != 4 || string(rb.ByteBuffer().Bytes()) != "xxxx" || !rb.IsFull() {
+		t.Fatalf("expect xxxx in 4 bytes but got %q, cap %d", rb.ByteBuffer().Bytes(), rb.Cap())
+	}
+	_, _ = rb.Discard(4)
+	rb.Shrink(0)
+	if rb.Cap() != 0 || !rb.IsEmpty() {
+		t.Fatalf("expect the buffer released but got cap %d", rb.Cap())
+	}
+	if n, _ := rb.WriteString("abc"); n != 3 || string(rb.ByteBuffer().Bytes()) != "abc" {
+		t.Fatal("expect the buffer reusable after being released")
+	}
+}
+
+func BenchmarkRingBuffer_WriteRead(b *testing.B) {
+	rb := New(4096)
+	data := make([]byte, 1000)
+	buf := make([]byte, 1000)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = rb.Write(data)
+		_, _ = rb.Read(buf)
+	}
+}
+
+func BenchmarkRingBuffer_PeekDiscard(b *testing.B) {
+	rb := New(4096)
+	data := make([]byte, 1000)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = rb.Write(data)
+		_, _, _ = rb.Peek(len(data))
+		_, _ = rb.Discard(len(data))
+	}
+}
+
+func BenchmarkRingBuffer_ReadFromWriteTo(b *testing.B) {
+	rb := New(4096)
+	data := make([]byte, 1000)
+	r := bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		_, _ = rb.ReadFrom(r)
+		_, _ = rb.WriteTo(ioutil.Discard)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	rtpVersion       = 2
+	rtpHeaderSize    = 12
+	rtcpHeaderSize   = 8
+	rtpMaxFrameSize  = 1<<16 - 1
+	rtcpMinType      = 192
+	rtcpMaxType      = 223
+	rtpFrameSizeSize = 2
+)
+
+// RTPHeader is the header of an RTP packet, see RFC 3550.
+type RTPHeader struct {
+	// Marker is the marker bit, whose meaning is up to the profile, e.g. the end of a video frame.
+	Marker bool
+
+	// PayloadType is the format of the payload, e.g. 0 for PCMU and 96 to 127 for the dynamic payload types.
+	PayloadType uint8
+
+	// SequenceNumber increments by one for every packet sent, e.g. for detecting losses and reordering.
+	SequenceNumber uint16
+
+	// Timestamp is the sampling instant of the first octet of the payload, at the clock rate of the payload type.
+	Timestamp uint32
+
+	// SSRC identifies the source of the stream.
+	SSRC uint32
+
+	// CSRCCount is the number of the contributing sources listed after SSRC, which are parsed by CSRC.
+	CSRCCount int
+
+	// ExtensionProfile is the profile of the header extension, it is zero if there is no header extension.
+	ExtensionProfile uint16
+
+	// Extension is the header extension, excluding its profile and length, it is nil if there is none.
+	// It is a slice of the packet, thus it is only valid as long as the packet.
+	Extension []byte
+
+	packet []byte
+}
+
+// CSRC returns the i-th contributing source, i must be less than CSRCCount.
+func (h *RTPHeader) CSRC(i int) uint32 {
+	return binary.BigEndian.Uint32(h.packet[rtpHeaderSize+4*i:])
+}
+
+// ParseRTPHeader parses the header of the RTP packet and returns the payload without the padding, which is a slice of
+// the packet, e.g. for ingesting media in React on UDP. It fails with ErrInvalidRTPPacket if the packet is malformed.
+func ParseRTPHeader(packet []byte) (h RTPHeader, payload []byte, err error) {
+	if len(packet) < rtpHeaderSize || packet[0]>>6 != rtpVersion {
+		return h, nil, ErrInvalidRTPPacket
+	}
+	h.Marker = packet[1]&0x80 != 0
+	h.PayloadType = packet[1] & 0x7f
+	h.SequenceNumber = binary.BigEndian.Uint16(packet[2:])
+	h.Timestamp = binary.BigEndian.Uint32(packet[4:])
+	h.SSRC = binary.BigEndian.Uint32(packet[8:])
+	h.CSRCCount = int(packet[0] & 0x0f)
+	h.packet = packet
+
+	offset := rtpHeaderSize + 4*h.CSRCCount
+	if packet[0]&0x10 != 0 {
+		if len(packet) < offset+4 {
+			return h, nil, ErrInvalidRTPPacket
+		}
+		h.ExtensionProfile = binary.BigEndian.Uint16(packet[offset:])
+		size := 4 * int(binary.BigEndian.Uint16(packet[offset+2:]))
+		offset += 4
+		if len(packet) < offset+size {
+			return h, nil, ErrInvalidRTPPacket
+		}
+		h.Extension = packet[offset : offset+size]
+		offset += size
+	}
+	end := len(packet)
+	if packet[0]&0x20 != 0 {
+		// The last octet of the padding is the size of the padding, including itself.
+		end -= int(packet[end-1])
+	}
+	if end < offset || end == len(packet) && packet[0]&0x20 != 0 {
+		return h, nil, ErrInvalidRTPPacket
+	}
+	return h, packet[offset:end], nil
+}
+
+// RTCPHeader is the header of the first RTCP packet of a compound RTCP packet, see RFC 3550.
+type RTCPHeader struct {
+	// Count is the number of the reception report blocks or the sources, or the feedback message type, depending
+	// on PacketType.
+	Count uint8
+
+	// PacketType is the type of the packet, e.g. 200 for sender reports and 201 for receiver reports.
+	PacketType uint8
+
+	// Length is the length of the packet in bytes, including the header and the padding, the next packet of
+	// the compound packet, if any, follows at this offset.
+	Length int
+
+	// SSRC identifies the sender of the packet.
+	SSRC uint32
+}
+
+// IsRTCPPacket reports whether the packet is an RTCP packet rather than an RTP packet, for demultiplexing RTP and
+// RTCP on the same port as specified in RFC 5761, by the packet type in the range of 192 to 223, which the payload
+// types of the multiplexed RTP streams must keep clear of.
+func IsRTCPPacket(packet []byte) bool {
+	return len(packet) >= rtcpHeaderSize && packet[0]>>6 == rtpVersion &&
+		packet[1] >= rtcpMinType && packet[1] <= rtcpMaxType
+}
+
+// ParseRTCPHeader parses the header of the RTCP packet, it fails with ErrInvalidRTPPacket if the packet is not
+// an RTCP packet or it is truncated.
+func ParseRTCPHeader(packet []byte) (h RTCPHeader, err error) {
+	if !IsRTCPPacket(packet) {
+		return h, ErrInvalidRTPPacket
+	}
+	h.Count = packet[0] & 0x1f
+	h.PacketType = packet[1]
+	h.Length = 4 * (int(binary.BigEndian.Uint16(packet[2:])) + 1)
+	h.SSRC = binary.BigEndian.Uint32(packet[4:])
+	if h.Length > len(packet) {
+		return h, ErrInvalidRTPPacket
+	}
+	return h, nil
+}
+
+// RTPCodec encodes/decodes the RTP and RTCP packets multiplexed on a stream connection, which are framed by
+// the 16-bit length prefix specified in RFC 4571, e.g. for RTP over RTSP or ICE-TCP. Decode validates every packet,
+// failing with ErrInvalidRTPPacket for the invalid ones, see DecodeErrorHandler, and passes it to React without
+// the length prefix, use IsRTCPPacket to demultiplex them and ParseRTPHeader or ParseRTCPHeader to parse them.
+// The UDP packets don't go through codecs, so the servers ingesting media over UDP use these functions on the frames
+// passed to React directly.
+type RTPCodec struct {
+}
+
+// Encode ...
+func (cc *RTPCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	if len(buf) > rtpMaxFrameSize {
+		return nil, fmt.Errorf("length does not fit into a short integer: %d", len(buf))
+	}
+	out := make([]byte, rtpFrameSizeSize, rtpFrameSizeSize+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	return append(out, buf...), nil
+}
+
+// Decode ...
+func (cc *RTPCodec) Decode(c Conn) ([]byte, error) {
+	header, err := c.Peek(rtpFrameSizeSize)
+	if err != nil {
+		return nil, ErrUnexpectedEOF
+	}
+	size := rtpFrameSizeSize + int(binary.BigEndian.Uint16(header))
+	buf, err := c.Next(size)
+	if err != nil {
+		return nil, ErrUnexpectedEOF
+	}
+	packet := buf[rtpFrameSizeSize:]
+	if IsRTCPPacket(packet) {
+		_, err = ParseRTCPHeader(packet)
+	} else {
+		_, _, err = ParseRTPHeader(packet)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
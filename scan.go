@@ -0,0 +1,127 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import "time"
+
+// ScanVerdict tells what to do with a connection inspected by the connection scanner, see ConnScan.
+type ScanVerdict int
+
+const (
+	// ScanKeep keeps the connection as is.
+	ScanKeep ScanVerdict = iota
+
+	// ScanClose closes the connection as if Conn.Close was invoked.
+	ScanClose
+
+	// ScanNotify fires an OnUserEvent event with an IdleNotice for the connection, or a React event with nil
+	// frame if the event handler doesn't implement UserEventHandler.
+	ScanNotify
+)
+
+// IdleNotice is the tag of the OnUserEvent events fired for the connections inspected with ScanNotify.
+type IdleNotice struct {
+	// Idle is the duration for which no data has been transferred over the connection.
+	Idle time.Duration
+}
+
+// ConnScan sets up the connection scanner, which sweeps the stream connections of every event-loop once per
+// Interval and lets Inspect decide what to do with each of them, e.g. for expiring the stale sessions without
+// keeping track of the connections in the application. The sweeps run within the event-loops and are spread over
+// the interval in small batches, so that no event-loop is blocked by inspecting all of its connections at once.
+type ConnScan struct {
+	// Interval is the duration of a sweep over the connections of an event-loop.
+	Interval time.Duration
+
+	// Inspect is invoked within the event-loop for every connection once per sweep, idle is the duration for which
+	// no data has been read from or written to the connection as observed by the sweeps, thus it is accurate to
+	// within Interval, and it is zero when the connection is inspected for the first time.
+	Inspect func(c Conn, idle time.Duration) ScanVerdict
+}
+
+// connScanSteps is the number of the batches a sweep of the connection scanner is spread over.
+const connScanSteps = 16
+
+// connScanState is the state of a connection kept by the connection scanner.
+type connScanState struct {
+	bytes     uint64    // number of bytes transferred as of the last inspection
+	idleSince time.Time // moment of the first inspection seeing no transfer since the previous one
+}
+
+// idle updates the state with the number of bytes transferred so far and returns the idle duration.
+func (s *connScanState) idle(bytes uint64, now time.Time) time.Duration {
+	if s.idleSince.IsZero() || bytes != s.bytes {
+		s.bytes = bytes
+		s.idleSince = now
+	}
+	return now.Sub(s.idleSince)
+}
+
+// connScanner is the state of the connection scanner within an event-loop.
+type connScanner struct {
+	sweep []uint64 // IDs of the connections in the current sweep
+	next  int      // index of the next connection to inspect in sweep
+	batch int      // number of the connections inspected per step of the current sweep
+	steps int      // number of the steps taken in the current sweep
+}
+
+// startConnScan starts the connection scanner if it is set up.
+func (svr *server) startConnScan() {
+	scan := svr.opts.ConnScan
+	if scan == nil {
+		return
+	}
+	period := scan.Interval / connScanSteps
+	var step func()
+	step = func() {
+		select {
+		case <-svr.shutdown:
+			return
+		default:
+		}
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			_ = el.post(busMessage{fn: el.loopScan})
+			return true
+		})
+		time.AfterFunc(period, step)
+	}
+	time.AfterFunc(period, step)
+}
+
+// loopScan inspects the next batch of the connections in the current sweep, and starts a new sweep once
+// the current one has taken all of its steps.
+func (el *eventloop) loopScan() {
+	s := &el.scanner
+	if s.steps%connScanSteps == 0 {
+		s.sweep, s.next, s.steps = s.sweep[:0], 0, 0
+		for id := range el.connsByID {
+			s.sweep = append(s.sweep, id)
+		}
+		s.batch = (len(s.sweep) + connScanSteps - 1) / connScanSteps
+	}
+	s.steps++
+	end := s.next + s.batch
+	if end > len(s.sweep) {
+		end = len(s.sweep)
+	}
+	now := time.Now()
+	for ; s.next < end; s.next++ {
+		c, ok := el.connsByID[s.sweep[s.next]]
+		if !ok {
+			continue
+		}
+		idle := c.scanState().idle(c.bytesIn+c.bytesOut, now)
+		switch el.svr.opts.ConnScan.Inspect(c, idle) {
+		case ScanClose:
+			_ = c.Close()
+		case ScanNotify:
+			if err := el.loopUserEvent(c, IdleNotice{Idle: idle}); err != nil {
+				el.svr.requestShutdown()
+			}
+		}
+	}
+}
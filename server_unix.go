@@ -8,7 +8,6 @@
 package gnet
 
 import (
-	"runtime"
 	"sync"
 	"time"
 
@@ -16,36 +15,71 @@ import (
 )
 
 type server struct {
-	ln               *listener          // all the listeners
-	wg               sync.WaitGroup     // event-loop close WaitGroup
-	opts             *Options           // options with server
-	once             sync.Once          // make sure only signalShutdown once
-	cond             *sync.Cond         // shutdown signaler
-	codec            ICodec             // codec for TCP stream
-	logger           Logger             // customized logger for logging info
-	ticktock         chan time.Duration // ticker channel
-	mainLoop         *eventloop         // main loop for accepting connections
-	eventHandler     EventHandler       // user eventHandler
-	subLoopGroup     IEventLoopGroup    // loops for handling events
-	subLoopGroupSize int                // number of loops
+	ln               *listener             // all the listeners
+	wg               sync.WaitGroup        // event-loop close WaitGroup
+	opts             *Options              // options with server
+	once             sync.Once             // make sure only signalShutdown once
+	shutdown         chan struct{}         // closed by signalShutdown
+	started          int32                 // whether the server has been started
+	done             chan struct{}         // closed after the server has been stopped
+	codec            ICodec                // codec for TCP stream
+	bufferProvider   ReadBufferProvider    // optional NextBuffer implementation of codec
+	logger           Logger                // customized logger for logging info
+	ticktock         chan time.Duration    // ticker channel
+	tickerStopped    int32                 // 1 if the ticker is stopped by StopTicker
+	tickerStart      chan struct{}         // wakes the ticker stopped by StopTicker up
+	tickers          namedTickers          // tickers added by AddTicker
+	mainLoop         *eventloop            // main loop for accepting connections
+	acceptor         *eventloop            // main loop, or event-loop 0 with AcceptOnLoop, accepting for the event-loops
+	eventHandler     EventHandler          // user eventHandler
+	trafficHandler   TrafficHandler        // optional OnTraffic implementation of eventHandler
+	batchHandler     BatchHandler          // optional ReactBatch implementation of eventHandler
+	acceptHandler    AcceptHandler         // optional OnAccepted implementation of eventHandler
+	userEventHandler UserEventHandler      // optional OnUserEvent implementation of eventHandler
+	fdHandler        FileDescriptorHandler // optional OnFileDescriptors implementation of eventHandler
+	loopErrorHandler LoopErrorHandler      // optional OnLoopError implementation of eventHandler
+	subLoopGroup     IEventLoopGroup       // loops for handling events
+	subLoopGroupSize int                   // number of loops
+	dialMu           sync.Mutex            // serializes the connections assigned by DialMemory and ListenPassive
+	stopped          bool                  // whether the server running in test mode has been shut down
+	faultSeq         int32                 // sequence number of the connections subject to fault injection
+	transport        connTransport         // transport performing I/O on the connections
+	acceptLimit      *tokenBucket          // accept rate limit, nil if it is disabled
+	overload         *acceptGuard          // accept overload protection, nil if it is disabled
+	acceptPause      acceptPause           // state of pausing accepting via PauseAccept
+	labels           labelRegistry         // counters of the labels of the connections, see Conn.SetLabel
+	overloadHandler  OverloadHandler       // optional OnOverload implementation of eventHandler
+	handshakeHandler HandshakeHandler      // optional OnHandshake implementation of eventHandler
+	urgentHandler    UrgentDataHandler     // optional OnUrgentData implementation of eventHandler
+	decodeErrHandler DecodeErrorHandler    // optional OnDecodeError implementation of eventHandler
+	outboundHandler  OutboundFullHandler   // optional OnOutboundFull implementation of eventHandler
+	stallHandler     WriteStallHandler     // optional OnWriteStall implementation of eventHandler
+	shutdownHandler  ShutdownHandler       // optional OnShutdown implementation of eventHandler
+	slowReactHandler SlowReactHandler      // optional OnSlowReact implementation of eventHandler
+	watchdogHandler  WatchdogHandler       // optional OnLoopBlocked implementation of eventHandler
+	reloadHandler    ReloadHandler         // optional OnReload implementation of eventHandler
+	pendingAccepts   int32                 // number of the connections accepted but not opened yet
+	enrichWG         sync.WaitGroup        // enrichments in flight, see WithEnrichment
+	cpuLoops         map[int]*eventloop    // event-loops by the CPUs they are pinned to, nil without loop affinity
 }
 
 // waitForShutdown waits for a signal to shutdown
 func (svr *server) waitForShutdown() {
-	svr.cond.L.Lock()
-	svr.cond.Wait()
-	svr.cond.L.Unlock()
+	<-svr.shutdown
 }
 
 // signalShutdown signals a shutdown an begins server closing
 func (svr *server) signalShutdown() {
 	svr.once.Do(func() {
-		svr.cond.L.Lock()
-		svr.cond.Signal()
-		svr.cond.L.Unlock()
+		close(svr.shutdown)
 	})
 }
 
+// requestShutdown signals a shutdown from outside the event-loops.
+func (svr *server) requestShutdown() {
+	svr.signalShutdown()
+}
+
 func (svr *server) startLoops() {
 	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
 		svr.wg.Add(1)
@@ -59,6 +93,7 @@ func (svr *server) startLoops() {
 
 func (svr *server) closeLoops() {
 	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		el.releaseLingering()
 		_ = el.poller.Close()
 		return true
 	})
@@ -75,10 +110,21 @@ func (svr *server) startReactors() {
 	})
 }
 
+// openPoller opens a poller set up with the polling options.
+func (svr *server) openPoller() (*netpoll.Poller, error) {
+	p, err := netpoll.OpenPoller()
+	if err != nil {
+		return nil, err
+	}
+	p.SetPollTimeout(svr.opts.PollTimeout)
+	p.SetEventsCap(svr.opts.PollEventsCap)
+	return p, nil
+}
+
 func (svr *server) activateLoops(numEventLoop int) error {
 	// Create loops locally and bind the listeners.
 	for i := 0; i < numEventLoop; i++ {
-		if p, err := netpoll.OpenPoller(); err == nil {
+		if p, err := svr.openPoller(); err == nil {
 			el := &eventloop{
 				idx:          i,
 				svr:          svr,
@@ -86,15 +132,28 @@ func (svr *server) activateLoops(numEventLoop int) error {
 				poller:       p,
 				packet:       make([]byte, 0x10000),
 				connections:  make(map[int]*conn),
+				connsByID:    make(map[uint64]*conn),
+				mailbox:      newMailbox(),
 				eventHandler: svr.eventHandler,
+				exited:       make(chan struct{}),
+			}
+			el.setPollerHooks()
+			if svr.opts.MassiveConnections && svr.ln.pconn == nil {
+				// Wake up one of the event-loops rather than all of them for every incoming connection.
+				_ = el.poller.AddReadExclusive(svr.ln.fd)
+			} else {
+				_ = el.poller.AddRead(svr.ln.fd)
 			}
-			_ = el.poller.AddRead(svr.ln.fd)
+			svr.addPacketRead(el)
 			svr.subLoopGroup.register(el)
 		} else {
 			return err
 		}
 	}
 	svr.subLoopGroupSize = svr.subLoopGroup.len()
+	if err := svr.assignCPUs(); err != nil {
+		return err
+	}
 	// Start loops in background
 	svr.startLoops()
 	return nil
@@ -102,7 +161,7 @@ func (svr *server) activateLoops(numEventLoop int) error {
 
 func (svr *server) activateReactors(numEventLoop int) error {
 	for i := 0; i < numEventLoop; i++ {
-		if p, err := netpoll.OpenPoller(); err == nil {
+		if p, err := svr.openPoller(); err == nil {
 			el := &eventloop{
 				idx:          i,
 				svr:          svr,
@@ -110,25 +169,46 @@ func (svr *server) activateReactors(numEventLoop int) error {
 				poller:       p,
 				packet:       make([]byte, 0x10000),
 				connections:  make(map[int]*conn),
+				connsByID:    make(map[uint64]*conn),
+				mailbox:      newMailbox(),
 				eventHandler: svr.eventHandler,
+				exited:       make(chan struct{}),
 			}
+			el.setPollerHooks()
+			svr.addPacketRead(el)
 			svr.subLoopGroup.register(el)
 		} else {
 			return err
 		}
 	}
 	svr.subLoopGroupSize = svr.subLoopGroup.len()
+	if err := svr.assignCPUs(); err != nil {
+		return err
+	}
+	if svr.ln.network != "memory" && svr.opts.AcceptMode == AcceptOnLoop {
+		// Event-loop 0 accepts connections for all the sub reactors, thus no main reactor is needed.
+		svr.acceptor = svr.subLoopGroup.index(0)
+		if err := svr.acceptor.poller.AddRead(svr.ln.fd); err != nil {
+			return err
+		}
+	}
 	// Start sub reactors.
 	svr.startReactors()
 
-	if p, err := netpoll.OpenPoller(); err == nil {
+	if svr.ln.network == "memory" || svr.acceptor != nil {
+		// In-memory connections are handed over to sub reactors by DialMemory, thus no main reactor is needed.
+		return nil
+	}
+
+	if p, err := svr.openPoller(); err == nil {
 		el := &eventloop{
 			idx:    -1,
 			poller: p,
 			svr:    svr,
+			exited: make(chan struct{}),
 		}
 		_ = el.poller.AddRead(svr.ln.fd)
-		svr.mainLoop = el
+		svr.mainLoop, svr.acceptor = el, el
 		// Start main reactor.
 		svr.wg.Add(1)
 		go func() {
@@ -141,8 +221,94 @@ func (svr *server) activateReactors(numEventLoop int) error {
 	return nil
 }
 
+func (svr *server) activateTestLoop() error {
+	p, err := svr.openPoller()
+	if err != nil {
+		return err
+	}
+	el := &eventloop{
+		idx:          0,
+		svr:          svr,
+		codec:        svr.codec,
+		poller:       p,
+		packet:       make([]byte, 0x10000),
+		connections:  make(map[int]*conn),
+		connsByID:    make(map[uint64]*conn),
+		mailbox:      newMailbox(),
+		eventHandler: svr.eventHandler,
+	}
+	el.setPollerHooks()
+	if svr.ln.network != "memory" {
+		_ = el.poller.AddRead(svr.ln.fd)
+		svr.addPacketRead(el)
+	}
+	svr.subLoopGroup.register(el)
+	svr.subLoopGroupSize = svr.subLoopGroup.len()
+	// No goroutine is started in test mode, the loop is driven by pollOnce.
+	return nil
+}
+
+// pollOnce runs one iteration of the only event-loop of a server running in test mode.
+func (svr *server) pollOnce(timeout time.Duration) error {
+	if svr.stopped {
+		return ErrServerShutdown
+	}
+	el := svr.testLoop()
+	err := el.poller.PollOnce(timeout, el.handleEvent)
+	if err == nil && svr.opts.Ticker && !svr.tickerIsStopped() {
+		if _, action := el.eventHandler.Tick(); action == Shutdown {
+			err = ErrServerShutdown
+		}
+	}
+	if err != nil {
+		svr.stopTestLoop()
+	}
+	return err
+}
+
+func (svr *server) stopTestLoop() {
+	el := svr.testLoop()
+	svr.stopped = true
+	if svr.ln.network == "memory" {
+		unregisterMemoryServer(svr.ln.addr, svr)
+	} else {
+		_ = el.poller.DeleteRead(svr.ln.fd)
+		svr.deletePacketRead(el)
+	}
+	if deadline := svr.shutdownFlushDeadline(); !deadline.IsZero() {
+		for _, c := range el.connections {
+			el.flushOnShutdown(c, deadline)
+		}
+	}
+	for _, c := range el.connections {
+		sniffErrorAndLog(el.loopCloseConn(c, nil))
+	}
+	el.counters.publish()
+	svr.closeLoops()
+	svr.ln.close()
+	svr.onShutdown()
+	close(svr.done)
+}
+
+// loopsResizable reports whether new connections are assigned to the event-loops by the load-balancing algorithm.
+func (svr *server) loopsResizable() bool {
+	return svr.ln.network == "memory" || !svr.loopsAccept()
+}
+
+// loopsAccept reports whether all the event-loops accept connections from the listener, or read datagrams from it,
+// rather than a main reactor accepting connections for them.
+func (svr *server) loopsAccept() bool {
+	return svr.opts.ReusePort || svr.opts.MassiveConnections || svr.ln.pconn != nil
+}
+
 func (svr *server) start(numEventLoop int) error {
-	if svr.opts.ReusePort || svr.ln.pconn != nil {
+	if svr.opts.TestMode {
+		return svr.activateTestLoop()
+	}
+	if svr.ln.network == "memory" {
+		return svr.activateReactors(numEventLoop)
+	}
+	if svr.loopsAccept() {
 		return svr.activateLoops(numEventLoop)
 	}
 	return svr.activateReactors(numEventLoop)
@@ -152,7 +318,14 @@ func (svr *server) stop() {
 	// Wait on a signal for shutdown
 	svr.waitForShutdown()
 
-	// Notify all loops to close by closing all listeners
+	if svr.ln.network == "memory" {
+		unregisterMemoryServer(svr.ln.addr, svr)
+	}
+
+	// Stop accepting new connections before anything else, so that no connection is opened from now on.
+	svr.stopAccepting()
+
+	// Stop reading from the connections by stopping all loops.
 	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
 		sniffErrorAndLog(el.poller.Trigger(func() error {
 			return ErrServerShutdown
@@ -160,21 +333,23 @@ func (svr *server) stop() {
 		return true
 	})
 
-	if svr.mainLoop != nil {
-		svr.ln.close()
-		sniffErrorAndLog(svr.mainLoop.poller.Trigger(func() error {
-			return ErrServerShutdown
-		}))
-	}
-
 	// Wait on all loops to complete reading events
 	svr.wg.Wait()
 
-	// Close loops and all outstanding connections
+	// Flush the outbound data within the deadline, then close loops and all outstanding connections.
+	if deadline := svr.shutdownFlushDeadline(); !deadline.IsZero() {
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			for _, c := range el.connections {
+				el.flushOnShutdown(c, deadline)
+			}
+			return true
+		})
+	}
 	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
 		for _, c := range el.connections {
 			sniffErrorAndLog(el.loopCloseConn(c, nil))
 		}
+		el.counters.publish()
 		return true
 	})
 	svr.closeLoops()
@@ -184,20 +359,118 @@ func (svr *server) stop() {
 	}
 }
 
-func serve(eventHandler EventHandler, listener *listener, options *Options) error {
-	// Figure out the correct number of loops/goroutines to use.
-	numEventLoop := 1
-	if options.Multicore {
-		numEventLoop = runtime.NumCPU()
+// stopAccepting stops accepting new connections and waits until no connection is being accepted.
+func (svr *server) stopAccepting() {
+	if svr.ln.udp != nil {
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			el.runSync(func() {
+				svr.deletePacketRead(el)
+			})
+			return true
+		})
 	}
-	if options.NumEventLoop > 0 {
-		numEventLoop = options.NumEventLoop
+	switch {
+	case svr.mainLoop != nil:
+		sniffErrorAndLog(svr.mainLoop.poller.Trigger(func() error {
+			return ErrServerShutdown
+		}))
+		<-svr.mainLoop.exited
+		// The connections accepted by the main reactor are handed over to the sub reactors by the jobs that run
+		// before the shutdown jobs triggered later on, thus all of them are opened.
+		svr.ln.close()
+	case svr.acceptor != nil:
+		// Event-loop 0 accepts connections for the others, the connections it has accepted so far are handed over
+		// to the others by the jobs that run before the shutdown jobs triggered later on, just like above.
+		svr.acceptor.runSync(func() {
+			_ = svr.acceptor.poller.DeleteRead(svr.ln.fd)
+		})
+		svr.ln.close()
+	case svr.ln.network != "memory":
+		// All the loops accept connections from the shared listener, or read datagrams from it.
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			el.runSync(func() {
+				_ = el.poller.DeleteRead(svr.ln.fd)
+			})
+			return true
+		})
 	}
+	// The connections still being enriched are handed over to the loops by the jobs that run before the shutdown
+	// jobs as well, or closed.
+	svr.enrichWG.Wait()
+}
 
+// watchListener starts or stops watching the listener on the event-loops accepting connections from it.
+func (svr *server) watchListener(watch bool) {
+	fd := svr.ln.fd
+	toggle := func(el *eventloop) {
+		switch {
+		case !watch:
+			_ = el.poller.DeleteRead(fd)
+		case svr.opts.MassiveConnections:
+			_ = el.poller.AddReadExclusive(fd)
+		default:
+			_ = el.poller.AddRead(fd)
+		}
+	}
+	switch {
+	case svr.opts.TestMode:
+		// The event-loop only runs within PollOnce.
+		toggle(svr.testLoop())
+	case svr.acceptor != nil:
+		svr.acceptor.runSync(func() {
+			toggle(svr.acceptor)
+		})
+	default:
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			el.runSync(func() {
+				toggle(el)
+			})
+			return true
+		})
+	}
+}
+
+// addPacketRead makes the sub event-loop read the datagrams of the "tcp+udp" network, which are read by all the sub
+// event-loops just like those of the "udp" network, while the TCP connections are accepted as usual.
+func (svr *server) addPacketRead(el *eventloop) {
+	if u := svr.ln.udp; u != nil {
+		_ = el.poller.AddRead(u.fd)
+	}
+}
+
+func (svr *server) deletePacketRead(el *eventloop) {
+	if u := svr.ln.udp; u != nil {
+		_ = el.poller.DeleteRead(u.fd)
+	}
+}
+
+func newServer(eventHandler EventHandler, listener *listener, options *Options) *server {
 	svr := new(server)
 	svr.opts = options
 	svr.eventHandler = eventHandler
+	svr.trafficHandler, _ = eventHandler.(TrafficHandler)
+	svr.batchHandler, _ = eventHandler.(BatchHandler)
+	svr.userEventHandler, _ = eventHandler.(UserEventHandler)
+	svr.acceptHandler, _ = eventHandler.(AcceptHandler)
+	svr.overloadHandler, _ = eventHandler.(OverloadHandler)
+	svr.handshakeHandler, _ = eventHandler.(HandshakeHandler)
+	svr.urgentHandler, _ = eventHandler.(UrgentDataHandler)
+	svr.decodeErrHandler, _ = eventHandler.(DecodeErrorHandler)
+	svr.outboundHandler, _ = eventHandler.(OutboundFullHandler)
+	svr.stallHandler, _ = eventHandler.(WriteStallHandler)
+	svr.loopErrorHandler, _ = eventHandler.(LoopErrorHandler)
+	svr.shutdownHandler, _ = eventHandler.(ShutdownHandler)
+	svr.reloadHandler, _ = eventHandler.(ReloadHandler)
+	svr.slowReactHandler, _ = eventHandler.(SlowReactHandler)
+	svr.watchdogHandler, _ = eventHandler.(WatchdogHandler)
+	svr.acceptLimit = newTokenBucket(options.AcceptRateLimit, options.AcceptRateBurst)
+	svr.overload = newAcceptGuard(options.AcceptOverload)
+	svr.fdHandler, _ = eventHandler.(FileDescriptorHandler)
 	svr.ln = listener
+	svr.transport = sysTransport{}
+	if listener.transport != nil {
+		svr.transport = listener.transport
+	}
 
 	switch options.LB {
 	case RoundRobin:
@@ -208,8 +481,10 @@ func serve(eventHandler EventHandler, listener *listener, options *Options) erro
 		svr.subLoopGroup = new(sourceAddrHashEventLoopGroup)
 	}
 
-	svr.cond = sync.NewCond(&sync.Mutex{})
+	svr.shutdown = make(chan struct{})
+	svr.done = make(chan struct{})
 	svr.ticktock = make(chan time.Duration, 1)
+	svr.tickerStart = make(chan struct{}, 1)
 	svr.logger = func() Logger {
 		if options.Logger == nil {
 			return defaultLogger
@@ -222,27 +497,61 @@ func serve(eventHandler EventHandler, listener *listener, options *Options) erro
 		}
 		return options.Codec
 	}()
-
-	server := Server{
-		svr:          svr,
-		Multicore:    options.Multicore,
-		Addr:         listener.lnaddr,
-		NumEventLoop: numEventLoop,
-		ReusePort:    options.ReusePort,
-		TCPKeepAlive: options.TCPKeepAlive,
+	if svr.trafficHandler == nil {
+		svr.bufferProvider, _ = svr.codec.(ReadBufferProvider)
 	}
+	return svr
+}
+
+// serve fires OnInitComplete and starts the event-loops, the server is stopped in the background
+// after the shutdown is signaled.
+func (svr *server) serve(server Server) error {
 	switch svr.eventHandler.OnInitComplete(server) {
 	case None:
 	case Shutdown:
+		svr.ln.close()
+		close(svr.done)
 		return nil
 	}
 
-	if err := svr.start(numEventLoop); err != nil {
+	listener := svr.ln
+	if listener.network == "memory" {
+		// Hold dialMu until all loops are started, so that DialMemory won't see a server without loops.
+		svr.dialMu.Lock()
+		if err := registerMemoryServer(listener.addr, svr); err != nil {
+			svr.dialMu.Unlock()
+			listener.close()
+			close(svr.done)
+			return err
+		}
+	}
+	err := svr.start(server.NumEventLoop)
+	if listener.network == "memory" {
+		svr.dialMu.Unlock()
+	}
+	if err != nil {
+		unregisterMemoryServer(listener.addr, svr)
 		svr.closeLoops()
+		listener.close()
+		close(svr.done)
 		svr.logger.Printf("gnet server is stoping with error: %v\n", err)
 		return err
 	}
-	defer svr.stop()
-
+	svr.startConnScan()
+	svr.startSlowReactSampler()
+	svr.startBufferReaper()
+	svr.startExpvar()
+	svr.startLoopUtilization()
+	if svr.opts.TestMode {
+		return nil
+	}
+	svr.startSignals(server)
+	svr.startWatchdog()
+	go func() {
+		svr.stop()
+		listener.close()
+		svr.onShutdown()
+		close(svr.done)
+	}()
 	return nil
 }
@@ -9,7 +9,6 @@ package gnet
 
 import (
 	"errors"
-	"runtime"
 	"sync"
 	"time"
 )
@@ -26,7 +25,9 @@ var (
 
 type server struct {
 	ln               *listener          // all the listeners
-	cond             *sync.Cond         // shutdown signaler
+	shutdown         chan struct{}      // closed by signalShutdown
+	started          int32              // whether the server has been started
+	done             chan struct{}      // closed after the server has been stopped
 	opts             *Options           // options with server
 	serr             error              // signal error
 	once             sync.Once          // make sure only signalShutdown once
@@ -34,35 +35,72 @@ type server struct {
 	loopWG           sync.WaitGroup     // loop close WaitGroup
 	logger           Logger             // customized logger for logging info
 	ticktock         chan time.Duration // ticker channel
+	tickerStopped    int32              // 1 if the ticker is stopped by StopTicker
+	tickerStart      chan struct{}      // wakes the ticker stopped by StopTicker up
+	tickers          namedTickers       // tickers added by AddTicker
 	listenerWG       sync.WaitGroup     // listener close WaitGroup
 	eventHandler     EventHandler       // user eventHandler
+	trafficHandler   TrafficHandler     // optional OnTraffic implementation of eventHandler
+	batchHandler     BatchHandler       // optional ReactBatch implementation of eventHandler
+	acceptHandler    AcceptHandler      // optional OnAccepted implementation of eventHandler
+	userEventHandler UserEventHandler   // optional OnUserEvent implementation of eventHandler
+	loopErrorHandler LoopErrorHandler   // optional OnLoopError implementation of eventHandler
 	subLoopGroup     IEventLoopGroup    // loops for handling events
 	subLoopGroupSize int                // number of loops
+	dialMu           sync.Mutex         // serializes the connections assigned by DialMemory and ListenPassive
+	stopped          bool               // whether the server running in test mode has been shut down
+	faultSeq         int32              // sequence number of the connections subject to fault injection
+	acceptLimit      *tokenBucket       // accept rate limit, nil if it is disabled
+	overload         *acceptGuard       // accept overload protection, nil if it is disabled
+	acceptPause      acceptPause        // state of pausing accepting via PauseAccept
+	labels           labelRegistry      // counters of the labels of the connections, see Conn.SetLabel
+	overloadHandler  OverloadHandler    // optional OnOverload implementation of eventHandler
+	handshakeHandler HandshakeHandler   // optional OnHandshake implementation of eventHandler
+	decodeErrHandler DecodeErrorHandler // optional OnDecodeError implementation of eventHandler
+	shutdownHandler  ShutdownHandler    // optional OnShutdown implementation of eventHandler
+	slowReactHandler SlowReactHandler   // optional OnSlowReact implementation of eventHandler
+	watchdogHandler  WatchdogHandler    // optional OnLoopBlocked implementation of eventHandler
+	reloadHandler    ReloadHandler      // optional OnReload implementation of eventHandler
+	pendingAccepts   int32              // number of the connections accepted but not opened yet
+	enrichWG         sync.WaitGroup     // enrichments in flight, see WithEnrichment
 }
 
 // waitForShutdown waits for a signal to shutdown.
 func (svr *server) waitForShutdown() error {
-	svr.cond.L.Lock()
-	svr.cond.Wait()
-	err := svr.serr
-	svr.cond.L.Unlock()
-	return err
+	<-svr.shutdown
+	return svr.serr
 }
 
 // signalShutdown signals a shutdown an begins server closing.
 func (svr *server) signalShutdown(err error) {
 	svr.once.Do(func() {
-		svr.cond.L.Lock()
 		svr.serr = err
-		svr.cond.Signal()
-		svr.cond.L.Unlock()
+		close(svr.shutdown)
 	})
 }
 
+// requestShutdown signals a shutdown from outside the event-loops.
+func (svr *server) requestShutdown() {
+	svr.signalShutdown(ErrServerShutdown)
+}
+
+// loopsResizable reports whether new connections are assigned to the event-loops by the load-balancing algorithm.
+func (svr *server) loopsResizable() bool {
+	return true
+}
+
 func (svr *server) startListener() {
+	svr.runListener(svr.ln)
+	if svr.ln.udp != nil {
+		// The datagrams of the "tcp+udp" network are read by a goroutine of their own.
+		svr.runListener(svr.ln.udp)
+	}
+}
+
+func (svr *server) runListener(ln *listener) {
 	svr.listenerWG.Add(1)
 	go func() {
-		svr.listenerRun()
+		svr.listenerRun(ln)
 		svr.listenerWG.Done()
 	}()
 }
@@ -75,6 +113,8 @@ func (svr *server) startLoops(numEventLoop int) {
 			svr:          svr,
 			codec:        svr.codec,
 			connections:  make(map[*stdConn]struct{}),
+			connsByID:    make(map[uint64]*stdConn),
+			mailbox:      newMailbox(),
 			eventHandler: svr.eventHandler,
 		}
 		svr.subLoopGroup.register(el)
@@ -87,15 +127,78 @@ func (svr *server) startLoops(numEventLoop int) {
 	})
 }
 
+// pollOnce handles the pending commands of the only event-loop of a server running in test mode.
+func (svr *server) pollOnce(timeout time.Duration) (err error) {
+	if svr.stopped {
+		return ErrServerShutdown
+	}
+	el := svr.testLoop()
+	select {
+	case v := <-el.ch:
+		err = el.handleCommand(v)
+	default:
+		if timeout != 0 {
+			var timer <-chan time.Time
+			if timeout > 0 {
+				t := time.NewTimer(timeout)
+				defer t.Stop()
+				timer = t.C
+			}
+			select {
+			case v := <-el.ch:
+				err = el.handleCommand(v)
+			case <-timer:
+			}
+		}
+	}
+	// Handle the commands that are already pending, but not the ones arriving meanwhile.
+	for n := len(el.ch); err == nil && n > 0; n-- {
+		err = el.handleCommand(<-el.ch)
+	}
+	el.flushWriteBatch()
+	el.counters.endBatch()
+	if err == nil && svr.opts.Ticker && !svr.tickerIsStopped() {
+		if _, action := el.eventHandler.Tick(); action == Shutdown {
+			err = ErrServerShutdown
+		}
+	}
+	if err != nil {
+		svr.stopTestLoop()
+	}
+	return
+}
+
+func (svr *server) stopTestLoop() {
+	el := svr.testLoop()
+	svr.stopped = true
+	if svr.ln.network == "memory" {
+		unregisterMemoryServer(svr.ln.addr, svr)
+	}
+	svr.ln.close()
+	svr.listenerWG.Wait()
+	// The connections still being enriched are handed over to the loops ahead of the shutdown, or closed.
+	svr.enrichWG.Wait()
+	el.ch <- errCloseConns
+	el.loopEgress()
+	svr.onShutdown()
+	close(svr.done)
+}
+
 func (svr *server) stop() {
 	// Wait on a signal for shutdown.
 	svr.logger.Printf("server is being shutdown with err: %v\n", svr.waitForShutdown())
 
-	// Close listener.
+	if svr.ln.network == "memory" {
+		unregisterMemoryServer(svr.ln.addr, svr)
+	}
+
+	// Close listener to stop accepting new connections before anything else.
 	svr.ln.close()
 	svr.listenerWG.Wait()
+	// The connections still being enriched are handed over to the loops ahead of the shutdown, or closed.
+	svr.enrichWG.Wait()
 
-	// Notify all loops to close.
+	// Notify all loops to close, which stops handling the inbound data.
 	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
 		el.ch <- errClosing
 		return true
@@ -104,7 +207,7 @@ func (svr *server) stop() {
 	// Wait on all loops to close.
 	svr.loopWG.Wait()
 
-	// Close all connections.
+	// Flush the outbound data within the deadline and close all connections.
 	svr.loopWG.Add(svr.subLoopGroupSize)
 	svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
 		el.ch <- errCloseConns
@@ -113,19 +216,29 @@ func (svr *server) stop() {
 	svr.loopWG.Wait()
 }
 
-func serve(eventHandler EventHandler, listener *listener, options *Options) (err error) {
-	// Figure out the correct number of loops/goroutines to use.
-	numEventLoop := 1
-	if options.Multicore {
-		numEventLoop = runtime.NumCPU()
-	}
-	if options.NumEventLoop > 0 {
-		numEventLoop = options.NumEventLoop
-	}
+// watchListener is a no-op on Windows, where the goroutine accepting connections waits while accepting is paused.
+func (svr *server) watchListener(watch bool) {
+}
 
+func newServer(eventHandler EventHandler, listener *listener, options *Options) *server {
 	svr := new(server)
 	svr.opts = options
+	svr.acceptPause.resume = make(chan struct{}, 1)
 	svr.eventHandler = eventHandler
+	svr.trafficHandler, _ = eventHandler.(TrafficHandler)
+	svr.batchHandler, _ = eventHandler.(BatchHandler)
+	svr.userEventHandler, _ = eventHandler.(UserEventHandler)
+	svr.acceptHandler, _ = eventHandler.(AcceptHandler)
+	svr.overloadHandler, _ = eventHandler.(OverloadHandler)
+	svr.handshakeHandler, _ = eventHandler.(HandshakeHandler)
+	svr.decodeErrHandler, _ = eventHandler.(DecodeErrorHandler)
+	svr.loopErrorHandler, _ = eventHandler.(LoopErrorHandler)
+	svr.shutdownHandler, _ = eventHandler.(ShutdownHandler)
+	svr.reloadHandler, _ = eventHandler.(ReloadHandler)
+	svr.slowReactHandler, _ = eventHandler.(SlowReactHandler)
+	svr.watchdogHandler, _ = eventHandler.(WatchdogHandler)
+	svr.acceptLimit = newTokenBucket(options.AcceptRateLimit, options.AcceptRateBurst)
+	svr.overload = newAcceptGuard(options.AcceptOverload)
 	svr.ln = listener
 
 	switch options.LB {
@@ -138,7 +251,9 @@ func serve(eventHandler EventHandler, listener *listener, options *Options) (err
 	}
 
 	svr.ticktock = make(chan time.Duration, 1)
-	svr.cond = sync.NewCond(&sync.Mutex{})
+	svr.tickerStart = make(chan struct{}, 1)
+	svr.shutdown = make(chan struct{})
+	svr.done = make(chan struct{})
 	svr.logger = func() Logger {
 		if options.Logger == nil {
 			return defaultLogger
@@ -151,26 +266,69 @@ func serve(eventHandler EventHandler, listener *listener, options *Options) (err
 		}
 		return options.Codec
 	}()
+	return svr
+}
 
-	server := Server{
-		svr:          svr,
-		Multicore:    options.Multicore,
-		Addr:         listener.lnaddr,
-		NumEventLoop: numEventLoop,
-		ReusePort:    options.ReusePort,
-		TCPKeepAlive: options.TCPKeepAlive,
-	}
+// serve fires OnInitComplete and starts the event-loops along with the listener, the server is stopped
+// in the background after the shutdown is signaled.
+func (svr *server) serve(server Server) (err error) {
 	switch svr.eventHandler.OnInitComplete(server) {
 	case None:
 	case Shutdown:
+		svr.ln.close()
+		close(svr.done)
 		return
 	}
 
-	// Start all loops.
-	svr.startLoops(numEventLoop)
-	// Start listener.
-	svr.startListener()
-	defer svr.stop()
+	listener, options := svr.ln, svr.opts
+	if listener.network == "memory" {
+		// Hold dialMu until all loops are started, so that DialMemory won't see a server without loops.
+		svr.dialMu.Lock()
+		if err = registerMemoryServer(listener.addr, svr); err != nil {
+			svr.dialMu.Unlock()
+			listener.close()
+			close(svr.done)
+			return
+		}
+	}
 
+	// Start all loops, the only loop is driven by pollOnce in test mode.
+	if options.TestMode {
+		el := &eventloop{
+			ch:           make(chan interface{}, commandBufferSize),
+			svr:          svr,
+			codec:        svr.codec,
+			connections:  make(map[*stdConn]struct{}),
+			connsByID:    make(map[uint64]*stdConn),
+			mailbox:      newMailbox(),
+			eventHandler: svr.eventHandler,
+		}
+		svr.subLoopGroup.register(el)
+		svr.subLoopGroupSize = svr.subLoopGroup.len()
+	} else {
+		svr.startLoops(server.NumEventLoop)
+	}
+	// Start listener.
+	if listener.network == "memory" {
+		svr.dialMu.Unlock()
+	} else {
+		svr.startListener()
+	}
+	svr.startConnScan()
+	svr.startSlowReactSampler()
+	svr.startBufferReaper()
+	svr.startExpvar()
+	svr.startLoopUtilization()
+	if options.TestMode {
+		return
+	}
+	svr.startSignals(server)
+	svr.startWatchdog()
+	go func() {
+		svr.stop()
+		listener.close()
+		svr.onShutdown()
+		close(svr.done)
+	}()
 	return
 }
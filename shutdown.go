@@ -0,0 +1,33 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import "time"
+
+// DefaultShutdownFlushTimeout is the maximum duration of flushing the outbound data of the connections on shutdown
+// if ShutdownFlushTimeout is not set.
+const DefaultShutdownFlushTimeout = 5 * time.Second
+
+// shutdownFlushDeadline returns the deadline of flushing the outbound data of the connections on shutdown,
+// which is the zero time if flushing is skipped.
+func (svr *server) shutdownFlushDeadline() time.Time {
+	if svr.opts.SkipShutdownFlush {
+		return time.Time{}
+	}
+	timeout := svr.opts.ShutdownFlushTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownFlushTimeout
+	}
+	return time.Now().Add(timeout)
+}
+
+// onShutdown fires OnShutdown as the last event of the server.
+func (svr *server) onShutdown() {
+	if h := svr.shutdownHandler; h != nil {
+		h.OnShutdown()
+	}
+}
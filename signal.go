@@ -0,0 +1,49 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"os"
+	"os/signal"
+)
+
+// containsSignal reports whether sigs contains sig.
+func containsSignal(sigs []os.Signal, sig os.Signal) bool {
+	for _, s := range sigs {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// startSignals relays the signals set up by WithGracefulSignals and WithReloadSignals to the server until
+// it is shut down.
+func (svr *server) startSignals(server Server) {
+	graceful, reload := svr.opts.GracefulSignals, svr.opts.ReloadSignals
+	if len(graceful) == 0 && len(reload) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, append(append([]os.Signal(nil), graceful...), reload...)...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case sig := <-ch:
+				if containsSignal(graceful, sig) {
+					svr.logger.Printf("gnet server is shutting down on signal: %v\n", sig)
+					svr.requestShutdown()
+					return
+				}
+				svr.reloadHandler.OnReload(server, sig)
+			case <-svr.shutdown:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,303 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultSIPMaxHeaderSize is the maximum size of the start line and the headers of a message decoded by SIPCodec
+	// if SIPCodec.MaxHeaderSize is not set.
+	DefaultSIPMaxHeaderSize = 16 << 10
+
+	// DefaultSIPMaxBodySize is the maximum size of the body of a message decoded by SIPCodec if
+	// SIPCodec.MaxBodySize is not set.
+	DefaultSIPMaxBodySize = 64 << 10
+
+	rtspInterleavedMarker     = '$'
+	rtspInterleavedHeaderSize = 4
+)
+
+// sipCompactHeaders maps the compact forms of the SIP header names to their full names, see RFC 3261 section 7.3.3.
+var sipCompactHeaders = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+}
+
+// SIPHeader is a header field of a SIP or RTSP message.
+type SIPHeader struct {
+	// Name is the name of the header as is, but for the compact forms of SIP, which are expanded to the full names,
+	// e.g. "Via" for "v".
+	Name string
+
+	// Value is the value of the header with the surrounding spaces trimmed and the folded lines joined by a space.
+	Value string
+}
+
+// SIPMessage is a SIP or RTSP message parsed by ParseSIPMessage, the two protocols share the syntax of HTTP/1.1
+// but carry their own methods, e.g. INVITE for SIP and DESCRIBE for RTSP.
+type SIPMessage struct {
+	// Method is the method of a request, e.g. "INVITE" or "SETUP", it is empty for a response.
+	Method string
+
+	// URI is the Request-URI of a request, e.g. "sip:bob@example.com" or "rtsp://example.com/media".
+	URI string
+
+	// Proto is the protocol version, e.g. "SIP/2.0" or "RTSP/1.0".
+	Proto string
+
+	// StatusCode is the status code of a response, e.g. 200, it is 0 for a request.
+	StatusCode int
+
+	// Reason is the reason phrase of a response, e.g. "OK".
+	Reason string
+
+	// Headers are the header fields in the order of the message, which matters for the repeated ones such as Via.
+	Headers []SIPHeader
+
+	// Body is the body of the message, e.g. an SDP session description, which is a slice of the message.
+	Body []byte
+}
+
+// IsRequest reports whether the message is a request rather than a response.
+func (m *SIPMessage) IsRequest() bool {
+	return m.Method != ""
+}
+
+// Get returns the value of the first header with the given name, which is case-insensitive and may be a compact
+// form, e.g. "Call-ID" or "i", or an empty string if there is no such header.
+func (m *SIPMessage) Get(name string) string {
+	name = sipHeaderName(name)
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all the headers with the given name in order, see Get, the values of a header may
+// also be joined by commas within one header though, e.g. those of Via.
+func (m *SIPMessage) Values(name string) (values []string) {
+	name = sipHeaderName(name)
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return
+}
+
+// sipHeaderName expands the compact form of a SIP header name.
+func sipHeaderName(name string) string {
+	if len(name) == 1 {
+		if full, ok := sipCompactHeaders[strings.ToLower(name)]; ok {
+			return full
+		}
+	}
+	return name
+}
+
+// ParseSIPMessage parses the SIP or RTSP message, e.g. a datagram passed to React on UDP or a frame decoded by
+// SIPCodec, skipping the CRLFs before it and unfolding the headers continued on the lines starting with spaces or
+// tabs. The body is the rest of the message after the headers, cut at Content-Length if there is the header.
+// It fails with ErrInvalidSIPMessage if the start line or a header is malformed, or the body is shorter than
+// Content-Length, e.g. when a datagram is truncated.
+func ParseSIPMessage(msg []byte) (m SIPMessage, err error) {
+	for len(msg) > 0 && (msg[0] == '\r' || msg[0] == '\n') {
+		msg = msg[1:]
+	}
+	line, msg := nextSIPLine(msg)
+	parts := strings.SplitN(string(line), " ", 3)
+	if len(parts) < 3 {
+		return m, ErrInvalidSIPMessage
+	}
+	if isSIPProto(parts[0]) {
+		m.Proto, m.Reason = parts[0], parts[2]
+		if len(parts[1]) != 3 {
+			return m, ErrInvalidSIPMessage
+		}
+		if m.StatusCode, err = strconv.Atoi(parts[1]); err != nil || m.StatusCode < 100 {
+			return m, ErrInvalidSIPMessage
+		}
+	} else {
+		m.Method, m.URI, m.Proto = parts[0], parts[1], parts[2]
+		if m.Method == "" || m.URI == "" || !isSIPProto(m.Proto) {
+			return m, ErrInvalidSIPMessage
+		}
+	}
+
+	for len(msg) > 0 {
+		if line, msg = nextSIPLine(msg); len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(m.Headers) == 0 {
+				return m, ErrInvalidSIPMessage
+			}
+			h := &m.Headers[len(m.Headers)-1]
+			h.Value += " " + string(bytes.TrimSpace(line))
+			continue
+		}
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			return m, ErrInvalidSIPMessage
+		}
+		m.Headers = append(m.Headers, SIPHeader{
+			Name:  sipHeaderName(string(bytes.TrimSpace(line[:i]))),
+			Value: string(bytes.TrimSpace(line[i+1:])),
+		})
+	}
+
+	if cl := m.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > len(msg) {
+			return m, ErrInvalidSIPMessage
+		}
+		msg = msg[:n]
+	}
+	if len(msg) > 0 {
+		m.Body = msg
+	}
+	return m, nil
+}
+
+// nextSIPLine returns the line without its CRLF or LF and the rest after it.
+func nextSIPLine(msg []byte) (line, rest []byte) {
+	i := bytes.IndexByte(msg, '\n')
+	if i < 0 {
+		return bytes.TrimSuffix(msg, []byte{'\r'}), nil
+	}
+	return bytes.TrimSuffix(msg[:i], []byte{'\r'}), msg[i+1:]
+}
+
+func isSIPProto(proto string) bool {
+	return strings.HasPrefix(proto, "SIP/") || strings.HasPrefix(proto, "RTSP/")
+}
+
+// ParseRTSPInterleaved parses the interleaved binary frame of RTSP over TCP, which starts with a dollar sign followed
+// by the channel and the size of the payload, see RFC 2326 section 10.12, e.g. an RTP or RTCP packet of the channel
+// negotiated by SETUP. The payload is a slice of the frame, and ok is false if the frame is not an interleaved frame.
+func ParseRTSPInterleaved(frame []byte) (channel uint8, payload []byte, ok bool) {
+	if len(frame) < rtspInterleavedHeaderSize || frame[0] != rtspInterleavedMarker ||
+		int(binary.BigEndian.Uint16(frame[2:])) != len(frame)-rtspInterleavedHeaderSize {
+		return 0, nil, false
+	}
+	return frame[1], frame[rtspInterleavedHeaderSize:], true
+}
+
+// SIPCodec encodes/decodes the SIP and RTSP messages transmitted over stream connections, which are framed by
+// the empty line ending the headers and the Content-Length header, the body is empty if there is no Content-Length.
+// Decode passes every message to React as is, use ParseSIPMessage to parse it, and skips the CRLFs between
+// the messages, e.g. the keep-alive pings of RFC 5626. The interleaved binary frames of RTSP are passed to React as
+// they are as well, use ParseRTSPInterleaved to tell them apart. Since the stream can't be resynchronized once
+// the framing is lost, Decode discards all the buffered data and fails with ErrInvalidSIPMessage if the headers
+// exceed MaxHeaderSize, Content-Length is malformed or exceeds MaxBodySize, which closes the connection unless
+// the event handler keeps it via DecodeErrorHandler, in which case Decode goes on with the data arriving next.
+// Encode passes the messages through.
+//
+// The messages over UDP don't go through codecs, so the servers serving UDP use ParseSIPMessage on the datagrams
+// passed to React directly, every datagram carries one message.
+type SIPCodec struct {
+	// MaxHeaderSize is the maximum size of the start line and the headers of a message, DefaultSIPMaxHeaderSize if
+	// it is not set.
+	MaxHeaderSize int
+
+	// MaxBodySize is the maximum size of the body of a message, DefaultSIPMaxBodySize if it is not set.
+	MaxBodySize int
+}
+
+// Encode ...
+func (cc *SIPCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+// Decode ...
+func (cc *SIPCodec) Decode(c Conn) ([]byte, error) {
+	maxHeader, maxBody := cc.MaxHeaderSize, cc.MaxBodySize
+	if maxHeader <= 0 {
+		maxHeader = DefaultSIPMaxHeaderSize
+	}
+	if maxBody <= 0 {
+		maxBody = DefaultSIPMaxBodySize
+	}
+	for {
+		cur := c.Cursor()
+		if cur.Len() == 0 {
+			return nil, ErrUnexpectedEOF
+		}
+		switch b, _ := cur.ReadByte(); b {
+		case '\r', '\n':
+			c.ShiftN(1)
+			continue
+		case rtspInterleavedMarker:
+			cur.Rewind(0)
+			header, err := cur.ReadBytes(rtspInterleavedHeaderSize)
+			if err != nil {
+				return nil, ErrUnexpectedEOF
+			}
+			buf, err := c.Next(rtspInterleavedHeaderSize + int(binary.BigEndian.Uint16(header[2:])))
+			if err != nil {
+				return nil, ErrUnexpectedEOF
+			}
+			return buf, nil
+		}
+
+		cur.Rewind(0)
+		size, bodySize := 0, 0
+		for {
+			i := cur.indexByte('\n')
+			if i < 0 || size+i+1 > maxHeader {
+				if size+cur.Len() > maxHeader {
+					c.ResetBuffer()
+					return nil, ErrInvalidSIPMessage
+				}
+				return nil, ErrUnexpectedEOF
+			}
+			line, _ := cur.ReadBytes(i + 1)
+			size += i + 1
+			line = bytes.TrimRight(line, "\r\n")
+			if len(line) == 0 {
+				break
+			}
+			j := bytes.IndexByte(line, ':')
+			if j <= 0 {
+				continue
+			}
+			if name := bytes.TrimSpace(line[:j]); !bytes.EqualFold(name, []byte("Content-Length")) &&
+				!bytes.EqualFold(name, []byte("l")) {
+				continue
+			}
+			n, err := strconv.Atoi(string(bytes.TrimSpace(line[j+1:])))
+			if err != nil || n < 0 || n > maxBody {
+				c.ResetBuffer()
+				return nil, ErrInvalidSIPMessage
+			}
+			bodySize = n
+		}
+		buf, err := c.Next(size + bodySize)
+		if err != nil {
+			return nil, ErrUnexpectedEOF
+		}
+		return buf, nil
+	}
+}
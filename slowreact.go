@@ -0,0 +1,172 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// maxGoroutineDump is the maximum size of the dump of the stacks of all the goroutines.
+const maxGoroutineDump = 4 << 20
+
+// slowReactState is the state of the slow React detection within an event-loop. It is guarded by a mutex rather
+// than accessed atomically since it is not guaranteed to be 64-bit aligned within eventloop.
+type slowReactState struct {
+	gid []byte // header of the stack of the goroutine running the event-loop, e.g. "goroutine 42 ["
+
+	mu         sync.Mutex
+	start      int64  // start of the React in progress in nanoseconds, zero if there is none
+	stack      []byte // stack captured by the sampler while the React started at stackStart was running
+	stackStart int64
+}
+
+// SlowReacts returns the number of the invocations of React, ReactBatch and OnTraffic that took longer than
+// SlowReactThreshold. The event-loops publish it in batches, see loopCounters.
+func (s Server) SlowReacts() (n uint64) {
+	s.svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		n += el.counters.loadSlowReacts()
+		return true
+	})
+	return
+}
+
+// beginReact marks the start of an invocation of the event handler on the inbound data of c, it returns the zero
+// time if the slow React detection is disabled.
+func (el *eventloop) beginReact(c Conn) time.Time {
+	if el.svr.opts.WatchdogTimeout > 0 {
+		el.watchdog.track(c.ID())
+	}
+	if el.svr.opts.SlowReactThreshold <= 0 {
+		return time.Time{}
+	}
+	now := time.Now()
+	if el.svr.opts.SlowReactStack {
+		s := &el.slowReact
+		s.mu.Lock()
+		if s.gid == nil {
+			s.gid = goroutineHeader()
+		}
+		s.start = now.UnixNano()
+		s.mu.Unlock()
+	}
+	return now
+}
+
+// endReact marks the end of the invocation of the event handler started at start, and reports it if it is slow.
+func (el *eventloop) endReact(c Conn, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	d := time.Since(start)
+	var stack []byte
+	if el.svr.opts.SlowReactStack {
+		s := &el.slowReact
+		s.mu.Lock()
+		s.start = 0
+		if s.stackStart == start.UnixNano() {
+			stack = s.stack
+		}
+		s.stack, s.stackStart = nil, 0
+		s.mu.Unlock()
+	}
+	if d < el.svr.opts.SlowReactThreshold {
+		return
+	}
+	el.counters.addSlowReact()
+	if h := el.svr.slowReactHandler; h != nil {
+		h.OnSlowReact(c, d, stack)
+		return
+	}
+	el.svr.logger.Printf("event-loop:%d spent %v handling the inbound data of connection %d from %v\n%s",
+		el.idx, d, c.ID(), c.RemoteAddr(), stack)
+}
+
+// sampleReact captures the stack of the event-loop if the React in progress has been running for longer than
+// threshold, it is invoked by the sampler rather than the event-loop.
+func (el *eventloop) sampleReact(now time.Time, threshold time.Duration) {
+	s := &el.slowReact
+	s.mu.Lock()
+	start, gid := s.start, s.gid
+	captured := s.stackStart == start
+	s.mu.Unlock()
+	if start == 0 || captured || now.UnixNano()-start < int64(threshold) {
+		return
+	}
+	stack := goroutineStack(gid)
+	s.mu.Lock()
+	// Drop the stack if the React has returned meanwhile.
+	if s.start == start {
+		s.stack, s.stackStart = stack, start
+	}
+	s.mu.Unlock()
+}
+
+// startSlowReactSampler starts the sampler capturing the stacks of the slow React invocations, if it is enabled.
+func (svr *server) startSlowReactSampler() {
+	threshold := svr.opts.SlowReactThreshold
+	if threshold <= 0 || !svr.opts.SlowReactStack {
+		return
+	}
+	period := threshold / 2
+	var sample func()
+	sample = func() {
+		select {
+		case <-svr.shutdown:
+			return
+		default:
+		}
+		now := time.Now()
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			el.sampleReact(now, threshold)
+			return true
+		})
+		time.AfterFunc(period, sample)
+	}
+	time.AfterFunc(period, sample)
+}
+
+// goroutineHeader returns the header of the stack of the calling goroutine, e.g. "goroutine 42 [".
+func goroutineHeader() []byte {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	if i := bytes.IndexByte(buf, '['); i > 0 {
+		return buf[:i+1]
+	}
+	return nil
+}
+
+// goroutineStack returns the stack of the goroutine with the given header.
+func goroutineStack(header []byte) []byte {
+	if len(header) == 0 {
+		return nil
+	}
+	buf := goroutineDump()
+	i := bytes.Index(buf, header)
+	if i < 0 {
+		return nil
+	}
+	stack := buf[i:]
+	if j := bytes.Index(stack, []byte("\n\n")); j >= 0 {
+		stack = stack[:j+1]
+	}
+	return append([]byte(nil), stack...)
+}
+
+// goroutineDump returns the stacks of all the goroutines, truncated to maxGoroutineDump.
+func goroutineDump() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxGoroutineDump {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
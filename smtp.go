@@ -0,0 +1,206 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"bytes"
+	"strings"
+)
+
+const (
+	// DefaultSMTPMaxLineLength is the maximum length of a command line including its CRLF if
+	// SMTPCodec.MaxLineLength is not set, which leaves room for the extensions enlarging the 512 bytes of RFC 5321,
+	// e.g. AUTH.
+	DefaultSMTPMaxLineLength = 4096
+
+	// DefaultSMTPMaxMessageSize is the maximum size of the mail data if SMTPCodec.MaxMessageSize is not set.
+	DefaultSMTPMaxMessageSize = 10 << 20
+)
+
+// SMTPFrameKind is the kind of the frames decoded by SMTPCodec, see SMTPFrameKindOf.
+type SMTPFrameKind int
+
+const (
+	// SMTPCommand is a command line without its CRLF, see ParseSMTPCommand.
+	SMTPCommand SMTPFrameKind = iota
+
+	// SMTPMessage is the mail data following a DATA command, with the dot-stuffing removed and without the line
+	// ending the data, the lines keep their CRLF.
+	SMTPMessage
+
+	// SMTPMessageTooLarge is an empty frame telling that the mail data exceeded SMTPCodec.MaxMessageSize and has been
+	// discarded up to the line ending it, which is usually replied to with 552.
+	SMTPMessageTooLarge
+
+	// SMTPLineTooLong is an empty frame telling that a command line exceeded SMTPCodec.MaxLineLength and has been
+	// discarded, which is usually replied to with 500.
+	SMTPLineTooLong
+)
+
+// SMTPCodec encodes/decodes the SMTP protocol on the server side, see RFC 5321. It decodes the command lines until
+// SMTPStartData is invoked, usually in React along with the 354 reply to a DATA command, after which it decodes
+// the mail data up to the line consisting of a single dot as one frame, undoing the dot-stuffing, and goes back to
+// the command lines. SMTPFrameKindOf tells the kind of the frame passed to React, and the lines exceeding the limits
+// are discarded rather than buffered, so that the memory held by a connection is bounded.
+//
+// Encode appends CRLF to the reply, use AppendSMTPReply to build the multiline replies. The state of the codec is
+// kept in the codec context of the connection, see Conn.CodecContext.
+type SMTPCodec struct {
+	// MaxLineLength is the maximum length of a command line including its CRLF, DefaultSMTPMaxLineLength if it is
+	// not set.
+	MaxLineLength int
+
+	// MaxMessageSize is the maximum size of the mail data as transmitted, DefaultSMTPMaxMessageSize if it is not set,
+	// which is usually advertised by the SIZE extension as well.
+	MaxMessageSize int
+}
+
+// smtpState is the state of SMTPCodec for a connection.
+type smtpState struct {
+	kind       SMTPFrameKind // kind of the last frame decoded
+	data       bool          // whether the mail data is being decoded
+	discarding bool          // whether the line or the mail data being decoded is discarded since it is too long
+	midLine    bool          // whether the start of the line of the mail data being decoded has been discarded
+	scanned    int           // length of the complete lines of the mail data buffered
+}
+
+func smtpStateOf(c Conn) *smtpState {
+	st, _ := c.CodecContext().(*smtpState)
+	if st == nil {
+		st = new(smtpState)
+		c.SetCodecContext(st)
+	}
+	return st
+}
+
+// SMTPStartData switches SMTPCodec to decoding the mail data of the connection, it must be invoked within
+// the event-loop goroutine, usually in React when replying 354 to a DATA command.
+func SMTPStartData(c Conn) {
+	st := smtpStateOf(c)
+	st.data, st.discarding, st.midLine, st.scanned = true, false, false, 0
+}
+
+// SMTPFrameKindOf returns the kind of the last frame SMTPCodec decoded for the connection, namely the one passed to
+// React, it must be invoked within the event-loop goroutine.
+func SMTPFrameKindOf(c Conn) SMTPFrameKind {
+	return smtpStateOf(c).kind
+}
+
+// ParseSMTPCommand splits a command line into its verb in upper case, e.g. "MAIL", and its argument with
+// the surrounding spaces trimmed, e.g. "FROM:<alice@example.com>", which is a slice of the line.
+func ParseSMTPCommand(line []byte) (verb string, arg []byte) {
+	line = bytes.TrimSpace(line)
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		return strings.ToUpper(string(line[:i])), bytes.TrimSpace(line[i+1:])
+	}
+	return strings.ToUpper(string(line)), nil
+}
+
+// AppendSMTPReply appends to dst the reply with the given code and lines, which continue with the code followed by
+// a hyphen but for the last line, without the CRLF of the last line, which is appended by SMTPCodec.Encode, and
+// returns the extended buffer, e.g. for the replies to EHLO listing the extensions.
+func AppendSMTPReply(dst []byte, code int, lines ...string) []byte {
+	return appendTextReply(dst, code, lines)
+}
+
+// Encode ...
+func (cc *SMTPCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	return append(buf, '\r', '\n'), nil
+}
+
+// Decode ...
+func (cc *SMTPCodec) Decode(c Conn) ([]byte, error) {
+	st := smtpStateOf(c)
+	if st.data {
+		return cc.decodeData(c, st)
+	}
+	maxLine := cc.MaxLineLength
+	if maxLine <= 0 {
+		maxLine = DefaultSMTPMaxLineLength
+	}
+	line, tooLong, err := decodeTextLine(c, maxLine, &st.discarding)
+	switch {
+	case err != nil:
+		return nil, err
+	case tooLong:
+		st.kind = SMTPLineTooLong
+		return []byte{}, nil
+	}
+	st.kind = SMTPCommand
+	return line, nil
+}
+
+// decodeData decodes the mail data up to the line consisting of a single dot, scanning only the lines that have
+// not been scanned by the previous calls.
+func (cc *SMTPCodec) decodeData(c Conn, st *smtpState) ([]byte, error) {
+	maxSize := cc.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultSMTPMaxMessageSize
+	}
+	cur := c.Cursor()
+	_ = cur.Skip(st.scanned)
+	for {
+		i := cur.indexByte('\n')
+		if i < 0 {
+			break
+		}
+		n := i + 1
+		if n > 3 || st.midLine {
+			st.midLine = false
+			_ = cur.Skip(n)
+			st.scanned += n
+			continue
+		}
+		line, _ := cur.ReadBytes(n)
+		if s := string(line); s != ".\r\n" && s != ".\n" {
+			st.scanned += n
+			continue
+		}
+		size := st.scanned
+		st.data, st.scanned = false, 0
+		if st.discarding || size > maxSize {
+			st.discarding = false
+			c.ShiftN(size + n)
+			st.kind = SMTPMessageTooLarge
+			return []byte{}, nil
+		}
+		buf, err := c.Next(size + n)
+		if err != nil {
+			return nil, err
+		}
+		st.kind = SMTPMessage
+		return smtpUnstuff(buf[:size]), nil
+	}
+	if !st.discarding && st.scanned+cur.Len() > maxSize {
+		st.discarding = true
+	}
+	if st.discarding {
+		// The partial line is discarded as well, so that a never-ending line doesn't pile up.
+		if cur.Len() > 0 {
+			st.midLine = true
+		}
+		c.ShiftN(st.scanned + cur.Len())
+		st.scanned = 0
+	}
+	return nil, ErrUnexpectedEOF
+}
+
+// smtpUnstuff removes the leading dot of the lines of the mail data in place, see RFC 5321 section 4.5.2.
+func smtpUnstuff(data []byte) []byte {
+	out := data[:0]
+	for len(data) > 0 {
+		n := len(data)
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			n = i + 1
+		}
+		line := data[:n]
+		data = data[n:]
+		if line[0] == '.' {
+			line = line[1:]
+		}
+		out = append(out, line...)
+	}
+	return out
+}
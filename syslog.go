@@ -0,0 +1,275 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultSyslogMaxMessageSize is the maximum size of a message decoded by SyslogCodec if
+	// SyslogCodec.MaxMessageSize is not set, which is the size RFC 5425 recommends the receivers to support.
+	DefaultSyslogMaxMessageSize = 8192
+
+	// syslogMaxFrameSizeDigits is the maximum number of the digits of the size of an octet-counted message.
+	syslogMaxFrameSizeDigits = 10
+
+	syslogMaxPriority = 191
+)
+
+// SyslogMessage is a syslog message parsed by ParseSyslog. Its byte slices are slices of the message, thus they are
+// only valid as long as the message, and they are nil if the fields are missing or are the NILVALUE "-".
+type SyslogMessage struct {
+	// Facility is the facility of the message, e.g. 4 for the security/authorization messages.
+	Facility int
+
+	// Severity is the severity of the message, from 0 for emergency to 7 for debug.
+	Severity int
+
+	// Version is 1 for the messages of RFC 5424 and 0 for the BSD messages of RFC 3164.
+	Version int
+
+	// Timestamp is the time of the message, it is zero if it is missing. The BSD messages carry neither the year
+	// nor the time zone, thus their times are taken as the local time of the latest year that doesn't put them
+	// more than one day ahead.
+	Timestamp time.Time
+
+	// Hostname is the host the message originates from.
+	Hostname []byte
+
+	// AppName is the application the message originates from, which is the TAG of the BSD messages.
+	AppName []byte
+
+	// ProcID is the process the message originates from, e.g. the PID within the brackets after the TAG of the BSD
+	// messages.
+	ProcID []byte
+
+	// MsgID is the type of the message, it is nil for the BSD messages.
+	MsgID []byte
+
+	// StructuredData is the structured data elements of the message as is, e.g. `[origin ip="192.0.2.1"]`, it is
+	// nil for the BSD messages.
+	StructuredData []byte
+
+	// Message is the free-form message.
+	Message []byte
+}
+
+// ParseSyslog parses the syslog message of RFC 5424 or the BSD syslog message of RFC 3164, which is told apart by
+// the version following the priority, e.g. for ingesting the syslog datagrams in React on UDP or the frames
+// decoded by SyslogCodec. A trailing LF or CRLF is ignored, and a BSD message without a valid timestamp is taken as
+// a whole as the free-form message. It fails with ErrInvalidSyslogMessage if the priority is malformed.
+func ParseSyslog(msg []byte) (m SyslogMessage, err error) {
+	msg = bytes.TrimSuffix(msg, []byte{'\n'})
+	msg = bytes.TrimSuffix(msg, []byte{'\r'})
+	if len(msg) < 3 || msg[0] != '<' {
+		return m, ErrInvalidSyslogMessage
+	}
+	pri, i := 0, 1
+	for ; i < len(msg) && i <= 4 && msg[i] >= '0' && msg[i] <= '9'; i++ {
+		pri = pri*10 + int(msg[i]-'0')
+	}
+	// The priority is 1 to 3 digits without leading zeros.
+	if i == 1 || i > 4 || i == len(msg) || msg[i] != '>' || pri > syslogMaxPriority || i > 2 && msg[1] == '0' {
+		return m, ErrInvalidSyslogMessage
+	}
+	m.Facility, m.Severity = pri/8, pri%8
+	msg = msg[i+1:]
+	if len(msg) >= 2 && msg[0] == '1' && msg[1] == ' ' {
+		m.Version = 1
+		parseSyslog5424(&m, msg[2:])
+	} else {
+		parseSyslog3164(&m, msg, time.Now())
+	}
+	return m, nil
+}
+
+// parseSyslog5424 parses the header following the version, the structured data and the message of RFC 5424.
+func parseSyslog5424(m *SyslogMessage, msg []byte) {
+	var field []byte
+	field, msg = nextSyslogField(msg)
+	if field != nil {
+		m.Timestamp, _ = time.Parse(time.RFC3339Nano, string(field))
+	}
+	m.Hostname, msg = nextSyslogField(msg)
+	m.AppName, msg = nextSyslogField(msg)
+	m.ProcID, msg = nextSyslogField(msg)
+	m.MsgID, msg = nextSyslogField(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		n := syslogStructuredDataSize(msg)
+		m.StructuredData, msg = msg[:n], msg[n:]
+	} else {
+		_, msg = nextSyslogField(msg)
+	}
+	msg = bytes.TrimPrefix(msg, []byte{' '})
+	// The UTF-8 messages start with a BOM.
+	msg = bytes.TrimPrefix(msg, []byte("\xef\xbb\xbf"))
+	if len(msg) > 0 {
+		m.Message = msg
+	}
+}
+
+// nextSyslogField returns the field up to the next space, nil for the NILVALUE, and the rest after the space.
+func nextSyslogField(msg []byte) (field, rest []byte) {
+	i := bytes.IndexByte(msg, ' ')
+	if i < 0 {
+		field, rest = msg, nil
+	} else {
+		field, rest = msg[:i], msg[i+1:]
+	}
+	if len(field) == 0 || len(field) == 1 && field[0] == '-' {
+		field = nil
+	}
+	return
+}
+
+// syslogStructuredDataSize returns the size of the structured data elements at the start of msg, skipping the
+// brackets within the quoted parameter values and the escaped characters.
+func syslogStructuredDataSize(msg []byte) int {
+	inElement, quoted := false, false
+	for i := 0; i < len(msg); i++ {
+		switch b := msg[i]; {
+		case quoted && b == '\\':
+			i++
+		case b == '"' && inElement:
+			quoted = !quoted
+		case quoted:
+		case b == '[':
+			inElement = true
+		case b == ']':
+			inElement = false
+		case !inElement:
+			return i
+		}
+	}
+	return len(msg)
+}
+
+// parseSyslog3164 parses the timestamp, the hostname, the tag and the message of RFC 3164.
+func parseSyslog3164(m *SyslogMessage, msg []byte, now time.Time) {
+	if len(msg) < len(time.Stamp)+1 || msg[len(time.Stamp)] != ' ' {
+		m.Message = msg
+		return
+	}
+	t, err := time.ParseInLocation(time.Stamp, string(msg[:len(time.Stamp)]), now.Location())
+	if err != nil {
+		m.Message = msg
+		return
+	}
+	m.Timestamp = t.AddDate(now.Year(), 0, 0)
+	if m.Timestamp.After(now.AddDate(0, 0, 1)) {
+		m.Timestamp = m.Timestamp.AddDate(-1, 0, 0)
+	}
+	m.Hostname, msg = nextSyslogField(msg[len(time.Stamp)+1:])
+
+	// The TAG is terminated by the first character that is not alphanumeric, usually a colon or a bracket.
+	i := 0
+	for i < len(msg) && msg[i] != ':' && msg[i] != '[' && msg[i] != ' ' {
+		i++
+	}
+	if i < len(msg) && msg[i] != ' ' {
+		m.AppName, msg = msg[:i], msg[i:]
+		if msg[0] == '[' {
+			if j := bytes.IndexByte(msg, ']'); j > 0 {
+				m.ProcID, msg = msg[1:j], msg[j+1:]
+			}
+		}
+		msg = bytes.TrimPrefix(msg, []byte{':'})
+		msg = bytes.TrimPrefix(msg, []byte{' '})
+	}
+	if len(msg) > 0 {
+		m.Message = msg
+	}
+}
+
+// SyslogCodec encodes/decodes the syslog messages transmitted over stream connections, see RFC 6587. It decodes
+// both the octet-counted messages, which are preceded by their sizes and a space, and the messages terminated by LF,
+// told apart by their first characters, and passes the messages to React without the framing, use ParseSyslog to
+// parse them. The messages larger than MaxMessageSize are discarded rather than buffered, as are the empty lines.
+// Encode frames the messages by octet counting. The syslog datagrams don't go through codecs, so the servers
+// ingesting syslog over UDP use ParseSyslog on the frames passed to React directly.
+type SyslogCodec struct {
+	// MaxMessageSize is the maximum size of a message, DefaultSyslogMaxMessageSize if it is not set.
+	MaxMessageSize int
+}
+
+// syslogState is the state of SyslogCodec for a connection.
+type syslogState struct {
+	skip       int  // number of the bytes of the octet-counted message being discarded that haven't arrived yet
+	discarding bool // whether the line being decoded is discarded since it is too long
+}
+
+// Encode ...
+func (cc *SyslogCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	out := strconv.AppendInt(make([]byte, 0, syslogMaxFrameSizeDigits+1+len(buf)), int64(len(buf)), 10)
+	out = append(out, ' ')
+	return append(out, buf...), nil
+}
+
+// Decode ...
+func (cc *SyslogCodec) Decode(c Conn) ([]byte, error) {
+	st, _ := c.CodecContext().(*syslogState)
+	if st == nil {
+		st = new(syslogState)
+		c.SetCodecContext(st)
+	}
+	maxSize := cc.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultSyslogMaxMessageSize
+	}
+	for {
+		if st.skip > 0 {
+			n := c.BufferLength()
+			if n == 0 {
+				return nil, ErrUnexpectedEOF
+			}
+			if n > st.skip {
+				n = st.skip
+			}
+			c.ShiftN(n)
+			if st.skip -= n; st.skip > 0 {
+				return nil, ErrUnexpectedEOF
+			}
+		}
+		cur := c.Cursor()
+		if cur.Len() == 0 {
+			return nil, ErrUnexpectedEOF
+		}
+		if b, _ := cur.ReadByte(); !st.discarding && b >= '1' && b <= '9' {
+			cur.Rewind(0)
+			i := cur.indexByte(' ')
+			if i < 0 && cur.Len() <= syslogMaxFrameSizeDigits {
+				return nil, ErrUnexpectedEOF
+			}
+			if i > 0 && i <= syslogMaxFrameSizeDigits {
+				header, _ := cur.ReadBytes(i)
+				if size, err := strconv.Atoi(string(header)); err == nil {
+					if size > maxSize {
+						c.ShiftN(i + 1)
+						st.skip = size
+						continue
+					}
+					buf, err := c.Next(i + 1 + size)
+					if err != nil {
+						return nil, ErrUnexpectedEOF
+					}
+					return buf[i+1:], nil
+				}
+			}
+		}
+
+		// It is not an octet-counted message, go on with the line.
+		line, tooLong, err := decodeTextLine(c, maxSize+1, &st.discarding)
+		if err != nil {
+			return nil, err
+		}
+		if tooLong || len(line) == 0 {
+			continue
+		}
+		return line, nil
+	}
+}
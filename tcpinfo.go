@@ -0,0 +1,34 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import "time"
+
+// TCPInfo is the state of the path of a TCP connection sampled from TCP_INFO of the kernel, see Conn.TCPInfo.
+type TCPInfo struct {
+	// RTT is the smoothed round-trip time.
+	RTT time.Duration
+
+	// RTTVar is the variance of the round-trip time.
+	RTTVar time.Duration
+
+	// MinRTT is the minimum round-trip time observed, zero if the kernel doesn't report it.
+	MinRTT time.Duration
+
+	// Retransmits is the total number of the retransmitted segments.
+	Retransmits uint32
+
+	// Lost is the number of the segments currently considered lost.
+	Lost uint32
+
+	// SndCwnd is the congestion window in segments.
+	SndCwnd uint32
+
+	// SndMSS is the maximum segment size for sending.
+	SndMSS uint32
+
+	// DeliveryRate is the most recent delivery rate in bytes per second, zero if the kernel doesn't report it.
+	DeliveryRate uint64
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package gnet
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// linuxTCPInfo is struct tcp_info of linux/tcp.h up to tcpi_delivery_rate, which unix.TCPInfo falls short of.
+type linuxTCPInfo struct {
+	state, caState, retransmits, probes, backoff, options, wscale, appLimited uint8
+
+	rto, ato, sndMSS, rcvMSS                                                 uint32
+	unacked, sacked, lost, retrans, fackets                                  uint32
+	lastDataSent, lastAckSent, lastDataRecv, lastAckRecv                     uint32
+	pmtu, rcvSSThresh, rtt, rttVar, sndSSThresh, sndCwnd, advMSS, reordering uint32
+	rcvRTT, rcvSpace                                                         uint32
+	totalRetrans                                                             uint32
+	pacingRate, maxPacingRate, bytesAcked, bytesReceived                     uint64
+	segsOut, segsIn                                                          uint32
+	notsentBytes, minRTT, dataSegsIn, dataSegsOut                            uint32
+	deliveryRate                                                             uint64
+}
+
+// getTCPInfo samples TCP_INFO of the socket, the fields unknown to the running kernel are left zero.
+func getTCPInfo(fd int) (info TCPInfo, err error) {
+	var raw linuxTCPInfo
+	size := uint32(unsafe.Sizeof(raw))
+	if _, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.IPPROTO_TCP, unix.TCP_INFO,
+		uintptr(unsafe.Pointer(&raw)), uintptr(unsafe.Pointer(&size)), 0); e != 0 {
+		return info, os.NewSyscallError("getsockopt", e)
+	}
+	info.RTT = time.Duration(raw.rtt) * time.Microsecond
+	info.RTTVar = time.Duration(raw.rttVar) * time.Microsecond
+	info.MinRTT = time.Duration(raw.minRTT) * time.Microsecond
+	info.Retransmits = raw.totalRetrans
+	info.Lost = raw.lost
+	info.SndCwnd = raw.sndCwnd
+	info.SndMSS = raw.sndMSS
+	info.DeliveryRate = raw.deliveryRate
+	return info, nil
+}
@@ -0,0 +1,403 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// DefaultTelnetMaxLineLength is the maximum length of a line of input without its line ending if
+// TelnetCodec.MaxLineLength is not set, which bounds the subnegotiations as well.
+const DefaultTelnetMaxLineLength = 4096
+
+// The commands of the Telnet protocol, which follow IAC, see RFC 854.
+const (
+	TelnetSE   byte = 240 // end of subnegotiation
+	TelnetNOP  byte = 241 // no operation
+	TelnetDM   byte = 242 // Data Mark, sent as TCP urgent data along with Synch
+	TelnetBRK  byte = 243 // break
+	TelnetIP   byte = 244 // interrupt process
+	TelnetAO   byte = 245 // abort output
+	TelnetAYT  byte = 246 // are you there
+	TelnetEC   byte = 247 // erase character
+	TelnetEL   byte = 248 // erase line
+	TelnetGA   byte = 249 // go ahead
+	TelnetSB   byte = 250 // start of subnegotiation
+	TelnetWILL byte = 251
+	TelnetWONT byte = 252
+	TelnetDO   byte = 253
+	TelnetDONT byte = 254
+	TelnetIAC  byte = 255 // interpret as command
+)
+
+// The common options of the Telnet protocol.
+const (
+	TelnetOptionBinary          byte = 0  // RFC 856
+	TelnetOptionEcho            byte = 1  // RFC 857
+	TelnetOptionSuppressGoAhead byte = 3  // RFC 858
+	TelnetOptionStatus          byte = 5  // RFC 859
+	TelnetOptionTimingMark      byte = 6  // RFC 860
+	TelnetOptionTerminalType    byte = 24 // RFC 1091
+	TelnetOptionNAWS            byte = 31 // negotiate about window size, RFC 1073
+	TelnetOptionTerminalSpeed   byte = 32 // RFC 1079
+	TelnetOptionLinemode        byte = 34 // RFC 1184
+	TelnetOptionEnviron         byte = 39 // RFC 1572
+)
+
+// TelnetFrameKind is the kind of the frames decoded by TelnetCodec, see TelnetFrameKindOf.
+type TelnetFrameKind int
+
+const (
+	// TelnetLine is a line of input without its line ending, with the commands removed, IAC IAC unescaped, and
+	// the erase character and erase line commands applied.
+	TelnetLine TelnetFrameKind = iota
+
+	// TelnetCommand is a frame of one byte holding a command sent by the client, one of TelnetIP, TelnetAO,
+	// TelnetAYT, TelnetBRK and TelnetDM, which is handed over as soon as it is received, ahead of the line being
+	// received, e.g. to interrupt the process of the session.
+	TelnetCommand
+
+	// TelnetSubnegotiation is the option of a subnegotiation followed by its parameters with IAC IAC unescaped,
+	// e.g. TelnetOptionNAWS followed by the width and the height of the window of the client.
+	TelnetSubnegotiation
+
+	// TelnetLineTooLong is an empty frame telling that a line exceeded TelnetCodec.MaxLineLength and has been
+	// discarded.
+	TelnetLineTooLong
+)
+
+// TelnetCodec encodes/decodes the Telnet protocol on the server side, see RFC 854 and RFC 855, e.g. for BBS and
+// terminal gateways. It takes the commands out of the inbound data and decodes the rest as lines, which end with
+// CR LF, CR NUL, a bare CR or a bare LF, so that React gets clean line-oriented input, TelnetFrameKindOf tells
+// the kind of the frame passed to React. The option negotiation is answered by the codec itself: the options listed
+// in LocalOptions and RemoteOptions are agreed to and the others are refused, following RFC 1143 so that
+// the negotiation never loops. Use TelnetRequest to ask the client for the options, e.g. in OnOpened, and
+// TelnetOptionEnabled to check the options in effect.
+//
+// Encode escapes IAC as IAC IAC and converts the bare LFs to CR LF and the bare CRs to CR NUL, without appending
+// a line ending, so that prompts can be written as well. The state of the codec is kept in the codec context of
+// the connection, see Conn.CodecContext.
+type TelnetCodec struct {
+	// LocalOptions are the options the server agrees to enable on its side when the client asks for them with DO,
+	// e.g. TelnetOptionEcho and TelnetOptionSuppressGoAhead for the character-at-a-time mode.
+	LocalOptions []byte
+
+	// RemoteOptions are the options the server agrees the client enables on its side when the client offers them
+	// with WILL, e.g. TelnetOptionNAWS for the window size to be reported via subnegotiations.
+	RemoteOptions []byte
+
+	// MaxLineLength is the maximum length of a line of input without its line ending, DefaultTelnetMaxLineLength if
+	// it is not set.
+	MaxLineLength int
+}
+
+// The states of the parser of TelnetCodec.
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSubnegotiation
+	telnetSubnegotiationCommand
+)
+
+// The states of the options of a connection, for the side of the server and for the side of the client.
+const (
+	telnetLocalEnabled byte = 1 << iota
+	telnetLocalPending
+	telnetRemoteEnabled
+	telnetRemotePending
+)
+
+// telnetState is the state of TelnetCodec for a connection.
+type telnetState struct {
+	kind           TelnetFrameKind // kind of the last frame decoded
+	mode           int             // state of the parser
+	verb           byte            // negotiation command whose option is awaited
+	cr             bool            // whether the last line ended with CR, whose LF or NUL is skipped
+	lineDiscarding bool            // whether the line being decoded is discarded since it is too long
+	subDiscarding  bool            // whether the subnegotiation being decoded is discarded since it is too long
+	line           []byte          // line being decoded
+	sub            []byte          // subnegotiation being decoded
+	replies        []byte          // replies to the negotiation, written once the inbound data has been decoded
+	options        [256]byte       // states of the options
+}
+
+func telnetStateOf(c Conn) *telnetState {
+	st, _ := c.CodecContext().(*telnetState)
+	if st == nil {
+		st = new(telnetState)
+		c.SetCodecContext(st)
+	}
+	return st
+}
+
+// TelnetFrameKindOf returns the kind of the last frame TelnetCodec decoded for the connection, namely the one passed
+// to React, it must be invoked within the event-loop goroutine.
+func TelnetFrameKindOf(c Conn) TelnetFrameKind {
+	return telnetStateOf(c).kind
+}
+
+// TelnetOptionEnabled returns whether the option is in effect on the side of the server and on the side of
+// the client, it must be invoked within the event-loop goroutine.
+func TelnetOptionEnabled(c Conn, option byte) (local, remote bool) {
+	st := telnetStateOf(c).options[option]
+	return st&telnetLocalEnabled != 0, st&telnetRemoteEnabled != 0
+}
+
+// TelnetRequest starts the negotiation of an option with the client, command is TelnetWILL or TelnetWONT to enable
+// or disable it on the side of the server, and TelnetDO or TelnetDONT to ask the client to enable or disable it on
+// its side. Nothing is written if the option is already in the state requested or being negotiated. It must be
+// invoked within the event-loop goroutine, e.g. in OnOpened.
+func TelnetRequest(c Conn, command, option byte) error {
+	st := telnetStateOf(c)
+	state := &st.options[option]
+	switch command {
+	case TelnetWILL:
+		if *state&(telnetLocalEnabled|telnetLocalPending) != 0 {
+			return nil
+		}
+		*state |= telnetLocalPending
+	case TelnetWONT:
+		if *state&telnetLocalEnabled == 0 {
+			return nil
+		}
+		*state &^= telnetLocalEnabled
+	case TelnetDO:
+		if *state&(telnetRemoteEnabled|telnetRemotePending) != 0 {
+			return nil
+		}
+		*state |= telnetRemotePending
+	case TelnetDONT:
+		if *state&telnetRemoteEnabled == 0 {
+			return nil
+		}
+		*state &^= telnetRemoteEnabled
+	default:
+		return ErrInvalidTelnetCommand
+	}
+	_, err := c.Write([]byte{TelnetIAC, command, option})
+	return err
+}
+
+// Encode ...
+func (cc *TelnetCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	n := 0
+	for i, b := range buf {
+		if b == TelnetIAC || telnetBareCR(buf, i) || telnetBareLF(buf, i) {
+			n++
+		}
+	}
+	if n == 0 {
+		return buf, nil
+	}
+	out := make([]byte, 0, len(buf)+n)
+	for i, b := range buf {
+		switch {
+		case b == TelnetIAC:
+			out = append(out, TelnetIAC, TelnetIAC)
+		case telnetBareCR(buf, i):
+			out = append(out, '\r', 0)
+		case telnetBareLF(buf, i):
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+func telnetBareCR(buf []byte, i int) bool {
+	return buf[i] == '\r' && (i+1 == len(buf) || buf[i+1] != '\n')
+}
+
+func telnetBareLF(buf []byte, i int) bool {
+	return buf[i] == '\n' && (i == 0 || buf[i-1] != '\r')
+}
+
+// Decode ...
+func (cc *TelnetCodec) Decode(c Conn) ([]byte, error) {
+	st := telnetStateOf(c)
+	buf, _ := c.Peek(0)
+	frame, n := cc.decode(st, buf)
+	c.ShiftN(n)
+	if len(st.replies) > 0 {
+		// The replies are written once the codec returns, since the connection may be closed by a failing write.
+		replies := st.replies
+		st.replies = nil
+		if t, ok := c.(jobTrigger); ok {
+			_ = t.trigger(func() error {
+				_, _ = c.Write(replies)
+				return nil
+			})
+		}
+	}
+	if frame == nil {
+		return nil, ErrCRLFNotFound
+	}
+	return frame, nil
+}
+
+// decode parses the inbound data up to the end of the first frame, and returns the frame along with the number of
+// the bytes parsed, the frame is nil if the inbound data doesn't complete one.
+func (cc *TelnetCodec) decode(st *telnetState, buf []byte) (frame []byte, n int) {
+	maxLine := cc.MaxLineLength
+	if maxLine <= 0 {
+		maxLine = DefaultTelnetMaxLineLength
+	}
+	for i := 0; i < len(buf); i++ {
+		b := buf[i]
+		switch st.mode {
+		case telnetData:
+			cr := st.cr
+			st.cr = false
+			switch {
+			case b == TelnetIAC:
+				st.mode = telnetCommand
+			case cr && (b == '\n' || b == 0):
+			case b == '\r' || b == '\n':
+				st.cr = b == '\r'
+				return st.endLine(), i + 1
+			default:
+				st.appendLine(b, maxLine)
+			}
+		case telnetCommand:
+			st.mode = telnetData
+			switch b {
+			case TelnetIAC:
+				st.appendLine(b, maxLine)
+			case TelnetWILL, TelnetWONT, TelnetDO, TelnetDONT:
+				st.mode, st.verb = telnetOption, b
+			case TelnetSB:
+				st.mode, st.sub, st.subDiscarding = telnetSubnegotiation, st.sub[:0], false
+			case TelnetEC:
+				if l := len(st.line); l > 0 && !st.lineDiscarding {
+					st.line = st.line[:l-1]
+				}
+			case TelnetEL:
+				st.line = st.line[:0]
+			case TelnetIP, TelnetAO, TelnetAYT, TelnetBRK, TelnetDM:
+				st.kind = TelnetCommand
+				return []byte{b}, i + 1
+			}
+		case telnetOption:
+			st.mode = telnetData
+			cc.negotiate(st, st.verb, b)
+		case telnetSubnegotiation:
+			if b == TelnetIAC {
+				st.mode = telnetSubnegotiationCommand
+			} else if st.sub = append(st.sub, b); len(st.sub) > maxLine {
+				st.sub = st.sub[:0]
+				st.subDiscarding = true
+			}
+		case telnetSubnegotiationCommand:
+			switch b {
+			case TelnetIAC:
+				st.mode = telnetSubnegotiation
+				st.sub = append(st.sub, b)
+			case TelnetSE:
+				st.mode = telnetData
+				if sub := st.sub; len(sub) > 0 && !st.subDiscarding {
+					st.sub = nil
+					st.kind = TelnetSubnegotiation
+					return sub, i + 1
+				}
+				st.subDiscarding = false
+			default:
+				// The subnegotiation is aborted by any other command, which is handled as such.
+				st.mode, st.subDiscarding = telnetCommand, false
+				i--
+			}
+		}
+	}
+	return nil, len(buf)
+}
+
+// appendLine appends a byte of input to the line being decoded, unless the line is too long.
+func (st *telnetState) appendLine(b byte, maxLine int) {
+	if st.lineDiscarding {
+		return
+	}
+	if len(st.line) == maxLine {
+		st.line, st.lineDiscarding = st.line[:0], true
+		return
+	}
+	st.line = append(st.line, b)
+}
+
+// endLine hands over the line that has been decoded.
+func (st *telnetState) endLine() []byte {
+	if st.lineDiscarding {
+		st.lineDiscarding = false
+		st.kind = TelnetLineTooLong
+		return []byte{}
+	}
+	line := st.line
+	if line == nil {
+		line = []byte{}
+	}
+	st.line = nil
+	st.kind = TelnetLine
+	return line
+}
+
+// negotiate answers a negotiation command of the client, following RFC 1143: the acknowledgements of the commands of
+// the server and the commands that don't change the state of the option aren't answered.
+func (cc *TelnetCodec) negotiate(st *telnetState, verb, option byte) {
+	state := &st.options[option]
+	var reply byte
+	switch verb {
+	case TelnetWILL:
+		switch {
+		case *state&telnetRemoteEnabled != 0:
+		case *state&telnetRemotePending != 0:
+			*state = *state&^telnetRemotePending | telnetRemoteEnabled
+		case telnetOptionListed(cc.RemoteOptions, option):
+			*state |= telnetRemoteEnabled
+			reply = TelnetDO
+		default:
+			reply = TelnetDONT
+		}
+	case TelnetWONT:
+		switch {
+		case *state&telnetRemotePending != 0:
+			*state &^= telnetRemotePending
+		case *state&telnetRemoteEnabled != 0:
+			*state &^= telnetRemoteEnabled
+			reply = TelnetDONT
+		}
+	case TelnetDO:
+		switch {
+		case *state&telnetLocalEnabled != 0:
+		case *state&telnetLocalPending != 0:
+			*state = *state&^telnetLocalPending | telnetLocalEnabled
+		case telnetOptionListed(cc.LocalOptions, option):
+			*state |= telnetLocalEnabled
+			reply = TelnetWILL
+		default:
+			reply = TelnetWONT
+		}
+	case TelnetDONT:
+		switch {
+		case *state&telnetLocalPending != 0:
+			*state &^= telnetLocalPending
+		case *state&telnetLocalEnabled != 0:
+			*state &^= telnetLocalEnabled
+			reply = TelnetWONT
+		}
+	}
+	if reply != 0 {
+		st.replies = append(st.replies, TelnetIAC, reply, option)
+	}
+}
+
+func telnetOptionListed(options []byte, option byte) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// jobTrigger is implemented by the stream connections, which run jobs within their event-loops.
+type jobTrigger interface {
+	trigger(job func() error) error
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import "strconv"
+
+// decodeTextLine decodes a line terminated by LF without its CRLF or LF, for the line-based text protocols such as
+// SMTP and FTP. The lines longer than maxLine including their terminators are discarded as they arrive rather than
+// buffered, and reported by tooLong once they end, discarding keeps track of the line being discarded across calls.
+func decodeTextLine(c Conn, maxLine int, discarding *bool) (line []byte, tooLong bool, err error) {
+	cur := c.Cursor()
+	i := cur.indexByte('\n')
+	if i < 0 {
+		if buffered := cur.Len(); *discarding || buffered > maxLine {
+			*discarding = true
+			c.ShiftN(buffered)
+		}
+		return nil, false, ErrCRLFNotFound
+	}
+	if *discarding || i+1 > maxLine {
+		*discarding = false
+		c.ShiftN(i + 1)
+		return nil, true, nil
+	}
+	if line, err = c.Next(i + 1); err != nil {
+		return nil, false, err
+	}
+	line = line[:i]
+	if i > 0 && line[i-1] == '\r' {
+		line = line[:i-1]
+	}
+	return line, false, nil
+}
+
+// appendTextReply appends to dst the reply with the given code and lines in the multiline format shared by SMTP
+// and FTP, without the CRLF of the last line.
+func appendTextReply(dst []byte, code int, lines []string) []byte {
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	for i, line := range lines {
+		if i > 0 {
+			dst = append(dst, '\r', '\n')
+		}
+		dst = strconv.AppendInt(dst, int64(code), 10)
+		if i < len(lines)-1 {
+			dst = append(dst, '-')
+		} else if line != "" {
+			dst = append(dst, ' ')
+		}
+		dst = append(dst, line...)
+	}
+	return dst
+}
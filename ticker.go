@@ -0,0 +1,167 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StartTicker resumes the Tick events stopped by StopTicker, the next Tick fires right away. It fails with
+// ErrTickerDisabled if the server is not set up with a ticker.
+func (s Server) StartTicker() error {
+	if !s.svr.opts.Ticker {
+		return ErrTickerDisabled
+	}
+	if atomic.CompareAndSwapInt32(&s.svr.tickerStopped, 1, 0) {
+		select {
+		case s.svr.tickerStart <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// StopTicker stops the Tick events until StartTicker is invoked, e.g. for the phases of a service which don't need
+// ticking, a Tick that is already due may still fire. It can be invoked within OnInitComplete to start the server
+// with the ticker stopped. It fails with ErrTickerDisabled if the server is not set up with a ticker.
+func (s Server) StopTicker() error {
+	if !s.svr.opts.Ticker {
+		return ErrTickerDisabled
+	}
+	atomic.StoreInt32(&s.svr.tickerStopped, 1)
+	return nil
+}
+
+// tickerIsStopped reports whether the ticker is stopped by StopTicker.
+func (svr *server) tickerIsStopped() bool {
+	return atomic.LoadInt32(&svr.tickerStopped) == 1
+}
+
+// waitTicker blocks while the ticker is stopped, it reports false if the server is shut down meanwhile.
+func (svr *server) waitTicker() bool {
+	for svr.tickerIsStopped() {
+		select {
+		case <-svr.tickerStart:
+		case <-svr.shutdown:
+			return false
+		}
+	}
+	return true
+}
+
+// delayTicker waits for the initial delay of the ticker, it reports false if the server is shut down meanwhile.
+func (svr *server) delayTicker() bool {
+	if svr.opts.TickerInitialDelay <= 0 {
+		return true
+	}
+	t := time.NewTimer(svr.opts.TickerInitialDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-svr.shutdown:
+		return false
+	}
+}
+
+// jitterTick randomizes the delay returned by Tick per TickerJitter.
+func (svr *server) jitterTick(delay time.Duration) time.Duration {
+	if jitter := svr.opts.TickerJitter; jitter > 0 && delay > 0 {
+		delay += time.Duration(float64(delay) * jitter * (2*rand.Float64() - 1))
+	}
+	return delay
+}
+
+// namedTicker is a ticker added by Server.AddTicker.
+type namedTicker struct {
+	el      *eventloop
+	d       time.Duration
+	fn      func() Action
+	timer   *time.Timer
+	removed bool
+}
+
+// namedTickers holds the tickers added by Server.AddTicker by name.
+type namedTickers struct {
+	mu      sync.Mutex
+	tickers map[string]*namedTicker
+}
+
+// AddTicker adds a ticker named name, which runs fn within the event-loop with the given index every d, measured
+// from the end of the previous run, independently of Tick and the other tickers. Return Shutdown from fn to shut
+// the server down. The tickers can only be added after the server starts, and they stop running once the server
+// is shut down. It fails with ErrTickerExists if there is already a ticker with the same name.
+func (s Server) AddTicker(name string, loopIdx int, d time.Duration, fn func() (action Action)) error {
+	if d <= 0 || fn == nil {
+		return ErrInvalidTicker
+	}
+	el := s.svr.loopAt(loopIdx)
+	if el == nil {
+		return ErrInvalidLoopIndex
+	}
+	nt := &s.svr.tickers
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	if _, ok := nt.tickers[name]; ok {
+		return ErrTickerExists
+	}
+	if nt.tickers == nil {
+		nt.tickers = make(map[string]*namedTicker)
+	}
+	t := &namedTicker{el: el, d: d, fn: fn}
+	t.timer = time.AfterFunc(d, func() {
+		s.svr.runTicker(t)
+	})
+	nt.tickers[name] = t
+	return nil
+}
+
+// RemoveTicker removes the ticker added by AddTicker with the given name, a run that is already due may still
+// take place. It fails with ErrTickerNotFound if there is no such ticker.
+func (s Server) RemoveTicker(name string) error {
+	nt := &s.svr.tickers
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	t, ok := nt.tickers[name]
+	if !ok {
+		return ErrTickerNotFound
+	}
+	delete(nt.tickers, name)
+	t.removed = true
+	t.timer.Stop()
+	return nil
+}
+
+// runTicker runs the ticker within its event-loop and schedules the next run.
+func (svr *server) runTicker(t *namedTicker) {
+	select {
+	case <-svr.shutdown:
+		return
+	default:
+	}
+	_ = t.el.post(busMessage{fn: func() {
+		nt := &svr.tickers
+		nt.mu.Lock()
+		removed := t.removed
+		nt.mu.Unlock()
+		if removed {
+			return
+		}
+		if t.fn() == Shutdown {
+			svr.requestShutdown()
+			return
+		}
+		nt.mu.Lock()
+		if !t.removed {
+			t.timer.Reset(t.d)
+		}
+		nt.mu.Unlock()
+	}})
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTracePreviewSize is the number of the leading bytes of a frame carried by its trace if
+// FrameTracerConfig.PreviewSize is not set.
+const DefaultTracePreviewSize = 32
+
+// FrameTrace describes a frame decoded from or encoded for a stream connection, it is emitted to the FrameTraceSink
+// of a FrameTracer.
+type FrameTrace struct {
+	// ConnID is the identifier of the connection, see Conn.ID.
+	ConnID uint64
+
+	// Inbound tells whether the frame is decoded from the connection, rather than written to it.
+	Inbound bool
+
+	// Time is the moment the frame was traced.
+	Time time.Time
+
+	// Size is the size of the frame seen by the event handler, namely the one before encoding for the outbound
+	// frames.
+	Size int
+
+	// Preview is a copy of the leading bytes of the frame, up to FrameTracerConfig.PreviewSize bytes.
+	Preview []byte
+}
+
+// FrameTraceSink receives the traces of a FrameTracer. Trace is invoked within the event-loops for the inbound
+// frames and within the goroutines writing the outbound frames, so it must not block and must be safe for
+// concurrent use.
+type FrameTraceSink interface {
+	Trace(t *FrameTrace)
+}
+
+// FrameTraceSinkFunc is an adapter to allow the use of ordinary functions as frame trace sinks.
+type FrameTraceSinkFunc func(t *FrameTrace)
+
+// Trace calls f(t).
+func (f FrameTraceSinkFunc) Trace(t *FrameTrace) {
+	f(t)
+}
+
+// FrameTracerConfig is the configuration of a FrameTracer.
+type FrameTracerConfig struct {
+	// Filter selects the frames to trace, e.g. the ones of the connections from a peer or the frames starting with
+	// a certain opcode, all frames are if it is nil. The frame is only valid within Filter.
+	Filter func(c Conn, inbound bool, frame []byte) bool
+
+	// SampleRate is the fraction (0-1) of the selected frames to trace, all of them are traced if it is not
+	// within (0, 1).
+	SampleRate float64
+
+	// Rate is the maximum number of the traces per second, the traces beyond it are dropped, which keeps tracing
+	// a busy server cheap, there is no limit if it is not positive.
+	Rate float64
+
+	// Burst is the number of the traces allowed in a burst beyond Rate, 1 if it is not set.
+	Burst int
+
+	// PreviewSize is the number of the leading bytes of a frame carried by its trace, DefaultTracePreviewSize
+	// if it is not set.
+	PreviewSize int
+
+	// Seed is the seed of the random source used for sampling.
+	Seed int64
+}
+
+// FrameTracer traces a sample of the frames of the stream connections of a server, namely the ones decoded by
+// the codec and the ones written by the event handler before they are encoded, for debugging protocol issues in
+// production, set it up via WithFrameTracer. The frames are selected by FrameTracerConfig.Filter, then sampled
+// and rate limited, so that tracing can be left on without flooding the sink.
+type FrameTracer struct {
+	mu      sync.Mutex
+	sink    FrameTraceSink
+	config  FrameTracerConfig
+	rand    *rand.Rand
+	limit   *tokenBucket
+	dropped uint64
+}
+
+// NewFrameTracer instantiates a frame tracer emitting the traces to the given sink, they are written to the logger
+// of the server in logfmt if it is nil, see NewFrameTraceWriter.
+func NewFrameTracer(sink FrameTraceSink, config FrameTracerConfig) *FrameTracer {
+	if config.PreviewSize <= 0 {
+		config.PreviewSize = DefaultTracePreviewSize
+	}
+	return &FrameTracer{
+		sink:   sink,
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+		limit:  newTokenBucket(config.Rate, config.Burst),
+	}
+}
+
+// Dropped returns the number of the selected frames dropped by the rate limit.
+func (t *FrameTracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// trace emits the trace of the frame if it is selected, sampled and admitted by the rate limit.
+func (t *FrameTracer) trace(c Conn, inbound bool, frame []byte) {
+	if t.config.Filter != nil && !t.config.Filter(c, inbound, frame) {
+		return
+	}
+	if rate := t.config.SampleRate; rate > 0 && rate < 1 {
+		t.mu.Lock()
+		skip := t.rand.Float64() >= rate
+		t.mu.Unlock()
+		if skip {
+			return
+		}
+	}
+	if t.limit.take() != 0 {
+		atomic.AddUint64(&t.dropped, 1)
+		return
+	}
+	preview := frame
+	if len(preview) > t.config.PreviewSize {
+		preview = preview[:t.config.PreviewSize]
+	}
+	ft := &FrameTrace{
+		ConnID:  c.ID(),
+		Inbound: inbound,
+		Time:    time.Now(),
+		Size:    len(frame),
+		Preview: append([]byte(nil), preview...),
+	}
+	if t.sink != nil {
+		t.sink.Trace(ft)
+		return
+	}
+	defaultLogger.Printf("%s", appendFrameTrace(nil, ft))
+}
+
+// frameTraceWriter writes the frame traces in logfmt.
+type frameTraceWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewFrameTraceWriter returns a frame trace sink writing every trace to w in one line of logfmt, e.g.
+// "conn_id=1 dir=in size=5 preview=68656c6c6f", where the preview is the hex dump of the leading bytes of the frame.
+// The writes to w are serialized, and they block the event-loops as long as w does.
+func NewFrameTraceWriter(w io.Writer) FrameTraceSink {
+	return &frameTraceWriter{w: w}
+}
+
+func (tw *frameTraceWriter) Trace(t *FrameTrace) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	b := append(tw.buf[:0], "time="...)
+	b = t.Time.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, ' ')
+	b = appendFrameTrace(b, t)
+	b = append(b, '\n')
+	_, _ = tw.w.Write(b)
+	tw.buf = b
+}
+
+func appendFrameTrace(b []byte, t *FrameTrace) []byte {
+	b = append(b, "conn_id="...)
+	b = strconv.AppendUint(b, t.ConnID, 10)
+	if t.Inbound {
+		b = append(b, " dir=in"...)
+	} else {
+		b = append(b, " dir=out"...)
+	}
+	b = append(b, " size="...)
+	b = strconv.AppendInt(b, int64(t.Size), 10)
+	b = append(b, " preview="...)
+	n := len(b)
+	b = append(b, make([]byte, hex.EncodedLen(len(t.Preview)))...)
+	hex.Encode(b[n:], t.Preview)
+	return b
+}
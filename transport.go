@@ -0,0 +1,75 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"net"
+	"sync"
+)
+
+// Transport is a custom stream transport over pollable file descriptors, e.g. AF_VSOCK or AF_XDP sockets, which
+// reuses the event-loops, codecs and event handlers of gnet. A transport registered with RegisterTransport is served
+// by Serve on the addresses of "name://address", on Unix-like systems only.
+//
+// All the file descriptors must be non-blocking, the methods return syscall.EAGAIN if they would block.
+type Transport interface {
+	// Listen creates a listener on the given address, the returned file descriptor becomes readable
+	// when there are pending connections.
+	Listen(addr string) (fd int, lnaddr net.Addr, err error)
+
+	// Accept accepts a pending connection of the listener.
+	Accept(fd int) (nfd int, remoteAddr net.Addr, err error)
+
+	// Read reads the data of the connection into p.
+	Read(fd int, p []byte) (n int, err error)
+
+	// Write writes p to the connection.
+	Write(fd int, p []byte) (n int, err error)
+
+	// Close closes the connection or the listener.
+	Close(fd int) error
+}
+
+// connTransport is the part of Transport performing I/O on the connections.
+type connTransport interface {
+	Read(fd int, p []byte) (n int, err error)
+	Write(fd int, p []byte) (n int, err error)
+	Close(fd int) error
+}
+
+var builtinNetworks = map[string]bool{
+	"tcp": true, "tcp4": true, "tcp6": true,
+	"udp": true, "udp4": true, "udp6": true,
+	"unix": true, "memory": true,
+}
+
+// transports holds all the registered transports.
+var transports = struct {
+	sync.RWMutex
+	m map[string]Transport
+}{m: make(map[string]Transport)}
+
+// RegisterTransport makes the transport available under the given name, it panics if the name is one of
+// the built-in networks or has been registered already.
+func RegisterTransport(name string, t Transport) {
+	transports.Lock()
+	defer transports.Unlock()
+	if t == nil {
+		panic("gnet: RegisterTransport transport is nil")
+	}
+	if builtinNetworks[name] {
+		panic("gnet: RegisterTransport called for built-in network " + name)
+	}
+	if _, dup := transports.m[name]; dup {
+		panic("gnet: RegisterTransport called twice for transport " + name)
+	}
+	transports.m[name] = t
+}
+
+func lookupTransport(name string) Transport {
+	transports.RLock()
+	defer transports.RUnlock()
+	return transports.m[name]
+}
@@ -0,0 +1,24 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package gnet
+
+import "golang.org/x/sys/unix"
+
+// sysTransport performs I/O on the connections of the built-in networks with the system calls on sockets.
+type sysTransport struct{}
+
+func (sysTransport) Read(fd int, p []byte) (int, error) {
+	return unix.Read(fd, p)
+}
+
+func (sysTransport) Write(fd int, p []byte) (int, error) {
+	return unix.Write(fd, p)
+}
+
+func (sysTransport) Close(fd int) error {
+	return unix.Close(fd)
+}
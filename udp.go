@@ -0,0 +1,21 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+const (
+	// MaxUDPReadBufferSize is the maximum of UDPReadBufferSize, which fits the largest datagrams.
+	MaxUDPReadBufferSize = 64 << 10
+
+	// DefaultUDPReadBufferSize is the size of the buffer every datagram is read into if UDPReadBufferSize is not set.
+	DefaultUDPReadBufferSize = MaxUDPReadBufferSize
+)
+
+// udpReadBufferSize returns the size of the buffer every datagram is read into.
+func (opts *Options) udpReadBufferSize() int {
+	if opts.UDPReadBufferSize > 0 {
+		return opts.UDPReadBufferSize
+	}
+	return DefaultUDPReadBufferSize
+}
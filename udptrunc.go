@@ -0,0 +1,29 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+// TruncatedDatagrams returns the number of the datagrams dropped as they exceeded UDPReadBufferSize. The event-loops
+// publish it in batches, see loopCounters.
+func (s Server) TruncatedDatagrams() (n uint64) {
+	s.svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		n += el.counters.loadTruncatedDatagrams()
+		return true
+	})
+	return
+}
+
+// dropTruncated counts a datagram from c which didn't fit the read buffer and reports it rather than handing it
+// over to React, head is the part of the datagram read.
+func (el *eventloop) dropTruncated(c Conn, head []byte) Action {
+	el.counters.addTruncatedDatagram()
+	if h, ok := el.eventHandler.(TruncatedDatagramHandler); ok {
+		return h.OnTruncatedDatagram(c, head)
+	}
+	el.svr.logger.Printf("event-loop:%d dropped a datagram from %v exceeding the read buffer of %d bytes\n",
+		el.idx, c.RemoteAddr(), len(head))
+	return None
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"sync"
+	"time"
+)
+
+// loopUtilizationPeriod is the period over which the utilization of the event-loops is measured.
+const loopUtilizationPeriod = time.Second
+
+// loopUtilization is the state of measuring the utilization of an event-loop, namely the fraction of the time it
+// spends on handling events rather than waiting for them. It is guarded by a mutex rather than accessed atomically
+// since it is not guaranteed to be 64-bit aligned within eventloop.
+type loopUtilization struct {
+	mu         sync.Mutex
+	wokenAt    int64   // moment the event-loop was woken up in nanoseconds, zero if it is waiting for events
+	busy       int64   // total time spent on handling events in nanoseconds, but for the batch in progress
+	value      float64 // utilization over the last period
+	overloaded bool    // whether the utilization has reached LoopOverloadThreshold over the last period
+
+	// The fields below are only accessed by the sampler.
+	sampledAt   int64 // moment of the last sample in nanoseconds
+	sampledBusy int64 // busy time at the last sample
+}
+
+// wake marks the event-loop woken up to handle a batch of events.
+func (u *loopUtilization) wake() {
+	now := time.Now().UnixNano()
+	u.mu.Lock()
+	u.wokenAt = now
+	u.mu.Unlock()
+}
+
+// sleep marks the batch of events handled, the event-loop is about to wait for events again.
+func (u *loopUtilization) sleep() {
+	now := time.Now().UnixNano()
+	u.mu.Lock()
+	if u.wokenAt != 0 {
+		u.busy += now - u.wokenAt
+		u.wokenAt = 0
+	}
+	u.mu.Unlock()
+}
+
+// sample computes the utilization since the last sample, counting the batch in progress as well, so that
+// an event-loop blocked on a batch is seen as fully utilized rather than idle. It reports whether the utilization
+// has reached threshold and whether it has just reached it.
+func (u *loopUtilization) sample(now int64, threshold float64) (value float64, overloaded, edge bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	busy := u.busy
+	if u.wokenAt != 0 {
+		busy += now - u.wokenAt
+	}
+	if u.sampledAt != 0 && now > u.sampledAt {
+		u.value = float64(busy-u.sampledBusy) / float64(now-u.sampledAt)
+		if u.value > 1 {
+			u.value = 1
+		}
+		overloaded = u.value >= threshold
+		edge = overloaded && !u.overloaded
+		u.overloaded = overloaded
+	}
+	u.sampledAt, u.sampledBusy = now, busy
+	return u.value, overloaded, edge
+}
+
+func (u *loopUtilization) load() (value float64) {
+	u.mu.Lock()
+	value = u.value
+	u.mu.Unlock()
+	return
+}
+
+// LoopUtilization returns the utilization of every event-loop over the last second, indexed by the event-loops,
+// which is the fraction (0-1) of the time the event-loop spent on handling events rather than waiting for them,
+// a saturated event-loop falls behind its connections however idle the process looks. It returns nil unless
+// the server is set up via WithLoopOverload.
+func (s Server) LoopUtilization() (utilization []float64) {
+	if s.svr.opts.LoopOverloadThreshold <= 0 {
+		return nil
+	}
+	s.svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		for len(utilization) <= el.idx {
+			utilization = append(utilization, 0)
+		}
+		utilization[el.idx] = el.utilization.load()
+		return true
+	})
+	return
+}
+
+// startLoopUtilization starts measuring the utilization of the event-loops every second if LoopOverloadThreshold
+// is set, and reports the event-loops whose utilization reaches it.
+func (svr *server) startLoopUtilization() {
+	threshold := svr.opts.LoopOverloadThreshold
+	if threshold <= 0 {
+		return
+	}
+	var sample func()
+	sample = func() {
+		select {
+		case <-svr.shutdown:
+			return
+		default:
+		}
+		now := time.Now().UnixNano()
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			if value, overloaded, edge := el.utilization.sample(now, threshold); overloaded {
+				svr.onLoopOverload(el.idx, value, edge)
+			}
+			return true
+		})
+		time.AfterFunc(loopUtilizationPeriod, sample)
+	}
+	sample()
+}
+
+// onLoopOverload hands over the utilization of an overloaded event-loop to LoopOverloadHandler if the event handler
+// implements it, otherwise logs it once the event-loop becomes overloaded.
+func (svr *server) onLoopOverload(loop int, utilization float64, edge bool) {
+	if h, ok := svr.eventHandler.(LoopOverloadHandler); ok {
+		h.OnLoopOverload(loop, utilization)
+		return
+	}
+	if edge {
+		svr.logger.Printf("event-loop:%d is overloaded, utilization: %.2f\n", loop, utilization)
+	}
+}
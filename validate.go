@@ -0,0 +1,295 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"reflect"
+	"runtime"
+)
+
+// OptionsError is returned by Options.Validate and Serve when an option is invalid on its own
+// or conflicts with other options, the network or the event handler.
+type OptionsError struct {
+	// Option is the name of the offending field of Options.
+	Option string
+
+	// Reason tells what is wrong with the option.
+	Reason string
+}
+
+func (e *OptionsError) Error() string {
+	return "invalid option " + e.Option + ": " + e.Reason
+}
+
+// Validate checks the options on their own and returns an *OptionsError for the first invalid option or
+// incompatible combination of options, Serve invokes it and additionally checks the options against the network
+// and the event handler, e.g. SO_REUSEPORT on Unix domain sockets or a ticker without an implementation of Tick.
+func (opts *Options) Validate() error {
+	switch {
+	case opts.LB < RoundRobin || opts.LB > SourceAddrHash:
+		return &OptionsError{"LB", "unknown load-balancing algorithm"}
+	case opts.NumEventLoop < 0:
+		return &OptionsError{"NumEventLoop", "must not be negative"}
+	case opts.NumEventLoop > 1<<connIDLoopBits:
+		return &OptionsError{"NumEventLoop", "exceeds the maximum number of event-loops"}
+	case opts.TestMode && (opts.Multicore || opts.NumEventLoop > 1):
+		return &OptionsError{"TestMode", "runs exactly one event-loop, it conflicts with Multicore and NumEventLoop"}
+	case opts.TestMode && opts.AcceptMode != AcceptOnMainReactor:
+		return &OptionsError{"TestMode", "the event-loop accepts connections itself, it conflicts with AcceptMode"}
+	case opts.TestMode && opts.LoopAffinity:
+		return &OptionsError{"TestMode", "runs the event-loop within the caller of PollOnce, it conflicts with LoopAffinity"}
+	case opts.LoopRestart < LoopRestartNone || opts.LoopRestart > LoopRestartCloseConns:
+		return &OptionsError{"LoopRestart", "unknown policy"}
+	case opts.TickerInitialDelay < 0:
+		return &OptionsError{"TickerInitialDelay", "must not be negative"}
+	case opts.TickerJitter < 0 || opts.TickerJitter >= 1:
+		return &OptionsError{"TickerJitter", "must be within [0, 1)"}
+	case !opts.Ticker && (opts.TickerInitialDelay != 0 || opts.TickerJitter != 0):
+		return &OptionsError{"Ticker", "must be set for TickerInitialDelay and TickerJitter"}
+	case opts.TCPKeepAlive < 0:
+		return &OptionsError{"TCPKeepAlive", "must not be negative"}
+	case opts.IPTOS < 0 || opts.IPTOS > 255:
+		return &OptionsError{"IPTOS", "must be within [0, 255]"}
+	case opts.IPTTL < 0 || opts.IPTTL > 255:
+		return &OptionsError{"IPTTL", "must be within [0, 255]"}
+	case opts.UDPReadBufferSize < 0 || opts.UDPReadBufferSize > MaxUDPReadBufferSize:
+		return &OptionsError{"UDPReadBufferSize", "must be within [0, 65536]"}
+	case len(opts.AcceptFilter) > 15:
+		return &OptionsError{"AcceptFilter", "the name must not be longer than 15 bytes"}
+	case opts.MaxReadsPerLoopIteration < 0:
+		return &OptionsError{"MaxReadsPerLoopIteration", "must not be negative"}
+	case opts.PartialFrameTimeout < 0:
+		return &OptionsError{"PartialFrameTimeout", "must not be negative"}
+	case opts.SlowReactThreshold < 0:
+		return &OptionsError{"SlowReactThreshold", "must not be negative"}
+	case opts.SlowReactStack && opts.SlowReactThreshold == 0:
+		return &OptionsError{"SlowReactThreshold", "must be set for SlowReactStack"}
+	case opts.ConnGoroutineQueue < 0:
+		return &OptionsError{"ConnGoroutineQueue", "must not be negative"}
+	case opts.ConnQueuePolicy < ConnQueueBlockReads || opts.ConnQueuePolicy > ConnQueueClose:
+		return &OptionsError{"ConnQueuePolicy", "unknown policy"}
+	case !opts.ConnGoroutine && (opts.ConnGoroutineQueue != 0 || opts.ConnQueuePolicy != ConnQueueBlockReads):
+		return &OptionsError{"ConnGoroutine", "must be set for ConnGoroutineQueue and ConnQueuePolicy"}
+	case opts.WatchdogTimeout < 0:
+		return &OptionsError{"WatchdogTimeout", "must not be negative"}
+	case opts.LoopOverloadThreshold < 0 || opts.LoopOverloadThreshold > 1:
+		return &OptionsError{"LoopOverloadThreshold", "must be within [0, 1]"}
+	case opts.MaxLabelValues < 0:
+		return &OptionsError{"MaxLabelValues", "must not be negative"}
+	case opts.Enricher != nil && opts.EnrichmentTimeout <= 0:
+		return &OptionsError{"EnrichmentTimeout", "must be positive along with Enricher"}
+	case opts.OutboundLimit < 0:
+		return &OptionsError{"OutboundLimit", "must not be negative"}
+	case opts.WriteStallTimeout < 0:
+		return &OptionsError{"WriteStallTimeout", "must not be negative"}
+	case opts.BufferIdleTimeout < 0:
+		return &OptionsError{"BufferIdleTimeout", "must not be negative"}
+	case opts.ExpectedConnections < 0:
+		return &OptionsError{"ExpectedConnections", "must not be negative"}
+	case opts.OutboundFullPolicy < OutboundBlockReads || opts.OutboundFullPolicy > OutboundCallback:
+		return &OptionsError{"OutboundFullPolicy", "unknown policy"}
+	case opts.ShutdownFlushTimeout < 0:
+		return &OptionsError{"ShutdownFlushTimeout", "must not be negative"}
+	case opts.AcceptRateLimit < 0:
+		return &OptionsError{"AcceptRateLimit", "must not be negative"}
+	case opts.AcceptRateBurst < 0:
+		return &OptionsError{"AcceptRateBurst", "must not be negative"}
+	case opts.AcceptLimitPolicy < AcceptLimitDefer || opts.AcceptLimitPolicy > AcceptLimitClose:
+		return &OptionsError{"AcceptLimitPolicy", "unknown policy"}
+	case opts.AcceptMode < AcceptOnMainReactor || opts.AcceptMode > AcceptOnLoop:
+		return &OptionsError{"AcceptMode", "unknown mode"}
+	case opts.AcceptMode != AcceptOnMainReactor && (opts.ReusePort || opts.MassiveConnections):
+		return &OptionsError{"AcceptMode", "all the event-loops accept connections with ReusePort and MassiveConnections"}
+	case opts.HandshakeTimeout < 0:
+		return &OptionsError{"HandshakeTimeout", "must not be negative"}
+	case opts.WriteCoalescingWindow < 0:
+		return &OptionsError{"WriteCoalescingWindow", "must not be negative"}
+	case !opts.WriteCoalescing && (opts.WriteCoalescingWindow != 0 || opts.WriteCoalescingMaxBytes != 0):
+		return &OptionsError{"WriteCoalescing", "must be set for WriteCoalescingWindow and WriteCoalescingMaxBytes"}
+	case opts.LoopWriteBatching && opts.WriteCoalescing:
+		return &OptionsError{"LoopWriteBatching", "must not be set along with WriteCoalescing"}
+	}
+	if ao := opts.AcceptOverload; ao != nil && ao.MaxAcceptRate <= 0 && ao.MaxPendingAccepts <= 0 {
+		return &OptionsError{"AcceptOverload", "neither MaxAcceptRate nor MaxPendingAccepts is set"}
+	}
+	if scan := opts.ConnScan; scan != nil && (scan.Interval <= 0 || scan.Inspect == nil) {
+		return &OptionsError{"ConnScan", "both Interval and Inspect must be set"}
+	}
+	if fi := opts.FaultInjection; fi != nil {
+		if !validFaultPolicy(&fi.Read) {
+			return &OptionsError{"FaultInjection", "the rates of Read must be within [0, 1]"}
+		}
+		if !validFaultPolicy(&fi.Write) {
+			return &OptionsError{"FaultInjection", "the rates of Write must be within [0, 1]"}
+		}
+	}
+	return nil
+}
+
+// validate checks the options for serving the given network with the given event handler.
+func (opts *Options) validate(network string, eventHandler EventHandler) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.ReusePort && (network == "unix" || network == "memory" || lookupTransport(network) != nil) {
+		return &OptionsError{"ReusePort", "SO_REUSEPORT is not supported on " + network + " network"}
+	}
+	if opts.KernelZeroCopySendThreshold > 0 && lookupTransport(network) != nil {
+		return &OptionsError{"KernelZeroCopySendThreshold", "MSG_ZEROCOPY is not supported on " + network + " network"}
+	}
+	if network == "unix" || network == "memory" || lookupTransport(network) != nil {
+		switch {
+		case opts.BindToDevice != "":
+			return &OptionsError{"BindToDevice", "SO_BINDTODEVICE is not supported on " + network + " network"}
+		case opts.IPTOS != 0:
+			return &OptionsError{"IPTOS", "IP_TOS is not supported on " + network + " network"}
+		case opts.IPTTL != 0:
+			return &OptionsError{"IPTTL", "IP_TTL is not supported on " + network + " network"}
+		case opts.Transparent:
+			return &OptionsError{"Transparent", "IP_TRANSPARENT is not supported on " + network + " network"}
+		}
+	}
+	if opts.AcceptRateLimit > 0 && network == "udp" {
+		return &OptionsError{"AcceptRateLimit", "there are no connections to accept on udp network"}
+	}
+	if opts.AcceptMode != AcceptOnMainReactor && (network == "udp" || network == "memory") {
+		return &OptionsError{"AcceptMode", "there are no connections to accept on " + network + " network"}
+	}
+	if opts.PartialFrameTimeout > 0 && network == "udp" {
+		return &OptionsError{"PartialFrameTimeout", "there are no partial frames on udp network"}
+	}
+	if opts.OutboundLimit > 0 && network == "udp" {
+		return &OptionsError{"OutboundLimit", "there is no outbound buffer on udp network"}
+	}
+	if opts.MassiveConnections && network == "udp" {
+		return &OptionsError{"MassiveConnections", "there are no connections on udp network"}
+	}
+	if opts.BufferIdleTimeout > 0 && network == "udp" {
+		return &OptionsError{"BufferIdleTimeout", "there are no connections on udp network"}
+	}
+	if opts.WriteStallTimeout > 0 && network == "udp" {
+		return &OptionsError{"WriteStallTimeout", "there is no outbound buffer on udp network"}
+	}
+	if opts.OutboundLimit > 0 && opts.OutboundFullPolicy == OutboundCallback {
+		if _, ok := eventHandler.(OutboundFullHandler); !ok {
+			return &OptionsError{"OutboundFullPolicy", "the event handler doesn't implement OutboundFullHandler"}
+		}
+	}
+	if opts.ConnGoroutine {
+		switch eventHandler.(type) {
+		case TrafficHandler:
+			return &OptionsError{"ConnGoroutine", "hybrid mode doesn't support TrafficHandler"}
+		case BatchHandler:
+			return &OptionsError{"ConnGoroutine", "hybrid mode doesn't support BatchHandler"}
+		}
+		if _, ok := opts.Codec.(ReadBufferProvider); ok {
+			return &OptionsError{"ConnGoroutine", "hybrid mode doesn't support ReadBufferProvider"}
+		}
+		if network == "udp" {
+			return &OptionsError{"ConnGoroutine", "there are no connections on udp network"}
+		}
+	}
+	if len(opts.ReloadSignals) > 0 {
+		if _, ok := eventHandler.(ReloadHandler); !ok {
+			return &OptionsError{"ReloadSignals", "the event handler doesn't implement ReloadHandler"}
+		}
+	}
+	if opts.BindToDevice != "" && runtime.GOOS != "linux" {
+		return &OptionsError{"BindToDevice", "SO_BINDTODEVICE is only supported on Linux"}
+	}
+	if opts.Transparent && runtime.GOOS != "linux" {
+		return &OptionsError{"Transparent", "IP_TRANSPARENT is only supported on Linux"}
+	}
+	if opts.AcceptFilter != "" {
+		switch {
+		case network != "tcp" && network != "tcp4" && network != "tcp6":
+			return &OptionsError{"AcceptFilter", "SO_ACCEPTFILTER is not supported on " + network + " network"}
+		case runtime.GOOS != "freebsd" && runtime.GOOS != "netbsd" && runtime.GOOS != "dragonfly":
+			return &OptionsError{"AcceptFilter", "SO_ACCEPTFILTER is only supported on FreeBSD, NetBSD and DragonFly BSD"}
+		}
+	}
+	if opts.AcceptMode == AcceptOnLoop && runtime.GOOS == "windows" {
+		return &OptionsError{"AcceptMode", "the connections are accepted by a blocking goroutine on Windows"}
+	}
+	if opts.LoopAffinity && runtime.GOOS != "linux" {
+		return &OptionsError{"LoopAffinity", "sched_setaffinity and SO_INCOMING_CPU are only supported on Linux"}
+	}
+	if opts.Ticker && !implementsMethod(reflect.TypeOf(eventHandler), "Tick") {
+		return &OptionsError{"Ticker", "the event handler doesn't implement Tick"}
+	}
+	return nil
+}
+
+func validFaultPolicy(p *FaultPolicy) bool {
+	for _, rate := range []float64{p.DropRate, p.TruncateRate, p.DuplicateRate} {
+		if rate < 0 || rate > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+var eventServerType = reflect.TypeOf(EventServer{})
+
+// implementsMethod reports whether the method of the given type is implemented by the type or any type embedded
+// in it other than EventServer, whose methods are no-ops.
+func implementsMethod(t reflect.Type, name string) bool {
+	if t == nil {
+		return false
+	}
+	base := t
+	if base.Kind() == reflect.Ptr {
+		base = base.Elem()
+	}
+	if base == eventServerType {
+		return false
+	}
+	m, ok := t.MethodByName(name)
+	if !ok {
+		return false
+	}
+	if !isAutogenerated(m.Func.Pointer()) {
+		return true
+	}
+	// The method is a wrapper generated by the compiler, either of a method with value receiver
+	// or of a method promoted from an embedded field.
+	if base != t {
+		if _, ok := base.MethodByName(name); ok {
+			return implementsMethod(base, name)
+		}
+	}
+	if base.Kind() != reflect.Struct {
+		return true
+	}
+	for i := 0; i < base.NumField(); i++ {
+		f := base.Field(i)
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Interface {
+			if _, ok := ft.MethodByName(name); ok {
+				return true
+			}
+			continue
+		}
+		if ft.Kind() != reflect.Ptr {
+			ft = reflect.PtrTo(ft)
+		}
+		if _, ok := ft.MethodByName(name); ok {
+			return implementsMethod(ft, name)
+		}
+	}
+	return true
+}
+
+func isAutogenerated(pc uintptr) bool {
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return false
+	}
+	file, _ := f.FileLine(f.Entry())
+	return file == "<autogenerated>"
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is a version of the protocol served by a VersionNegotiator.
+type ProtocolVersion struct {
+	// Version is the number of the version, the newer versions have the greater numbers.
+	Version int
+
+	// Codec is the codec of the connections of the version, which decodes the frames following the negotiation and
+	// encodes the reply to it, the codec of the server is kept if it is nil.
+	Codec ICodec
+
+	// Handler handles the connections of the version once it is negotiated, OnOpened fires right after
+	// the negotiation rather than when the connection is opened.
+	Handler EventHandler
+}
+
+// VersionNegotiatorConfig is the configuration of a VersionNegotiator.
+type VersionNegotiatorConfig struct {
+	// Parse extracts the version requested by the peer from the first frame of a connection, which is decoded by
+	// the codec of the server. The connection is rejected if it fails.
+	Parse func(frame []byte) (version int, err error)
+
+	// Reply builds the reply to the negotiation, with the version chosen, or with the error the connection is
+	// rejected with, e.g. ErrUnsupportedVersion, nothing is replied if it is nil or returns nil. The accepting
+	// reply is encoded by the codec of the version chosen.
+	Reply func(version int, err error) []byte
+
+	// MinVersion is the oldest version served, the connections requesting or downgraded to the older versions are
+	// rejected, so that the versions being phased out can be turned off without unregistering them.
+	MinVersion int
+
+	// AllowDowngrade allows serving the peers requesting a version that is not registered with the newest
+	// registered version older than the requested one, e.g. a v3 client with v2 on a server serving v1 and v2,
+	// which is meant for the protocols that are backward compatible. Only the requested version is served
+	// otherwise.
+	AllowDowngrade bool
+}
+
+// codecSetter is implemented by the stream connections, whose codecs can be overridden.
+type codecSetter interface {
+	setCodec(codec ICodec)
+}
+
+// VersionNegotiator is an event handler serving several versions of a protocol on one port, e.g. v1 and v2 clients
+// of a long-lived deployment. It negotiates the version from the first frame of every stream connection as
+// a HandshakeHandler, then installs the codec of the version for the connection and hands the connection over to
+// the handler of the version. Only the methods of EventHandler are delegated to the handlers of the versions,
+// the optional interfaces they implement aren't. It is not meant for datagrams, which are rejected.
+type VersionNegotiator struct {
+	config   VersionNegotiatorConfig
+	versions []ProtocolVersion // sorted by the version numbers
+	conns    sync.Map          // versions of the connections negotiated, by the connections
+}
+
+// NewVersionNegotiator instantiates a version negotiator serving the given versions, whose numbers must be distinct.
+func NewVersionNegotiator(config VersionNegotiatorConfig, versions ...ProtocolVersion) *VersionNegotiator {
+	vs := append([]ProtocolVersion(nil), versions...)
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Version < vs[j].Version })
+	return &VersionNegotiator{config: config, versions: vs}
+}
+
+// negotiate chooses the version served to a peer requesting the given one.
+func (n *VersionNegotiator) negotiate(requested int) (*ProtocolVersion, error) {
+	i := sort.Search(len(n.versions), func(i int) bool { return n.versions[i].Version > requested }) - 1
+	if i < 0 {
+		return nil, ErrUnsupportedVersion
+	}
+	v := &n.versions[i]
+	if v.Version != requested && !n.config.AllowDowngrade || v.Version < n.config.MinVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	return v, nil
+}
+
+// Version returns the version negotiated for the connection, and whether it has been negotiated.
+func (n *VersionNegotiator) Version(c Conn) (version int, ok bool) {
+	if v, ok := n.conns.Load(c); ok {
+		return v.(*ProtocolVersion).Version, true
+	}
+	return 0, false
+}
+
+// OnHandshake negotiates the version from the first frame of the connection.
+func (n *VersionNegotiator) OnHandshake(c Conn, frame []byte) (ok bool, out []byte, action Action) {
+	requested, err := n.config.Parse(frame)
+	var v *ProtocolVersion
+	if err == nil {
+		v, err = n.negotiate(requested)
+	}
+	if err != nil {
+		if n.config.Reply != nil {
+			out = n.config.Reply(0, err)
+		}
+		return false, out, Close
+	}
+	if cs, ok := c.(codecSetter); ok && v.Codec != nil {
+		c.SetCodecContext(nil)
+		cs.setCodec(v.Codec)
+	}
+	n.conns.Store(c, v)
+	if n.config.Reply != nil {
+		out = n.config.Reply(v.Version, nil)
+	}
+	opened, action := v.Handler.OnOpened(c)
+	if opened != nil {
+		// The output of OnOpened is written as a frame of its own following the reply.
+		_ = c.AsyncWrite(opened)
+	}
+	return true, out, action
+}
+
+// OnInitComplete fires OnInitComplete of the handlers of all the versions.
+func (n *VersionNegotiator) OnInitComplete(server Server) (action Action) {
+	for _, v := range n.versions {
+		if a := v.Handler.OnInitComplete(server); a != None {
+			action = a
+		}
+	}
+	return
+}
+
+// OnOpened does nothing, OnOpened of the handler of the version fires once it is negotiated.
+func (n *VersionNegotiator) OnOpened(c Conn) (out []byte, action Action) {
+	return
+}
+
+// OnClosed fires OnClosed of the handler of the version of the connection if it has been negotiated.
+func (n *VersionNegotiator) OnClosed(c Conn, err error) (action Action) {
+	v, ok := n.conns.Load(c)
+	if !ok {
+		return
+	}
+	n.conns.Delete(c)
+	return v.(*ProtocolVersion).Handler.OnClosed(c, err)
+}
+
+// PreWrite fires PreWrite of the handlers of all the versions.
+func (n *VersionNegotiator) PreWrite() {
+	for _, v := range n.versions {
+		v.Handler.PreWrite()
+	}
+}
+
+// React hands over the frame to the handler of the version of the connection.
+func (n *VersionNegotiator) React(frame []byte, c Conn) (out []byte, action Action) {
+	v, ok := n.conns.Load(c)
+	if !ok {
+		return nil, Close
+	}
+	return v.(*ProtocolVersion).Handler.React(frame, c)
+}
+
+// Tick fires Tick of the handlers of all the versions together, the next tick is due when the earliest one of them
+// is.
+func (n *VersionNegotiator) Tick() (delay time.Duration, action Action) {
+	for _, v := range n.versions {
+		d, a := v.Handler.Tick()
+		if d > 0 && (delay == 0 || d < delay) {
+			delay = d
+		}
+		if a != None {
+			action = a
+		}
+	}
+	return
+}
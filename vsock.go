@@ -0,0 +1,74 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// VsockCIDAny is the wildcard context ID, which binds a vsock listener to any context ID.
+	VsockCIDAny = 1<<32 - 1
+
+	// VsockCIDLocal is the context ID of the local communication within the same host or virtual machine.
+	VsockCIDLocal = 1
+
+	// VsockCIDHost is the context ID of the host, which the virtual machines connect to.
+	VsockCIDHost = 2
+)
+
+// VsockAddr is the address of a virtio-vsock (AF_VSOCK) endpoint, the transport for the communication
+// between virtual machines and their host, served on "vsock://cid:port" on Linux.
+type VsockAddr struct {
+	// CID is the context ID of the virtual machine or the host, e.g. VsockCIDHost.
+	CID uint32
+
+	// Port is the port number.
+	Port uint32
+}
+
+// Network returns "vsock".
+func (a *VsockAddr) Network() string { return "vsock" }
+
+func (a *VsockAddr) String() string {
+	return strconv.FormatUint(uint64(a.CID), 10) + ":" + strconv.FormatUint(uint64(a.Port), 10)
+}
+
+var errInvalidVsockAddr = errors.New("invalid vsock address, expected cid:port")
+
+// DialVsock connects to the vsock endpoint at "cid:port", e.g. "2:5000" for the port 5000 of the host
+// from within a virtual machine, the returned connection works with the deadlines of net.Conn.
+//
+// It is only supported on Linux.
+func DialVsock(addr string) (net.Conn, error) {
+	a, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialVsock(a)
+}
+
+// parseVsockAddr parses "cid:port", the cid is VsockCIDAny if it is empty.
+func parseVsockAddr(addr string) (*VsockAddr, error) {
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 {
+		return nil, errInvalidVsockAddr
+	}
+	cid := uint64(VsockCIDAny)
+	if i > 0 {
+		var err error
+		if cid, err = strconv.ParseUint(addr[:i], 10, 32); err != nil {
+			return nil, errInvalidVsockAddr
+		}
+	}
+	port, err := strconv.ParseUint(addr[i+1:], 10, 32)
+	if err != nil {
+		return nil, errInvalidVsockAddr
+	}
+	return &VsockAddr{CID: uint32(cid), Port: uint32(port)}, nil
+}
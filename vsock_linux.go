@@ -0,0 +1,123 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package gnet
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	RegisterTransport("vsock", vsockTransport{})
+}
+
+// vsockTransport is the transport of AF_VSOCK stream sockets.
+type vsockTransport struct {
+	sysTransport
+}
+
+func (vsockTransport) Listen(addr string) (fd int, lnaddr net.Addr, err error) {
+	a, err := parseVsockAddr(addr)
+	if err != nil {
+		return -1, nil, err
+	}
+	if fd, err = unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0); err != nil {
+		return -1, nil, os.NewSyscallError("socket", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+			fd = -1
+		}
+	}()
+	if err = unix.Bind(fd, &unix.SockaddrVM{CID: a.CID, Port: a.Port}); err != nil {
+		return fd, nil, os.NewSyscallError("bind", err)
+	}
+	if err = unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		return fd, nil, os.NewSyscallError("listen", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return fd, nil, os.NewSyscallError("getsockname", err)
+	}
+	return fd, vsockAddr(sa), nil
+}
+
+func (vsockTransport) Accept(fd int) (int, net.Addr, error) {
+	nfd, sa, err := unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+	if err != nil {
+		return -1, nil, err
+	}
+	return nfd, vsockAddr(sa), nil
+}
+
+// vsockConn is the client side connection of vsock, which is polled by the runtime via os.File.
+type vsockConn struct {
+	*os.File
+	localAddr, remoteAddr net.Addr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func dialVsock(addr *VsockAddr) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), "vsock://"+addr.String())
+	if err = unix.Connect(fd, &unix.SockaddrVM{CID: addr.CID, Port: addr.Port}); err == unix.EINPROGRESS {
+		err = waitConnect(f)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, os.NewSyscallError("connect", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		_ = f.Close()
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	return &vsockConn{f, vsockAddr(sa), addr}, nil
+}
+
+// waitConnect waits for the non-blocking connect of the file to complete.
+func waitConnect(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		soErr  int
+		sysErr error
+	)
+	if err = rc.Write(func(fd uintptr) bool {
+		if _, err := unix.Getpeername(int(fd)); err == nil {
+			return true
+		}
+		soErr, sysErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		return sysErr != nil || soErr != 0
+	}); err != nil {
+		return err
+	}
+	if sysErr != nil {
+		return sysErr
+	}
+	if soErr != 0 {
+		return unix.Errno(soErr)
+	}
+	return nil
+}
+
+func vsockAddr(sa unix.Sockaddr) net.Addr {
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		return &VsockAddr{CID: vm.CID, Port: vm.Port}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly windows
+
+package gnet
+
+import (
+	"sync"
+	"time"
+)
+
+// BlockedLoop is the report of an event-loop found blocked by the watchdog, see WithWatchdog.
+type BlockedLoop struct {
+	// Loop is the index of the event-loop.
+	Loop int
+
+	// Blocked is the duration for which the event-loop hasn't responded to the watchdog.
+	Blocked time.Duration
+
+	// LastConn is the ID of the last connection whose inbound data the event-loop handed over to the event handler,
+	// which is likely the one the event-loop is blocked on, it is zero if there is none.
+	LastConn uint64
+
+	// Goroutines is the dump of the stacks of all the goroutines taken when the event-loop was found blocked.
+	Goroutines []byte
+}
+
+// loopWatchdog is the state of the watchdog within an event-loop. It is guarded by a mutex rather than accessed
+// atomically since it is not guaranteed to be 64-bit aligned within eventloop.
+type loopWatchdog struct {
+	mu       sync.Mutex
+	lastConn uint64 // ID of the last connection whose inbound data has been handed over to the event handler
+}
+
+func (w *loopWatchdog) track(connID uint64) {
+	w.mu.Lock()
+	w.lastConn = connID
+	w.mu.Unlock()
+}
+
+func (w *loopWatchdog) last() (connID uint64) {
+	w.mu.Lock()
+	connID = w.lastConn
+	w.mu.Unlock()
+	return
+}
+
+// watchdogPing is a ping sent by the watchdog to an event-loop.
+type watchdogPing struct {
+	sent     time.Time
+	done     chan struct{} // closed by the event-loop
+	reported bool          // whether the event-loop has been reported blocked on this ping
+}
+
+// startWatchdog starts the watchdog, which pings every event-loop via its mailbox four times per WatchdogTimeout
+// and reports the event-loops not responding within WatchdogTimeout, once per blocking.
+func (svr *server) startWatchdog() {
+	timeout := svr.opts.WatchdogTimeout
+	if timeout <= 0 {
+		return
+	}
+	period := timeout / 4
+	pings := make(map[*eventloop]*watchdogPing)
+	var check func()
+	check = func() {
+		select {
+		case <-svr.shutdown:
+			return
+		default:
+		}
+		now := time.Now()
+		live := make(map[*eventloop]*watchdogPing, len(pings))
+		svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+			p := pings[el]
+			if p == nil || isClosed(p.done) {
+				done := make(chan struct{})
+				p = &watchdogPing{sent: now, done: done}
+				_ = el.post(busMessage{fn: func() { close(done) }})
+			} else if blocked := now.Sub(p.sent); blocked >= timeout && !p.reported {
+				p.reported = true
+				svr.onLoopBlocked(BlockedLoop{
+					Loop:       el.idx,
+					Blocked:    blocked,
+					LastConn:   el.watchdog.last(),
+					Goroutines: goroutineDump(),
+				})
+			}
+			live[el] = p
+			return true
+		})
+		pings = live
+		time.AfterFunc(period, check)
+	}
+	time.AfterFunc(period, check)
+}
+
+// onLoopBlocked hands over the report of a blocked event-loop to WatchdogHandler if the event handler implements it,
+// otherwise logs it.
+func (svr *server) onLoopBlocked(report BlockedLoop) {
+	if h := svr.watchdogHandler; h != nil {
+		h.OnLoopBlocked(report)
+		return
+	}
+	svr.logger.Printf("event-loop:%d has been blocked for %v, last connection: %d, goroutines:\n%s",
+		report.Loop, report.Blocked, report.LastConn, report.Goroutines)
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gnet
+
+// WriteBatchingStats returns the number of the writes held by write batching and the number of the write(2) calls
+// the data held was flushed in, writes/flushes is the average number of writes per write(2) call. The event-loops
+// publish them in batches, see loopCounters.
+func (s Server) WriteBatchingStats() (writes, flushes uint64) {
+	s.svr.subLoopGroup.iterate(func(i int, el *eventloop) bool {
+		w, f := el.counters.loadBatched()
+		writes += w
+		flushes += f
+		return true
+	})
+	return
+}
+
+// flushWriteBatch flushes the data held for the connections written to within the iteration of the event-loop,
+// see LoopWriteBatching.
+func (el *eventloop) flushWriteBatch() {
+	// Index the batch rather than ranging over it, since a flush may close a connection and fire event handlers.
+	for i := 0; i < len(el.writeBatch); i++ {
+		c := el.writeBatch[i]
+		el.writeBatch[i] = nil
+		c.flushBatched()
+	}
+	el.writeBatch = el.writeBatch[:0]
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package gnet
+
+import "time"
+
+// writeStall keeps track of the age of the outbound data of a connection, namely of the moments the bytes in
+// the outbound buffer were queued, for the write stall timeout, see WithWriteStallTimeout.
+type writeStall struct {
+	marks   []stallMark // moments the outbound data was queued, oldest first
+	queued  uint64      // number of bytes queued so far
+	flushed uint64      // number of bytes written to the socket so far
+	timer   *time.Timer // timer of the write stall timeout, nil if the outbound buffer is empty
+}
+
+// stallMark is the moment a run of outbound bytes started to be queued.
+type stallMark struct {
+	end uint64    // number of bytes queued so far once the last byte of the run was queued
+	at  time.Time // moment the first byte of the run was queued
+}
+
+// queue records n bytes queued at now, which join the latest run unless it started granularity or longer ago,
+// so that the runs of a busy connection don't pile up.
+func (s *writeStall) queue(n int, now time.Time, granularity time.Duration) {
+	s.queued += uint64(n)
+	if last := len(s.marks) - 1; last >= 0 && now.Sub(s.marks[last].at) < granularity {
+		s.marks[last].end = s.queued
+		return
+	}
+	s.marks = append(s.marks, stallMark{end: s.queued, at: now})
+}
+
+// flush records n bytes written to the socket, dropping the runs written completely.
+func (s *writeStall) flush(n int) {
+	s.flushed += uint64(n)
+	i := 0
+	for i < len(s.marks) && s.marks[i].end <= s.flushed {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	if i == len(s.marks) {
+		s.marks = s.marks[:0]
+		return
+	}
+	s.marks = s.marks[:copy(s.marks, s.marks[i:])]
+}
+
+// oldest returns the moment the oldest byte left in the outbound buffer was queued, or the zero time if the outbound
+// buffer is empty.
+func (s *writeStall) oldest() time.Time {
+	if len(s.marks) == 0 {
+		return time.Time{}
+	}
+	return s.marks[0].at
+}
+
+func (s *writeStall) reset() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	*s = writeStall{}
+}
@@ -0,0 +1,30 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gnet
+
+import "golang.org/x/sys/unix"
+
+// zeroCopySender is a placeholder, MSG_ZEROCOPY is only available on Linux.
+type zeroCopySender struct{}
+
+func newZeroCopySender(fd int) *zeroCopySender {
+	return nil
+}
+
+func (z *zeroCopySender) send(fd int, buf []byte) (int, error) {
+	return unix.Write(fd, buf)
+}
+
+// zeroCopyLinger is a placeholder, no socket lingers without zero-copy sends.
+type zeroCopyLinger struct{}
+
+func (el *eventloop) closeConnFD(c *conn) error {
+	return el.svr.transport.Close(c.fd)
+}
+
+func (el *eventloop) releaseLingering() {
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 Andy Pan. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package gnet
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/panjf2000/gnet/pool/bytebuffer"
+	"golang.org/x/sys/unix"
+)
+
+// zeroCopyLingerInterval is the interval of polling the sockets closed with zero-copy sends in flight for
+// the completions, see lingerZeroCopy.
+const zeroCopyLingerInterval = 10 * time.Millisecond
+
+// sockExtendedErr is struct sock_extended_err carried by the IP_RECVERR/IPV6_RECVERR control messages.
+type sockExtendedErr struct {
+	errno  uint32
+	origin uint8
+	typ    uint8
+	code   uint8
+	pad    uint8
+	info   uint32
+	data   uint32
+}
+
+// zeroCopyBuffer is a buffer sent with MSG_ZEROCOPY, seq is the number of the send counted by the kernel.
+type zeroCopyBuffer struct {
+	seq uint32
+	bb  *bytebuffer.ByteBuffer
+}
+
+// zeroCopySender sends data with MSG_ZEROCOPY and retains the buffers until the kernel reports the completion
+// of the sends on the error queue of the socket, it must only be used within the event-loop.
+type zeroCopySender struct {
+	seq      uint32           // number of the next zero-copy send
+	inflight []zeroCopyBuffer // buffers of the uncompleted sends in order
+	oob      [128]byte        // buffer for the control messages of the completions
+}
+
+// newZeroCopySender enables SO_ZEROCOPY on the socket, it returns nil if the socket doesn't support it.
+func newZeroCopySender(fd int) *zeroCopySender {
+	if unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1) != nil {
+		return nil
+	}
+	return new(zeroCopySender)
+}
+
+// send sends buf with MSG_ZEROCOPY, or with a plain write if the kernel can't pin more memory for it. The kernel
+// reads the data until the send completes, so a copy of buf owned by the sender is sent rather than buf, which
+// the caller may reuse right away, e.g. the buffer passed to AsyncWrite and returned by the codec unchanged.
+func (z *zeroCopySender) send(fd int, buf []byte) (int, error) {
+	bb := bytebuffer.Get()
+	_, _ = bb.Write(buf)
+	n, err := unix.SendmsgN(fd, bb.B, nil, nil, unix.MSG_ZEROCOPY)
+	if err != nil {
+		bytebuffer.Put(bb)
+		if err == unix.ENOBUFS {
+			return unix.Write(fd, buf)
+		}
+		return n, err
+	}
+	z.inflight = append(z.inflight, zeroCopyBuffer{seq: z.seq, bb: bb})
+	z.seq++
+	return n, nil
+}
+
+// drain reads the completions from the error queue of the socket and releases the buffers of the completed sends.
+func (z *zeroCopySender) drain(fd int) {
+	for {
+		_, oobn, _, _, err := unix.Recvmsg(fd, nil, z.oob[:], unix.MSG_ERRQUEUE)
+		if err != nil {
+			return
+		}
+		msgs, err := unix.ParseSocketControlMessage(z.oob[:oobn])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if !(m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) &&
+				!(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR) ||
+				len(m.Data) < int(unsafe.Sizeof(sockExtendedErr{})) {
+				continue
+			}
+			ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.origin == unix.SO_EE_ORIGIN_ZEROCOPY {
+				z.complete(ee.data)
+			}
+		}
+	}
+}
+
+// complete releases the buffers of the sends up to the given one, the kernel reports completions in ranges
+// of sends which are contiguous and in order, so it suffices to release all the sends not after the last one.
+func (z *zeroCopySender) complete(last uint32) {
+	n := 0
+	for n < len(z.inflight) && int32(z.inflight[n].seq-last) <= 0 {
+		bytebuffer.Put(z.inflight[n].bb)
+		z.inflight[n] = zeroCopyBuffer{}
+		n++
+	}
+	z.inflight = z.inflight[n:]
+}
+
+// zeroCopyLinger is a socket closed with zero-copy sends in flight, which is kept open until they complete.
+type zeroCopyLinger struct {
+	fd int
+	z  *zeroCopySender
+}
+
+// zeroCopyOrphans holds the buffers of the zero-copy sends still in flight on the sockets closed by the shutdown
+// of the event-loops, which are never released since their completions can't be reported anymore.
+var zeroCopyOrphans struct {
+	sync.Mutex
+	bufs []zeroCopyBuffer
+}
+
+// closeConnFD closes the socket of a connection being closed, unless zero-copy sends are still in flight on it.
+func (el *eventloop) closeConnFD(c *conn) error {
+	if x := c.ext; x != nil && x.zeroCopy != nil {
+		z := x.zeroCopy
+		z.drain(c.fd)
+		if len(z.inflight) > 0 {
+			el.lingerZeroCopy(c.fd, z)
+			return nil
+		}
+	}
+	return el.svr.transport.Close(c.fd)
+}
+
+// lingerZeroCopy keeps a socket closed with zero-copy sends in flight open until the kernel reports their
+// completions, as the kernel keeps reading their buffers after close(2), which would be freed along with
+// the connection otherwise. The socket is shut down right away, so the peer sees the connection closed, and is
+// polled for the completions every zeroCopyLingerInterval, since it is no longer watched by the poller.
+func (el *eventloop) lingerZeroCopy(fd int, z *zeroCopySender) {
+	_ = unix.Shutdown(fd, unix.SHUT_RDWR)
+	el.lingering = append(el.lingering, zeroCopyLinger{fd, z})
+	if len(el.lingering) == 1 {
+		el.scheduleLingering()
+	}
+}
+
+func (el *eventloop) scheduleLingering() {
+	time.AfterFunc(zeroCopyLingerInterval, func() {
+		_ = el.poller.Trigger(el.loopDrainLingering)
+	})
+}
+
+// loopDrainLingering closes the lingering sockets whose zero-copy sends have all completed.
+func (el *eventloop) loopDrainLingering() error {
+	remaining := el.lingering[:0]
+	for _, l := range el.lingering {
+		if l.z.drain(l.fd); len(l.z.inflight) > 0 {
+			remaining = append(remaining, l)
+			continue
+		}
+		_ = el.svr.transport.Close(l.fd)
+	}
+	for i := len(remaining); i < len(el.lingering); i++ {
+		el.lingering[i] = zeroCopyLinger{}
+	}
+	if el.lingering = remaining; len(remaining) > 0 {
+		el.scheduleLingering()
+	}
+	return nil
+}
+
+// releaseLingering closes the lingering sockets once the event-loop exits, the buffers of the sends still in
+// flight are left to zeroCopyOrphans.
+func (el *eventloop) releaseLingering() {
+	for _, l := range el.lingering {
+		if l.z.drain(l.fd); len(l.z.inflight) > 0 {
+			zeroCopyOrphans.Lock()
+			zeroCopyOrphans.bufs = append(zeroCopyOrphans.bufs, l.z.inflight...)
+			zeroCopyOrphans.Unlock()
+		}
+		_ = el.svr.transport.Close(l.fd)
+	}
+	el.lingering = nil
+}